@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Aggregation types
+const (
+	AggregationTerms     = "terms"
+	AggregationHistogram = "histogram"
+	AggregationRange     = "range"
+	AggregationStats     = "stats"
+)
+
+// Calendar intervals of date histograms
+const (
+	IntervalHour  = "hour"
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+// DefaultTermsSize is the number of buckets of a terms aggregation
+const DefaultTermsSize = 10
+
+// Aggregation summarizes a metadata field over every document matching a
+// search
+type Aggregation struct {
+	Name  string // Key of the result; the field by default
+	Type  string
+	Field string // Metadata key
+	// Size is the number of buckets of a terms aggregation, most frequent
+	// first
+	Size int
+	// Interval is the bucket width of a histogram: a number, or hour, day,
+	// week, month or year for a date field
+	Interval string
+	// Ranges are the buckets of a range aggregation
+	Ranges []BucketRange
+}
+
+// BucketRange is a bucket of a range aggregation. From is inclusive
+// and To exclusive; an empty bound is open.
+type BucketRange struct {
+	From string
+	To   string
+}
+
+// ParseAggregation parses an aggregation written as "[name=]type:field[:param]":
+//
+//	terms:category[:size]
+//	histogram:price:10, histogram:published:month
+//	range:price:..10,10..100,100..
+//	stats:price
+//
+// The field may carry the "metadata." field prefix.
+func ParseAggregation(s string) (Aggregation, error) {
+	var agg Aggregation
+	spec := s
+	if name, rest, ok := strings.Cut(s, "="); ok {
+		agg.Name, spec = strings.TrimSpace(name), rest
+	}
+
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return Aggregation{}, fmt.Errorf("invalid aggregation %q, expected type:field[:param]", s)
+	}
+	agg.Type = parts[0]
+	agg.Field = strings.TrimPrefix(parts[1], metadataFieldPrefix)
+	if agg.Name == "" {
+		agg.Name = agg.Field
+	}
+	var param string
+	if len(parts) == 3 {
+		param = parts[2]
+	}
+
+	switch agg.Type {
+	case AggregationTerms:
+		agg.Size = DefaultTermsSize
+		if param != "" {
+			size, err := strconv.Atoi(param)
+			if err != nil || size <= 0 {
+				return Aggregation{}, fmt.Errorf("invalid size %q in aggregation %q, expected a positive integer", param, s)
+			}
+			agg.Size = size
+		}
+	case AggregationHistogram:
+		if param == "" {
+			return Aggregation{}, fmt.Errorf("aggregation %q needs an interval, e.g. histogram:price:10", s)
+		}
+		agg.Interval = param
+	case AggregationRange:
+		for _, r := range strings.Split(param, ",") {
+			from, to, ok := strings.Cut(strings.TrimSpace(r), "..")
+			if !ok || (from == "" && to == "") {
+				return Aggregation{}, fmt.Errorf("invalid range %q in aggregation %q, expected from..to", r, s)
+			}
+			agg.Ranges = append(agg.Ranges, BucketRange{From: from, To: to})
+		}
+	case AggregationStats:
+		if param != "" {
+			return Aggregation{}, fmt.Errorf("aggregation %q takes no parameter", s)
+		}
+	default:
+		return Aggregation{}, fmt.Errorf("unknown aggregation type %q (want %s, %s, %s or %s)", agg.Type, AggregationTerms, AggregationHistogram, AggregationRange, AggregationStats)
+	}
+	return agg, nil
+}
+
+// ParseAggregations parses aggregations, rejecting duplicate names
+func ParseAggregations(values []string) ([]Aggregation, error) {
+	aggs := make([]Aggregation, 0, len(values))
+	names := make(map[string]bool)
+	for _, value := range values {
+		agg, err := ParseAggregation(value)
+		if err != nil {
+			return nil, err
+		}
+		if names[agg.Name] {
+			return nil, fmt.Errorf("duplicate aggregation name %q, name them as name=type:field", agg.Name)
+		}
+		names[agg.Name] = true
+		aggs = append(aggs, agg)
+	}
+	return aggs, nil
+}
+
+// AggregationResult is the outcome of an aggregation: buckets for terms,
+// histogram and range aggregations, statistics for stats aggregations
+type AggregationResult struct {
+	Type    string              `json:"type"`
+	Buckets []AggregationBucket `json:"buckets,omitempty"`
+	// OtherCount is the number of documents in terms beyond Size
+	OtherCount int         `json:"other_doc_count,omitempty"`
+	Stats      *ValueStats `json:"stats,omitempty"`
+}
+
+// AggregationBucket counts the documents with a value or in a range.
+// Histogram and range buckets also give their numeric bounds; dates are in
+// milliseconds since the Unix epoch.
+type AggregationBucket struct {
+	Key      string   `json:"key"`
+	From     *float64 `json:"from,omitempty"`
+	To       *float64 `json:"to,omitempty"`
+	DocCount int      `json:"doc_count"`
+}
+
+// ValueStats summarizes the values of a number or date field. Min,
+// Max and Avg are nil when no document has a value.
+type ValueStats struct {
+	Count int      `json:"count"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+	Sum   float64  `json:"sum"`
+	// MinAsString and MaxAsString format the bounds of a date field
+	MinAsString string `json:"min_as_string,omitempty"`
+	MaxAsString string `json:"max_as_string,omitempty"`
+}
+
+// checkAggregations checks that aggregations fit the types of their fields
+func (e *SearchEngine) checkAggregations(aggs []Aggregation) error {
+	for _, agg := range aggs {
+		typ := e.schema.Type(agg.Field)
+		switch agg.Type {
+		case AggregationTerms:
+			if isRangeType(typ) {
+				return &SchemaError{Field: agg.Field, Message: fmt.Sprintf("terms aggregations need a %s or %s field, not %s", FieldTypeKeyword, FieldTypeBoolean, typ)}
+			}
+		case AggregationHistogram:
+			if !isRangeType(typ) {
+				return &SchemaError{Field: agg.Field, Message: fmt.Sprintf("histogram aggregations need a %s or %s field, not %s", FieldTypeNumber, FieldTypeDate, typ)}
+			}
+			if typ == FieldTypeDate {
+				switch agg.Interval {
+				case IntervalHour, IntervalDay, IntervalWeek, IntervalMonth, IntervalYear:
+				default:
+					return &SchemaError{Field: agg.Field, Message: fmt.Sprintf("invalid date interval %q, expected %s, %s, %s, %s or %s", agg.Interval, IntervalHour, IntervalDay, IntervalWeek, IntervalMonth, IntervalYear)}
+				}
+			} else if interval, err := strconv.ParseFloat(agg.Interval, 64); err != nil || !(interval > 0) || math.IsInf(interval, 0) {
+				return &SchemaError{Field: agg.Field, Message: fmt.Sprintf("invalid interval %q, expected a positive number", agg.Interval)}
+			}
+		case AggregationRange, AggregationStats:
+			if !isRangeType(typ) {
+				return &SchemaError{Field: agg.Field, Message: fmt.Sprintf("%s aggregations need a %s or %s field, not %s", agg.Type, FieldTypeNumber, FieldTypeDate, typ)}
+			}
+			for _, r := range agg.Ranges {
+				for _, bound := range []string{r.From, r.To} {
+					if bound == "" {
+						continue
+					}
+					if _, err := parseRangeValue(agg.Field, typ, bound); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// aggregate computes aggregations over a set of documents from their doc
+// values. The aggregations must have been checked.
+func (e *SearchEngine) aggregate(aggs []Aggregation, docs []uint32) map[string]*AggregationResult {
+	results := make(map[string]*AggregationResult, len(aggs))
+	for _, agg := range aggs {
+		typ := e.schema.Type(agg.Field)
+		var result *AggregationResult
+		switch agg.Type {
+		case AggregationTerms:
+			result = e.values.termBuckets(agg, docs)
+		case AggregationHistogram:
+			result = e.values.histogramBuckets(agg, typ, docs)
+		case AggregationRange:
+			result = e.values.rangeBuckets(agg, typ, docs)
+		case AggregationStats:
+			result = e.values.valueStats(agg, typ, docs)
+		}
+		result.Type = agg.Type
+		results[agg.Name] = result
+	}
+	return results
+}
+
+// termBuckets counts the documents with each keyword of a field, most frequent
+// first and then by keyword
+func (dv *docValues) termBuckets(agg Aggregation, docs []uint32) *AggregationResult {
+	result := &AggregationResult{Buckets: []AggregationBucket{}}
+	column, ok := dv.keywords[agg.Field]
+	if !ok {
+		return result
+	}
+
+	counts := make(map[string]int)
+	for _, doc := range docs {
+		if value, ok := column.get(doc); ok {
+			counts[value]++
+		}
+	}
+	for key, count := range counts {
+		result.Buckets = append(result.Buckets, AggregationBucket{Key: key, DocCount: count})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		a, b := result.Buckets[i], result.Buckets[j]
+		return a.DocCount > b.DocCount || (a.DocCount == b.DocCount && a.Key < b.Key)
+	})
+
+	if len(result.Buckets) > agg.Size {
+		for _, bucket := range result.Buckets[agg.Size:] {
+			result.OtherCount += bucket.DocCount
+		}
+		result.Buckets = result.Buckets[:agg.Size]
+	}
+	return result
+}
+
+// histogramBuckets counts the documents in each interval of a number or date
+// field that has any, in order
+func (dv *docValues) histogramBuckets(agg Aggregation, typ FieldType, docs []uint32) *AggregationResult {
+	result := &AggregationResult{Buckets: []AggregationBucket{}}
+	column := dv.numberColumn(agg.Field)
+	if column == nil {
+		return result
+	}
+
+	counts := make(map[float64]int)
+	for _, doc := range docs {
+		if value, ok := column.get(doc); ok {
+			counts[bucketStart(agg.Interval, typ, value)]++
+		}
+	}
+	starts := make([]float64, 0, len(counts))
+	for start := range counts {
+		starts = append(starts, start)
+	}
+	sort.Float64s(starts)
+
+	for _, start := range starts {
+		from, to := start, bucketEnd(agg.Interval, typ, start)
+		result.Buckets = append(result.Buckets, AggregationBucket{
+			Key:      formatBucketKey(agg.Interval, typ, start),
+			From:     &from,
+			To:       &to,
+			DocCount: counts[start],
+		})
+	}
+	return result
+}
+
+// bucketStart returns the start of the histogram bucket holding a value
+func bucketStart(interval string, typ FieldType, value float64) float64 {
+	if typ != FieldTypeDate {
+		width, _ := strconv.ParseFloat(interval, 64)
+		return math.Floor(value/width) * width
+	}
+
+	t := time.UnixMilli(int64(value)).UTC()
+	switch interval {
+	case IntervalHour:
+		t = t.Truncate(time.Hour)
+	case IntervalDay:
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case IntervalWeek:
+		// Weeks start on Monday
+		t = time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case IntervalMonth:
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case IntervalYear:
+		t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return float64(t.UnixMilli())
+}
+
+// bucketEnd returns the end of the histogram bucket starting at start
+func bucketEnd(interval string, typ FieldType, start float64) float64 {
+	if typ != FieldTypeDate {
+		width, _ := strconv.ParseFloat(interval, 64)
+		return start + width
+	}
+
+	t := time.UnixMilli(int64(start)).UTC()
+	switch interval {
+	case IntervalHour:
+		t = t.Add(time.Hour)
+	case IntervalDay:
+		t = t.AddDate(0, 0, 1)
+	case IntervalWeek:
+		t = t.AddDate(0, 0, 7)
+	case IntervalMonth:
+		t = t.AddDate(0, 1, 0)
+	case IntervalYear:
+		t = t.AddDate(1, 0, 0)
+	}
+	return float64(t.UnixMilli())
+}
+
+// formatBucketKey formats the start of a histogram bucket
+func formatBucketKey(interval string, typ FieldType, start float64) string {
+	if typ != FieldTypeDate {
+		return strconv.FormatFloat(start, 'g', -1, 64)
+	}
+
+	t := time.UnixMilli(int64(start)).UTC()
+	switch interval {
+	case IntervalHour:
+		return t.Format(time.RFC3339)
+	case IntervalMonth:
+		return t.Format("2006-01")
+	case IntervalYear:
+		return t.Format("2006")
+	}
+	return t.Format("2006-01-02")
+}
+
+// rangeBuckets counts the documents in each range of a range aggregation, in
+// the order requested. A document may fall in several ranges.
+func (dv *docValues) rangeBuckets(agg Aggregation, typ FieldType, docs []uint32) *AggregationResult {
+	result := &AggregationResult{Buckets: make([]AggregationBucket, len(agg.Ranges))}
+	var lower, upper []*float64
+	for i, r := range agg.Ranges {
+		bucket := AggregationBucket{Key: r.From + ".." + r.To}
+		if r.From != "" {
+			from, _ := parseRangeValue(agg.Field, typ, r.From)
+			bucket.From = &from
+		}
+		if r.To != "" {
+			to, _ := parseRangeValue(agg.Field, typ, r.To)
+			bucket.To = &to
+		}
+		result.Buckets[i] = bucket
+		lower, upper = append(lower, bucket.From), append(upper, bucket.To)
+	}
+
+	column := dv.numberColumn(agg.Field)
+	if column == nil {
+		return result
+	}
+	for _, doc := range docs {
+		value, ok := column.get(doc)
+		if !ok {
+			continue
+		}
+		for i := range result.Buckets {
+			if (lower[i] == nil || value >= *lower[i]) && (upper[i] == nil || value < *upper[i]) {
+				result.Buckets[i].DocCount++
+			}
+		}
+	}
+	return result
+}
+
+// valueStats computes the count, minimum, maximum, average and sum of the
+// values of a number or date field
+func (dv *docValues) valueStats(agg Aggregation, typ FieldType, docs []uint32) *AggregationResult {
+	stats := &ValueStats{}
+	column := dv.numberColumn(agg.Field)
+	var min, max float64
+	for _, doc := range docs {
+		if column == nil {
+			break
+		}
+		value, ok := column.get(doc)
+		if !ok {
+			continue
+		}
+		if stats.Count == 0 || value < min {
+			min = value
+		}
+		if stats.Count == 0 || value > max {
+			max = value
+		}
+		stats.Count++
+		stats.Sum += value
+	}
+
+	if stats.Count > 0 {
+		avg := stats.Sum / float64(stats.Count)
+		stats.Min, stats.Max, stats.Avg = &min, &max, &avg
+		if typ == FieldTypeDate {
+			stats.MinAsString = time.UnixMilli(int64(min)).UTC().Format(time.RFC3339)
+			stats.MaxAsString = time.UnixMilli(int64(max)).UTC().Format(time.RFC3339)
+		}
+	}
+	return &AggregationResult{Stats: stats}
+}
+
+// numberColumn returns the column of a number or date field, or nil if no
+// document has a value
+func (dv *docValues) numberColumn(key string) *numberColumn {
+	if ranges, ok := dv.ranges[key]; ok {
+		return &ranges.column
+	}
+	return nil
+}
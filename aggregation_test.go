@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAggregation(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Aggregation
+		wantErr bool
+	}{
+		{in: "terms:category", want: Aggregation{Name: "category", Type: AggregationTerms, Field: "category", Size: DefaultTermsSize}},
+		{in: "top=terms:metadata.category:3", want: Aggregation{Name: "top", Type: AggregationTerms, Field: "category", Size: 3}},
+		{in: "histogram:price:10", want: Aggregation{Name: "price", Type: AggregationHistogram, Field: "price", Interval: "10"}},
+		{in: "histogram:published:month", want: Aggregation{Name: "published", Type: AggregationHistogram, Field: "published", Interval: "month"}},
+		{in: "range:price:..10, 10..100,100..", want: Aggregation{Name: "price", Type: AggregationRange, Field: "price", Ranges: []BucketRange{
+			{To: "10"}, {From: "10", To: "100"}, {From: "100"},
+		}}},
+		{in: "stats:price", want: Aggregation{Name: "price", Type: AggregationStats, Field: "price"}},
+		{in: "terms", wantErr: true},
+		{in: "terms:", wantErr: true},
+		{in: "terms:category:0", wantErr: true},
+		{in: "terms:category:many", wantErr: true},
+		{in: "histogram:price", wantErr: true},
+		{in: "range:price:10", wantErr: true},
+		{in: "range:price:..", wantErr: true},
+		{in: "stats:price:10", wantErr: true},
+		{in: "average:price", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAggregation(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAggregation(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAggregation(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := ParseAggregations([]string{"terms:category", "stats:category"}); err == nil {
+		t.Error("ParseAggregations with duplicate names succeeded")
+	}
+	if _, err := ParseAggregations([]string{"terms:category", "count=stats:category"}); err != nil {
+		t.Errorf("ParseAggregations with distinct names: %v", err)
+	}
+}
+
+// formatBuckets writes buckets as "key:count ..."
+func formatBuckets(result *AggregationResult) string {
+	parts := make([]string, len(result.Buckets))
+	for i, bucket := range result.Buckets {
+		parts[i] = fmt.Sprintf("%s:%d", bucket.Key, bucket.DocCount)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestSearchAggregations(t *testing.T) {
+	engine := newSchemaEngine(t, "price:number,published:date,draft:boolean")
+	addDocuments(t, engine,
+		metadataDocument("1", "book", map[string]string{"category": "fiction", "price": "5", "published": "2025-01-06", "draft": "false"}),
+		metadataDocument("2", "book", map[string]string{"category": "fiction", "price": "15", "published": "2025-01-12T23:00:00Z", "draft": "true"}),
+		metadataDocument("3", "book", map[string]string{"category": "science", "price": "25", "published": "2025-02-03"}),
+		metadataDocument("4", "book", map[string]string{"category": "history"}),
+		metadataDocument("5", "magazine", map[string]string{"category": "fiction", "price": "100", "published": "2025-03-01"}),
+	)
+
+	tests := []struct {
+		agg  string
+		want string
+	}{
+		// Most frequent first, then by key
+		{"terms:category", "fiction:2 history:1 science:1"},
+		{"terms:draft", "false:1 true:1"},
+		{"terms:missing", ""},
+		{"histogram:price:10", "0:1 10:1 20:1"},
+		{"histogram:price:7.5", "0:1 15:1 22.5:1"},
+		{"histogram:published:month", "2025-01:2 2025-02:1"},
+		// Weeks start on Monday
+		{"histogram:published:week", "2025-01-06:2 2025-02-03:1"},
+		{"histogram:published:day", "2025-01-06:1 2025-01-12:1 2025-02-03:1"},
+		{"histogram:published:year", "2025:3"},
+		// From is inclusive and To exclusive; ranges may overlap
+		{"range:price:..10,10..25,10..", "..10:1 10..25:1 10..:2"},
+		{"range:published:..2025-02-01,2025-02-01..", "..2025-02-01:2 2025-02-01..:1"},
+	}
+	for _, tt := range tests {
+		aggs, err := ParseAggregations([]string{tt.agg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Aggregations cover every match, not only the returned page
+		result, err := engine.Search("book", SearchOptions{UseRanking: true, Limit: 1, Aggregations: aggs})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.agg, err)
+		}
+		if got := formatBuckets(result.Aggregations[aggs[0].Name]); got != tt.want {
+			t.Errorf("%s: buckets %q, want %q", tt.agg, got, tt.want)
+		}
+		if result.Total != 4 || !result.TotalExact {
+			t.Errorf("%s: total %d (exact %v), want exactly 4", tt.agg, result.Total, result.TotalExact)
+		}
+	}
+
+	// Buckets beyond the size are counted together
+	result, err := engine.Search("book", SearchOptions{Limit: 1, Aggregations: []Aggregation{{Name: "top", Type: AggregationTerms, Field: "category", Size: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top := result.Aggregations["top"]; formatBuckets(top) != "fiction:2 history:1" || top.OtherCount != 1 {
+		t.Errorf("terms of size 2 = %q with %d others, want fiction:2 history:1 with 1 other", formatBuckets(top), top.OtherCount)
+	}
+
+	// Histogram buckets carry their bounds
+	result, err = engine.Search("book", SearchOptions{Limit: 1, Aggregations: []Aggregation{{Name: "price", Type: AggregationHistogram, Field: "price", Interval: "10"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket := result.Aggregations["price"].Buckets[1]; *bucket.From != 10 || *bucket.To != 20 {
+		t.Errorf("second price bucket from %v to %v, want from 10 to 20", *bucket.From, *bucket.To)
+	}
+}
+
+func TestSearchStatsAggregation(t *testing.T) {
+	engine := newSchemaEngine(t, "price:number,published:date")
+	addDocuments(t, engine,
+		metadataDocument("1", "book", map[string]string{"price": "5", "published": "2025-01-06"}),
+		metadataDocument("2", "book", map[string]string{"price": "15.5", "published": "2025-02-03T10:30:00Z"}),
+		metadataDocument("3", "book", map[string]string{"price": "-2.5"}),
+		metadataDocument("4", "book", nil),
+		metadataDocument("5", "magazine", map[string]string{"price": "100"}),
+	)
+	float := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		query string
+		agg   string
+		want  ValueStats
+	}{
+		{"book", "stats:price", ValueStats{Count: 3, Min: float(-2.5), Max: float(15.5), Avg: float(6), Sum: 18}},
+		{"magazine", "stats:price", ValueStats{Count: 1, Min: float(100), Max: float(100), Avg: float(100), Sum: 100}},
+		{"book", "stats:published", ValueStats{
+			Count: 2, Min: float(1736121600000), Max: float(1738578600000), Avg: float(1737350100000), Sum: 3474700200000,
+			MinAsString: "2025-01-06T00:00:00Z", MaxAsString: "2025-02-03T10:30:00Z",
+		}},
+		// Without values there are no bounds or average
+		{"magazine", "stats:published", ValueStats{}},
+		{"missing", "stats:price", ValueStats{}},
+	}
+	for _, tt := range tests {
+		aggs, err := ParseAggregations([]string{tt.agg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := engine.Search(tt.query, SearchOptions{Limit: 1, Aggregations: aggs})
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.query, tt.agg, err)
+		}
+		stats := result.Aggregations[aggs[0].Name].Stats
+		if stats == nil || !reflect.DeepEqual(*stats, tt.want) {
+			t.Errorf("%s %s: stats %+v, want %+v", tt.query, tt.agg, stats, tt.want)
+		}
+	}
+}
+
+func TestAggregationFieldTypes(t *testing.T) {
+	engine := newSchemaEngine(t, "price:number,published:date")
+	addDocuments(t, engine, metadataDocument("1", "book", map[string]string{"price": "5", "category": "fiction"}))
+
+	// Aggregations that do not fit the type of their field are schema errors
+	for _, agg := range []string{
+		"terms:price",
+		"histogram:category:10",
+		"histogram:price:0",
+		"histogram:price:-5",
+		"histogram:price:month",
+		"histogram:published:fortnight",
+		"histogram:published:10",
+		"range:category:..10",
+		"range:price:..cheap",
+		"range:published:..tomorrow",
+		"stats:category",
+	} {
+		aggs, err := ParseAggregations([]string{agg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = engine.Search("book", SearchOptions{Limit: 1, Aggregations: aggs})
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) || schemaErr.Field != aggs[0].Field {
+			t.Errorf("%s: %v, want a schema error for %s", agg, err, aggs[0].Field)
+		}
+	}
+}
+
+func TestAggregationParameter(t *testing.T) {
+	api, engine := newTestAPI(t)
+	addDocuments(t, engine,
+		metadataDocument("1", "book", map[string]string{"category": "fiction"}),
+		metadataDocument("2", "book", map[string]string{"category": "science"}),
+		metadataDocument("3", "book", map[string]string{"category": "fiction"}),
+	)
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/search?query=book&limit=1&agg=terms:category", 200, `"aggregations":{"category":{"type":"terms","buckets":[{"key":"fiction","doc_count":2},{"key":"science","doc_count":1}]}}`},
+		{"/search?filter=category:fiction&agg=n=terms:category&agg=terms:category", 200, `"n":{"type":"terms","buckets":[{"key":"fiction","doc_count":2}]}`},
+		{"/search?query=book&agg=terms:category&agg=terms:category", 400, "duplicate aggregation name"},
+		{"/search?query=book&agg=stats:category", 400, `"field":"category"`},
+	}
+	for _, tt := range tests {
+		status, body := getJSON(t, api, tt.path)
+		if status != tt.status || !strings.Contains(body, tt.want) {
+			t.Errorf("GET %s = %d %s, want %d with %s", tt.path, status, body, tt.status, tt.want)
+		}
+	}
+}
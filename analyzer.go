@@ -1,40 +1,209 @@
 package main
 
 import (
-	"strings"
-	"unicode"
+	"fmt"
+	"sort"
+	"sync"
+	"unicode/utf8"
 )
 
-// analyze tokenizes and normalizes text for indexing
-func analyze(text string) []string {
-	// Convert to lowercase
-	text = strings.ToLower(text)
+// DefaultAnalyzer is the analyzer used when none is configured
+const DefaultAnalyzer = "standard"
 
-	// Split into tokens
-	var tokens []string
-	var currentToken strings.Builder
+// Analyzer turns text into a stream of index terms
+type Analyzer interface {
+	Analyze(text string) []Token
+}
 
-	for _, r := range text {
-		if unicode.IsLetter(r) || unicode.IsNumber(r) {
-			currentToken.WriteRune(r)
-		} else {
-			if currentToken.Len() > 0 {
-				token := currentToken.String()
-				if len(token) >= 2 { // Filter out single character tokens
-					tokens = append(tokens, token)
-				}
-				currentToken.Reset()
-			}
-		}
+// PipelineAnalyzer runs char filters, a tokenizer and token filters in order
+type PipelineAnalyzer struct {
+	CharFilters  []CharFilter
+	Tokenizer    Tokenizer
+	TokenFilters []TokenFilter
+}
+
+// Analyze implements Analyzer
+func (a *PipelineAnalyzer) Analyze(text string) []Token {
+	for _, cf := range a.CharFilters {
+		text = cf.Filter(text)
 	}
 
-	// Add last token if exists
-	if currentToken.Len() > 0 {
-		token := currentToken.String()
-		if len(token) >= 2 {
-			tokens = append(tokens, token)
+	tokens := a.Tokenizer.Tokenize(text)
+
+	for _, tf := range a.TokenFilters {
+		if len(tokens) == 0 {
+			break
 		}
+		tokens = tf.Filter(tokens)
 	}
 
+	for i := range tokens {
+		tokens[i].Term = truncateTerm(tokens[i].Term)
+	}
 	return tokens
 }
+
+// truncateTerm cuts a term to maxTermLength bytes at a character boundary.
+// Queries are cut the same way, so a long keyword still matches itself.
+func truncateTerm(term string) string {
+	if len(term) <= maxTermLength {
+		return term
+	}
+	end := maxTermLength
+	for end > 0 && !utf8.RuneStart(term[end]) {
+		end--
+	}
+	return term[:end]
+}
+
+// AnalyzerConfig holds per-index settings passed to analyzer factories
+type AnalyzerConfig struct {
+	// Stopwords are extra stopwords on top of the analyzer's defaults
+	Stopwords []string
+	// RemoveStopwords drops stopwords instead of marking them
+	RemoveStopwords bool
+	// Synonyms maps a term to the terms injected at its position
+	Synonyms map[string][]string
+}
+
+// AnalyzerFactory builds a fresh analyzer instance
+type AnalyzerFactory func(config AnalyzerConfig) Analyzer
+
+var (
+	analyzersMu sync.RWMutex
+	analyzers   = make(map[string]AnalyzerFactory)
+)
+
+// RegisterAnalyzer makes an analyzer available by name
+func RegisterAnalyzer(name string, factory AnalyzerFactory) {
+	analyzersMu.Lock()
+	defer analyzersMu.Unlock()
+	analyzers[name] = factory
+}
+
+// LookupAnalyzer returns a new instance of a registered analyzer
+func LookupAnalyzer(name string, config AnalyzerConfig) (Analyzer, error) {
+	analyzersMu.RLock()
+	factory, ok := analyzers[name]
+	analyzersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown analyzer %q (available: %v)", name, AnalyzerNames())
+	}
+	return factory(config), nil
+}
+
+// AnalyzerNames returns the names of all registered analyzers
+func AnalyzerNames() []string {
+	analyzersMu.RLock()
+	defer analyzersMu.RUnlock()
+
+	names := make([]string, 0, len(analyzers))
+	for name := range analyzers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tokenTerms returns the term of each token
+func tokenTerms(tokens []Token) []string {
+	terms := make([]string, len(tokens))
+	for i, token := range tokens {
+		terms[i] = token.Term
+	}
+	return terms
+}
+
+// withStopwords appends a stop filter when any stopwords are configured
+func withStopwords(filters []TokenFilter, defaults []string, config AnalyzerConfig) []TokenFilter {
+	words := append(append([]string{}, defaults...), config.Stopwords...)
+	if len(words) == 0 {
+		return filters
+	}
+	filter := NewStopFilter(words)
+	filter.Remove = config.RemoveStopwords
+	return append(filters, filter)
+}
+
+// withSynonyms appends a synonym filter when any synonyms are configured
+func withSynonyms(filters []TokenFilter, config AnalyzerConfig) []TokenFilter {
+	if len(config.Synonyms) == 0 {
+		return filters
+	}
+	return append(filters, SynonymFilter{Synonyms: config.Synonyms})
+}
+
+// tokenLength returns the number of positions tokens take up. Synonyms
+// injected at the position of another token do not count.
+func tokenLength(tokens []Token) int {
+	n := 0
+	for i, token := range tokens {
+		if i == 0 || token.Position != tokens[i-1].Position {
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	// standard: letter/digit words and CJK bigrams, lowercased, single
+	// ASCII characters dropped
+	RegisterAnalyzer("standard", func(config AnalyzerConfig) Analyzer {
+		return &PipelineAnalyzer{
+			Tokenizer:    StandardTokenizer{},
+			TokenFilters: withSynonyms(withStopwords([]TokenFilter{LowercaseFilter{}, LengthFilter{Min: 2}}, nil, config), config),
+		}
+	})
+
+	// english: standard plus English stopwords and Porter2 stemming, so
+	// "programming" matches "programs"
+	RegisterAnalyzer("english", func(config AnalyzerConfig) Analyzer {
+		filters := withStopwords([]TokenFilter{LowercaseFilter{}, LengthFilter{Min: 2}}, EnglishStopwords, config)
+		return &PipelineAnalyzer{
+			Tokenizer:    StandardTokenizer{},
+			TokenFilters: append(withSynonyms(filters, config), EnglishStemFilter{}),
+		}
+	})
+
+	// minimal_english: standard plus English stopwords and plural removal
+	// only, so "queries" matches "query" but "programming" stays apart
+	// from "programs"
+	RegisterAnalyzer("minimal_english", func(config AnalyzerConfig) Analyzer {
+		filters := withStopwords([]TokenFilter{LowercaseFilter{}, LengthFilter{Min: 2}}, EnglishStopwords, config)
+		return &PipelineAnalyzer{
+			Tokenizer:    StandardTokenizer{},
+			TokenFilters: append(withSynonyms(filters, config), MinimalEnglishStemFilter{}),
+		}
+	})
+
+	// folding: standard plus diacritic folding so "cafe" matches "café"
+	RegisterAnalyzer("folding", func(config AnalyzerConfig) Analyzer {
+		return &PipelineAnalyzer{
+			Tokenizer:    StandardTokenizer{},
+			TokenFilters: withSynonyms(withStopwords([]TokenFilter{LowercaseFilter{}, ASCIIFoldingFilter{}, LengthFilter{Min: 2}}, nil, config), config),
+		}
+	})
+
+	// html: standard over text with markup stripped
+	RegisterAnalyzer("html", func(config AnalyzerConfig) Analyzer {
+		return &PipelineAnalyzer{
+			CharFilters:  []CharFilter{HTMLStripCharFilter{}},
+			Tokenizer:    StandardTokenizer{},
+			TokenFilters: withSynonyms(withStopwords([]TokenFilter{LowercaseFilter{}, LengthFilter{Min: 2}}, nil, config), config),
+		}
+	})
+
+	// whitespace: split on whitespace only, lowercased
+	RegisterAnalyzer("whitespace", func(config AnalyzerConfig) Analyzer {
+		return &PipelineAnalyzer{
+			Tokenizer:    WhitespaceTokenizer{},
+			TokenFilters: withSynonyms(withStopwords([]TokenFilter{LowercaseFilter{}}, nil, config), config),
+		}
+	})
+
+	// keyword: the whole text as a single exact-match term
+	RegisterAnalyzer("keyword", func(AnalyzerConfig) Analyzer {
+		return &PipelineAnalyzer{Tokenizer: KeywordTokenizer{}}
+	})
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -31,11 +34,16 @@ func (api *API) setupRoutes() {
 	api.router.GET("/health", api.handleHealth)
 	api.router.POST("/documents", api.handleInsertDocument)
 	api.router.POST("/documents/batch", api.handleBatchInsert)
+	api.router.POST("/_bulk", api.handleBulk)
 	api.router.GET("/documents/:id", api.handleGetDocument)
 	api.router.PUT("/documents/:id", api.handleUpdateDocument)
 	api.router.DELETE("/documents/:id", api.handleDeleteDocument)
+	api.router.GET("/documents/:id/explain", api.handleExplain)
 	api.router.GET("/search", api.handleSearch)
 	api.router.GET("/stats", api.handleStats)
+	api.router.POST("/_compact", api.handleCompact)
+	api.router.GET("/schema", api.handleSchema)
+	api.router.GET("/export", api.handleExport)
 }
 
 // Run starts the API server
@@ -55,23 +63,91 @@ type errorResponse struct {
 	Error   string `json:"error"`
 }
 
+type queryErrorResponse struct {
+	Success  bool   `json:"success"`
+	Error    string `json:"error"`
+	Position int    `json:"position"`
+}
+
+type schemaErrorResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Field   string `json:"field"`
+}
+
 // Request types
 type insertDocumentRequest struct {
-	ID      string `json:"id" binding:"required"`
-	Title   string `json:"title" binding:"required"`
-	Content string `json:"content" binding:"required"`
-	URL     string `json:"url"`
+	ID string `json:"id" binding:"required"`
+	updateDocumentRequest
+}
+
+// updateDocumentRequest is a document whose ID is given by the URL
+type updateDocumentRequest struct {
+	Title    string            `json:"title" binding:"required"`
+	Content  string            `json:"content" binding:"required"`
+	URL      string            `json:"url"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// validate checks the fields binding requires, for documents of a batch,
+// which are not validated when the request is bound
+func (req insertDocumentRequest) validate() error {
+	switch {
+	case req.ID == "":
+		return errMissingID
+	case req.Title == "":
+		return errors.New("title is required")
+	case req.Content == "":
+		return errors.New("content is required")
+	}
+	return validateDocumentID(req.ID)
+}
+
+// document returns the requested document with the given ID
+func (req updateDocumentRequest) document(id string) *Document {
+	doc := NewDocument(id, req.Title, req.Content)
+	doc.URL = req.URL
+	for key, value := range req.Metadata {
+		doc.Metadata[key] = value
+	}
+	return doc
 }
 
 type batchInsertRequest struct {
 	Documents []insertDocumentRequest `json:"documents" binding:"required"`
 }
 
+// batchItemResult is the outcome of one document of a batch request, in
+// the order of the request
+type batchItemResult struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// Field is the metadata field that does not match the schema
+	Field string `json:"field,omitempty"`
+}
+
+type batchInsertResponse struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []batchItemResult `json:"results"`
+}
+
 type searchResponse struct {
 	Documents []*Document `json:"documents"`
 	Total     int         `json:"total"`
-	Query     string      `json:"query"`
-	Scores    []float64   `json:"scores,omitempty"`
+	// TotalRelation is "eq" when Total is exact and "gte" when it is a
+	// lower bound
+	TotalRelation string    `json:"total_relation"`
+	Query         string    `json:"query"`
+	Scores        []float64 `json:"scores,omitempty"`
+	// Explanations are returned with explain=true
+	Explanations []*Explanation `json:"explanations,omitempty"`
+	// Aggregations are returned for each agg parameter, by name
+	Aggregations map[string]*AggregationResult `json:"aggregations,omitempty"`
+	// Highlights are returned with highlight=true: the fragments of each
+	// document by field, in the order of the documents
+	Highlights []map[string][]string `json:"highlights,omitempty"`
 }
 
 // Handlers
@@ -93,14 +169,10 @@ func (api *API) handleInsertDocument(c *gin.Context) {
 		return
 	}
 
-	doc := NewDocument(req.ID, req.Title, req.Content)
-	doc.URL = req.URL
+	doc := req.document(req.ID)
 
 	if err := api.engine.UpsertDocument(doc); err != nil {
-		c.JSON(http.StatusInternalServerError, errorResponse{
-			Success: false,
-			Error:   err.Error(),
-		})
+		writeDocumentError(c, err)
 		return
 	}
 
@@ -120,22 +192,53 @@ func (api *API) handleBatchInsert(c *gin.Context) {
 		return
 	}
 
-	for _, docReq := range req.Documents {
-		doc := NewDocument(docReq.ID, docReq.Title, docReq.Content)
-		doc.URL = docReq.URL
+	// Items missing required fields are rejected without failing the batch
+	items := make([]batchItemResult, len(req.Documents))
+	var docs []*Document
+	var positions []int
+	for i, docReq := range req.Documents {
+		items[i].ID = docReq.ID
+		if err := docReq.validate(); err != nil {
+			items[i].Error = err.Error()
+			continue
+		}
 
-		if err := api.engine.UpsertDocument(doc); err != nil {
-			c.JSON(http.StatusInternalServerError, errorResponse{
-				Success: false,
-				Error:   err.Error(),
-			})
-			return
+		docs = append(docs, docReq.document(docReq.ID))
+		positions = append(positions, i)
+	}
+
+	results, err := api.engine.UpsertBatch(docs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	response := batchInsertResponse{Results: items}
+	for i, result := range results {
+		if result.Err != nil {
+			items[positions[i]].Error = result.Err.Error()
+			var schemaErr *SchemaError
+			if errors.As(result.Err, &schemaErr) {
+				items[positions[i]].Field = schemaErr.Field
+			}
+		}
+	}
+	for i := range items {
+		items[i].Success = items[i].Error == ""
+		if items[i].Success {
+			response.Succeeded++
+		} else {
+			response.Failed++
 		}
 	}
 
 	c.JSON(http.StatusOK, successResponse{
 		Success: true,
-		Message: "Documents inserted successfully",
+		Data:    response,
+		Message: fmt.Sprintf("Inserted %d of %d documents", response.Succeeded, len(items)),
 	})
 }
 
@@ -168,7 +271,7 @@ func (api *API) handleGetDocument(c *gin.Context) {
 func (api *API) handleUpdateDocument(c *gin.Context) {
 	id := c.Param("id")
 
-	var req insertDocumentRequest
+	var req updateDocumentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, errorResponse{
 			Success: false,
@@ -177,14 +280,10 @@ func (api *API) handleUpdateDocument(c *gin.Context) {
 		return
 	}
 
-	doc := NewDocument(id, req.Title, req.Content)
-	doc.URL = req.URL
+	doc := req.document(id)
 
 	if err := api.engine.UpsertDocument(doc); err != nil {
-		c.JSON(http.StatusInternalServerError, errorResponse{
-			Success: false,
-			Error:   err.Error(),
-		})
+		writeDocumentError(c, err)
 		return
 	}
 
@@ -212,6 +311,55 @@ func (api *API) handleDeleteDocument(c *gin.Context) {
 }
 
 func (api *API) handleSearch(c *gin.Context) {
+	query := c.Query("query")
+	options, ok := api.parseSearchOptions(c)
+	if !ok {
+		return
+	}
+
+	// An empty query lists the documents passing the filters
+	if query == "" && len(options.Filters) == 0 {
+		c.JSON(http.StatusBadRequest, errorResponse{
+			Success: false,
+			Error:   "query or filter parameter is required",
+		})
+		return
+	}
+
+	// Perform search
+	result, err := api.engine.Search(query, options)
+	if err != nil {
+		writeSearchError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, successResponse{
+		Success: true,
+		Data: searchResponse{
+			Documents:     result.Documents,
+			Total:         result.Total,
+			TotalRelation: totalRelation(result),
+			Query:         query,
+			Scores:        result.Scores,
+			Explanations:  result.Explanations,
+			Aggregations:  result.Aggregations,
+			Highlights:    result.Highlights,
+		},
+	})
+}
+
+// totalRelation describes whether a search total is exact, as in
+// Elasticsearch's hits.total.relation
+func totalRelation(result *SearchResult) string {
+	if result.TotalExact {
+		return "eq"
+	}
+	return "gte"
+}
+
+func (api *API) handleExplain(c *gin.Context) {
+	id := c.Param("id")
+
 	query := c.Query("query")
 	if query == "" {
 		c.JSON(http.StatusBadRequest, errorResponse{
@@ -221,7 +369,80 @@ func (api *API) handleSearch(c *gin.Context) {
 		return
 	}
 
-	// Parse options
+	options, ok := api.parseSearchOptions(c)
+	if !ok {
+		return
+	}
+
+	explanation, err := api.engine.Explain(id, query, options)
+	if err != nil {
+		writeSearchError(c, err)
+		return
+	}
+
+	if explanation == nil {
+		c.JSON(http.StatusNotFound, errorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, successResponse{
+		Success: true,
+		Data:    explanation,
+	})
+}
+
+// writeSearchError responds with 400 and the error position for a query
+// syntax error, 400 and the field for a filter that does not fit the
+// schema, or 500 for anything else
+func writeSearchError(c *gin.Context, err error) {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		c.JSON(http.StatusBadRequest, queryErrorResponse{
+			Success:  false,
+			Error:    queryErr.Message,
+			Position: queryErr.Position,
+		})
+		return
+	}
+
+	writeDocumentError(c, err)
+}
+
+// writeDocumentError responds with 400 and the field for a value that does
+// not match the schema, 400 for an invalid document ID, or 500 for
+// anything else
+func writeDocumentError(c *gin.Context, err error) {
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		c.JSON(http.StatusBadRequest, schemaErrorResponse{
+			Success: false,
+			Error:   schemaErr.Error(),
+			Field:   schemaErr.Field,
+		})
+		return
+	}
+
+	var idErr *IDError
+	if errors.As(err, &idErr) {
+		c.JSON(http.StatusBadRequest, errorResponse{
+			Success: false,
+			Error:   idErr.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, errorResponse{
+		Success: false,
+		Error:   err.Error(),
+	})
+}
+
+// parseSearchOptions reads search options from query parameters. It
+// writes a 400 response and returns false if a parameter is invalid.
+func (api *API) parseSearchOptions(c *gin.Context) (SearchOptions, bool) {
 	options := DefaultSearchOptions()
 
 	if mode := c.Query("mode"); mode == "or" {
@@ -244,32 +465,183 @@ func (api *API) handleSearch(c *gin.Context) {
 		}
 	}
 
-	// Perform search
-	result, err := api.engine.Search(query, options)
-	if err != nil {
+	if slopStr := c.Query("slop"); slopStr != "" {
+		if slop, err := strconv.Atoi(slopStr); err == nil && slop >= 0 {
+			options.Slop = slop
+		}
+	}
+
+	if inOrder := c.Query("in_order"); inOrder == "true" {
+		options.InOrder = true
+	}
+
+	if explain := c.Query("explain"); explain == "true" {
+		options.Explain = true
+	}
+
+	if exactTotal := c.Query("exact_total"); exactTotal == "true" {
+		options.ExactTotal = true
+	}
+
+	if highlight := c.Query("highlight"); highlight == "true" {
+		highlightOptions := DefaultHighlightOptions()
+		if size, err := strconv.Atoi(c.Query("fragment_size")); err == nil && size > 0 {
+			highlightOptions.FragmentSize = size
+		}
+		if fragments, err := strconv.Atoi(c.Query("fragments")); err == nil && fragments > 0 {
+			highlightOptions.Fragments = fragments
+		}
+		if tag, ok := c.GetQuery("pre_tag"); ok {
+			highlightOptions.PreTag = tag
+		}
+		if tag, ok := c.GetQuery("post_tag"); ok {
+			highlightOptions.PostTag = tag
+		}
+		if name, ok := c.GetQuery("encoder"); ok {
+			encoder, err := ParseHighlightEncoder(name)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errorResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return options, false
+			}
+			highlightOptions.Encoder = encoder
+		}
+		if fields := c.Query("highlight_fields"); fields != "" {
+			highlightOptions.Fields = strings.Split(fields, ",")
+			for _, field := range highlightOptions.Fields {
+				if !isSearchableField(field) {
+					c.JSON(http.StatusBadRequest, errorResponse{
+						Success: false,
+						Error:   fmt.Sprintf("unknown field %q", field),
+					})
+					return options, false
+				}
+			}
+		}
+		options.Highlight = &highlightOptions
+	}
+
+	if fields := c.Query("fields"); fields != "" {
+		options.Fields = strings.Split(fields, ",")
+		for _, field := range options.Fields {
+			if !isSearchableField(field) {
+				c.JSON(http.StatusBadRequest, errorResponse{
+					Success: false,
+					Error:   fmt.Sprintf("unknown field %q", field),
+				})
+				return options, false
+			}
+		}
+	}
+
+	if boost := c.Query("boost"); boost != "" {
+		boosts, err := ParseFieldBoosts(boost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return options, false
+		}
+		options.FieldBoosts = boosts
+	}
+
+	if values := c.QueryArray("filter"); len(values) > 0 {
+		filters, err := ParseSearchFilters(values)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return options, false
+		}
+		options.Filters = filters
+	}
+
+	if value := c.Query("sort"); value != "" {
+		fields, err := ParseSort(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return options, false
+		}
+		options.Sort = fields
+	}
+
+	if values := c.QueryArray("agg"); len(values) > 0 {
+		aggs, err := ParseAggregations(values)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return options, false
+		}
+		options.Aggregations = aggs
+	}
+
+	options.Scorer = c.Query("scorer")
+	if params := c.Query("scorer_params"); params != "" {
+		scorerParams, err := ParseScorerParams(params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return options, false
+		}
+		options.ScorerParams = scorerParams
+	}
+	if options.Scorer != "" || options.ScorerParams != nil {
+		name := options.Scorer
+		if name == "" {
+			name = api.engine.Scoring().Scorer
+		}
+		if _, err := LookupScorer(name, options.ScorerParams); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return options, false
+		}
+	}
+
+	return options, true
+}
+
+func (api *API) handleStats(c *gin.Context) {
+	stats := api.engine.Stats()
+
+	c.JSON(http.StatusOK, successResponse{
+		Success: true,
+		Data:    stats,
+	})
+}
+
+// handleCompact rebuilds the index to drop the numbers of deleted
+// documents, returning the statistics after compaction
+func (api *API) handleCompact(c *gin.Context) {
+	if err := api.engine.Compact(); err != nil {
 		c.JSON(http.StatusInternalServerError, errorResponse{
 			Success: false,
-			Error:   err.Error(),
+			Error:   fmt.Sprintf("Failed to compact index: %v", err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, successResponse{
 		Success: true,
-		Data: searchResponse{
-			Documents: result.Documents,
-			Total:     result.Total,
-			Query:     query,
-			Scores:    result.Scores,
-		},
+		Data:    api.engine.Stats(),
 	})
 }
 
-func (api *API) handleStats(c *gin.Context) {
-	stats := api.engine.Stats()
-
+func (api *API) handleSchema(c *gin.Context) {
 	c.JSON(http.StatusOK, successResponse{
 		Success: true,
-		Data:    stats,
+		Data:    api.engine.Schema(),
 	})
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDocumentErrorStatus(t *testing.T) {
+	api, _ := newTestAPI(t)
+	longID := strings.Repeat("x", maxTermLength+1)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"valid", http.MethodPost, "/documents", `{"id":"1","title":"Title","content":"Content"}`, http.StatusOK},
+		{"missing id", http.MethodPost, "/documents", `{"title":"Title","content":"Content"}`, http.StatusBadRequest},
+		{"long id", http.MethodPost, "/documents", `{"id":"` + longID + `","title":"Title","content":"Content"}`, http.StatusBadRequest},
+		{"long id in url", http.MethodPut, "/documents/" + longID, `{"title":"Title","content":"Content"}`, http.StatusBadRequest},
+		{"long metadata value", http.MethodPost, "/documents", `{"id":"2","title":"Title","content":"Content","metadata":{"tag":"` + strings.Repeat("x", maxKeywordLength+1) + `"}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		api.router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+// getJSON sends a GET request to the API and returns the status and body
+func getJSON(t *testing.T, api *API, path string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestSearchFieldsParameter(t *testing.T) {
+	api, engine := newTestAPI(t)
+	addDocuments(t, engine, NewDocument("1", "Go", "rust"), NewDocument("2", "Rust", "go"))
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/search?query=go&fields=title", http.StatusOK, `"total":1`},
+		{"/search?query=go&fields=title,content", http.StatusOK, `"total":2`},
+		{"/search?query=go&fields=body", http.StatusBadRequest, `unknown field \"body\"`},
+	}
+	for _, tt := range tests {
+		status, body := getJSON(t, api, tt.path)
+		if status != tt.status || !strings.Contains(body, tt.want) {
+			t.Errorf("GET %s = %d %s, want %d with %s", tt.path, status, body, tt.status, tt.want)
+		}
+	}
+}
+
+func TestBatchInsertResults(t *testing.T) {
+	api, engine := newTestAPI(t)
+	body := `{"documents":[
+		{"id":"1","title":"One","content":"first"},
+		{"id":"2","title":"Two"},
+		{"id":"` + strings.Repeat("x", maxTermLength+1) + `","title":"Long","content":"long id"},
+		{"id":"3","title":"Three","content":"third","metadata":{"tag":"` + strings.Repeat("x", maxKeywordLength+1) + `"}},
+		{"id":"4","title":"Four","content":"fourth"}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/documents/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var response struct {
+		Data batchInsertResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.Succeeded != 2 || response.Data.Failed != 3 {
+		t.Errorf("succeeded %d, failed %d, want 2 and 3", response.Data.Succeeded, response.Data.Failed)
+	}
+
+	want := []batchItemResult{
+		{ID: "1", Success: true},
+		{ID: "2", Error: "content is required"},
+		{Error: "document ID is longer than 32768 bytes"},
+		{ID: "3", Field: "tag"},
+		{ID: "4", Success: true},
+	}
+	if len(response.Data.Results) != len(want) {
+		t.Fatalf("%d results, want %d", len(response.Data.Results), len(want))
+	}
+	for i, got := range response.Data.Results {
+		w := want[i]
+		if got.Success != w.Success || (w.ID != "" && got.ID != w.ID) || (w.Error != "" && got.Error != w.Error) ||
+			got.Field != w.Field || (!got.Success && got.Error == "") {
+			t.Errorf("result %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	for _, id := range []string{"1", "4"} {
+		if doc, _ := engine.GetDocument(id); doc == nil {
+			t.Errorf("document %s was not saved", id)
+		}
+	}
+}
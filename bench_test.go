@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Benchmarks compare the index with mapIndex, the previous layout, on the
+// same synthetic corpus of Zipf-distributed terms:
+//
+//	go test -run '^$' -bench . -benchmem
+
+const (
+	benchDocs       = 10000 // Documents in the corpus
+	benchDocLength  = 100   // Tokens per document
+	benchVocabulary = 20000 // Distinct terms
+	benchQueries    = 200   // Queries per query kind
+	benchSeed       = 1
+)
+
+// mapPosting is a posting of the baseline index
+type mapPosting struct {
+	DocID     string `json:"doc_id"`
+	Positions []int  `json:"positions"`
+}
+
+// mapIndex is the baseline the benchmarks compare against: the previous
+// index layout, unsorted postings keyed by document ID with hash map
+// intersections
+type mapIndex struct {
+	index map[string]map[string][]mapPosting
+	docs  map[string]bool
+}
+
+func newMapIndex() *mapIndex {
+	return &mapIndex{
+		index: make(map[string]map[string][]mapPosting),
+		docs:  make(map[string]bool),
+	}
+}
+
+func (idx *mapIndex) addDocument(docID string, fields map[string][]Token) {
+	idx.docs[docID] = true
+	for field, tokens := range fields {
+		positions := make(map[string][]int)
+		for _, token := range tokens {
+			positions[token.Term] = append(positions[token.Term], token.Position)
+		}
+
+		terms, ok := idx.index[field]
+		if !ok {
+			terms = make(map[string][]mapPosting)
+			idx.index[field] = terms
+		}
+
+		for token, tokenPositions := range positions {
+			postings := terms[token]
+			found := false
+			for i := range postings {
+				if postings[i].DocID == docID {
+					postings[i].Positions = tokenPositions
+					found = true
+					break
+				}
+			}
+			if !found {
+				terms[token] = append(postings, mapPosting{DocID: docID, Positions: tokenPositions})
+			}
+		}
+	}
+}
+
+func (idx *mapIndex) removeDocument(docID string) {
+	delete(idx.docs, docID)
+	for _, terms := range idx.index {
+		for token, postings := range terms {
+			remaining := make([]mapPosting, 0, len(postings))
+			for _, posting := range postings {
+				if posting.DocID != docID {
+					remaining = append(remaining, posting)
+				}
+			}
+			if len(remaining) == 0 {
+				delete(terms, token)
+			} else {
+				terms[token] = remaining
+			}
+		}
+	}
+}
+
+func (idx *mapIndex) searchAND(terms []FieldTerm) []string {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	result := make(map[string]bool)
+	for _, posting := range idx.index[terms[0].Field][terms[0].Term] {
+		result[posting.DocID] = true
+	}
+	for _, term := range terms[1:] {
+		next := make(map[string]bool)
+		for _, posting := range idx.index[term.Field][term.Term] {
+			if result[posting.DocID] {
+				next[posting.DocID] = true
+			}
+		}
+		result = next
+	}
+	return mapKeys(result)
+}
+
+func (idx *mapIndex) searchOR(terms []FieldTerm) []string {
+	result := make(map[string]bool)
+	for _, term := range terms {
+		for _, posting := range idx.index[term.Field][term.Term] {
+			result[posting.DocID] = true
+		}
+	}
+	return mapKeys(result)
+}
+
+func (idx *mapIndex) searchNOT(terms []FieldTerm) []string {
+	excluded := make(map[string]bool)
+	for _, docID := range idx.searchOR(terms) {
+		excluded[docID] = true
+	}
+
+	docIDs := make([]string, 0, len(idx.docs))
+	for docID := range idx.docs {
+		if !excluded[docID] {
+			docIDs = append(docIDs, docID)
+		}
+	}
+	return docIDs
+}
+
+// save stores the index the way it used to be stored, as a single JSON
+// value
+func (idx *mapIndex) save(s *Storage) error {
+	data, err := json.Marshal(idx.index)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).Put(legacyIndexKey, data)
+	})
+}
+
+func mapKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// benchCorpus generates documents of Zipf-distributed terms in the content
+// field
+func benchCorpus(r *rand.Rand, docs int) []map[string][]Token {
+	zipf := rand.NewZipf(r, 1.1, 1, benchVocabulary-1)
+	corpus := make([]map[string][]Token, docs)
+	for i := range corpus {
+		tokens := make([]Token, benchDocLength)
+		for pos := range tokens {
+			tokens[pos] = Token{Term: fmt.Sprintf("t%d", zipf.Uint64()), Position: pos}
+		}
+		corpus[i] = map[string][]Token{FieldContent: tokens}
+	}
+	return corpus
+}
+
+// benchTermQueries picks query terms with the corpus distribution, so
+// common terms with long posting lists are queried most
+func benchTermQueries(r *rand.Rand, terms int) [][]FieldTerm {
+	zipf := rand.NewZipf(r, 1.1, 1, benchVocabulary-1)
+	queries := make([][]FieldTerm, benchQueries)
+	for i := range queries {
+		for j := 0; j < terms; j++ {
+			queries[i] = append(queries[i], FieldTerm{Field: FieldContent, Term: fmt.Sprintf("t%d", zipf.Uint64())})
+		}
+	}
+	return queries
+}
+
+func benchDocID(i int) string {
+	return fmt.Sprintf("doc-%08d", i)
+}
+
+// benchIndexes builds both indexes from the same corpus
+func benchIndexes(docs int) ([]map[string][]Token, *mapIndex, *Index) {
+	corpus := benchCorpus(rand.New(rand.NewSource(benchSeed)), docs)
+	baseline, current := newMapIndex(), NewIndex()
+	for i, fields := range corpus {
+		baseline.addDocument(benchDocID(i), fields)
+		current.AddDocument(benchDocID(i), fields)
+	}
+	return corpus, baseline, current
+}
+
+// benchStorage opens a storage in a temporary directory
+func benchStorage(b *testing.B, name string) *Storage {
+	storage, err := NewStorage(filepath.Join(b.TempDir(), name))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+// indexSize returns the bytes the stored index takes up in database pages
+func indexSize(s *Storage) (int, error) {
+	var size int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stats := tx.Bucket(indexBucket).Stats()
+		size = stats.BranchInuse + stats.LeafInuse + stats.InlineBucketInuse
+		return nil
+	})
+	return size, err
+}
+
+// benchSearches are the query kinds run against both indexes
+var benchSearches = []struct {
+	name     string
+	terms    int
+	baseline func(*mapIndex, []FieldTerm) []string
+	current  func(*Index, []FieldTerm) []string
+}{
+	{"AND-2", 2, (*mapIndex).searchAND, (*Index).SearchAND},
+	{"AND-3", 3, (*mapIndex).searchAND, (*Index).SearchAND},
+	{"OR-2", 2, (*mapIndex).searchOR, (*Index).SearchOR},
+	{"OR-5", 5, (*mapIndex).searchOR, (*Index).SearchOR},
+	{"NOT-2", 2, (*mapIndex).searchNOT, (*Index).SearchNOT},
+}
+
+// TestIndexMatchesMapIndex checks that the index finds the same documents
+// as the baseline, so the benchmarks compare equal work
+func TestIndexMatchesMapIndex(t *testing.T) {
+	_, baseline, current := benchIndexes(2000)
+	r := rand.New(rand.NewSource(benchSeed))
+	for _, search := range benchSearches {
+		for _, query := range benchTermQueries(r, search.terms) {
+			want, got := search.baseline(baseline, query), search.current(current, query)
+			sort.Strings(want)
+			sort.Strings(got)
+			if fmt.Sprint(want) != fmt.Sprint(got) {
+				t.Fatalf("%s %v: got %d documents, want %d", search.name, query, len(got), len(want))
+			}
+		}
+	}
+}
+
+func BenchmarkIndexBuild(b *testing.B) {
+	corpus := benchCorpus(rand.New(rand.NewSource(benchSeed)), benchDocs)
+
+	// heap is the live heap held by one more index, measured once the
+	// indexes of the timed loop are released
+	heap := func(build func() any) float64 {
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		idx := build()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(idx)
+		return (float64(after.HeapAlloc) - float64(before.HeapAlloc)) / (1 << 20)
+	}
+
+	b.Run("map", func(b *testing.B) {
+		var idx *mapIndex
+		for i := 0; i < b.N; i++ {
+			idx = newMapIndex()
+			for j, fields := range corpus {
+				idx.addDocument(benchDocID(j), fields)
+			}
+		}
+		b.StopTimer()
+		idx = nil
+		b.ReportMetric(heap(func() any {
+			idx := newMapIndex()
+			for j, fields := range corpus {
+				idx.addDocument(benchDocID(j), fields)
+			}
+			return idx
+		}), "heap-MiB")
+	})
+	b.Run("current", func(b *testing.B) {
+		var idx *Index
+		for i := 0; i < b.N; i++ {
+			idx = NewIndex()
+			for j, fields := range corpus {
+				idx.AddDocument(benchDocID(j), fields)
+			}
+		}
+		b.StopTimer()
+		idx = nil
+		b.ReportMetric(heap(func() any {
+			idx := NewIndex()
+			for j, fields := range corpus {
+				idx.AddDocument(benchDocID(j), fields)
+			}
+			return idx
+		}), "heap-MiB")
+	})
+}
+
+func BenchmarkIndexSave(b *testing.B) {
+	_, baseline, current := benchIndexes(benchDocs)
+
+	b.Run("map", func(b *testing.B) {
+		storage := benchStorage(b, "map.db")
+		for i := 0; i < b.N; i++ {
+			if err := baseline.save(storage); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		size, err := indexSize(storage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(size)/(1<<20), "stored-MiB")
+	})
+	b.Run("current", func(b *testing.B) {
+		storage := benchStorage(b, "current.db")
+		for i := 0; i < b.N; i++ {
+			// Write the whole index every time, as the baseline does
+			current.changes.all = true
+			if err := storage.SaveIndex(current); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		size, err := indexSize(storage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(size)/(1<<20), "stored-MiB")
+	})
+}
+
+func BenchmarkSearch(b *testing.B) {
+	_, baseline, current := benchIndexes(benchDocs)
+	r := rand.New(rand.NewSource(benchSeed))
+
+	for _, search := range benchSearches {
+		search := search
+		queries := benchTermQueries(r, search.terms)
+		b.Run(search.name+"/map", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				search.baseline(baseline, queries[i%len(queries)])
+			}
+		})
+		b.Run(search.name+"/current", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				search.current(current, queries[i%len(queries)])
+			}
+		})
+	}
+}
+
+// BenchmarkUpdate replaces documents with others of the corpus. With the
+// forward index an update touches only the document's own terms, so the
+// current index should take about as long at every corpus size.
+func BenchmarkUpdate(b *testing.B) {
+	for _, docs := range []int{benchDocs / 4, benchDocs / 2, benchDocs} {
+		corpus, baseline, current := benchIndexes(docs)
+		b.Run(fmt.Sprintf("map/%d", docs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				doc := i % docs
+				baseline.removeDocument(benchDocID(doc))
+				baseline.addDocument(benchDocID(doc), corpus[(doc+1)%docs])
+			}
+		})
+		b.Run(fmt.Sprintf("current/%d", docs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				doc := i % docs
+				current.UpdateDocument(benchDocID(doc), corpus[(doc+1)%docs])
+			}
+		})
+	}
+}
+
+// BenchmarkDelete removes documents and adds them back untimed
+func BenchmarkDelete(b *testing.B) {
+	for _, docs := range []int{benchDocs / 4, benchDocs / 2, benchDocs} {
+		corpus, baseline, current := benchIndexes(docs)
+		b.Run(fmt.Sprintf("map/%d", docs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				doc := i % docs
+				baseline.removeDocument(benchDocID(doc))
+				b.StopTimer()
+				baseline.addDocument(benchDocID(doc), corpus[doc])
+				b.StartTimer()
+			}
+		})
+		b.Run(fmt.Sprintf("current/%d", docs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				doc := i % docs
+				current.RemoveDocument(benchDocID(doc))
+				b.StopTimer()
+				current.AddDocument(benchDocID(doc), corpus[doc])
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkAddAndSave adds a document and saves the index. The baseline
+// rewrites its whole JSON value; the current index writes only the
+// changed terms.
+func BenchmarkAddAndSave(b *testing.B) {
+	corpus, baseline, current := benchIndexes(benchDocs)
+	updates := benchCorpus(rand.New(rand.NewSource(benchSeed+1)), 100)
+
+	b.Run("map", func(b *testing.B) {
+		storage := benchStorage(b, "map.db")
+		for i := 0; i < b.N; i++ {
+			baseline.addDocument(benchDocID(len(corpus)+i), updates[i%len(updates)])
+			if err := baseline.save(storage); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("current", func(b *testing.B) {
+		storage := benchStorage(b, "current.db")
+		if err := storage.SaveIndex(current); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			current.AddDocument(benchDocID(len(corpus)+i), updates[i%len(updates)])
+			if err := storage.SaveIndex(current); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// arrayMaxSize is the largest container kept as a sorted array; past it a
+// 65536-bit bitset (8 KiB) is smaller than the array
+const arrayMaxSize = 4096
+
+// bitsetWords is the number of 64-bit words in a bitset container
+const bitsetWords = 1 << 16 / 64
+
+// Bitmap is a compressed set of document numbers in the style of roaring
+// bitmaps. Numbers are grouped by their high 16 bits into containers; a
+// container holds its low 16 bits as a sorted array while it has at most
+// arrayMaxSize values and as a bitset beyond that. Set operations work a
+// container at a time, on bitsets a word at a time.
+type Bitmap struct {
+	keys       []uint16
+	containers []*container
+}
+
+// container holds the low 16 bits of the numbers sharing a key. Exactly
+// one of array and bitset is set.
+type container struct {
+	array  []uint16
+	bitset []uint64
+	n      int
+}
+
+// NewBitmap creates an empty bitmap
+func NewBitmap() *Bitmap {
+	return &Bitmap{}
+}
+
+// bitmapOf creates a bitmap from sorted document numbers
+func bitmapOf(nums []uint32) *Bitmap {
+	b := NewBitmap()
+	for len(nums) > 0 {
+		key := uint16(nums[0] >> 16)
+		end := sort.Search(len(nums), func(i int) bool { return uint16(nums[i]>>16) != key })
+		c := &container{array: make([]uint16, end)}
+		for i, num := range nums[:end] {
+			c.array[i] = uint16(num)
+		}
+		c.n = end
+		b.keys = append(b.keys, key)
+		b.containers = append(b.containers, c.optimize())
+		nums = nums[end:]
+	}
+	return b
+}
+
+// Cardinality returns the number of documents in the set
+func (b *Bitmap) Cardinality() int {
+	n := 0
+	for _, c := range b.containers {
+		n += c.n
+	}
+	return n
+}
+
+// find returns the index of the container for a key, or where it would be
+// inserted
+func (b *Bitmap) find(key uint16) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+// Contains reports whether a document is in the set
+func (b *Bitmap) Contains(num uint32) bool {
+	i, ok := b.find(uint16(num >> 16))
+	return ok && b.containers[i].contains(uint16(num))
+}
+
+// Add adds a document to the set
+func (b *Bitmap) Add(num uint32) {
+	key := uint16(num >> 16)
+	i, ok := b.find(key)
+	if !ok {
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = &container{}
+	}
+	b.containers[i] = b.containers[i].add(uint16(num))
+}
+
+// Remove removes a document from the set
+func (b *Bitmap) Remove(num uint32) {
+	i, ok := b.find(uint16(num >> 16))
+	if !ok {
+		return
+	}
+	c := b.containers[i].remove(uint16(num))
+	if c.n > 0 {
+		b.containers[i] = c
+		return
+	}
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	b.containers = append(b.containers[:i], b.containers[i+1:]...)
+}
+
+// ToArray returns the documents in the set in ascending order
+func (b *Bitmap) ToArray() []uint32 {
+	nums := make([]uint32, 0, b.Cardinality())
+	for i, c := range b.containers {
+		high := uint32(b.keys[i]) << 16
+		c.each(func(low uint16) {
+			nums = append(nums, high|uint32(low))
+		})
+	}
+	return nums
+}
+
+// Clone returns a copy of the set
+func (b *Bitmap) Clone() *Bitmap {
+	clone := &Bitmap{
+		keys:       append([]uint16(nil), b.keys...),
+		containers: make([]*container, len(b.containers)),
+	}
+	for i, c := range b.containers {
+		clone.containers[i] = c.clone()
+	}
+	return clone
+}
+
+// And returns the documents in both sets
+func (b *Bitmap) And(other *Bitmap) *Bitmap {
+	result := NewBitmap()
+	i, j := 0, 0
+	for i < len(b.keys) && j < len(other.keys) {
+		switch {
+		case b.keys[i] < other.keys[j]:
+			i++
+		case b.keys[i] > other.keys[j]:
+			j++
+		default:
+			if c := b.containers[i].and(other.containers[j]); c.n > 0 {
+				result.keys = append(result.keys, b.keys[i])
+				result.containers = append(result.containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// Or returns the documents in either set
+func (b *Bitmap) Or(other *Bitmap) *Bitmap {
+	result := NewBitmap()
+	i, j := 0, 0
+	for i < len(b.keys) || j < len(other.keys) {
+		switch {
+		case j == len(other.keys) || (i < len(b.keys) && b.keys[i] < other.keys[j]):
+			result.keys = append(result.keys, b.keys[i])
+			result.containers = append(result.containers, b.containers[i].clone())
+			i++
+		case i == len(b.keys) || b.keys[i] > other.keys[j]:
+			result.keys = append(result.keys, other.keys[j])
+			result.containers = append(result.containers, other.containers[j].clone())
+			j++
+		default:
+			result.keys = append(result.keys, b.keys[i])
+			result.containers = append(result.containers, b.containers[i].or(other.containers[j]))
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// AndNot returns the documents in this set but not in the other
+func (b *Bitmap) AndNot(other *Bitmap) *Bitmap {
+	result := NewBitmap()
+	j := 0
+	for i, key := range b.keys {
+		for j < len(other.keys) && other.keys[j] < key {
+			j++
+		}
+		c := b.containers[i].clone()
+		if j < len(other.keys) && other.keys[j] == key {
+			c = c.andNot(other.containers[j])
+		}
+		if c.n > 0 {
+			result.keys = append(result.keys, key)
+			result.containers = append(result.containers, c)
+		}
+	}
+	return result
+}
+
+// MarshalBinary encodes the set: the container count, then for each
+// container its key, cardinality and either its array values or its
+// bitset words
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(b.keys)))
+	for i, c := range b.containers {
+		buf = binary.LittleEndian.AppendUint16(buf, b.keys[i])
+		buf = binary.AppendUvarint(buf, uint64(c.n))
+		if c.array != nil {
+			for _, value := range c.array {
+				buf = binary.LittleEndian.AppendUint16(buf, value)
+			}
+		} else {
+			for _, word := range c.bitset {
+				buf = binary.LittleEndian.AppendUint64(buf, word)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// errCorruptBitmap is returned when a bitmap cannot be decoded
+var errCorruptBitmap = fmt.Errorf("%w: bad bitmap", errCorruptIndex)
+
+// UnmarshalBinary decodes a set encoded by MarshalBinary
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return errCorruptBitmap
+	}
+	data = data[n:]
+
+	*b = Bitmap{
+		keys:       make([]uint16, count),
+		containers: make([]*container, count),
+	}
+	for i := range b.keys {
+		if len(data) < 2 {
+			return errCorruptBitmap
+		}
+		b.keys[i] = binary.LittleEndian.Uint16(data)
+		size, n := binary.Uvarint(data[2:])
+		if n <= 0 || size == 0 || size > 1<<16 {
+			return errCorruptBitmap
+		}
+		data = data[2+n:]
+
+		c := &container{n: int(size)}
+		if c.n <= arrayMaxSize {
+			if len(data) < 2*c.n {
+				return errCorruptBitmap
+			}
+			c.array = make([]uint16, c.n)
+			for j := range c.array {
+				c.array[j] = binary.LittleEndian.Uint16(data[2*j:])
+			}
+			data = data[2*c.n:]
+		} else {
+			if len(data) < 8*bitsetWords {
+				return errCorruptBitmap
+			}
+			c.bitset = make([]uint64, bitsetWords)
+			for j := range c.bitset {
+				c.bitset[j] = binary.LittleEndian.Uint64(data[8*j:])
+			}
+			data = data[8*bitsetWords:]
+		}
+		b.containers[i] = c
+	}
+	return nil
+}
+
+func (c *container) contains(value uint16) bool {
+	if c.bitset != nil {
+		return c.bitset[value/64]&(1<<(value%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= value })
+	return i < len(c.array) && c.array[i] == value
+}
+
+func (c *container) add(value uint16) *container {
+	if c.bitset != nil {
+		if c.bitset[value/64]&(1<<(value%64)) == 0 {
+			c.bitset[value/64] |= 1 << (value % 64)
+			c.n++
+		}
+		return c
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= value })
+	if i < len(c.array) && c.array[i] == value {
+		return c
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = value
+	c.n++
+	return c.optimize()
+}
+
+func (c *container) remove(value uint16) *container {
+	if c.bitset != nil {
+		if c.bitset[value/64]&(1<<(value%64)) != 0 {
+			c.bitset[value/64] &^= 1 << (value % 64)
+			c.n--
+		}
+		return c.optimize()
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= value })
+	if i < len(c.array) && c.array[i] == value {
+		c.array = append(c.array[:i], c.array[i+1:]...)
+		c.n--
+	}
+	return c
+}
+
+// each calls fn for every value in ascending order
+func (c *container) each(fn func(value uint16)) {
+	if c.bitset == nil {
+		for _, value := range c.array {
+			fn(value)
+		}
+		return
+	}
+	for i, word := range c.bitset {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			fn(uint16(i*64 + bit))
+			word &= word - 1
+		}
+	}
+}
+
+func (c *container) clone() *container {
+	return &container{
+		array:  append([]uint16(nil), c.array...),
+		bitset: append([]uint64(nil), c.bitset...),
+		n:      c.n,
+	}
+}
+
+// toBitset returns the values of the container as a new bitset
+func (c *container) toBitset() []uint64 {
+	if c.bitset != nil {
+		return append([]uint64(nil), c.bitset...)
+	}
+	bitset := make([]uint64, bitsetWords)
+	for _, value := range c.array {
+		bitset[value/64] |= 1 << (value % 64)
+	}
+	return bitset
+}
+
+// optimize switches between the array and bitset representations so the
+// container uses the smaller one
+func (c *container) optimize() *container {
+	switch {
+	case c.bitset == nil && c.n > arrayMaxSize:
+		c.bitset = c.toBitset()
+		c.array = nil
+	case c.bitset != nil && c.n <= arrayMaxSize:
+		array := make([]uint16, 0, c.n)
+		c.each(func(value uint16) {
+			array = append(array, value)
+		})
+		c.array = array
+		c.bitset = nil
+	}
+	return c
+}
+
+// fromBitset creates a container from a bitset it may keep
+func fromBitset(bitset []uint64) *container {
+	n := 0
+	for _, word := range bitset {
+		n += bits.OnesCount64(word)
+	}
+	return (&container{bitset: bitset, n: n}).optimize()
+}
+
+func (c *container) and(other *container) *container {
+	switch {
+	case c.bitset != nil && other.bitset != nil:
+		bitset := make([]uint64, bitsetWords)
+		for i := range bitset {
+			bitset[i] = c.bitset[i] & other.bitset[i]
+		}
+		return fromBitset(bitset)
+	case c.bitset != nil:
+		return other.and(c)
+	}
+
+	// c is an array: keep the values the other container has
+	result := &container{array: make([]uint16, 0, c.n)}
+	if other.bitset != nil {
+		for _, value := range c.array {
+			if other.contains(value) {
+				result.array = append(result.array, value)
+			}
+		}
+	} else {
+		i, j := 0, 0
+		for i < len(c.array) && j < len(other.array) {
+			switch {
+			case c.array[i] < other.array[j]:
+				i++
+			case c.array[i] > other.array[j]:
+				j++
+			default:
+				result.array = append(result.array, c.array[i])
+				i++
+				j++
+			}
+		}
+	}
+	result.n = len(result.array)
+	return result
+}
+
+func (c *container) or(other *container) *container {
+	if c.bitset == nil && other.bitset == nil && c.n+other.n <= arrayMaxSize {
+		result := &container{array: make([]uint16, 0, c.n+other.n)}
+		i, j := 0, 0
+		for i < len(c.array) || j < len(other.array) {
+			switch {
+			case j == len(other.array) || (i < len(c.array) && c.array[i] < other.array[j]):
+				result.array = append(result.array, c.array[i])
+				i++
+			case i == len(c.array) || c.array[i] > other.array[j]:
+				result.array = append(result.array, other.array[j])
+				j++
+			default:
+				result.array = append(result.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		result.n = len(result.array)
+		return result
+	}
+
+	bitset := c.toBitset()
+	if other.bitset != nil {
+		for i, word := range other.bitset {
+			bitset[i] |= word
+		}
+	} else {
+		for _, value := range other.array {
+			bitset[value/64] |= 1 << (value % 64)
+		}
+	}
+	return fromBitset(bitset)
+}
+
+// andNot removes the values of another container; c is modified
+func (c *container) andNot(other *container) *container {
+	if c.bitset != nil {
+		if other.bitset != nil {
+			for i, word := range other.bitset {
+				c.bitset[i] &^= word
+			}
+		} else {
+			for _, value := range other.array {
+				c.bitset[value/64] &^= 1 << (value % 64)
+			}
+		}
+		return fromBitset(c.bitset)
+	}
+
+	array := c.array[:0]
+	for _, value := range c.array {
+		if !other.contains(value) {
+			array = append(array, value)
+		}
+	}
+	c.array = array
+	c.n = len(array)
+	return c
+}
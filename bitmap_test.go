@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// bitmapModel is the expected content of a bitmap
+type bitmapModel map[uint32]bool
+
+func (m bitmapModel) nums() []uint32 {
+	nums := make([]uint32, 0, len(m))
+	for num := range m {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+// checkBitmap compares a bitmap with the model and checks each container
+// uses the representation its cardinality calls for
+func checkBitmap(t *testing.T, b *Bitmap, want bitmapModel) {
+	t.Helper()
+
+	if got := b.ToArray(); !reflect.DeepEqual(got, want.nums()) {
+		t.Fatalf("ToArray() has %d numbers, want %d", len(got), len(want))
+	}
+	if b.Cardinality() != len(want) {
+		t.Fatalf("Cardinality() = %d, want %d", b.Cardinality(), len(want))
+	}
+	for i, c := range b.containers {
+		if c.n == 0 || (c.n > arrayMaxSize) != (c.bitset != nil) || (c.array == nil) == (c.bitset == nil) {
+			t.Fatalf("container %d has %d values, array %v, bitset %v", b.keys[i], c.n, c.array != nil, c.bitset != nil)
+		}
+		if i > 0 && b.keys[i-1] >= b.keys[i] {
+			t.Fatalf("keys out of order: %v", b.keys)
+		}
+	}
+}
+
+// randomBitmap returns a bitmap and its model, with numbers spread over a
+// few containers, some dense enough to be bitsets
+func randomBitmap(r *rand.Rand, n int) (*Bitmap, bitmapModel) {
+	b := NewBitmap()
+	m := make(bitmapModel)
+	for i := 0; i < n; i++ {
+		num := uint32(r.Intn(3))<<16 | uint32(r.Intn(1<<14))
+		b.Add(num)
+		m[num] = true
+	}
+	return b, m
+}
+
+func TestBitmapAddRemoveContains(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := NewBitmap()
+	want := make(bitmapModel)
+
+	// Grow containers past arrayMaxSize, then shrink them back to arrays
+	// and to nothing
+	for i := 0; i < 30000; i++ {
+		num := uint32(r.Intn(2))<<16 | uint32(r.Intn(8000))
+		b.Add(num)
+		want[num] = true
+	}
+	checkBitmap(t, b, want)
+	for _, c := range b.containers {
+		if c.bitset == nil {
+			t.Fatal("dense container is not a bitset")
+		}
+	}
+
+	for num := range want {
+		if !b.Contains(num) {
+			t.Fatalf("Contains(%d) = false", num)
+		}
+	}
+	if b.Contains(5<<16) || b.Contains(9000) {
+		t.Fatal("Contains reports a number never added")
+	}
+
+	for _, num := range want.nums() {
+		if r.Intn(10) > 0 || num>>16 == 1 {
+			b.Remove(num)
+			delete(want, num)
+		}
+	}
+	b.Remove(7 << 16) // Missing container
+	checkBitmap(t, b, want)
+	if len(b.keys) != 1 {
+		t.Fatalf("keys = %v, want the emptied container removed", b.keys)
+	}
+}
+
+func TestBitmapOf(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	_, want := randomBitmap(r, 20000)
+	checkBitmap(t, bitmapOf(want.nums()), want)
+	checkBitmap(t, bitmapOf(nil), bitmapModel{})
+}
+
+func TestBitmapSetOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for _, sizes := range [][2]int{{0, 100}, {100, 100}, {100, 20000}, {20000, 20000}} {
+		a, am := randomBitmap(r, sizes[0])
+		b, bm := randomBitmap(r, sizes[1])
+		before := a.ToArray()
+
+		and, or, andNot := make(bitmapModel), make(bitmapModel), make(bitmapModel)
+		for num := range am {
+			or[num] = true
+			if bm[num] {
+				and[num] = true
+			} else {
+				andNot[num] = true
+			}
+		}
+		for num := range bm {
+			or[num] = true
+		}
+
+		checkBitmap(t, a.And(b), and)
+		checkBitmap(t, b.And(a), and)
+		checkBitmap(t, a.Or(b), or)
+		checkBitmap(t, a.AndNot(b), andNot)
+		if !reflect.DeepEqual(a.ToArray(), before) {
+			t.Fatal("set operation changed its receiver")
+		}
+	}
+}
+
+func TestBitmapClone(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	b, want := randomBitmap(r, 10000)
+	clone := b.Clone()
+	for num := range want {
+		clone.Remove(num)
+	}
+	checkBitmap(t, b, want)
+	checkBitmap(t, clone, bitmapModel{})
+}
+
+func TestBitmapMarshalRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for _, n := range []int{0, 1, 1000, 20000} {
+		b, want := randomBitmap(r, n)
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded Bitmap
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%d numbers: %v", n, err)
+		}
+		checkBitmap(t, &decoded, want)
+
+		for _, cut := range []int{len(data) / 2, len(data) - 1} {
+			if cut <= 0 {
+				continue
+			}
+			if err := decoded.UnmarshalBinary(data[:cut]); !errors.Is(err, errCorruptIndex) {
+				t.Errorf("%d numbers cut at %d: err = %v, want errCorruptIndex", n, cut, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of the bulk API
+const (
+	// bulkBatchSize is the number of consecutive index, create and update
+	// actions saved together in one transaction
+	bulkBatchSize = 500
+
+	// maxBulkLineSize is the longest line a bulk request may contain
+	maxBulkLineSize = 16 << 20
+)
+
+// Actions of the bulk API
+const (
+	bulkIndex  = "index"
+	bulkCreate = "create"
+	bulkUpdate = "update"
+	bulkDelete = "delete"
+)
+
+// bulkActionMeta is the metadata of a bulk action line
+type bulkActionMeta struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// bulkUpdateSource is the source line of an update action
+type bulkUpdateSource struct {
+	Doc         map[string]json.RawMessage `json:"doc"`
+	Upsert      map[string]json.RawMessage `json:"upsert"`
+	DocAsUpsert bool                       `json:"doc_as_upsert"`
+}
+
+// bulkError describes why an action failed, in the Elasticsearch format
+type bulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// bulkItemResult is the outcome of one action
+type bulkItemResult struct {
+	Index  string     `json:"_index,omitempty"`
+	ID     string     `json:"_id"`
+	Result string     `json:"result,omitempty"`
+	Status int        `json:"status"`
+	Error  *bulkError `json:"error,omitempty"`
+}
+
+// bulkItem is the response entry of one action, keyed by the action name
+type bulkItem map[string]*bulkItemResult
+
+type bulkResponse struct {
+	Took   int64      `json:"took"` // Milliseconds
+	Errors bool       `json:"errors"`
+	Items  []bulkItem `json:"items"`
+}
+
+// bulkParseErrorResponse is returned when a line cannot be parsed and the
+// rest of the request cannot be read. Actions before the line were
+// applied and are listed in items.
+type bulkParseErrorResponse struct {
+	Error  bulkError  `json:"error"`
+	Status int        `json:"status"`
+	Items  []bulkItem `json:"items"`
+}
+
+// handleBulk applies an Elasticsearch-style bulk request: NDJSON with an
+// action line per action, followed by a source line for index, create and
+// update. The body is streamed, and runs of index, create and update
+// actions are saved in batches.
+func (api *API) handleBulk(c *gin.Context) {
+	start := time.Now()
+	bulk := newBulkProcessor(api.engine)
+
+	scanner := bufio.NewScanner(c.Request.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxBulkLineSize)
+	line := 0
+	nextLine := func() ([]byte, bool) {
+		for scanner.Scan() {
+			line++
+			if text := scanner.Bytes(); len(bytes.TrimSpace(text)) > 0 {
+				return text, true
+			}
+		}
+		return nil, false
+	}
+
+	parseError := func(reason string) {
+		bulk.flush()
+		c.JSON(http.StatusBadRequest, bulkParseErrorResponse{
+			Error:  bulkError{Type: "parse_exception", Reason: fmt.Sprintf("line %d: %s", line, reason)},
+			Status: http.StatusBadRequest,
+			Items:  bulk.items,
+		})
+	}
+
+	for {
+		actionLine, ok := nextLine()
+		if !ok {
+			break
+		}
+
+		var action map[string]bulkActionMeta
+		if err := json.Unmarshal(actionLine, &action); err != nil || len(action) != 1 {
+			parseError("expected an action line with exactly one action")
+			return
+		}
+		for name, meta := range action {
+			var source []byte
+			switch name {
+			case bulkIndex, bulkCreate, bulkUpdate:
+				if source, ok = nextLine(); !ok {
+					parseError(fmt.Sprintf("%s action has no source line", name))
+					return
+				}
+				// The scanner reuses its buffer
+				source = append([]byte(nil), source...)
+			case bulkDelete:
+			default:
+				parseError(fmt.Sprintf("unknown action %q", name))
+				return
+			}
+			bulk.apply(name, meta, source)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			parseError(fmt.Sprintf("line is longer than %d bytes", maxBulkLineSize))
+		} else {
+			parseError(err.Error())
+		}
+		return
+	}
+	bulk.flush()
+
+	response := bulkResponse{
+		Took:  time.Since(start).Milliseconds(),
+		Items: bulk.items,
+	}
+	for _, item := range bulk.items {
+		for _, result := range item {
+			if result.Error != nil {
+				response.Errors = true
+			}
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// bulkProcessor applies bulk actions in order. Documents written by index,
+// create and update actions are held until the batch is full or a delete
+// follows, then saved with UpsertBatch.
+type bulkProcessor struct {
+	engine  *SearchEngine
+	items   []bulkItem
+	pending []*Document
+	results []*bulkItemResult    // Result of each pending document
+	latest  map[string]*Document // Latest pending version of each document
+}
+
+func newBulkProcessor(engine *SearchEngine) *bulkProcessor {
+	return &bulkProcessor{
+		engine: engine,
+		latest: make(map[string]*Document),
+	}
+}
+
+// apply applies one action and records its result
+func (p *bulkProcessor) apply(action string, meta bulkActionMeta, source []byte) {
+	result := &bulkItemResult{Index: meta.Index, ID: meta.ID}
+	p.items = append(p.items, bulkItem{action: result})
+
+	fail := func(status int, errorType, reason string) {
+		result.Status = status
+		result.Error = &bulkError{Type: errorType, Reason: reason}
+	}
+
+	if meta.ID == "" {
+		if action != bulkIndex {
+			fail(http.StatusBadRequest, "action_request_validation_exception", "_id is required")
+			return
+		}
+		meta.ID = generateDocumentID()
+		result.ID = meta.ID
+	}
+	if err := validateDocumentID(meta.ID); err != nil {
+		fail(http.StatusBadRequest, "action_request_validation_exception", err.Error())
+		return
+	}
+
+	if action == bulkDelete {
+		p.flush()
+		existing, err := p.engine.GetDocument(meta.ID)
+		if err == nil && existing != nil {
+			err = p.engine.DeleteDocument(meta.ID)
+		}
+		switch {
+		case err != nil:
+			fail(http.StatusInternalServerError, "exception", err.Error())
+		case existing == nil:
+			result.Result, result.Status = "not_found", http.StatusNotFound
+		default:
+			result.Result, result.Status = "deleted", http.StatusOK
+		}
+		return
+	}
+
+	existing, err := p.current(meta.ID)
+	if err != nil {
+		fail(http.StatusInternalServerError, "exception", err.Error())
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	doc := NewDocument(meta.ID, "", "")
+	switch action {
+	case bulkIndex:
+		err = json.Unmarshal(source, &fields)
+	case bulkCreate:
+		if existing != nil {
+			fail(http.StatusConflict, "version_conflict_engine_exception", fmt.Sprintf("[%s]: version conflict, document already exists", meta.ID))
+			return
+		}
+		err = json.Unmarshal(source, &fields)
+	case bulkUpdate:
+		var update bulkUpdateSource
+		if err = json.Unmarshal(source, &update); err != nil {
+			break
+		}
+		switch {
+		case existing != nil:
+			doc = existing.clone()
+			fields = update.Doc
+		case update.DocAsUpsert:
+			fields = update.Doc
+		case update.Upsert != nil:
+			fields = update.Upsert
+		default:
+			fail(http.StatusNotFound, "document_missing_exception", fmt.Sprintf("[%s]: document missing", meta.ID))
+			return
+		}
+	}
+	if err == nil {
+		err = applySource(doc, fields)
+	}
+	if err != nil {
+		fail(http.StatusBadRequest, "mapper_parsing_exception", fmt.Sprintf("failed to parse source: %v", err))
+		return
+	}
+	// Reject an invalid document now, so a later update of the same ID
+	// does not build on it
+	if err := p.engine.validateDocument(doc); err != nil {
+		fail(http.StatusBadRequest, validationErrorType(err), err.Error())
+		return
+	}
+
+	if existing != nil {
+		result.Result, result.Status = "updated", http.StatusOK
+	} else {
+		result.Result, result.Status = "created", http.StatusCreated
+	}
+
+	p.pending = append(p.pending, doc)
+	p.results = append(p.results, result)
+	p.latest[doc.ID] = doc
+	if len(p.pending) >= bulkBatchSize {
+		p.flush()
+	}
+}
+
+// current returns the latest version of a document, pending or saved, or
+// nil if there is none
+func (p *bulkProcessor) current(docID string) (*Document, error) {
+	if doc, ok := p.latest[docID]; ok {
+		return doc, nil
+	}
+	return p.engine.GetDocument(docID)
+}
+
+// flush saves the pending documents in one batch
+func (p *bulkProcessor) flush() {
+	if len(p.pending) == 0 {
+		return
+	}
+
+	outcomes, err := p.engine.UpsertBatch(p.pending)
+	for i, result := range p.results {
+		switch {
+		case err != nil:
+			result.Result, result.Status = "", http.StatusInternalServerError
+			result.Error = &bulkError{Type: "exception", Reason: err.Error()}
+		case outcomes[i].Err != nil:
+			result.Result, result.Status = "", http.StatusBadRequest
+			result.Error = &bulkError{Type: validationErrorType(outcomes[i].Err), Reason: outcomes[i].Err.Error()}
+		}
+	}
+
+	p.pending = p.pending[:0]
+	p.results = p.results[:0]
+	p.latest = make(map[string]*Document)
+}
+
+// validationErrorType returns the Elasticsearch error type of a rejected
+// document
+func validationErrorType(err error) string {
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		return "document_parsing_exception"
+	}
+	return "action_request_validation_exception"
+}
+
+// applySource sets the fields of a document from an Elasticsearch source.
+// title, content and url map onto the document fields and metadata onto
+// its metadata; any other field is kept as metadata, with values that are
+// not strings stored as JSON.
+func applySource(doc *Document, source map[string]json.RawMessage) error {
+	for field, raw := range source {
+		var err error
+		switch field {
+		case "id", "_id":
+			// The ID comes from the action line
+		case FieldTitle:
+			err = json.Unmarshal(raw, &doc.Title)
+		case FieldContent:
+			err = json.Unmarshal(raw, &doc.Content)
+		case FieldURL:
+			err = json.Unmarshal(raw, &doc.URL)
+		case "metadata":
+			var metadata map[string]string
+			if err = json.Unmarshal(raw, &metadata); err == nil {
+				for key, value := range metadata {
+					doc.Metadata[key] = value
+				}
+			}
+		default:
+			var value string
+			if json.Unmarshal(raw, &value) != nil {
+				value = string(raw)
+			}
+			doc.Metadata[field] = value
+		}
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// generateDocumentID returns a random ID for a document indexed without
+// one, like Elasticsearch's 20 character IDs
+func generateDocumentID() string {
+	id := make([]byte, 15)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic(fmt.Sprintf("failed to generate document ID: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(id)
+}
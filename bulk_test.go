@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestAPI returns the API of a new search engine, without request logs
+func newTestAPI(t *testing.T) (*API, *SearchEngine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	engine := newTestEngine(t)
+	return NewAPI(engine), engine
+}
+
+// postBulk sends NDJSON lines to /_bulk and decodes the response into v
+func postBulk(t *testing.T, api *API, lines []string, v interface{}) int {
+	t.Helper()
+	body := strings.Join(lines, "\n") + "\n"
+	req := httptest.NewRequest(http.MethodPost, "/_bulk", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %s: %v", rec.Body, err)
+	}
+	return rec.Code
+}
+
+// bulkOutcome is the action, status and result or error type of an item
+func bulkOutcome(item bulkItem) string {
+	for action, result := range item {
+		outcome := result.Result
+		if result.Error != nil {
+			outcome = result.Error.Type
+		}
+		return fmt.Sprintf("%s %s %d %s", action, result.ID, result.Status, outcome)
+	}
+	return ""
+}
+
+func TestBulkActions(t *testing.T) {
+	api, engine := newTestAPI(t)
+	if err := engine.UpsertDocument(NewDocument("old", "Old", "saved before the request")); err != nil {
+		t.Fatal(err)
+	}
+
+	var response bulkResponse
+	status := postBulk(t, api, []string{
+		`{"index":{"_id":"a"}}`,
+		`{"title":"Go","content":"first version","lang":"en"}`,
+		`{"create":{"_id":"b"}}`,
+		`{"title":"Rust","content":"systems language"}`,
+		`{"create":{"_id":"a"}}`,
+		`{"title":"Conflict"}`,
+		`{"update":{"_id":"a"}}`,
+		`{"doc":{"content":"second version"}}`,
+		`{"update":{"_id":"c"}}`,
+		`{"doc":{"title":"Missing"}}`,
+		`{"update":{"_id":"c"}}`,
+		`{"doc":{"title":"Upserted"},"doc_as_upsert":true}`,
+		`{"update":{"_id":"d"}}`,
+		`{"doc":{"title":"Ignored"},"upsert":{"title":"Fresh"}}`,
+		`{"delete":{"_id":"b"}}`,
+		`{"delete":{"_id":"missing"}}`,
+		`{"delete":{"_id":"old"}}`,
+		`{"index":{"_id":"e"}}`,
+		`{"title":123}`,
+		`{"delete":{}}`,
+	}, &response)
+
+	if status != http.StatusOK || !response.Errors {
+		t.Fatalf("status %d, errors %v", status, response.Errors)
+	}
+	want := []string{
+		"index a 201 created",
+		"create b 201 created",
+		"create a 409 version_conflict_engine_exception",
+		"update a 200 updated",
+		"update c 404 document_missing_exception",
+		"update c 201 created",
+		"update d 201 created",
+		"delete b 200 deleted",
+		"delete missing 404 not_found",
+		"delete old 200 deleted",
+		"index e 400 mapper_parsing_exception",
+		"delete  400 action_request_validation_exception",
+	}
+	if len(response.Items) != len(want) {
+		t.Fatalf("%d items, want %d", len(response.Items), len(want))
+	}
+	for i, item := range response.Items {
+		if got := bulkOutcome(item); got != want[i] {
+			t.Errorf("item %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	docs := map[string]string{"a": "Go", "b": "", "c": "Upserted", "d": "Fresh", "e": "", "old": ""}
+	for id, title := range docs {
+		doc, err := engine.GetDocument(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case title == "" && doc != nil:
+			t.Errorf("document %s exists", id)
+		case title != "" && (doc == nil || doc.Title != title):
+			t.Errorf("document %s = %+v, want title %q", id, doc, title)
+		}
+	}
+	if doc, _ := engine.GetDocument("a"); doc.Content != "second version" || doc.Metadata["lang"] != "en" {
+		t.Errorf("updated document = %+v", doc)
+	}
+}
+
+func TestBulkIndexWithoutID(t *testing.T) {
+	api, engine := newTestAPI(t)
+
+	var response bulkResponse
+	postBulk(t, api, []string{`{"index":{}}`, `{"title":"Generated"}`}, &response)
+	result := response.Items[0][bulkIndex]
+	if result.Status != http.StatusCreated || len(result.ID) != 20 {
+		t.Fatalf("result = %+v, want a created document with a 20 character ID", result)
+	}
+	if doc, err := engine.GetDocument(result.ID); err != nil || doc == nil {
+		t.Fatalf("generated document not saved: %v", err)
+	}
+}
+
+func TestBulkRejectedDocumentIsNotUpdated(t *testing.T) {
+	api, engine := newTestAPI(t)
+
+	long := strings.Repeat("x", maxKeywordLength+1)
+	var response bulkResponse
+	postBulk(t, api, []string{
+		`{"index":{"_id":"a"}}`,
+		`{"title":"Invalid","tag":"` + long + `"}`,
+		`{"update":{"_id":"a"}}`,
+		`{"doc":{"tag":"short"}}`,
+	}, &response)
+
+	want := []string{
+		"index a 400 document_parsing_exception",
+		"update a 404 document_missing_exception",
+	}
+	for i, item := range response.Items {
+		if got := bulkOutcome(item); got != want[i] {
+			t.Errorf("item %d = %q, want %q", i, got, want[i])
+		}
+	}
+	if doc, _ := engine.GetDocument("a"); doc != nil {
+		t.Errorf("rejected document saved: %+v", doc)
+	}
+}
+
+func TestBulkBatches(t *testing.T) {
+	api, engine := newTestAPI(t)
+
+	n := 2*bulkBatchSize + 10
+	lines := make([]string, 0, 2*n)
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf(`{"index":{"_id":"doc%d"}}`, i), fmt.Sprintf(`{"title":"Document %d"}`, i))
+	}
+	var response bulkResponse
+	if status := postBulk(t, api, lines, &response); status != http.StatusOK || response.Errors {
+		t.Fatalf("status %d, errors %v", status, response.Errors)
+	}
+	if total := engine.Stats().TotalDocuments; total != n {
+		t.Fatalf("%d documents indexed, want %d", total, n)
+	}
+}
+
+func TestBulkParseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		reason string
+	}{
+		{"bad action line", []string{`{"index":{"_id":"a"}}`, `{"title":"A"}`, `not json`}, "line 3: expected an action line with exactly one action"},
+		{"unknown action", []string{`{"index":{"_id":"a"}}`, `{"title":"A"}`, `{"upsert":{"_id":"b"}}`}, `line 3: unknown action "upsert"`},
+		{"missing source", []string{`{"index":{"_id":"a"}}`, `{"title":"A"}`, `{"index":{"_id":"b"}}`}, "line 3: index action has no source line"},
+	}
+	for _, tt := range tests {
+		api, engine := newTestAPI(t)
+
+		var response bulkParseErrorResponse
+		status := postBulk(t, api, tt.lines, &response)
+		if status != http.StatusBadRequest || response.Error.Type != "parse_exception" || response.Error.Reason != tt.reason {
+			t.Errorf("%s: status %d, error %+v, want %q", tt.name, status, response.Error, tt.reason)
+		}
+
+		// Actions before the bad line are applied
+		if len(response.Items) != 1 {
+			t.Errorf("%s: %d items, want 1", tt.name, len(response.Items))
+		}
+		if doc, _ := engine.GetDocument("a"); doc == nil {
+			t.Errorf("%s: document before the bad line not saved", tt.name)
+		}
+	}
+}
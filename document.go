@@ -1,5 +1,24 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names of the built-in document fields
+const (
+	FieldTitle   = "title"
+	FieldContent = "content"
+	FieldURL     = "url"
+
+	// metadataFieldPrefix prefixes the field of each Metadata key
+	metadataFieldPrefix = "metadata."
+)
+
+// DefaultSearchFields are searched when a query term names no field
+var DefaultSearchFields = []string{FieldTitle, FieldContent}
+
 // Document represents a searchable document
 type Document struct {
 	ID       string            `json:"id"`
@@ -19,23 +38,111 @@ func NewDocument(id, title, content string) *Document {
 	}
 }
 
-// SearchableText returns the full text for indexing
-func (d *Document) SearchableText() string {
-	return d.Title + " " + d.Content
+// clone returns a copy of the document that can be changed independently
+func (d *Document) clone() *Document {
+	c := *d
+	c.Metadata = make(map[string]string, len(d.Metadata))
+	for key, value := range d.Metadata {
+		c.Metadata[key] = value
+	}
+	return &c
+}
+
+// FieldValues returns the text of every indexed field, keyed by field name.
+// Each Metadata key is indexed as the keyword field "metadata.<key>".
+func (d *Document) FieldValues() map[string]string {
+	values := map[string]string{
+		FieldTitle:   d.Title,
+		FieldContent: d.Content,
+		FieldURL:     d.URL,
+	}
+	for key, value := range d.Metadata {
+		values[metadataFieldPrefix+key] = value
+	}
+	return values
+}
+
+// isSearchableField reports whether name is a field documents can have
+func isSearchableField(name string) bool {
+	switch name {
+	case FieldTitle, FieldContent, FieldURL:
+		return true
+	}
+	return strings.HasPrefix(name, metadataFieldPrefix) && len(name) > len(metadataFieldPrefix)
+}
+
+// maxKeywordLength is the longest value indexed as a keyword. Documents
+// with longer metadata values are rejected when they are written; values
+// saved before that are stored but not indexed.
+const maxKeywordLength = 256
+
+// validateKeywords checks that every metadata value of a document is short
+// enough to be indexed, reporting the first key in order that is not
+func validateKeywords(doc *Document) error {
+	keys := make([]string, 0, len(doc.Metadata))
+	for key, value := range doc.Metadata {
+		if len(value) > maxKeywordLength {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return &SchemaError{
+		Field:   keys[0],
+		Message: fmt.Sprintf("value is %d bytes, longer than the %d bytes a metadata value can have", len(doc.Metadata[keys[0]]), maxKeywordLength),
+	}
+}
+
+// isKeywordField reports whether a field is indexed as one exact-match
+// term instead of being analyzed. Metadata values are keywords.
+func isKeywordField(name string) bool {
+	return strings.HasPrefix(name, metadataFieldPrefix)
+}
+
+// keywordTokens returns the single token a keyword value is indexed as, or
+// none for an empty or overly long value
+func keywordTokens(value string) []Token {
+	if value == "" || len(value) > maxKeywordLength {
+		return nil
+	}
+	return []Token{{Term: value, Start: 0, End: len(value)}}
 }
 
 // DocStats stores document statistics for BM25 ranking
 type DocStats struct {
-	ID               string         `json:"id"`
-	Length           int            `json:"length"`
-	TermFrequencies  map[string]int `json:"term_frequencies"`
+	ID     string                 `json:"id"`
+	Length int                    `json:"length"` // Total tokens across all fields
+	Fields map[string]*FieldStats `json:"fields"`
+}
+
+// FieldStats stores the statistics of one field of a document
+type FieldStats struct {
+	Length          int            `json:"length"`
+	TermFrequencies map[string]int `json:"term_frequencies"`
 }
 
 // NewDocStats creates new document statistics
-func NewDocStats(id string, length int) *DocStats {
+func NewDocStats(id string) *DocStats {
 	return &DocStats{
-		ID:              id,
-		Length:          length,
-		TermFrequencies: make(map[string]int),
+		ID:     id,
+		Fields: make(map[string]*FieldStats),
+	}
+}
+
+// TermFrequency returns how often term occurs in field
+func (s *DocStats) TermFrequency(field, term string) int {
+	if fs, ok := s.Fields[field]; ok {
+		return fs.TermFrequencies[term]
+	}
+	return 0
+}
+
+// FieldLength returns the number of tokens in field
+func (s *DocStats) FieldLength(field string) int {
+	if fs, ok := s.Fields[field]; ok {
+		return fs.Length
 	}
+	return 0
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sort fields that are not metadata keys
+const (
+	SortScore = "_score"
+	SortID    = "_id"
+)
+
+// SortField orders search results by the score, the document ID or a
+// metadata field
+type SortField struct {
+	Field      string // SortScore, SortID or a metadata key
+	Descending bool
+	// MissingFirst puts documents without a value before the others
+	// instead of after them, in either direction
+	MissingFirst bool
+}
+
+// ParseSort parses sort fields written as "priority:desc,_score". Each field
+// takes asc or desc (default: desc for _score, asc otherwise) and first or
+// last for where documents without a value go (default: last). Metadata keys
+// may carry the "metadata." field prefix.
+func ParseSort(s string) ([]SortField, error) {
+	var fields []SortField
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		options := strings.Split(part, ":")
+		field := SortField{Field: strings.TrimPrefix(options[0], metadataFieldPrefix)}
+		switch field.Field {
+		case "":
+			return nil, fmt.Errorf("invalid sort %q, expected field[:asc|desc][:first|last]", part)
+		case FieldTitle, FieldContent, FieldURL:
+			return nil, fmt.Errorf("cannot sort by text field %q", field.Field)
+		case SortScore:
+			field.Descending = true
+		}
+
+		for _, option := range options[1:] {
+			switch option {
+			case "asc":
+				field.Descending = false
+			case "desc":
+				field.Descending = true
+			case "first":
+				field.MissingFirst = true
+			case "last":
+				field.MissingFirst = false
+			default:
+				return nil, fmt.Errorf("invalid sort option %q for %q, expected asc, desc, first or last", option, field.Field)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// numberColumn holds the value of a number or date field by document
+// number
+type numberColumn struct {
+	values  []float64
+	present []bool
+}
+
+func (c *numberColumn) get(doc uint32) (float64, bool) {
+	if int(doc) < len(c.present) && c.present[doc] {
+		return c.values[doc], true
+	}
+	return 0, false
+}
+
+func (c *numberColumn) set(doc uint32, value float64) {
+	for int(doc) >= len(c.values) {
+		c.values = append(c.values, 0)
+		c.present = append(c.present, false)
+	}
+	c.values[doc], c.present[doc] = value, true
+}
+
+func (c *numberColumn) clear(doc uint32) {
+	if int(doc) < len(c.present) {
+		c.values[doc], c.present[doc] = 0, false
+	}
+}
+
+// keywordColumn holds the keyword of a field by document number; an empty
+// keyword means the document has none
+type keywordColumn struct {
+	values []string
+}
+
+func (c *keywordColumn) get(doc uint32) (string, bool) {
+	if int(doc) < len(c.values) && c.values[doc] != "" {
+		return c.values[doc], true
+	}
+	return "", false
+}
+
+func (c *keywordColumn) set(doc uint32, value string) {
+	for int(doc) >= len(c.values) {
+		c.values = append(c.values, "")
+	}
+	c.values[doc] = value
+}
+
+func (c *keywordColumn) clear(doc uint32) {
+	if int(doc) < len(c.values) {
+		c.values[doc] = ""
+	}
+}
+
+// docValues stores the metadata of every document in columns by document
+// number, so results can be filtered by range and sorted without loading
+// documents. Number and date fields keep their parsed value in a range
+// index; other fields keep the keyword they are indexed as.
+type docValues struct {
+	schema   Schema
+	keywords map[string]*keywordColumn
+	ranges   map[string]*rangeIndex
+}
+
+func newDocValues(schema Schema) *docValues {
+	return &docValues{
+		schema:   schema,
+		keywords: make(map[string]*keywordColumn),
+		ranges:   make(map[string]*rangeIndex),
+	}
+}
+
+// buildDocValues builds the columns from the keyword postings of an index,
+// without reading the documents
+func buildDocValues(idx *Index, schema Schema) (*docValues, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	dv := newDocValues(schema)
+	numbers := make(map[string]*numberColumn)
+	for field, terms := range idx.index {
+		if !isKeywordField(field) {
+			continue
+		}
+		key := strings.TrimPrefix(field, metadataFieldPrefix)
+		typ := schema.Type(key)
+
+		for term, postings := range terms {
+			if !isRangeType(typ) {
+				column := dv.keywordColumn(key)
+				for _, doc := range postings.docs() {
+					column.set(doc, term)
+				}
+				continue
+			}
+
+			value, err := parseRangeValue(key, typ, term)
+			if err != nil {
+				return nil, err
+			}
+			column, ok := numbers[key]
+			if !ok {
+				column = &numberColumn{}
+				numbers[key] = column
+			}
+			for _, doc := range postings.docs() {
+				column.set(doc, value)
+			}
+		}
+	}
+
+	for key, column := range numbers {
+		dv.ranges[key] = newRangeIndexOf(*column)
+	}
+	return dv, nil
+}
+
+// keywordColumn returns the column of a keyword field, creating it if
+// needed
+func (dv *docValues) keywordColumn(key string) *keywordColumn {
+	column, ok := dv.keywords[key]
+	if !ok {
+		column = &keywordColumn{}
+		dv.keywords[key] = column
+	}
+	return column
+}
+
+// set replaces the values of a document with those of its metadata
+func (dv *docValues) set(doc uint32, document *Document) {
+	dv.setAll([]uint32{doc}, []*Document{document})
+}
+
+// setAll replaces the values of documents with those of their metadata,
+// updating each range index once. A value is kept as it is indexed, so
+// values not indexed as keywords are left out.
+func (dv *docValues) setAll(docs []uint32, documents []*Document) {
+	updates := make(map[string][]rangeUpdate)
+	for i, doc := range docs {
+		for _, column := range dv.keywords {
+			column.clear(doc)
+		}
+		for key, ranges := range dv.ranges {
+			if _, ok := ranges.column.get(doc); ok {
+				updates[key] = append(updates[key], rangeUpdate{doc: doc})
+			}
+		}
+
+		for key, text := range documents[i].Metadata {
+			tokens := keywordTokens(text)
+			if len(tokens) == 0 {
+				continue
+			}
+
+			typ := dv.schema.Type(key)
+			if !isRangeType(typ) {
+				dv.keywordColumn(key).set(doc, tokens[0].Term)
+				continue
+			}
+			value, err := parseRangeValue(key, typ, text)
+			if err != nil {
+				// Documents are validated before they are saved
+				continue
+			}
+			updates[key] = append(updates[key], rangeUpdate{doc: doc, value: value, ok: true})
+		}
+	}
+
+	for key, keyUpdates := range updates {
+		ranges, ok := dv.ranges[key]
+		if !ok {
+			ranges = newRangeIndex()
+			dv.ranges[key] = ranges
+		}
+		ranges.apply(keyUpdates)
+	}
+}
+
+// remove removes every value of a document
+func (dv *docValues) remove(doc uint32) {
+	for _, column := range dv.keywords {
+		column.clear(doc)
+	}
+	for _, ranges := range dv.ranges {
+		ranges.remove(doc)
+	}
+}
+
+// move moves every value of a document to another document number
+func (dv *docValues) move(from, to uint32) {
+	for _, column := range dv.keywords {
+		if value, ok := column.get(from); ok {
+			column.clear(from)
+			column.set(to, value)
+		}
+	}
+	for _, ranges := range dv.ranges {
+		if value, ok := ranges.column.get(from); ok {
+			ranges.apply([]rangeUpdate{{doc: from}, {doc: to, value: value, ok: true}})
+		}
+	}
+}
+
+// sortOrder returns whether a sorts before b by the sort fields, then by
+// ID
+func (dv *docValues) sortOrder(fields []SortField) func(a, b ScoredDocument) bool {
+	return func(a, b ScoredDocument) bool {
+		for _, field := range fields {
+			if c := dv.compare(field, a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return a.DocID < b.DocID
+	}
+}
+
+// compare compares two documents by one sort field, returning a negative
+// number if a sorts first, a positive one if b does and 0 if they are tied
+func (dv *docValues) compare(field SortField, a, b ScoredDocument) int {
+	var c int
+	switch field.Field {
+	case SortScore:
+		c = compareNumbers(a.Score, b.Score)
+	case SortID:
+		c = strings.Compare(a.DocID, b.DocID)
+	default:
+		var aok, bok bool
+		if ranges, ok := dv.ranges[field.Field]; ok {
+			var av, bv float64
+			av, aok = ranges.column.get(a.num)
+			bv, bok = ranges.column.get(b.num)
+			c = compareNumbers(av, bv)
+		} else if column, ok := dv.keywords[field.Field]; ok {
+			var av, bv string
+			av, aok = column.get(a.num)
+			bv, bok = column.get(b.num)
+			c = strings.Compare(av, bv)
+		}
+
+		// Missing values go first or last whatever the direction
+		switch {
+		case !aok && !bok:
+			return 0
+		case aok != bok:
+			if aok == field.MissingFirst {
+				return 1
+			}
+			return -1
+		}
+	}
+
+	if field.Descending {
+		return -c
+	}
+	return c
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
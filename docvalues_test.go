@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []SortField
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "priority", want: []SortField{{Field: "priority"}}},
+		{in: "metadata.priority:desc", want: []SortField{{Field: "priority", Descending: true}}},
+		{in: "_score", want: []SortField{{Field: SortScore, Descending: true}}},
+		{in: "_score:asc", want: []SortField{{Field: SortScore}}},
+		{in: "priority:desc:first, _id", want: []SortField{{Field: "priority", Descending: true, MissingFirst: true}, {Field: SortID}}},
+		{in: "lang:first:last,", want: []SortField{{Field: "lang"}}},
+		{in: "title", wantErr: true},
+		{in: "content:asc", wantErr: true},
+		{in: ":asc", wantErr: true},
+		{in: "priority:down", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSort(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSort(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSort(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSort(t *testing.T) {
+	engine := newSchemaEngine(t, "priority:number")
+	addDocuments(t, engine,
+		metadataDocument("e", "release", nil),
+		metadataDocument("b", "release release", map[string]string{"priority": "10", "lang": "go"}),
+		metadataDocument("d", "release", map[string]string{"priority": "2", "lang": "rust"}),
+		metadataDocument("a", "release", map[string]string{"priority": "9", "lang": "go", "rank": "10"}),
+		metadataDocument("c", "release", map[string]string{"priority": "2", "rank": "9"}),
+	)
+
+	tests := []struct {
+		sort string
+		want string
+	}{
+		// Ties are ordered by ID
+		{"priority", "c,d,a,b,e"},
+		{"priority:desc", "b,a,c,d,e"},
+		{"priority:first", "e,c,d,a,b"},
+		{"priority:desc:first", "e,b,a,c,d"},
+		{"lang,priority:desc", "b,a,d,c,e"},
+		{"lang:desc:first,priority", "c,e,d,a,b"},
+		// Undeclared fields are keywords and compare as strings
+		{"rank", "a,c,b,d,e"},
+		{"_id:desc", "e,d,c,b,a"},
+		{"_score,_id:desc", "b,e,d,c,a"},
+		{"_score:asc", "a,c,d,e,b"},
+	}
+	for _, tt := range tests {
+		fields, err := ParseSort(tt.sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ranking := range []bool{true, false} {
+			// Unranked results have no scores to sort by
+			if !ranking && strings.HasPrefix(tt.sort, SortScore) {
+				continue
+			}
+			got := strings.Join(searchIDs(t, engine, "release", SearchOptions{UseRanking: ranking, Sort: fields}), ",")
+			if got != tt.want {
+				t.Errorf("sort %s, ranking %v: %s, want %s", tt.sort, ranking, got, tt.want)
+			}
+		}
+
+		// Pages follow the same order
+		var paged []string
+		for offset := 0; offset < 5; offset += 2 {
+			paged = append(paged, searchIDs(t, engine, "release", SearchOptions{UseRanking: true, Sort: fields, Offset: offset, Limit: 2})...)
+		}
+		if got := strings.Join(paged, ","); got != tt.want {
+			t.Errorf("sort %s in pages of 2: %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+
+	// Unsorted, unranked results are ordered by ID
+	if got := strings.Join(searchIDs(t, engine, "release", SearchOptions{}), ","); got != "a,b,c,d,e" {
+		t.Errorf("unranked results: %s, want a,b,c,d,e", got)
+	}
+
+	// Sorting follows updated and deleted values
+	addDocuments(t, engine, metadataDocument("e", "release", map[string]string{"priority": "1"}))
+	if err := engine.DeleteDocument("c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(searchIDs(t, engine, "release", SearchOptions{Sort: []SortField{{Field: "priority"}}}), ","); got != "e,d,a,b" {
+		t.Errorf("sort after writes: %s, want e,d,a,b", got)
+	}
+}
+
+func TestSortParameter(t *testing.T) {
+	api, engine := newTestAPI(t)
+	addDocuments(t, engine,
+		metadataDocument("1", "release", map[string]string{"lang": "rust"}),
+		metadataDocument("2", "release", map[string]string{"lang": "go"}),
+	)
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/search?query=release&sort=lang", 200, `"id":"2"`},
+		{"/search?query=release&sort=lang:desc", 200, `"id":"1"`},
+		{"/search?query=release&sort=lang:sideways", 400, "invalid sort option"},
+		{"/search?query=release&sort=title", 400, "cannot sort by text field"},
+	}
+	for _, tt := range tests {
+		status, body := getJSON(t, api, tt.path)
+		if status != tt.status {
+			t.Errorf("GET %s = %d %s, want %d", tt.path, status, body, tt.status)
+			continue
+		}
+		// The first document in the response comes first in the order
+		if i := strings.Index(body, `"id":"`); status == 200 && (i < 0 || !strings.HasPrefix(body[i:], tt.want)) {
+			t.Errorf("GET %s = %s, want %s first", tt.path, body, tt.want)
+		}
+		if status != 200 && !strings.Contains(body, tt.want) {
+			t.Errorf("GET %s = %s, want %s", tt.path, body, tt.want)
+		}
+	}
+}
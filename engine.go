@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -19,6 +24,38 @@ type SearchOptions struct {
 	UseRanking bool
 	Limit      int
 	Offset     int
+	// Slop is the default number of extra positions allowed between the
+	// terms of a quoted phrase; a ~N suffix on the phrase overrides it
+	Slop int
+	// InOrder requires sloppy phrase terms to keep their query order
+	InOrder bool
+	// Fields are searched by terms without a field prefix; empty means
+	// DefaultSearchFields
+	Fields []string
+	// FieldBoosts override the index's field weights for this query
+	FieldBoosts map[string]float64
+	// Scorer overrides the index's scorer for this query
+	Scorer string
+	// ScorerParams override the scorer's parameters for this query
+	ScorerParams map[string]float64
+	// Explain records how the score of each returned document was computed
+	Explain bool
+	// ExactTotal counts every matching document. By default ranked searches
+	// stop matching once the top Offset+Limit results are settled, and
+	// Total is then only a lower bound.
+	ExactTotal bool
+	// Filters restrict results by metadata without affecting scores. With
+	// an empty query they list every document passing them.
+	Filters []SearchFilter
+	// Sort orders results by the given fields in turn, then by ID. Empty
+	// means by score for ranked searches and by ID otherwise.
+	Sort []SortField
+	// Aggregations summarize metadata fields over every matching document.
+	// Requesting any also makes Total exact.
+	Aggregations []Aggregation
+	// Highlight returns fragments of each result with the matches tagged,
+	// if not nil
+	Highlight *HighlightOptions
 }
 
 // DefaultSearchOptions returns default search options
@@ -35,53 +72,517 @@ func DefaultSearchOptions() SearchOptions {
 type SearchResult struct {
 	Documents []*Document
 	Total     int
-	Scores    []float64
+	// TotalExact is false when Total is a lower bound on the number of
+	// matching documents
+	TotalExact bool
+	Scores     []float64
+	// Explanations holds the score calculation of each document when
+	// SearchOptions.Explain is set
+	Explanations []*Explanation
+	// Aggregations holds the result of each requested aggregation by name
+	Aggregations map[string]*AggregationResult
+	// Highlights holds the fragments of each document by field when
+	// SearchOptions.Highlight is set
+	Highlights []map[string][]string
+}
+
+// EngineOptions configures an index when it is opened
+type EngineOptions struct {
+	// Analyzer is the registered analyzer name. Empty means the analyzer
+	// the index was created with, or DefaultAnalyzer for a new index.
+	Analyzer string
+	// StopwordFiles are extra stopword lists, saved with the index. Empty
+	// means the saved list.
+	StopwordFiles []string
+	// ClearStopwords removes the saved stopword list before StopwordFiles
+	// are applied
+	ClearStopwords bool
+	// StopwordMode is StopwordModeIndex or StopwordModeRemove. Empty means
+	// the saved mode, or StopwordModeIndex for a new index. Changing the
+	// mode, or the stopwords in StopwordModeRemove, reindexes every
+	// document.
+	StopwordMode string
+	// SynonymFiles are synonym lists, saved with the index. Empty means the
+	// saved list. Changing the list reindexes every document.
+	SynonymFiles []string
+	// ClearSynonyms removes the saved synonym list before SynonymFiles are
+	// applied
+	ClearSynonyms bool
+	// Scorer is the registered scorer name. Empty means the saved scorer.
+	Scorer string
+	// ScorerParams tune the scorer, e.g. k1:1.2. Nil means the saved
+	// parameters, or the scorer's defaults when the scorer changes.
+	ScorerParams map[string]float64
+	// FieldBoosts weight matches per field, e.g. title:3. Nil means the
+	// saved weights.
+	FieldBoosts map[string]float64
+	// Schema declares typed metadata fields. Nil means the saved schema.
+	Schema Schema
+}
+
+// DefaultEngineOptions returns default engine options
+func DefaultEngineOptions() EngineOptions {
+	return EngineOptions{}
 }
 
 // SearchEngine is the main search engine
 type SearchEngine struct {
-	storage       *Storage
-	index         *Index
-	docStats      map[string]*DocStats
-	avgDocLength  float64
-	mu            sync.RWMutex
+	storage  *Storage
+	index    *Index
+	analyzer Analyzer
+	// queryAnalyzer analyzes query text. It leaves out synonyms, which are
+	// expanded when documents are indexed.
+	queryAnalyzer Analyzer
+	analyzerName  string
+	// stopwords are the extra stopwords saved with the index
+	stopwords    []string
+	stopwordMode string
+	// synonyms are the synonyms saved with the index
+	synonyms map[string][]string
+	scoring  ScoringConfig
+	scorer   Scorer
+	docStats map[string]*DocStats
+	// avgFieldLengths is the average token count of each field over the
+	// documents that have it
+	avgFieldLengths map[string]float64
+	// totalFieldLengths is the token count of each field over all documents
+	totalFieldLengths map[string]int
+	// fieldDocCounts is the number of documents that have each field
+	fieldDocCounts map[string]int
+	schema         Schema
+	// values holds the metadata of each document for range filters and
+	// sorting
+	values *docValues
+	mu     sync.RWMutex
 }
 
 // NewSearchEngine creates a new search engine
-func NewSearchEngine(storagePath string) (*SearchEngine, error) {
+func NewSearchEngine(storagePath string, options EngineOptions) (*SearchEngine, error) {
 	storage, err := NewStorage(storagePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create storage: %w", err)
 	}
 
+	stopwords, savedStopwords, stopwordsChanged, err := resolveStopwords(storage, options.StopwordFiles, options.ClearStopwords)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	stopwordMode, stopwordModeChanged, err := resolveStopwordMode(storage, options.StopwordMode)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	removeStopwords := stopwordMode == StopwordModeRemove
+
+	synonyms, savedSynonyms, synonymsChanged, err := resolveSynonyms(storage, options.SynonymFiles, options.ClearSynonyms)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	analyzerName, analyzer, err := resolveAnalyzer(storage, options.Analyzer, AnalyzerConfig{Stopwords: stopwords, RemoveStopwords: removeStopwords, Synonyms: synonyms})
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	queryAnalyzer, err := LookupAnalyzer(analyzerName, AnalyzerConfig{Stopwords: stopwords, RemoveStopwords: removeStopwords})
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	scoring, scorer, err := resolveScoring(storage, options)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	schema, err := resolveSchema(storage, options.Schema)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
 	// Load or create index
 	index, err := storage.LoadIndex()
-	if err != nil {
+	legacyIndex := errors.Is(err, errLegacyIndex)
+	if err != nil && !legacyIndex {
+		storage.Close()
 		return nil, fmt.Errorf("failed to load index: %w", err)
 	}
 
 	// Load document statistics
 	docStatsMap, err := storage.GetAllDocStats()
 	if err != nil {
+		storage.Close()
 		return nil, fmt.Errorf("failed to load doc stats: %w", err)
 	}
 
-	// Calculate average document length
-	avgDocLength := 0.0
-	if len(docStatsMap) > 0 {
-		totalLength := 0
-		for _, stats := range docStatsMap {
-			totalLength += stats.Length
+	// Documents indexed with other synonyms, or with other stopwords when
+	// they are removed, are rebuilt, and the settings are saved with the
+	// rebuilt index
+	metadata := make(map[string]string)
+	reindex := false
+	if stopwordsChanged {
+		metadata[stopwordsMetaKey] = savedStopwords
+		reindex = removeStopwords
+	}
+	if stopwordModeChanged {
+		metadata[stopwordModeMetaKey] = stopwordMode
+		reindex = true
+	}
+	if synonymsChanged {
+		metadata[synonymsMetaKey] = savedSynonyms
+		reindex = true
+	}
+	if reindex {
+		legacyIndex = legacyIndex || len(docStatsMap) > 0
+	}
+
+	// Statistics saved before fields were indexed separately are rebuilt
+	for _, stats := range docStatsMap {
+		if stats.Fields == nil {
+			legacyIndex = true
+			break
 		}
-		avgDocLength = float64(totalLength) / float64(len(docStatsMap))
 	}
 
-	return &SearchEngine{
-		storage:      storage,
-		index:        index,
-		docStats:     docStatsMap,
-		avgDocLength: avgDocLength,
-	}, nil
+	engine := &SearchEngine{
+		storage:       storage,
+		index:         index,
+		analyzer:      analyzer,
+		queryAnalyzer: queryAnalyzer,
+		analyzerName:  analyzerName,
+		stopwords:     stopwords,
+		stopwordMode:  stopwordMode,
+		synonyms:      synonyms,
+		scoring:       scoring,
+		scorer:        scorer,
+		docStats:      docStatsMap,
+		schema:        schema,
+	}
+
+	// Calculate average field lengths
+	engine.recalculateAvgLength()
+
+	// Indexes saved in an older format are rebuilt from the stored documents
+	if legacyIndex {
+		if err := engine.rebuildIndex(metadata); err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("failed to rebuild index: %w", err)
+		}
+		return engine, nil
+	}
+
+	if len(metadata) > 0 {
+		if err := storage.CommitMetadata(metadata); err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("failed to save analysis metadata: %w", err)
+		}
+	}
+
+	engine.values, err = buildDocValues(engine.index, schema)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to build doc values: %w", err)
+	}
+
+	return engine, nil
+}
+
+// resolveAnalyzer picks the analyzer for an index and records it in the
+// metadata bucket. Terms produced by a different analyzer would silently
+// stop matching, so reopening with another analyzer is an error.
+func resolveAnalyzer(storage *Storage, requested string, config AnalyzerConfig) (string, Analyzer, error) {
+	recorded, err := storage.GetMetadata(analyzerMetaKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read analyzer metadata: %w", err)
+	}
+
+	stored := recorded
+	if stored == "" {
+		// Indexes created before analyzers were recorded used the standard one
+		count, err := storage.CountDocuments()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to count documents: %w", err)
+		}
+		if count > 0 {
+			stored = DefaultAnalyzer
+		}
+	}
+
+	name := requested
+	switch {
+	case stored != "" && requested != "" && requested != stored:
+		return "", nil, fmt.Errorf("index was built with analyzer %q, cannot open it with %q", stored, requested)
+	case stored != "":
+		name = stored
+	case name == "":
+		name = DefaultAnalyzer
+	}
+
+	analyzer, err := LookupAnalyzer(name, config)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if recorded == "" {
+		if err := storage.SaveMetadata(analyzerMetaKey, name); err != nil {
+			return "", nil, fmt.Errorf("failed to save analyzer metadata: %w", err)
+		}
+	}
+	return name, analyzer, nil
+}
+
+// resolveStopwords loads user stopword files, or the list saved in the
+// metadata bucket when none are given; clear drops the saved list. Marked
+// stopwords are still indexed, so the list can change without reindexing
+// unless they are removed; a changed list is not saved here but returned
+// encoded, to be saved with the index or the index rebuilt with it; ""
+// means no extra stopwords.
+func resolveStopwords(storage *Storage, files []string, clear bool) ([]string, string, bool, error) {
+	stored, err := storage.GetMetadata(stopwordsMetaKey)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to read stopword metadata: %w", err)
+	}
+
+	if len(files) == 0 {
+		if clear || stored == "" {
+			return nil, "", stored != "", nil
+		}
+		var words []string
+		if err := json.Unmarshal([]byte(stored), &words); err != nil {
+			return nil, "", false, fmt.Errorf("failed to decode stopword metadata: %w", err)
+		}
+		return words, stored, false, nil
+	}
+
+	var words []string
+	for _, file := range files {
+		fileWords, err := LoadStopwords(file)
+		if err != nil {
+			return nil, "", false, err
+		}
+		words = append(words, fileWords...)
+	}
+	if len(words) == 0 {
+		return nil, "", stored != "", nil
+	}
+
+	data, err := json.Marshal(words)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return words, string(data), string(data) != stored, nil
+}
+
+// resolveStopwordMode returns the requested stopword mode, or the one saved
+// in the metadata bucket when none is requested, and whether it differs
+// from the saved one. A changed mode is saved with the index rebuilt with
+// it.
+func resolveStopwordMode(storage *Storage, requested string) (string, bool, error) {
+	stored, err := storage.GetMetadata(stopwordModeMetaKey)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read stopword mode metadata: %w", err)
+	}
+	if stored == "" {
+		stored = StopwordModeIndex
+	}
+
+	switch requested {
+	case "":
+		return stored, false, nil
+	case StopwordModeIndex, StopwordModeRemove:
+		return requested, requested != stored, nil
+	}
+	return "", false, fmt.Errorf("unknown stopword mode %q (want %s or %s)", requested, StopwordModeIndex, StopwordModeRemove)
+}
+
+// resolveSynonyms loads synonym files, or the list saved in the metadata
+// bucket when none are given; clear drops the saved list. Synonyms are
+// indexed, so a changed list is not saved here but returned encoded, to be
+// saved with the index rebuilt with it; "" means no synonyms.
+func resolveSynonyms(storage *Storage, files []string, clear bool) (map[string][]string, string, bool, error) {
+	stored, err := storage.GetMetadata(synonymsMetaKey)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to read synonym metadata: %w", err)
+	}
+
+	if len(files) == 0 {
+		if clear || stored == "" {
+			return nil, "", stored != "", nil
+		}
+		var synonyms map[string][]string
+		if err := json.Unmarshal([]byte(stored), &synonyms); err != nil {
+			return nil, "", false, fmt.Errorf("failed to decode synonym metadata: %w", err)
+		}
+		return synonyms, stored, false, nil
+	}
+
+	synonyms := make(map[string][]string)
+	for _, file := range files {
+		fileSynonyms, err := LoadSynonyms(file)
+		if err != nil {
+			return nil, "", false, err
+		}
+		for word, words := range fileSynonyms {
+			for _, synonym := range words {
+				if !containsString(synonyms[word], synonym) {
+					synonyms[word] = append(synonyms[word], synonym)
+				}
+			}
+		}
+	}
+	if len(synonyms) == 0 {
+		return nil, "", stored != "", nil
+	}
+
+	data, err := json.Marshal(synonyms)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return synonyms, string(data), string(data) != stored, nil
+}
+
+// resolveScoring loads the scoring setup saved in the metadata bucket and
+// applies any scorer, parameters or field boosts given in the options.
+// Scoring does not change what is indexed, so it can be changed on any open.
+func resolveScoring(storage *Storage, options EngineOptions) (ScoringConfig, Scorer, error) {
+	config := DefaultScoringConfig()
+	stored, err := storage.GetMetadata(scoringMetaKey)
+	if err != nil {
+		return config, nil, fmt.Errorf("failed to read scoring metadata: %w", err)
+	}
+	if stored != "" {
+		if err := json.Unmarshal([]byte(stored), &config); err != nil {
+			return config, nil, fmt.Errorf("failed to decode scoring metadata: %w", err)
+		}
+	}
+
+	changed := options.Scorer != "" || options.ScorerParams != nil || options.FieldBoosts != nil
+	if options.Scorer != "" && options.Scorer != config.Scorer {
+		// Parameters of the previous scorer do not apply to the new one
+		config.Scorer = options.Scorer
+		config.Params = nil
+	}
+	if options.ScorerParams != nil {
+		config.Params = options.ScorerParams
+	}
+	if options.FieldBoosts != nil {
+		config.FieldBoosts = options.FieldBoosts
+	}
+
+	scorer, err := LookupScorer(config.Scorer, config.Params)
+	if err != nil || !changed {
+		return config, scorer, err
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return config, nil, err
+	}
+	if err := storage.SaveMetadata(scoringMetaKey, string(data)); err != nil {
+		return config, nil, fmt.Errorf("failed to save scoring metadata: %w", err)
+	}
+	return config, scorer, nil
+}
+
+// resolveSchema loads the schema saved in the metadata bucket, or replaces
+// it with the requested one. Every stored document is checked against a
+// new schema first, and the schema is not changed if any does not match.
+func resolveSchema(storage *Storage, requested Schema) (Schema, error) {
+	schema := make(Schema)
+	stored, err := storage.GetMetadata(schemaMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema metadata: %w", err)
+	}
+	if stored != "" {
+		if err := json.Unmarshal([]byte(stored), &schema); err != nil {
+			return nil, fmt.Errorf("failed to decode schema metadata: %w", err)
+		}
+	}
+	if requested == nil || requested.String() == schema.String() {
+		return schema, nil
+	}
+
+	docs, err := storage.GetAllDocuments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load documents: %w", err)
+	}
+	for _, doc := range docs {
+		if err := requested.Validate(doc); err != nil {
+			return nil, fmt.Errorf("document %s does not match the schema: %w", doc.ID, err)
+		}
+	}
+
+	data, err := json.Marshal(requested)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.SaveMetadata(schemaMetaKey, string(data)); err != nil {
+		return nil, fmt.Errorf("failed to save schema metadata: %w", err)
+	}
+	return requested, nil
+}
+
+// setValues sets the doc values of a saved document
+func (e *SearchEngine) setValues(doc *Document) {
+	if num, ok := e.index.DocumentNumber(doc.ID); ok {
+		e.values.set(num, doc)
+	}
+}
+
+// searchScorer returns the scorer for a search, applying any per-query
+// scorer and parameter overrides to the index's scoring setup
+func (e *SearchEngine) searchScorer(options SearchOptions) (Scorer, error) {
+	if options.Scorer == "" && options.ScorerParams == nil {
+		return e.scorer, nil
+	}
+
+	name, params := e.scoring.Scorer, e.scoring.Params
+	if options.Scorer != "" && options.Scorer != name {
+		name, params = options.Scorer, nil
+	}
+	merged := make(map[string]float64)
+	for param, value := range params {
+		merged[param] = value
+	}
+	for param, value := range options.ScorerParams {
+		merged[param] = value
+	}
+	return LookupScorer(name, merged)
+}
+
+// AnalyzerName returns the name of the analyzer used by this index
+func (e *SearchEngine) AnalyzerName() string {
+	return e.analyzerName
+}
+
+// Stopwords returns the extra stopwords of this index
+func (e *SearchEngine) Stopwords() []string {
+	return e.stopwords
+}
+
+// StopwordMode returns whether this index keeps or removes stopwords
+func (e *SearchEngine) StopwordMode() string {
+	return e.stopwordMode
+}
+
+// Synonyms returns the synonyms of this index by term
+func (e *SearchEngine) Synonyms() map[string][]string {
+	return e.synonyms
+}
+
+// Scoring returns the scoring setup of this index
+func (e *SearchEngine) Scoring() ScoringConfig {
+	return e.scoring
+}
+
+// Schema returns the schema of this index
+func (e *SearchEngine) Schema() Schema {
+	return e.schema
 }
 
 // Close closes the search engine
@@ -89,49 +590,262 @@ func (e *SearchEngine) Close() error {
 	return e.storage.Close()
 }
 
+// validateDocument checks that a document can be written: its ID, the
+// length of its metadata values and their types
+func (e *SearchEngine) validateDocument(doc *Document) error {
+	if err := validateDocumentID(doc.ID); err != nil {
+		return err
+	}
+	if err := validateKeywords(doc); err != nil {
+		return err
+	}
+	return e.schema.Validate(doc)
+}
+
 // UpsertDocument inserts or updates a document
 func (e *SearchEngine) UpsertDocument(doc *Document) error {
+	if err := e.validateDocument(doc); err != nil {
+		return err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	// Analyze document text
-	tokens := analyze(doc.SearchableText())
+	fields, docStats := e.analyzeDocument(doc)
 
-	// Calculate term frequencies
-	termFreqs := make(map[string]int)
-	for _, token := range tokens {
-		termFreqs[token]++
+	// Keep the previous version to undo the in-memory changes
+	oldFields, oldStats := e.index.DocumentTokens(doc.ID), e.docStats[doc.ID]
+
+	// Update index
+	e.index.UpdateDocument(doc.ID, fields)
+
+	// Update doc stats and field lengths
+	if oldStats != nil {
+		e.addFieldLengths(oldStats, -1)
 	}
+	e.docStats[doc.ID] = docStats
+	e.addFieldLengths(docStats, 1)
 
-	// Create document statistics
-	docStats := &DocStats{
-		ID:              doc.ID,
-		Length:          len(tokens),
-		TermFrequencies: termFreqs,
+	// Save the document, its stats and the index changes in one transaction
+	err := failpoint("upsert-before-commit")
+	if err == nil {
+		err = e.storage.CommitDocument(doc, docStats, e.index)
+	}
+	if err != nil {
+		e.restoreDocument(doc.ID, oldFields, oldStats)
+		return fmt.Errorf("failed to commit document: %w", err)
 	}
+	e.setValues(doc)
+	crashpoint("upsert-after-commit")
 
-	// Update index
-	e.index.UpdateDocument(doc.ID, tokens)
+	return nil
+}
 
-	// Update doc stats
-	e.docStats[doc.ID] = docStats
+// BatchResult is the outcome of one document of a batch
+type BatchResult struct {
+	ID  string
+	Err error // Why the document was rejected, nil if it was saved
+}
 
-	// Recalculate average document length
-	e.recalculateAvgLength()
+// UpsertBatch inserts or updates documents together. Documents are analyzed
+// in parallel, applied to the index and saved in one transaction, so the
+// batch is saved entirely or not at all. Invalid documents are rejected
+// individually and reported in the results, which follow the order of docs;
+// the error is only set if the batch could not be saved. A document
+// repeated in the batch ends up with its last version.
+func (e *SearchEngine) UpsertBatch(docs []*Document) ([]BatchResult, error) {
+	results := make([]BatchResult, len(docs))
+	var valid []*Document
+	for i, doc := range docs {
+		results[i].ID = doc.ID
+		if results[i].Err = e.validateDocument(doc); results[i].Err == nil {
+			valid = append(valid, doc)
+		}
+	}
+
+	if len(valid) == 0 {
+		return results, nil
+	}
+	fields, stats := e.analyzeDocuments(valid)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Keep the version of each document from before the batch to undo the
+	// in-memory changes
+	type previous struct {
+		fields map[string][]Token
+		stats  *DocStats
+	}
+	undo := make(map[string]previous, len(valid))
+	for i, doc := range valid {
+		if _, ok := undo[doc.ID]; !ok {
+			undo[doc.ID] = previous{e.index.DocumentTokens(doc.ID), e.docStats[doc.ID]}
+		}
 
-	// Save to storage
-	if err := e.storage.SaveDocument(doc); err != nil {
-		return fmt.Errorf("failed to save document: %w", err)
+		e.index.UpdateDocument(doc.ID, fields[i])
+		if old, ok := e.docStats[doc.ID]; ok {
+			e.addFieldLengths(old, -1)
+		}
+		e.docStats[doc.ID] = stats[i]
+		e.addFieldLengths(stats[i], 1)
 	}
 
-	if err := e.storage.SaveDocStats(docStats); err != nil {
-		return fmt.Errorf("failed to save doc stats: %w", err)
+	err := failpoint("batch-before-commit")
+	if err == nil {
+		err = e.storage.CommitBatch(valid, stats, e.index)
+	}
+	if err != nil {
+		for docID, old := range undo {
+			e.restoreDocument(docID, old.fields, old.stats)
+		}
+		return nil, fmt.Errorf("failed to commit batch: %w", err)
 	}
+	nums := make([]uint32, 0, len(valid))
+	saved := make([]*Document, 0, len(valid))
+	for _, doc := range valid {
+		if num, ok := e.index.DocumentNumber(doc.ID); ok {
+			nums = append(nums, num)
+			saved = append(saved, doc)
+		}
+	}
+	e.values.setAll(nums, saved)
+	crashpoint("batch-after-commit")
+
+	return results, nil
+}
 
-	if err := e.storage.SaveIndex(e.index); err != nil {
-		return fmt.Errorf("failed to save index: %w", err)
+// analyzeDocuments analyzes documents in parallel, returning the tokens
+// and statistics of each in order
+func (e *SearchEngine) analyzeDocuments(docs []*Document) ([]map[string][]Token, []*DocStats) {
+	fields := make([]map[string][]Token, len(docs))
+	stats := make([]*DocStats, len(docs))
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(docs) {
+		workers = len(docs)
 	}
 
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fields[i], stats[i] = e.analyzeDocument(docs[i])
+			}
+		}()
+	}
+	for i := range docs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return fields, stats
+}
+
+// restoreDocument puts a document back in the index and statistics as it
+// was before a write that failed to commit, or removes it if stats is nil
+func (e *SearchEngine) restoreDocument(docID string, fields map[string][]Token, stats *DocStats) {
+	if current, ok := e.docStats[docID]; ok {
+		e.addFieldLengths(current, -1)
+		delete(e.docStats, docID)
+	}
+
+	if stats == nil {
+		e.index.RemoveDocument(docID)
+		return
+	}
+	e.index.UpdateDocument(docID, fields)
+	e.docStats[docID] = stats
+	e.addFieldLengths(stats, 1)
+}
+
+// analyzeDocument tokenizes each field of a document and computes its
+// statistics
+func (e *SearchEngine) analyzeDocument(doc *Document) (map[string][]Token, *DocStats) {
+	fields := make(map[string][]Token)
+	docStats := NewDocStats(doc.ID)
+
+	for field, text := range doc.FieldValues() {
+		tokens := e.fieldTokens(field, text)
+		if len(tokens) == 0 {
+			continue
+		}
+		fields[field] = tokens
+
+		// Calculate term frequencies
+		fieldStats := &FieldStats{
+			Length:          tokenLength(tokens),
+			TermFrequencies: make(map[string]int),
+		}
+		for _, token := range tokens {
+			fieldStats.TermFrequencies[token.Term]++
+		}
+		docStats.Fields[field] = fieldStats
+		docStats.Length += tokenLength(tokens)
+	}
+
+	return fields, docStats
+}
+
+// fieldTokens returns the tokens a field's text is indexed as
+func (e *SearchEngine) fieldTokens(field, text string) []Token {
+	if isKeywordField(field) {
+		return keywordTokens(text)
+	}
+	return e.analyzer.Analyze(text)
+}
+
+// rebuildIndex reindexes every stored document from scratch, saving
+// metadata entries with the new index. The index, statistics and doc values
+// are only replaced once all of them are built and saved, so on error the
+// engine keeps its previous state.
+func (e *SearchEngine) rebuildIndex(metadata map[string]string) error {
+	docs, err := e.storage.GetAllDocuments()
+	if err != nil {
+		return fmt.Errorf("failed to load documents: %w", err)
+	}
+
+	index := NewIndex()
+	docStats := make(map[string]*DocStats, len(docs))
+	for _, doc := range docs {
+		fields, stats := e.analyzeDocument(doc)
+		index.AddDocument(doc.ID, fields)
+		docStats[doc.ID] = stats
+	}
+
+	values, err := buildDocValues(index, e.schema)
+	if err != nil {
+		return fmt.Errorf("failed to build doc values: %w", err)
+	}
+
+	// Save the statistics and the index together, so a crash part way
+	// leaves the old ones to rebuild from on the next open
+	if err := e.storage.CommitRebuild(docStats, index, metadata); err != nil {
+		return fmt.Errorf("failed to save rebuilt index: %w", err)
+	}
+
+	e.index, e.docStats, e.values = index, docStats, values
+	e.recalculateAvgLength()
+	return nil
+}
+
+// Compact rebuilds the index from the stored documents, numbering them
+// densely again. Numbers of deleted documents are never reused, so the
+// document list, forward index and live bitmap keep growing with deletes
+// until the index is compacted; so do the numbers of terms no document
+// has any more.
+func (e *SearchEngine) Compact() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.rebuildIndex(nil); err != nil {
+		return fmt.Errorf("failed to rebuild index: %w", err)
+	}
 	return nil
 }
 
@@ -140,27 +854,36 @@ func (e *SearchEngine) DeleteDocument(docID string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	// Keep the document to undo the in-memory changes
+	oldFields, oldStats := e.index.DocumentTokens(docID), e.docStats[docID]
+	num, indexed := e.index.DocumentNumber(docID)
+
 	// Remove from index
 	e.index.RemoveDocument(docID)
 
-	// Remove from doc stats
-	delete(e.docStats, docID)
-
-	// Recalculate average document length
-	e.recalculateAvgLength()
-
-	// Remove from storage
-	if err := e.storage.DeleteDocument(docID); err != nil {
-		return fmt.Errorf("failed to delete document: %w", err)
+	// Remove from doc stats and field lengths
+	if oldStats != nil {
+		e.addFieldLengths(oldStats, -1)
+		delete(e.docStats, docID)
 	}
 
-	if err := e.storage.DeleteDocStats(docID); err != nil {
-		return fmt.Errorf("failed to delete doc stats: %w", err)
+	// Remove from storage with the index changes in one transaction
+	err := failpoint("delete-before-commit")
+	if err == nil {
+		err = e.storage.CommitDeletion(docID, e.index)
 	}
-
-	if err := e.storage.SaveIndex(e.index); err != nil {
-		return fmt.Errorf("failed to save index: %w", err)
+	if err != nil {
+		e.restoreDocument(docID, oldFields, oldStats)
+		// The restored document gets a new number; its values follow it
+		if restored, ok := e.index.DocumentNumber(docID); indexed && ok {
+			e.values.move(num, restored)
+		}
+		return fmt.Errorf("failed to commit deletion: %w", err)
 	}
+	if indexed {
+		e.values.remove(num)
+	}
+	crashpoint("delete-after-commit")
 
 	return nil
 }
@@ -175,34 +898,64 @@ func (e *SearchEngine) Search(query string, options SearchOptions) (*SearchResul
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	// Tokenize query
-	queryTokens := analyze(query)
-	if len(queryTokens) == 0 {
-		return &SearchResult{
-			Documents: []*Document{},
-			Total:     0,
-		}, nil
-	}
-
-	// Find matching documents
-	var candidateIDs []string
-	switch options.Mode {
-	case SearchModeAND:
-		candidateIDs = e.index.SearchAND(queryTokens)
-	case SearchModeOR:
-		candidateIDs = e.index.SearchOR(queryTokens)
-	default:
-		candidateIDs = e.index.SearchAND(queryTokens)
+	filter, err := e.filterSet(options.Filters)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkAggregations(options.Aggregations); err != nil {
+		return nil, err
+	}
+	var parsed Query
+	var scorer Scorer
+	if strings.TrimSpace(query) != "" || filter == nil {
+		if parsed, scorer, err = e.prepareQuery(query, options); err != nil {
+			return nil, err
+		}
+		if parsed == nil {
+			result := &SearchResult{
+				Documents:  []*Document{},
+				Total:      0,
+				TotalExact: true,
+			}
+			if len(options.Aggregations) > 0 {
+				result.Aggregations = e.aggregate(options.Aggregations, nil)
+			}
+			return result, nil
+		}
 	}
 
-	total := len(candidateIDs)
-
-	// Rank documents if requested
 	var sortedIDs []string
 	var scores []float64
+	var total int
+	totalExact := true
 
-	if options.UseRanking && total > 0 {
-		scoredDocs := RankDocuments(queryTokens, candidateIDs, e.docStats, e.index, e.avgDocLength)
+	ctx := NewScoringContext(e.index, e.avgFieldLengths, e.totalFieldLengths)
+	switch {
+	case len(options.Sort) > 0:
+		// Every match is collected, keeping the first up to the end of the
+		// page in sort order
+		var sortedDocs []ScoredDocument
+		sortedDocs, total = e.sortDocuments(parsed, scorer, ctx, filter, options.Sort, options.Offset+options.Limit, options.UseRanking)
+
+		sortedIDs = make([]string, len(sortedDocs))
+		for i, sd := range sortedDocs {
+			sortedIDs[i] = sd.DocID
+		}
+		if options.UseRanking && parsed != nil {
+			scores = make([]float64, len(sortedDocs))
+			for i, sd := range sortedDocs {
+				scores[i] = sd.Score
+			}
+		}
+	case parsed == nil:
+		// Without a query, list the documents passing the filters
+		sortedIDs = e.index.DocumentIDs(filter)
+		sort.Strings(sortedIDs)
+		total = len(sortedIDs)
+	case options.UseRanking:
+		// Only the documents up to the end of the page are ranked
+		var scoredDocs []ScoredDocument
+		scoredDocs, total, totalExact = e.rankDocuments(parsed, scorer, ctx, options.Offset+options.Limit, options.ExactTotal, filter)
 
 		sortedIDs = make([]string, len(scoredDocs))
 		scores = make([]float64, len(scoredDocs))
@@ -211,8 +964,18 @@ func (e *SearchEngine) Search(query string, options SearchOptions) (*SearchResul
 			sortedIDs[i] = sd.DocID
 			scores[i] = sd.Score
 		}
-	} else {
-		sortedIDs = candidateIDs
+	default:
+		sortedIDs = e.matchDocuments(parsed, filter)
+		sort.Strings(sortedIDs)
+		total = len(sortedIDs)
+	}
+
+	// Aggregations cover every match, which also gives the exact total
+	var aggregations map[string]*AggregationResult
+	if len(options.Aggregations) > 0 {
+		matched := e.matchNumbers(parsed, filter)
+		aggregations = e.aggregate(options.Aggregations, matched)
+		total, totalExact = len(matched), true
 	}
 
 	// Apply pagination
@@ -232,8 +995,16 @@ func (e *SearchEngine) Search(query string, options SearchOptions) (*SearchResul
 		pageScores = scores[start:end]
 	}
 
+	var highlightTerms map[string]*highlightQuery
+	if options.Highlight != nil && parsed != nil {
+		highlightTerms = make(map[string]*highlightQuery)
+		highlightQueries(parsed, highlightTerms)
+	}
+
 	// Fetch documents
 	documents := make([]*Document, 0, len(pageIDs))
+	var explanations []*Explanation
+	var highlights []map[string][]string
 	for _, docID := range pageIDs {
 		doc, err := e.storage.GetDocument(docID)
 		if err != nil {
@@ -241,16 +1012,315 @@ func (e *SearchEngine) Search(query string, options SearchOptions) (*SearchResul
 		}
 		if doc != nil {
 			documents = append(documents, doc)
+			if options.Explain && options.UseRanking && parsed != nil {
+				explanations = append(explanations, explainScore(scorer, parsed, e.docStats[docID], ctx))
+			}
+			if highlightTerms != nil {
+				highlights = append(highlights, e.highlight(doc, highlightTerms, options.Highlight))
+			}
 		}
 	}
 
 	return &SearchResult{
-		Documents: documents,
-		Total:     total,
-		Scores:    pageScores,
+		Documents:    documents,
+		Total:        total,
+		TotalExact:   totalExact,
+		Scores:       pageScores,
+		Explanations: explanations,
+		Aggregations: aggregations,
+		Highlights:   highlights,
 	}, nil
 }
 
+// prepareQuery parses a query, resolves its fields and boosts, and
+// computes the phrase matches and statistics needed to evaluate it. A nil
+// query means the query analyzed to nothing searchable.
+func (e *SearchEngine) prepareQuery(query string, options SearchOptions) (Query, Scorer, error) {
+	// Parse query into a query tree
+	parsed, err := ParseQuery(query, e.queryAnalyzer, options, isSearchableField)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed == nil {
+		return nil, nil, nil
+	}
+
+	// Terms without a field prefix search the requested fields
+	fields := options.Fields
+	if len(fields) == 0 {
+		fields = DefaultSearchFields
+	}
+	for _, field := range fields {
+		if !isSearchableField(field) {
+			return nil, nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	for field := range options.FieldBoosts {
+		if !isSearchableField(field) {
+			return nil, nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	scorer, err := e.searchScorer(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Per-query field boosts override the index's
+	weights := make(map[string]float64)
+	for field, weight := range e.scoring.FieldBoosts {
+		weights[field] = weight
+	}
+	for field, weight := range options.FieldBoosts {
+		weights[field] = weight
+	}
+	_, blend := scorer.(FieldScorer)
+	parsed = expandFields(parsed, fields, weights, blend)
+
+	for _, phrase := range queryPhrases(parsed) {
+		phrase.matches = e.index.SearchPhrase(phrase.Field, phrase.Terms, phrase.Slop, phrase.InOrder)
+	}
+	for _, multi := range multiFieldQueries(parsed) {
+		// A document counts once however many of the fields contain the term
+		multi.docFreq = e.candidates(multi).Cardinality()
+	}
+
+	return parsed, scorer, nil
+}
+
+// matchDocuments returns the documents matching a query and in the filter
+// set, if not nil. Candidates come from the index and are then checked
+// against the full query.
+func (e *SearchEngine) matchDocuments(q Query, filter *Bitmap) []string {
+	matched := make([]string, 0)
+	for _, docID := range e.index.DocumentIDs(e.filterCandidates(q, filter)) {
+		if stats, ok := e.docStats[docID]; ok && queryMatches(q, stats) {
+			matched = append(matched, docID)
+		}
+	}
+	return matched
+}
+
+// sortDocuments returns the first k documents matching a query in the
+// order of the sort fields, and the number of matching documents. A nil
+// query matches every document in the filter set. Documents are scored
+// only when ranking, and are compared by their doc values rather than
+// loaded.
+func (e *SearchEngine) sortDocuments(q Query, scorer Scorer, ctx *ScoringContext, filter *Bitmap, fields []SortField, k int, ranking bool) ([]ScoredDocument, int) {
+	set := filter
+	if q != nil {
+		set = e.filterCandidates(q, filter)
+	}
+
+	top := newSortedTopDocs(k, e.values.sortOrder(fields))
+	total := 0
+	nums := set.ToArray()
+	for i, docID := range e.index.DocumentIDs(set) {
+		doc := ScoredDocument{DocID: docID, num: nums[i]}
+		if q != nil {
+			stats, ok := e.docStats[docID]
+			if !ok || !queryMatches(q, stats) {
+				continue
+			}
+			if ranking {
+				doc.Score = scoreQuery(scorer, q, stats, ctx, nil)
+			}
+		}
+		total++
+		top.add(doc)
+	}
+	return top.results(), total
+}
+
+// matchNumbers returns the numbers of the documents matching a query and
+// in the filter set. A nil query matches every document in the filter set.
+func (e *SearchEngine) matchNumbers(q Query, filter *Bitmap) []uint32 {
+	if q == nil {
+		return filter.ToArray()
+	}
+
+	set := e.filterCandidates(q, filter)
+	nums := set.ToArray()
+	matched := nums[:0]
+	for i, docID := range e.index.DocumentIDs(set) {
+		if stats, ok := e.docStats[docID]; ok && queryMatches(q, stats) {
+			matched = append(matched, nums[i])
+		}
+	}
+	return matched
+}
+
+// rankDocuments returns the k best documents for a query, the number of
+// matching documents and whether that number is exact.
+//
+// A disjunction is evaluated with MaxScore pruning: its clauses are visited
+// in order of decreasing score upper bound, and a document is scored when
+// first seen. A document first seen in a later clause matches none of the
+// earlier ones, so it can score at most the sum of the bounds of the
+// remaining clauses. Once that sum drops below the k-th best score, no
+// unseen document can enter the top k and the remaining clauses are only
+// counted if exactTotal is set. Other queries are matched in full. Only
+// documents in the filter set are considered, if it is not nil.
+func (e *SearchEngine) rankDocuments(q Query, scorer Scorer, ctx *ScoringContext, k int, exactTotal bool, filter *Bitmap) ([]ScoredDocument, int, bool) {
+	clauses, boost := disjunctionClauses(q)
+	if clauses == nil {
+		matched := e.matchDocuments(q, filter)
+		return RankDocuments(q, matched, e.docStats, scorer, ctx, k), len(matched), true
+	}
+
+	type boundedClause struct {
+		query Query
+		bound float64
+	}
+	bounded := make([]boundedClause, len(clauses))
+	for i, clause := range clauses {
+		bounded[i] = boundedClause{query: clause, bound: boost * upperBound(scorer, clause, ctx)}
+	}
+	sort.SliceStable(bounded, func(i, j int) bool {
+		return bounded[i].bound > bounded[j].bound
+	})
+
+	// remaining[i] is the best score of a document first seen in clause i
+	remaining := make([]float64, len(bounded)+1)
+	for i := len(bounded) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + bounded[i].bound
+	}
+
+	top := newTopDocs(k)
+	seen := make(map[string]bool)
+	total := 0
+	pruned := false
+	for i, clause := range bounded {
+		if threshold, full := top.threshold(); full && remaining[i] < threshold {
+			if !exactTotal {
+				return top.results(), total, false
+			}
+			pruned = true
+		}
+
+		for _, docID := range e.index.DocumentIDs(e.filterCandidates(clause.query, filter)) {
+			if seen[docID] {
+				continue
+			}
+			seen[docID] = true
+
+			stats, ok := e.docStats[docID]
+			if !ok || !queryMatches(q, stats) {
+				continue
+			}
+			total++
+			if !pruned {
+				top.add(ScoredDocument{DocID: docID, Score: scoreQuery(scorer, q, stats, ctx, nil)})
+			}
+		}
+	}
+
+	return top.results(), total, true
+}
+
+// disjunctionClauses returns the clauses of a query whose score is the sum
+// of the scores of the clauses a document matches, and the boost applied to
+// that sum. It returns nil for queries with required clauses.
+func disjunctionClauses(q Query) ([]Query, float64) {
+	switch q := q.(type) {
+	case *TermQuery, *PhraseQuery, *MultiFieldQuery:
+		return []Query{q}, 1
+	case *BooleanQuery:
+		if len(q.Must) == 0 && len(q.Should) > 0 {
+			return q.Should, queryBoost(q.Boost)
+		}
+	}
+	return nil, 0
+}
+
+// candidates returns a superset of the documents matching a query using
+// only the index: the intersection of the must clauses or the union of the
+// should clauses, minus documents containing a prohibited term. A purely
+// negative query starts from every live document.
+func (e *SearchEngine) candidates(q Query) *Bitmap {
+	switch q := q.(type) {
+	case *TermQuery:
+		return e.index.TermSet(q.Field, q.Term)
+	case *PhraseQuery:
+		docIDs := make([]string, 0, len(q.matches))
+		for docID := range q.matches {
+			docIDs = append(docIDs, docID)
+		}
+		return e.index.DocumentSet(docIDs)
+	case *BooleanQuery:
+		var set *Bitmap
+		switch {
+		case matchesWithoutTerms(q):
+			set = e.index.LiveDocs()
+		case len(q.Must) > 0:
+			var terms []FieldTerm
+			for _, clause := range q.Must {
+				if term, ok := clause.(*TermQuery); ok {
+					terms = append(terms, FieldTerm{Field: term.Field, Term: term.Term})
+				} else if !matchesWithoutTerms(clause) {
+					set = intersectSets(set, e.candidates(clause))
+				}
+			}
+			if len(terms) > 0 {
+				set = intersectSets(set, e.index.IntersectTerms(terms))
+			}
+		default:
+			var terms []FieldTerm
+			set = NewBitmap()
+			for _, clause := range q.Should {
+				if term, ok := clause.(*TermQuery); ok {
+					terms = append(terms, FieldTerm{Field: term.Field, Term: term.Term})
+				} else {
+					set = set.Or(e.candidates(clause))
+				}
+			}
+			set = set.Or(e.index.UnionTerms(terms))
+		}
+
+		var prohibited []FieldTerm
+		for _, clause := range q.MustNot {
+			if term, ok := clause.(*TermQuery); ok {
+				prohibited = append(prohibited, FieldTerm{Field: term.Field, Term: term.Term})
+			}
+		}
+		if len(prohibited) > 0 {
+			set = set.AndNot(e.index.UnionTerms(prohibited))
+		}
+		return set
+	case *MultiFieldQuery:
+		var terms []FieldTerm
+		set := NewBitmap()
+		for _, clause := range q.Clauses {
+			if term, ok := clause.(*TermQuery); ok {
+				terms = append(terms, FieldTerm{Field: term.Field, Term: term.Term})
+			} else {
+				set = set.Or(e.candidates(clause))
+			}
+		}
+		return set.Or(e.index.UnionTerms(terms))
+	}
+	return NewBitmap()
+}
+
+// filterCandidates returns the candidates of a query that are in the
+// filter set, if it is not nil
+func (e *SearchEngine) filterCandidates(q Query, filter *Bitmap) *Bitmap {
+	set := e.candidates(q)
+	if filter != nil {
+		set = set.And(filter)
+	}
+	return set
+}
+
+// intersectSets intersects two sets, where a nil set means no constraint yet
+func intersectSets(set, other *Bitmap) *Bitmap {
+	if set == nil {
+		return other
+	}
+	return set.And(other)
+}
+
 // Stats returns index statistics
 func (e *SearchEngine) Stats() IndexStats {
 	e.mu.RLock()
@@ -258,16 +1328,40 @@ func (e *SearchEngine) Stats() IndexStats {
 	return e.index.Stats()
 }
 
-// recalculateAvgLength recalculates average document length
+// recalculateAvgLength recalculates the total and average length of every
+// field
 func (e *SearchEngine) recalculateAvgLength() {
-	if len(e.docStats) == 0 {
-		e.avgDocLength = 0
-		return
+	totalLengths := make(map[string]int)
+	docCounts := make(map[string]int)
+	for _, stats := range e.docStats {
+		for field, fieldStats := range stats.Fields {
+			totalLengths[field] += fieldStats.Length
+			docCounts[field]++
+		}
 	}
 
-	totalLength := 0
-	for _, stats := range e.docStats {
-		totalLength += stats.Length
+	e.totalFieldLengths = totalLengths
+	e.fieldDocCounts = docCounts
+	e.avgFieldLengths = make(map[string]float64, len(totalLengths))
+	for field, total := range totalLengths {
+		e.avgFieldLengths[field] = float64(total) / float64(docCounts[field])
+	}
+}
+
+// addFieldLengths adds a document's field lengths to the totals and
+// averages, or removes them with a sign of -1, without rescanning every
+// document
+func (e *SearchEngine) addFieldLengths(stats *DocStats, sign int) {
+	for field, fieldStats := range stats.Fields {
+		e.totalFieldLengths[field] += sign * fieldStats.Length
+		e.fieldDocCounts[field] += sign
+
+		if e.fieldDocCounts[field] <= 0 {
+			delete(e.totalFieldLengths, field)
+			delete(e.fieldDocCounts, field)
+			delete(e.avgFieldLengths, field)
+			continue
+		}
+		e.avgFieldLengths[field] = float64(e.totalFieldLengths[field]) / float64(e.fieldDocCounts[field])
 	}
-	e.avgDocLength = float64(totalLength) / float64(len(e.docStats))
 }
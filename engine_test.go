@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestEngine opens a search engine on a new index in a temporary
+// directory
+func newTestEngine(t *testing.T) *SearchEngine {
+	t.Helper()
+	engine, err := NewSearchEngine(filepath.Join(t.TempDir(), "index.db"), EngineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+// addDocuments upserts documents into an engine
+func addDocuments(t *testing.T, engine *SearchEngine, docs ...*Document) {
+	t.Helper()
+	for _, doc := range docs {
+		if err := engine.UpsertDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// searchIDs returns the IDs of the documents a search returns, in order
+func searchIDs(t *testing.T, engine *SearchEngine, query string, options SearchOptions) []string {
+	t.Helper()
+	if options.Limit == 0 {
+		options.Limit = 100
+	}
+	result, err := engine.Search(query, options)
+	if err != nil {
+		t.Fatalf("Search(%q): %v", query, err)
+	}
+	ids := make([]string, len(result.Documents))
+	for i, doc := range result.Documents {
+		ids[i] = doc.ID
+	}
+	return ids
+}
+
+func TestSearchCJK(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "关键技术", "全文检索的关键技术是倒排索引"),
+		NewDocument("2", "内容管理", "管理网站内容"),
+		NewDocument("3", "Search", "English only"),
+	)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"关键", []string{"1"}},
+		{"内容", []string{"2"}},
+		{"全文检索", []string{"1"}},
+		{"title:关键技术", []string{"1"}},
+		{`"倒排索引" -内容`, []string{"1"}},
+		{"检索 OR 管理", []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(t, engine, tt.query, SearchOptions{}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestStopwordModes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	open := func(mode string) *SearchEngine {
+		t.Helper()
+		engine, err := NewSearchEngine(path, EngineOptions{Analyzer: "english", StopwordMode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine
+	}
+
+	engine := open("")
+	addDocuments(t, engine,
+		NewDocument("1", "Bank", "the bank of america"),
+		NewDocument("2", "Rust", "rust is a language"),
+		NewDocument("3", "Hamlet", "to be or not to be"),
+	)
+
+	tests := []struct {
+		query string
+		index []string
+		// remove is the result with stopwords removed
+		remove []string
+	}{
+		{"bank", []string{"1"}, []string{"1"}},
+		{"the bank", []string{"1"}, []string{"1"}},
+		{`"bank of america"`, []string{"1"}, []string{"1"}},
+		{`"bank america"`, nil, nil},
+		{"to be or not to be", []string{"3"}, nil},
+		{"rust -the", []string{"2"}, []string{"2"}},
+	}
+	check := func(engine *SearchEngine, mode string) {
+		t.Helper()
+		if got := engine.StopwordMode(); got != mode {
+			t.Errorf("StopwordMode() = %q, want %q", got, mode)
+		}
+		for _, tt := range tests {
+			want := tt.index
+			if mode == StopwordModeRemove {
+				want = tt.remove
+			}
+			got := searchIDs(t, engine, tt.query, SearchOptions{Mode: SearchModeOR})
+			if len(got) != len(want) || (len(got) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("%s: Search(%q) = %v, want %v", mode, tt.query, got, want)
+			}
+		}
+	}
+
+	check(engine, StopwordModeIndex)
+	if got := engine.docStats["1"].Fields[FieldContent].Length; got != 4 {
+		t.Errorf("index: content length %d, want 4", got)
+	}
+	engine.Close()
+
+	// Switching the mode reindexes, and the mode is kept on reopening
+	engine = open(StopwordModeRemove)
+	check(engine, StopwordModeRemove)
+	if got := engine.docStats["1"].Fields[FieldContent].Length; got != 2 {
+		t.Errorf("remove: content length %d, want 2", got)
+	}
+	if _, ok := engine.index.index[FieldContent]["the"]; ok {
+		t.Error("remove: stopword is indexed")
+	}
+	engine.Close()
+
+	engine = open("")
+	check(engine, StopwordModeRemove)
+	engine.Close()
+
+	// Removed stopwords added to the list are dropped from the index too
+	file := filepath.Join(t.TempDir(), "stopwords.txt")
+	if err := os.WriteFile(file, []byte("rust\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewSearchEngine(path, EngineOptions{StopwordFiles: []string{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, engine, "rust language", SearchOptions{}); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("Search(%q) = %v, want [2]", "rust language", got)
+	}
+	if _, ok := engine.index.index[FieldContent]["rust"]; ok {
+		t.Error("remove: added stopword is indexed")
+	}
+	engine.Close()
+
+	engine = open(StopwordModeIndex)
+	defer engine.Close()
+	check(engine, StopwordModeIndex)
+
+	if _, err := NewSearchEngine(filepath.Join(t.TempDir(), "index.db"), EngineOptions{StopwordMode: "drop"}); err == nil {
+		t.Error("opened with an unknown stopword mode")
+	}
+}
+
+func TestSearchPhrase(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "Twice", "open source and open source"),
+		NewDocument("2", "Once", "open source source open"),
+		NewDocument("3", "Apart", "source code is open"),
+	)
+
+	tests := []struct {
+		query   string
+		options SearchOptions
+		want    []string
+	}{
+		{`"open source"`, SearchOptions{}, []string{"1", "2"}},
+		{`open source`, SearchOptions{}, []string{"1", "2", "3"}},
+		{`"source open"`, SearchOptions{}, []string{"2"}},
+		{`"open code"`, SearchOptions{}, nil},
+		// Documents are ranked by how often the phrase occurs
+		{`"open source"`, SearchOptions{UseRanking: true}, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		got := searchIDs(t, engine, tt.query, tt.options)
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSloppyPhrase(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "Exact", "quick fox"),
+		NewDocument("2", "One apart", "quick brown fox"),
+		NewDocument("3", "Three apart", "quick lazy sleepy brown fox"),
+		NewDocument("4", "Reversed", "fox quick"),
+	)
+
+	// Looser matches rank lower; ties are ordered by ID
+	ranked := SearchOptions{UseRanking: true}
+	tests := []struct {
+		query   string
+		options SearchOptions
+		want    []string
+	}{
+		{`"quick fox"~3`, ranked, []string{"1", "4", "2", "3"}},
+		{`"quick fox"~>3`, ranked, []string{"1", "2", "3"}},
+		{`"quick fox"~1`, ranked, []string{"1", "4", "2"}},
+		{`"quick fox"`, SearchOptions{UseRanking: true, Slop: 3}, []string{"1", "4", "2", "3"}},
+		{`"quick fox"`, SearchOptions{UseRanking: true, Slop: 3, InOrder: true}, []string{"1", "2", "3"}},
+		{`"quick fox"~0`, SearchOptions{UseRanking: true, Slop: 3}, []string{"1"}},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(t, engine, tt.query, tt.options); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q, slop %d) = %v, want %v", tt.query, tt.options.Slop, got, tt.want)
+		}
+	}
+}
+
+func TestSearchFields(t *testing.T) {
+	engine := newTestEngine(t)
+	doc := NewDocument("1", "Go", "rust programming")
+	doc.URL = "https://golang.org/doc"
+	doc.Metadata["lang"] = "go"
+	addDocuments(t, engine, doc, NewDocument("2", "Rust", "go programming go"))
+
+	unranked := SearchOptions{UseRanking: false}
+	tests := []struct {
+		query   string
+		options SearchOptions
+		want    []string
+	}{
+		{"go", unranked, []string{"1", "2"}},
+		{"title:go", unranked, []string{"1"}},
+		{"content:go", unranked, []string{"2"}},
+		{"url:golang", unranked, []string{"1"}},
+		{"golang", unranked, nil},
+		{"metadata.lang:go", unranked, []string{"1"}},
+		{"go", SearchOptions{Fields: []string{FieldTitle}}, []string{"1"}},
+		{"go", SearchOptions{Fields: []string{FieldContent}}, []string{"2"}},
+		{"golang", SearchOptions{Fields: []string{FieldURL}}, []string{"1"}},
+		// A field prefix overrides the searched fields
+		{"title:rust", SearchOptions{Fields: []string{FieldContent}}, []string{"2"}},
+		{"title:rust OR content:rust", unranked, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		got := searchIDs(t, engine, tt.query, tt.options)
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("Search(%q, fields %v) = %v, want %v", tt.query, tt.options.Fields, got, tt.want)
+		}
+	}
+
+	// Statistics are kept per field
+	stats := engine.docStats["2"]
+	for field, want := range map[string]FieldStats{
+		FieldTitle:   {Length: 1, TermFrequencies: map[string]int{"rust": 1}},
+		FieldContent: {Length: 3, TermFrequencies: map[string]int{"go": 2, "programming": 1}},
+	} {
+		if got := stats.Fields[field]; got == nil || !reflect.DeepEqual(*got, want) {
+			t.Errorf("stats of %s = %+v, want %+v", field, got, want)
+		}
+	}
+}
+
+func TestUpsertBatchResults(t *testing.T) {
+	newDoc := func(id, content string, metadata map[string]string) *Document {
+		doc := NewDocument(id, "Title "+id, content)
+		for key, value := range metadata {
+			doc.Metadata[key] = value
+		}
+		return doc
+	}
+	batch := []*Document{
+		newDoc("1", "first version", nil),
+		newDoc("", "no id", nil),
+		newDoc("2", "long tag", map[string]string{"tag": strings.Repeat("x", maxKeywordLength+1)}),
+		newDoc("3", "third", map[string]string{"priority": "high"}),
+		newDoc(strings.Repeat("x", maxTermLength+1), "long id", nil),
+		newDoc("4", "fourth", map[string]string{"priority": "4"}),
+		newDoc("1", "second version", nil),
+	}
+
+	engine, err := NewSearchEngine(filepath.Join(t.TempDir(), "index.db"), EngineOptions{Schema: Schema{"priority": FieldTypeNumber}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	addDocuments(t, engine, newDoc("2", "saved before", nil))
+
+	results, err := engine.UpsertBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Results follow the batch order; each rejection has its own error
+	var idErr *IDError
+	var schemaErr *SchemaError
+	checks := []func(error) bool{
+		func(err error) bool { return err == nil },
+		func(err error) bool { return errors.As(err, &idErr) },
+		func(err error) bool { return errors.As(err, &schemaErr) && schemaErr.Field == "tag" },
+		func(err error) bool { return errors.As(err, &schemaErr) && schemaErr.Field == "priority" },
+		func(err error) bool { return errors.As(err, &idErr) },
+		func(err error) bool { return err == nil },
+		func(err error) bool { return err == nil },
+	}
+	if len(results) != len(batch) {
+		t.Fatalf("%d results for %d documents", len(results), len(batch))
+	}
+	for i, result := range results {
+		if result.ID != batch[i].ID || !checks[i](result.Err) {
+			t.Errorf("result %d = %q %v", i, result.ID, result.Err)
+		}
+	}
+
+	// Saved documents match upserting the valid ones one at a time; a
+	// rejected update leaves the saved version
+	want := newTestEngine(t)
+	addDocuments(t, want, newDoc("2", "saved before", nil), batch[0], batch[5], batch[6])
+	checkSnapshot(t, "batch", snapshotEngine(t, engine), snapshotEngine(t, want))
+	for id, content := range map[string]string{"1": "second version", "2": "saved before", "4": "fourth"} {
+		doc, err := engine.GetDocument(id)
+		if err != nil || doc == nil || doc.Content != content {
+			t.Errorf("GetDocument(%s) = %+v, %v, want content %q", id, doc, err, content)
+		}
+	}
+	if doc, _ := engine.GetDocument("3"); doc != nil {
+		t.Errorf("rejected document 3 was saved")
+	}
+
+	// An all-invalid batch saves nothing and is not an error
+	results, err = engine.UpsertBatch([]*Document{newDoc("", "no id", nil)})
+	if err != nil || len(results) != 1 || results[0].Err == nil {
+		t.Errorf("UpsertBatch(invalid) = %v, %v", results, err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Explanation is a node of a score calculation: a value, what it is, and
+// the values it was computed from
+type Explanation struct {
+	Value       float64        `json:"value"`
+	Description string         `json:"description"`
+	Details     []*Explanation `json:"details,omitempty"`
+}
+
+// add appends a detail and returns it. Adding to a nil explanation does
+// nothing and returns nil, so scoring code can record unconditionally.
+func (e *Explanation) add(value float64, format string, args ...interface{}) *Explanation {
+	if e == nil {
+		return nil
+	}
+	detail := &Explanation{Value: value, Description: fmt.Sprintf(format, args...)}
+	e.Details = append(e.Details, detail)
+	return detail
+}
+
+// set records the value of a node once it is known and returns it
+func (e *Explanation) set(value float64) float64 {
+	if e != nil {
+		e.Value = value
+	}
+	return value
+}
+
+// String formats the explanation as an indented tree
+func (e *Explanation) String() string {
+	var sb strings.Builder
+	e.write(&sb, 0)
+	return sb.String()
+}
+
+func (e *Explanation) write(sb *strings.Builder, depth int) {
+	fmt.Fprintf(sb, "%s%.6g %s\n", strings.Repeat("  ", depth), e.Value, e.Description)
+	for _, detail := range e.Details {
+		detail.write(sb, depth+1)
+	}
+}
+
+// DocumentExplanation explains the score of one document for a query
+type DocumentExplanation struct {
+	ID          string       `json:"id"`
+	Matched     bool         `json:"matched"`
+	Score       float64      `json:"score"`
+	Explanation *Explanation `json:"explanation"`
+}
+
+// Explain scores a document for a query and records how the score was
+// computed, using the same scoring code as Search. A document that does not
+// match the query has a score of 0; its explanation shows the partial
+// score of the clauses it does contain. It returns nil if the document
+// does not exist.
+func (e *SearchEngine) Explain(docID, query string, options SearchOptions) (*DocumentExplanation, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	stats, ok := e.docStats[docID]
+	if !ok {
+		return nil, nil
+	}
+
+	parsed, scorer, err := e.prepareQuery(query, options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DocumentExplanation{ID: docID}
+	if parsed == nil {
+		result.Explanation = &Explanation{Description: "query has no searchable terms"}
+		return result, nil
+	}
+
+	ctx := NewScoringContext(e.index, e.avgFieldLengths, e.totalFieldLengths)
+	result.Explanation = explainScore(scorer, parsed, stats, ctx)
+	result.Matched = queryMatches(parsed, stats)
+	if result.Matched {
+		result.Score = result.Explanation.Value
+	}
+	return result, nil
+}
+
+// describeQuery writes a term, phrase or multi-field query in query syntax
+func describeQuery(q Query) string {
+	switch q := q.(type) {
+	case *TermQuery:
+		return q.Field + ":" + q.Term
+	case *PhraseQuery:
+		terms := make([]string, len(q.Terms))
+		for i, term := range q.Terms {
+			terms[i] = term.Term
+		}
+		phrase := fmt.Sprintf("%s:%q", q.Field, strings.Join(terms, " "))
+		switch {
+		case q.Slop > 0 && q.InOrder:
+			phrase += fmt.Sprintf("~>%d", q.Slop)
+		case q.Slop > 0:
+			phrase += fmt.Sprintf("~%d", q.Slop)
+		}
+		return phrase
+	case *MultiFieldQuery:
+		clauses := make([]string, len(q.Clauses))
+		for i, clause := range q.Clauses {
+			clauses[i] = describeQuery(clause)
+		}
+		return strings.Join(clauses, " | ")
+	}
+	return ""
+}
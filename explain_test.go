@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// checkExplanation checks that every sum and product node of an
+// explanation adds or multiplies up to its value
+func checkExplanation(t *testing.T, name string, expl *Explanation) {
+	t.Helper()
+
+	var want float64
+	switch description := expl.Description; {
+	case strings.HasSuffix(description, "sum of:"), strings.HasSuffix(description, "sum of fields:"):
+		boost := 1.0
+		if i := strings.Index(description, " * "); i > 0 {
+			var err error
+			if boost, err = strconv.ParseFloat(description[:i], 64); err != nil {
+				t.Fatalf("%s: bad boost in %q", name, description)
+			}
+		}
+		for _, detail := range expl.Details {
+			want += detail.Value
+		}
+		want *= boost
+	case strings.HasSuffix(description, "product of:"):
+		want = 1
+		for _, detail := range expl.Details {
+			want *= detail.Value
+		}
+	default:
+		want = expl.Value
+	}
+	if !closeTo(expl.Value, want) {
+		t.Errorf("%s: %q = %v, details give %v", name, expl.Description, expl.Value, want)
+	}
+
+	for _, detail := range expl.Details {
+		checkExplanation(t, name, detail)
+	}
+}
+
+func TestExplanationSums(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "Rust programming", "rust is a systems programming language"),
+		NewDocument("2", "Open source", "open source rust and go projects"),
+		NewDocument("3", "Go", "go is an open source programming language"),
+	)
+
+	queries := []string{
+		"rust",
+		"rust programming",
+		`rust OR "open source"`,
+		`"open language"~3 OR go^2`,
+		"title:rust^3 content:rust",
+		"+programming -go",
+	}
+	for _, scorer := range ScorerNames() {
+		for _, query := range queries {
+			name := scorer + " " + query
+			result, err := engine.Search(query, SearchOptions{Mode: SearchModeOR, UseRanking: true, Scorer: scorer, Explain: true, Limit: 10})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(result.Documents) == 0 || len(result.Explanations) != len(result.Documents) {
+				t.Fatalf("%s: %d explanations for %d documents", name, len(result.Explanations), len(result.Documents))
+			}
+			for i, expl := range result.Explanations {
+				if !closeTo(expl.Value, result.Scores[i]) {
+					t.Errorf("%s: explanation of %s = %v, score %v", name, result.Documents[i].ID, expl.Value, result.Scores[i])
+				}
+				checkExplanation(t, name, expl)
+			}
+		}
+	}
+}
+
+func TestExplainDocument(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "Rust", "rust rust programming"),
+		NewDocument("2", "Go", "go programming"),
+	)
+	options := SearchOptions{Mode: SearchModeAND, UseRanking: true, Limit: 10}
+
+	result, err := engine.Search("rust programming", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id      string
+		matched bool
+		score   float64
+	}{
+		{"1", true, result.Scores[0]},
+		// Only part of the query matches: the score is 0, but the
+		// explanation still shows the matching clause
+		{"2", false, 0},
+	}
+	for _, tt := range tests {
+		expl, err := engine.Explain(tt.id, "rust programming", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expl.Matched != tt.matched || !closeTo(expl.Score, tt.score) {
+			t.Errorf("Explain(%s) matched %v with score %v, want %v with %v", tt.id, expl.Matched, expl.Score, tt.matched, tt.score)
+		}
+		if expl.Explanation.Value == 0 {
+			t.Errorf("Explain(%s) has no partial score:\n%s", tt.id, expl.Explanation)
+		}
+		checkExplanation(t, tt.id, expl.Explanation)
+	}
+
+	// The BM25 inputs are recorded as leaves of the tree
+	expl, err := engine.Explain("1", "content:rust", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := expl.Explanation.String()
+	for _, want := range []string{"2 freq,", "1.5 k1,", "0.75 b,", "3 dl,", "1 n,", "2 N,"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("explanation has no %q:\n%s", want, text)
+		}
+	}
+
+	if expl, err := engine.Explain("missing", "rust", options); err != nil || expl != nil {
+		t.Errorf("Explain(missing) = %v, %v, want nil", expl, err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExportOptions selects what an export writes. A nil writer is skipped.
+type ExportOptions struct {
+	Documents io.Writer // Documents as JSONL, readable by import
+	Terms     io.Writer // Term dictionary as JSONL
+	Postings  bool      // Include each term's postings in the term dictionary
+}
+
+// ExportSummary counts what an export wrote
+type ExportSummary struct {
+	Documents int
+	Terms     int
+}
+
+// exportTerm is a line of the term dictionary
+type exportTerm struct {
+	Field     string          `json:"field"`
+	Term      string          `json:"term"`
+	DocFreq   int             `json:"doc_freq"`
+	TotalFreq int             `json:"total_freq"`
+	Postings  []exportPosting `json:"postings,omitempty"`
+}
+
+// exportPosting lists the positions of a term in a document
+type exportPosting struct {
+	ID        string `json:"id"`
+	Positions []int  `json:"positions"`
+}
+
+// Export writes the stored documents and term dictionary. Both are read in
+// one read-only transaction, so they are a consistent snapshot even while
+// documents are being written.
+func (e *SearchEngine) Export(options ExportOptions) (ExportSummary, error) {
+	return e.storage.Export(options)
+}
+
+// Export writes the stored documents and term dictionary from one read-only
+// transaction. While it is open, pages it reads cannot be reused, and a
+// write that needs to grow the database file waits for it to end, so a
+// slow writer stalls ingestion; spool the export to a file when the
+// destination is slow.
+func (s *Storage) Export(options ExportOptions) (ExportSummary, error) {
+	var summary ExportSummary
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if options.Documents != nil {
+			count, err := exportDocuments(tx.Bucket(docsBucket), options.Documents)
+			summary.Documents = count
+			if err != nil {
+				return err
+			}
+		}
+
+		if options.Terms != nil {
+			count, err := exportTerms(tx.Bucket(indexBucket), options.Terms, options.Postings)
+			summary.Terms = count
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return summary, err
+}
+
+// exportDocuments writes every stored document as a line of JSON, in ID
+// order
+func exportDocuments(b *bolt.Bucket, w io.Writer) (int, error) {
+	out := bufio.NewWriter(w)
+	count := 0
+	var line bytes.Buffer
+
+	err := b.ForEach(func(k, v []byte) error {
+		line.Reset()
+		if err := json.Compact(&line, v); err != nil {
+			return fmt.Errorf("failed to read document %s: %w", k, err)
+		}
+		line.WriteByte('\n')
+		if _, err := out.Write(line.Bytes()); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// exportTerms writes a line of JSON per term of the stored index, ordered
+// by field and term, with its document and total frequency and optionally
+// its postings
+func exportTerms(b *bolt.Bucket, w io.Writer, postings bool) (int, error) {
+	if version := b.Get(indexVersionKey); string(version) != strconv.Itoa(indexFormatVersion) {
+		return 0, fmt.Errorf("the stored index is in an older format, open the database once to rebuild it")
+	}
+
+	// Postings refer to documents by number
+	var docIDs map[uint32]string
+	if postings {
+		docIDs = make(map[uint32]string)
+		err := forEachRecord(b, docNumbersBucket, func(k, v []byte) error {
+			docID, _, err := decodeDocRecord(v)
+			if err != nil || len(k) != 4 {
+				return fmt.Errorf("failed to decode document %x: %w", k, errCorruptIndex)
+			}
+			docIDs[binary.BigEndian.Uint32(k)] = docID
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	count := 0
+
+	err := forEachField(b, termsBucket, func(field string, fieldTerms *bolt.Bucket) error {
+		return fieldTerms.ForEach(func(k, v []byte) error {
+			_, list, err := decodeTermRecord(v)
+			if err != nil {
+				return fmt.Errorf("failed to decode postings of %s:%s: %w", field, k, err)
+			}
+
+			term := exportTerm{
+				Field:     field,
+				Term:      string(k),
+				DocFreq:   list.Len(),
+				TotalFreq: list.TotalFreq(),
+			}
+			if postings {
+				term.Postings = make([]exportPosting, 0, list.Len())
+				it := list.iterator()
+				for it.next() {
+					term.Postings = append(term.Postings, exportPosting{ID: docIDs[it.doc], Positions: it.positions()})
+				}
+			}
+
+			count++
+			return encoder.Encode(term)
+		})
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// handleExport returns a snapshot of the documents as JSONL, or of the term
+// dictionary with type=terms. The export is spooled to a temporary file
+// before it is sent, so a slow client does not hold the read transaction
+// open and stall writes.
+func (api *API) handleExport(c *gin.Context) {
+	spool, err := os.CreateTemp("", "simplefts-export-*.jsonl")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to create export file: %v", err),
+		})
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	var options ExportOptions
+	switch exportType := c.DefaultQuery("type", "documents"); exportType {
+	case "documents":
+		options.Documents = spool
+	case "terms":
+		options.Terms = spool
+		options.Postings = c.Query("postings") == "true"
+	default:
+		c.JSON(http.StatusBadRequest, errorResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Unknown export type %q, expected documents or terms", exportType),
+		})
+		return
+	}
+
+	if _, err := api.engine.Export(options); err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to export: %v", err),
+		})
+		return
+	}
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to read export file: %v", err),
+		})
+		return
+	}
+	c.DataFromReader(http.StatusOK, size, "application/x-ndjson", spool, nil)
+}
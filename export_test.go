@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportSnapshot is what an export wrote: documents by ID, in the order
+// they were written, and postings in the form of an index snapshot
+type exportSnapshot struct {
+	ids      []string
+	docs     map[string]*Document
+	postings map[string]map[string][]int
+	freqs    map[string][2]int // field/term -> document and total frequency
+}
+
+func readExport(t *testing.T, docs, terms []byte) exportSnapshot {
+	t.Helper()
+	snapshot := exportSnapshot{
+		docs:     make(map[string]*Document),
+		postings: make(map[string]map[string][]int),
+		freqs:    make(map[string][2]int),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(docs))
+	for scanner.Scan() {
+		var doc Document
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("bad document line %s: %v", scanner.Text(), err)
+		}
+		snapshot.ids = append(snapshot.ids, doc.ID)
+		snapshot.docs[doc.ID] = &doc
+	}
+
+	scanner = bufio.NewScanner(bytes.NewReader(terms))
+	for scanner.Scan() {
+		var term exportTerm
+		if err := json.Unmarshal(scanner.Bytes(), &term); err != nil {
+			t.Fatalf("bad term line %s: %v", scanner.Text(), err)
+		}
+		key := term.Field + "/" + term.Term
+		postings := make(map[string][]int)
+		for _, posting := range term.Postings {
+			postings[posting.ID] = posting.Positions
+		}
+		snapshot.postings[key] = postings
+		snapshot.freqs[key] = [2]int{term.DocFreq, term.TotalFreq}
+	}
+	return snapshot
+}
+
+// checkExport compares an export with an index snapshot and the stored
+// documents
+func checkExport(t *testing.T, name string, got exportSnapshot, want indexSnapshot, docs map[string]*Document) {
+	t.Helper()
+	if !reflect.DeepEqual(got.docs, docs) {
+		t.Errorf("%s: exported documents %v, want %v", name, got.ids, docs)
+	}
+	for i := 1; i < len(got.ids); i++ {
+		if got.ids[i-1] >= got.ids[i] {
+			t.Errorf("%s: documents not in ID order: %v", name, got.ids)
+			break
+		}
+	}
+	checkSnapshot(t, name, indexSnapshot{postings: got.postings, stats: want.stats, lengths: want.lengths, live: want.live}, want)
+	for key, postings := range want.postings {
+		total := 0
+		for _, positions := range postings {
+			total += len(positions)
+		}
+		if freqs := got.freqs[key]; freqs != [2]int{len(postings), total} {
+			t.Errorf("%s: frequencies of %s = %v, want %v", name, key, freqs, [2]int{len(postings), total})
+		}
+	}
+}
+
+// storedDocuments returns every stored document by ID
+func storedDocuments(t *testing.T, engine *SearchEngine) map[string]*Document {
+	t.Helper()
+	docs, err := engine.storage.GetAllDocuments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]*Document, len(docs))
+	for _, doc := range docs {
+		byID[doc.ID] = doc
+	}
+	return byID
+}
+
+func TestExport(t *testing.T) {
+	engine := newTestEngine(t)
+	doc := NewDocument("b", "Rust", "rust and go")
+	doc.URL = "https://example.com"
+	doc.Metadata["lang"] = "rust"
+	addDocuments(t, engine,
+		doc,
+		NewDocument("a", "Go", "go go go"),
+		NewDocument("c", "Deleted", "gone"),
+	)
+	if err := engine.DeleteDocument("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var docs, terms bytes.Buffer
+	summary, err := engine.Export(ExportOptions{Documents: &docs, Terms: &terms, Postings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readExport(t, docs.Bytes(), terms.Bytes())
+	if summary.Documents != 2 || summary.Terms != len(got.postings) {
+		t.Errorf("summary %+v, want 2 documents and %d terms", summary, len(got.postings))
+	}
+	checkExport(t, "export", got, snapshotEngine(t, engine), storedDocuments(t, engine))
+
+	// Without postings only the frequencies are written
+	terms.Reset()
+	if _, err := engine.Export(ExportOptions{Terms: &terms}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(terms.Bytes(), []byte(`"postings"`)) {
+		t.Errorf("postings exported without Postings:\n%s", terms.Bytes())
+	}
+	if frequencies := readExport(t, nil, terms.Bytes()).freqs; !reflect.DeepEqual(frequencies, got.freqs) {
+		t.Errorf("frequencies without postings = %v, want %v", frequencies, got.freqs)
+	}
+}
+
+// writeHook calls a function on the first write
+type writeHook struct {
+	w      io.Writer
+	before func()
+}
+
+func (h *writeHook) Write(p []byte) (int, error) {
+	if h.before != nil {
+		h.before()
+		h.before = nil
+	}
+	return h.w.Write(p)
+}
+
+func TestExportIsASnapshot(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "One", "first document"),
+		NewDocument("2", "Two", "second document"),
+	)
+	// Pages freed before the export can be reused by the writes below, so
+	// they need not grow the file, which would wait for the export to end
+	filler := NewDocument("filler", "Filler", strings.Repeat("padding words for free pages ", 20000))
+	addDocuments(t, engine, filler)
+	if err := engine.DeleteDocument(filler.ID); err != nil {
+		t.Fatal(err)
+	}
+	want, wantDocs := snapshotEngine(t, engine), storedDocuments(t, engine)
+
+	// Documents are written before the term dictionary is read; writes made
+	// in between must not show up in either
+	written := make(chan error, 1)
+	var docs, terms bytes.Buffer
+	hook := &writeHook{w: &docs, before: func() {
+		go func() {
+			err := engine.UpsertDocument(NewDocument("3", "Three", "third document"))
+			if err == nil {
+				err = engine.DeleteDocument("1")
+			}
+			if err == nil {
+				err = engine.UpsertDocument(NewDocument("2", "Two", "changed"))
+			}
+			written <- err
+		}()
+		select {
+		case err := <-written:
+			written <- err
+		case <-time.After(time.Second):
+			t.Error("writes waited for the export")
+		}
+	}}
+
+	if _, err := engine.Export(ExportOptions{Documents: hook, Terms: &terms, Postings: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	checkExport(t, "during writes", readExport(t, docs.Bytes(), terms.Bytes()), want, wantDocs)
+
+	docs.Reset()
+	terms.Reset()
+	if _, err := engine.Export(ExportOptions{Documents: &docs, Terms: &terms, Postings: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkExport(t, "after writes", readExport(t, docs.Bytes(), terms.Bytes()), snapshotEngine(t, engine), storedDocuments(t, engine))
+}
@@ -0,0 +1,55 @@
+//go:build failpoints
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Failpoints are only compiled into binaries built with the failpoints
+// tag (go build -tags failpoints), for crash testing; see failpoint_off.go.
+
+// failpointEnv names a failpoint to trigger. NAME exits the process at that
+// point, as if it was killed; NAME:error makes a point before the end of a
+// commit return an error instead.
+const failpointEnv = "SIMPLEFTS_FAILPOINT"
+
+// failpointExitCode is the exit status of a process stopped at a failpoint
+const failpointExitCode = 99
+
+// activeFailpoint is the failpoint set in the environment, if any
+var activeFailpoint = os.Getenv(failpointEnv)
+
+// failpoint exits the process or returns an error if the environment names
+// this point; otherwise it does nothing
+func failpoint(name string) error {
+	if activeFailpoint == "" {
+		return nil
+	}
+
+	point, action, _ := strings.Cut(activeFailpoint, ":")
+	if point != name {
+		return nil
+	}
+	if action == "error" {
+		return fmt.Errorf("failpoint %s triggered", name)
+	}
+
+	crash(name)
+	return nil
+}
+
+// crashpoint exits the process if the environment names this point. It is
+// used after a commit, where there is nothing left to fail.
+func crashpoint(name string) {
+	if point, _, _ := strings.Cut(activeFailpoint, ":"); activeFailpoint != "" && point == name {
+		crash(name)
+	}
+}
+
+func crash(name string) {
+	fmt.Fprintf(os.Stderr, "failpoint %s: exiting\n", name)
+	os.Exit(failpointExitCode)
+}
@@ -0,0 +1,11 @@
+//go:build !failpoints
+
+package main
+
+// failpoint does nothing outside crash-test builds; see failpoint.go
+func failpoint(name string) error {
+	return nil
+}
+
+// crashpoint does nothing outside crash-test builds; see failpoint.go
+func crashpoint(name string) {}
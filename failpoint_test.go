@@ -0,0 +1,238 @@
+//go:build failpoints
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Environment of the helper process that runs an operation until it stops
+// at a failpoint
+const (
+	failpointOperationEnv = "SIMPLEFTS_FAILPOINT_OPERATION"
+	failpointPathEnv      = "SIMPLEFTS_FAILPOINT_PATH"
+)
+
+// failpointOperation is a write with the failpoints before, in the middle
+// of and after its commit
+type failpointOperation struct {
+	name   string
+	before string
+	mid    string
+	after  string
+	run    func(*SearchEngine) error
+}
+
+func rankedDocument(id, title, content, rank string) *Document {
+	doc := NewDocument(id, title, content)
+	doc.Metadata = map[string]string{"rank": rank}
+	return doc
+}
+
+var failpointOperations = []failpointOperation{
+	{"update", "upsert-before-commit", "upsert-mid-commit", "upsert-after-commit", func(e *SearchEngine) error {
+		return e.UpsertDocument(rankedDocument("a", "Apple", "zebra crossing fruit", "3"))
+	}},
+	{"insert", "upsert-before-commit", "upsert-mid-commit", "upsert-after-commit", func(e *SearchEngine) error {
+		return e.UpsertDocument(rankedDocument("c", "Cherry", "cherry blossom fruit", "0"))
+	}},
+	{"batch", "batch-before-commit", "batch-mid-commit", "batch-after-commit", func(e *SearchEngine) error {
+		_, err := e.UpsertBatch([]*Document{
+			rankedDocument("a", "Apple", "zebra crossing fruit", "3"),
+			rankedDocument("c", "Cherry", "cherry blossom fruit", "0"),
+		})
+		return err
+	}},
+	{"delete", "delete-before-commit", "delete-mid-commit", "delete-after-commit", func(e *SearchEngine) error {
+		return e.DeleteDocument("b")
+	}},
+}
+
+func lookupFailpointOperation(name string) (failpointOperation, bool) {
+	for _, op := range failpointOperations {
+		if op.name == name {
+			return op, true
+		}
+	}
+	return failpointOperation{}, false
+}
+
+// seedEngine opens an engine on a new index holding two documents
+func seedEngine(t *testing.T, path string) *SearchEngine {
+	t.Helper()
+	engine := openEngine(t, path)
+	addDocuments(t, engine,
+		rankedDocument("a", "Apple", "apple orchard fruit", "2"),
+		rankedDocument("b", "Banana", "banana plantation fruit", "1"),
+	)
+	return engine
+}
+
+// engineState is what a write changes: the index, the stored documents and
+// the document values results are filtered and sorted by
+type engineState struct {
+	index indexSnapshot
+	docs  map[string]*Document
+	ranks map[string]string // document ID -> rank value
+}
+
+func snapshotState(t *testing.T, engine *SearchEngine) engineState {
+	t.Helper()
+	stored, err := engine.storage.GetAllDocuments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := make(map[string]*Document, len(stored))
+	for _, doc := range stored {
+		docs[doc.ID] = doc
+	}
+	ranks := make(map[string]string)
+	if column, ok := engine.values.keywords["rank"]; ok {
+		for docID := range engine.docStats {
+			num, ok := engine.index.DocumentNumber(docID)
+			if !ok {
+				continue
+			}
+			if rank, ok := column.get(num); ok {
+				ranks[docID] = rank
+			}
+		}
+	}
+	return engineState{
+		index: snapshotEngine(t, engine),
+		docs:  docs,
+		ranks: ranks,
+	}
+}
+
+func checkState(t *testing.T, name string, got, want engineState) {
+	t.Helper()
+	checkSnapshot(t, name, got.index, want.index)
+	if !reflect.DeepEqual(got.docs, want.docs) {
+		t.Errorf("%s: stored documents differ", name)
+	}
+	if !reflect.DeepEqual(got.ranks, want.ranks) {
+		t.Errorf("%s: rank values = %v, want %v", name, got.ranks, want.ranks)
+	}
+}
+
+// checkVerify checks that an engine's storage is consistent
+func checkVerify(t *testing.T, name string, engine *SearchEngine) {
+	t.Helper()
+	problems, err := engine.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		t.Errorf("%s: %s", name, problem)
+	}
+}
+
+// committedState returns the state after an operation succeeds
+func committedState(t *testing.T, op failpointOperation) engineState {
+	t.Helper()
+	engine := seedEngine(t, filepath.Join(t.TempDir(), "index.db"))
+	defer engine.Close()
+	if err := op.run(engine); err != nil {
+		t.Fatal(err)
+	}
+	return snapshotState(t, engine)
+}
+
+// setFailpoint triggers a failpoint until the end of the test
+func setFailpoint(t *testing.T, failpoint string) {
+	previous := activeFailpoint
+	activeFailpoint = failpoint
+	t.Cleanup(func() { activeFailpoint = previous })
+}
+
+func TestFailedCommitRollsBack(t *testing.T) {
+	for _, op := range failpointOperations {
+		committed := committedState(t, op)
+		for _, point := range []string{op.before, op.mid} {
+			t.Run(op.name+"/"+point, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "index.db")
+				engine := seedEngine(t, path)
+				seeded := snapshotState(t, engine)
+
+				setFailpoint(t, point+":error")
+				if err := op.run(engine); err == nil {
+					engine.Close()
+					t.Fatal("commit succeeded at an error failpoint")
+				}
+				activeFailpoint = ""
+				checkState(t, "memory", snapshotState(t, engine), seeded)
+				engine.Close()
+
+				engine = openEngine(t, path)
+				defer engine.Close()
+				checkState(t, "disk", snapshotState(t, engine), seeded)
+				checkVerify(t, "disk", engine)
+
+				// The engine is still usable after the rollback
+				if err := op.run(engine); err != nil {
+					t.Fatalf("retry: %v", err)
+				}
+				checkState(t, "retry", snapshotState(t, engine), committed)
+			})
+		}
+	}
+}
+
+func TestCrashDuringCommit(t *testing.T) {
+	for _, op := range failpointOperations {
+		committed := committedState(t, op)
+		for _, point := range []string{op.before, op.mid, op.after} {
+			t.Run(op.name+"/"+point, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "index.db")
+				engine := seedEngine(t, path)
+				seeded := snapshotState(t, engine)
+				engine.Close()
+
+				cmd := exec.Command(os.Args[0], "-test.run=^TestFailpointProcess$")
+				cmd.Env = append(os.Environ(),
+					failpointEnv+"="+point,
+					failpointOperationEnv+"="+op.name,
+					failpointPathEnv+"="+path,
+				)
+				output, err := cmd.CombinedOutput()
+				var exitErr *exec.ExitError
+				if !errors.As(err, &exitErr) || exitErr.ExitCode() != failpointExitCode {
+					t.Fatalf("process did not stop at %s: %v\n%s", point, err, output)
+				}
+
+				want := seeded
+				if point == op.after {
+					want = committed
+				}
+				engine = openEngine(t, path)
+				defer engine.Close()
+				checkState(t, "disk", snapshotState(t, engine), want)
+				checkVerify(t, "disk", engine)
+			})
+		}
+	}
+}
+
+// TestFailpointProcess runs an operation in the process started by
+// TestCrashDuringCommit, which is expected to exit at the failpoint
+func TestFailpointProcess(t *testing.T) {
+	path := os.Getenv(failpointPathEnv)
+	if path == "" {
+		t.Skip("only run by TestCrashDuringCommit")
+	}
+	op, ok := lookupFailpointOperation(os.Getenv(failpointOperationEnv))
+	if !ok {
+		t.Fatalf("unknown operation %q", os.Getenv(failpointOperationEnv))
+	}
+
+	engine := openEngine(t, path)
+	defer engine.Close()
+	err := op.run(engine)
+	t.Fatalf("operation did not stop at failpoint %s: %v", activeFailpoint, err)
+}
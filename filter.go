@@ -0,0 +1,297 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// CharFilter rewrites raw text before it is tokenized
+type CharFilter interface {
+	Filter(text string) string
+}
+
+// TokenFilter transforms, drops or injects tokens after tokenization
+type TokenFilter interface {
+	Filter(tokens []Token) []Token
+}
+
+// HTMLStripCharFilter blanks out HTML tags, comments and the contents of
+// script and style elements, and decodes character references. Removed
+// characters are replaced with spaces so token offsets still point into
+// the original markup.
+type HTMLStripCharFilter struct{}
+
+// htmlHiddenElements are elements whose contents are not text
+var htmlHiddenElements = map[string]bool{
+	"script": true,
+	"style":  true,
+}
+
+// maxEntityLength bounds the search for the ';' ending a character reference
+const maxEntityLength = 32
+
+// Filter implements CharFilter
+func (HTMLStripCharFilter) Filter(text string) string {
+	var sb strings.Builder
+	sb.Grow(len(text))
+	blank := func(n int) {
+		sb.WriteString(strings.Repeat(" ", n))
+	}
+
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			if strings.HasPrefix(text[i:], "<!--") {
+				end := strings.Index(text[i+4:], "-->")
+				if end < 0 {
+					blank(len(text) - i)
+					return sb.String()
+				}
+				blank(end + 7)
+				i += end + 7
+				continue
+			}
+
+			end := strings.IndexByte(text[i:], '>')
+			if end < 0 {
+				sb.WriteString(text[i:])
+				return sb.String()
+			}
+			end += i + 1
+			if name, closing := htmlTagName(text[i:end]); htmlHiddenElements[name] && !closing {
+				end = htmlElementEnd(text, end, name)
+			}
+			blank(end - i)
+			i = end
+			continue
+		case '&':
+			limit := len(text)
+			if limit > i+maxEntityLength {
+				limit = i + maxEntityLength
+			}
+			if end := strings.IndexByte(text[i:limit], ';'); end > 1 {
+				entity := text[i : i+end+1]
+				if decoded := html.UnescapeString(entity); decoded != entity && len(decoded) <= len(entity) {
+					sb.WriteString(decoded)
+					blank(len(entity) - len(decoded))
+					i += len(entity)
+					continue
+				}
+			}
+		}
+		sb.WriteByte(text[i])
+		i++
+	}
+
+	return sb.String()
+}
+
+// htmlTagName returns the lowercased element name of a tag such as
+// "<script type=x>" or "</p>", and whether it is a closing tag
+func htmlTagName(tag string) (string, bool) {
+	tag = strings.TrimPrefix(tag, "<")
+	closing := strings.HasPrefix(tag, "/")
+	tag = strings.TrimPrefix(tag, "/")
+	end := strings.IndexFunc(tag, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	})
+	if end < 0 {
+		end = len(tag)
+	}
+	return strings.ToLower(tag[:end]), closing
+}
+
+// htmlElementEnd returns the offset just past the closing tag of an
+// element whose opening tag ends at start, or the end of the text when it
+// is not closed
+func htmlElementEnd(text string, start int, name string) int {
+	for at := start; ; {
+		i := strings.Index(text[at:], "</")
+		if i < 0 {
+			return len(text)
+		}
+		at += i
+		end := strings.IndexByte(text[at:], '>')
+		if end < 0 {
+			return len(text)
+		}
+		if tagName, _ := htmlTagName(text[at : at+end+1]); tagName == name {
+			return at + end + 1
+		}
+		at += 2
+	}
+}
+
+// LowercaseFilter lowercases every token
+type LowercaseFilter struct{}
+
+// Filter implements TokenFilter
+func (LowercaseFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Term = strings.ToLower(tokens[i].Term)
+	}
+	return tokens
+}
+
+// LengthFilter drops tokens outside [Min, Max] bytes. Max <= 0 means no
+// upper bound. Lengths are measured in bytes, so a single CJK character
+// (3 bytes in UTF-8) survives Min: 2 while a single ASCII letter does not.
+type LengthFilter struct {
+	Min int
+	Max int
+}
+
+// Filter implements TokenFilter
+func (f LengthFilter) Filter(tokens []Token) []Token {
+	kept := tokens[:0]
+	for _, token := range tokens {
+		if len(token.Term) < f.Min || (f.Max > 0 && len(token.Term) > f.Max) {
+			continue
+		}
+		kept = append(kept, token)
+	}
+	return kept
+}
+
+// ASCIIFoldingFilter strips diacritics and folds common Latin ligatures
+// ("café" -> "cafe", "straße" -> "strasse")
+type ASCIIFoldingFilter struct{}
+
+var foldingSpecialCases = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'đ': "d", 'Đ': "D", 'ł': "l", 'Ł': "L",
+	'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "TH", 'ı': "i",
+}
+
+// Filter implements TokenFilter
+func (ASCIIFoldingFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Term = foldASCII(tokens[i].Term)
+	}
+	return tokens
+}
+
+// foldASCII decomposes a term and drops combining marks
+func foldASCII(term string) string {
+	ascii := true
+	for i := 0; i < len(term); i++ {
+		if term[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return term
+	}
+
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(term) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if folded, ok := foldingSpecialCases[r]; ok {
+			sb.WriteString(folded)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return norm.NFC.String(sb.String())
+}
+
+// StopFilter marks tokens found in a stopword set. Marked stopwords stay in
+// the token stream so they are still indexed and counted in field lengths,
+// letting stopword-only queries match; the engine leaves them out of a
+// query that also contains regular terms. With Remove set they are dropped
+// instead, leaving a gap in positions so phrases still line up.
+type StopFilter struct {
+	Words  map[string]bool
+	Remove bool
+}
+
+// NewStopFilter creates a stop filter from a word list
+func NewStopFilter(words []string) *StopFilter {
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+	return &StopFilter{Words: set}
+}
+
+// Filter implements TokenFilter
+func (f *StopFilter) Filter(tokens []Token) []Token {
+	if f.Remove {
+		kept := tokens[:0]
+		for _, token := range tokens {
+			if !f.Words[token.Term] {
+				kept = append(kept, token)
+			}
+		}
+		return kept
+	}
+
+	for i := range tokens {
+		if f.Words[tokens[i].Term] {
+			tokens[i].Stopword = true
+		}
+	}
+	return tokens
+}
+
+// MinimalEnglishStemFilter removes English plural endings only
+// ("queries" -> "query", "documents" -> "document")
+type MinimalEnglishStemFilter struct{}
+
+// Filter implements TokenFilter
+func (MinimalEnglishStemFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Term = stemPlural(tokens[i].Term)
+	}
+	return tokens
+}
+
+// stemPlural strips a trailing plural "s", "es" or "ies"
+func stemPlural(term string) string {
+	n := len(term)
+	if n < 3 || term[n-1] != 's' {
+		return term
+	}
+
+	switch term[n-2] {
+	case 'u', 's':
+		return term
+	case 'e':
+		if n > 3 && term[n-3] == 'i' && term[n-4] != 'a' && term[n-4] != 'e' {
+			return term[:n-3] + "y"
+		}
+		switch term[n-3] {
+		case 'i', 'a', 'o', 'e':
+			return term
+		}
+	}
+	return term[:n-1]
+}
+
+// SynonymFilter injects synonyms at the same position as the original token
+type SynonymFilter struct {
+	Synonyms map[string][]string
+}
+
+// Filter implements TokenFilter
+func (f SynonymFilter) Filter(tokens []Token) []Token {
+	expanded := make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		expanded = append(expanded, token)
+		for _, synonym := range f.Synonyms[token.Term] {
+			if synonym == token.Term {
+				continue
+			}
+			injected := token
+			injected.Term = synonym
+			expanded = append(expanded, injected)
+		}
+	}
+	return expanded
+}
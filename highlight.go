@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Highlight encoders, applied to the document text of a fragment but not
+// to the tags
+const (
+	// HighlightEncoderHTML escapes the text, so fragments with the default
+	// tags can be rendered as HTML
+	HighlightEncoderHTML = "html"
+	// HighlightEncoderNone leaves the text as it is stored
+	HighlightEncoderNone = "none"
+)
+
+// HighlightOptions configures the fragments returned for each result
+type HighlightOptions struct {
+	// Fields are highlighted in turn; empty means DefaultSearchFields
+	Fields []string
+	// FragmentSize is the length of a fragment in characters. Fields no
+	// longer than that are returned whole.
+	FragmentSize int
+	// Fragments is the most fragments returned per field
+	Fragments int
+	// PreTag and PostTag wrap each match
+	PreTag  string
+	PostTag string
+	// Encoder is HighlightEncoderHTML or HighlightEncoderNone
+	Encoder string
+}
+
+// DefaultHighlightOptions returns default highlight options
+func DefaultHighlightOptions() HighlightOptions {
+	return HighlightOptions{
+		FragmentSize: 150,
+		Fragments:    3,
+		PreTag:       "<em>",
+		PostTag:      "</em>",
+		Encoder:      HighlightEncoderHTML,
+	}
+}
+
+// ParseHighlightEncoder checks the name of a highlight encoder
+func ParseHighlightEncoder(name string) (string, error) {
+	switch name {
+	case HighlightEncoderHTML, HighlightEncoderNone:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown highlight encoder %q, expected %s or %s", name, HighlightEncoderHTML, HighlightEncoderNone)
+}
+
+// highlightQuery holds what to highlight in one field: single terms, and
+// exact phrases highlighted as a whole
+type highlightQuery struct {
+	terms   map[string]bool
+	phrases [][]PhraseTerm
+}
+
+// highlightQueries collects the terms and phrases of the positive clauses
+// of a query by field. Terms of sloppy phrases are highlighted one by one.
+func highlightQueries(q Query, fields map[string]*highlightQuery) {
+	field := func(name string) *highlightQuery {
+		hq, ok := fields[name]
+		if !ok {
+			hq = &highlightQuery{terms: make(map[string]bool)}
+			fields[name] = hq
+		}
+		return hq
+	}
+
+	switch q := q.(type) {
+	case *TermQuery:
+		field(q.Field).terms[q.Term] = true
+	case *PhraseQuery:
+		hq := field(q.Field)
+		if q.Slop > 0 {
+			for _, term := range q.Terms {
+				hq.terms[term.Term] = true
+			}
+		} else {
+			hq.phrases = append(hq.phrases, q.Terms)
+		}
+	case *BooleanQuery:
+		for _, clauses := range [][]Query{q.Must, q.Should} {
+			for _, clause := range clauses {
+				highlightQueries(clause, fields)
+			}
+		}
+	case *MultiFieldQuery:
+		for _, clause := range q.Clauses {
+			highlightQueries(clause, fields)
+		}
+	}
+}
+
+// highlightSpan is a match in a field's text, by byte offsets. Spans of the
+// same term or phrase share a key.
+type highlightSpan struct {
+	start, end int
+	key        string
+}
+
+// highlight returns the best fragments of each field of a document with
+// the query's matches tagged, leaving out fields without matches
+func (e *SearchEngine) highlight(doc *Document, queries map[string]*highlightQuery, options *HighlightOptions) map[string][]string {
+	fields := options.Fields
+	if len(fields) == 0 {
+		fields = DefaultSearchFields
+	}
+	values := doc.FieldValues()
+
+	highlights := make(map[string][]string)
+	for _, field := range fields {
+		hq, ok := queries[field]
+		text := values[field]
+		if !ok || text == "" {
+			continue
+		}
+
+		spans := matchSpans(text, e.fieldTokens(field, text), hq)
+		if fragments := bestFragments(text, spans, options); len(fragments) > 0 {
+			highlights[field] = fragments
+		}
+	}
+	return highlights
+}
+
+// matchSpans returns the spans of the tokens matching a field's terms and
+// phrases, sorted and with overlapping spans merged. Tokens whose offsets
+// do not fall on character boundaries of the text are skipped.
+func matchSpans(text string, tokens []Token, hq *highlightQuery) []highlightSpan {
+	valid := func(token Token) bool {
+		return token.Start >= 0 && token.Start < token.End && token.End <= len(text) &&
+			utf8.RuneStart(text[token.Start]) && (token.End == len(text) || utf8.RuneStart(text[token.End]))
+	}
+
+	var spans []highlightSpan
+	byPosition := make(map[int][]Token)
+	for _, token := range tokens {
+		if !valid(token) {
+			continue
+		}
+		byPosition[token.Position] = append(byPosition[token.Position], token)
+		if hq.terms[token.Term] {
+			spans = append(spans, highlightSpan{start: token.Start, end: token.End, key: token.Term})
+		}
+	}
+
+	for _, phrase := range hq.phrases {
+		if len(phrase) == 0 {
+			continue
+		}
+		key := phraseKey(phrase)
+		for _, first := range tokens {
+			if first.Term != phrase[0].Term || !valid(first) {
+				continue
+			}
+			span := highlightSpan{start: first.Start, end: first.End, key: key}
+			matched := true
+			for _, term := range phrase[1:] {
+				token, ok := tokenAt(byPosition[first.Position+term.Offset-phrase[0].Offset], term.Term)
+				if !ok {
+					matched = false
+					break
+				}
+				if token.Start < span.start {
+					span.start = token.Start
+				}
+				if token.End > span.end {
+					span.end = token.End
+				}
+			}
+			if matched {
+				spans = append(spans, span)
+			}
+		}
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start || (spans[i].start == spans[j].start && spans[i].end > spans[j].end)
+	})
+	merged := spans[:0]
+	for _, span := range spans {
+		if n := len(merged); n > 0 && span.start < merged[n-1].end {
+			if span.end > merged[n-1].end {
+				merged[n-1].end = span.end
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// tokenAt returns the token with a term among the tokens at one position
+func tokenAt(tokens []Token, term string) (Token, bool) {
+	for _, token := range tokens {
+		if token.Term == term {
+			return token, true
+		}
+	}
+	return Token{}, false
+}
+
+// phraseKey identifies a phrase among the spans of a field
+func phraseKey(phrase []PhraseTerm) string {
+	terms := make([]string, len(phrase))
+	for i, term := range phrase {
+		terms[i] = term.Term
+	}
+	return `"` + strings.Join(terms, " ") + `"`
+}
+
+// fragment is a window of a field's text, by byte offsets, scored by the
+// distinct terms and phrases it contains, then by its number of matches
+type fragment struct {
+	start, end int
+	distinct   int
+	matches    int
+}
+
+// bestFragments picks the fragments of a text holding the most distinct
+// matches, best first, and tags the matches in them. A text no longer
+// than the fragment size is a single fragment.
+func bestFragments(text string, spans []highlightSpan, options *HighlightOptions) []string {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	// offsets[i] is the byte offset of character i
+	offsets := make([]int, 0, len(text)+1)
+	for i := range text {
+		offsets = append(offsets, i)
+	}
+	chars := len(offsets)
+	offsets = append(offsets, len(text))
+
+	if chars <= options.FragmentSize {
+		return []string{tagFragment(text, spans, fragment{start: 0, end: len(text)}, options)}
+	}
+
+	// One candidate per match, starting a little before it
+	charAt := func(offset int) int {
+		return sort.SearchInts(offsets, offset)
+	}
+	var candidates []fragment
+	for _, span := range spans {
+		first, last := charAt(span.start), charAt(span.end)
+		start := first - options.FragmentSize/4
+		if start < 0 {
+			start = 0
+		}
+		end := start + options.FragmentSize
+		if end > chars {
+			end, start = chars, chars-options.FragmentSize
+		}
+		if end < last {
+			end = last
+		}
+		start, end = snapToWords(text, offsets, start, end, first, last)
+
+		f := fragment{start: offsets[start], end: offsets[end]}
+		keys := make(map[string]bool)
+		for _, s := range spans {
+			if s.start >= f.start && s.end <= f.end {
+				keys[s.key] = true
+				f.matches++
+			}
+		}
+		f.distinct = len(keys)
+		candidates = append(candidates, f)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		return a.distinct > b.distinct || (a.distinct == b.distinct && a.matches > b.matches)
+	})
+
+	var chosen []fragment
+	for _, candidate := range candidates {
+		if len(chosen) == options.Fragments {
+			break
+		}
+		overlaps := false
+		for _, f := range chosen {
+			if candidate.start < f.end && f.start < candidate.end {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			chosen = append(chosen, candidate)
+		}
+	}
+
+	fragments := make([]string, len(chosen))
+	for i, f := range chosen {
+		fragments[i] = tagFragment(text, spans, f, options)
+	}
+	return fragments
+}
+
+// snapToWords moves the ends of a window, in characters, to word
+// boundaries when one is near, keeping the characters first to last inside
+func snapToWords(text string, offsets []int, start, end, first, last int) (int, int) {
+	near := (end - start) / 5
+	isSpace := func(i int) bool {
+		r, _ := utf8.DecodeRuneInString(text[offsets[i]:])
+		return unicode.IsSpace(r)
+	}
+
+	if start > 0 && !isSpace(start-1) {
+		for i := start; i < start+near && i < first; i++ {
+			if isSpace(i) {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if end < len(offsets)-1 && !isSpace(end) {
+		for i := end - 1; i > end-near && i >= last; i-- {
+			if isSpace(i) {
+				end = i
+				break
+			}
+		}
+	}
+	return start, end
+}
+
+// tagFragment returns the text of a fragment, encoded, with the spans
+// inside it wrapped in the highlight tags
+func tagFragment(text string, spans []highlightSpan, f fragment, options *HighlightOptions) string {
+	encode := func(s string) string { return s }
+	if options.Encoder == HighlightEncoderHTML {
+		encode = html.EscapeString
+	}
+
+	var sb strings.Builder
+	at := f.start
+	for _, span := range spans {
+		if span.start < f.start || span.end > f.end {
+			continue
+		}
+		sb.WriteString(encode(text[at:span.start]))
+		sb.WriteString(options.PreTag)
+		sb.WriteString(encode(text[span.start:span.end]))
+		sb.WriteString(options.PostTag)
+		at = span.end
+	}
+	sb.WriteString(encode(text[at:f.end]))
+	return strings.TrimSpace(sb.String())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// highlightDocument returns the highlights of the first result of a search
+func highlightDocument(t *testing.T, engine *SearchEngine, query string, options HighlightOptions) map[string][]string {
+	t.Helper()
+	result, err := engine.Search(query, SearchOptions{Mode: SearchModeOR, UseRanking: true, Limit: 1, Highlight: &options})
+	if err != nil {
+		t.Fatalf("Search(%q): %v", query, err)
+	}
+	if len(result.Highlights) != 1 {
+		t.Fatalf("Search(%q) returned %d highlights, want 1", query, len(result.Highlights))
+	}
+	return result.Highlights[0]
+}
+
+func TestHighlight(t *testing.T) {
+	html := DefaultHighlightOptions()
+	none := DefaultHighlightOptions()
+	none.Encoder = HighlightEncoderNone
+	tags := DefaultHighlightOptions()
+	tags.PreTag, tags.PostTag = `<mark class="hit">`, "</mark>"
+	content := DefaultHighlightOptions()
+	content.Fields = []string{FieldContent}
+
+	tests := []struct {
+		name     string
+		analyzer string
+		doc      *Document
+		query    string
+		options  HighlightOptions
+		want     map[string][]string
+	}{
+		{"terms", "", NewDocument("1", "Rust Guide", "learn rust and go today"), "rust go", html, map[string][]string{
+			FieldTitle:   {"<em>Rust</em> Guide"},
+			FieldContent: {"learn <em>rust</em> and <em>go</em> today"},
+		}},
+		{"fields", "", NewDocument("1", "Rust Guide", "learn rust"), "rust", content, map[string][]string{
+			FieldContent: {"learn <em>rust</em>"},
+		}},
+		{"field prefix", "", NewDocument("1", "Rust Guide", "learn rust"), "title:rust", html, map[string][]string{
+			FieldTitle: {"<em>Rust</em> Guide"},
+		}},
+		// The text is escaped, the tags are not
+		{"html", "", NewDocument("1", "", `a <b>rust</b> & "go"`), "rust", html, map[string][]string{
+			FieldContent: {"a &lt;b&gt;<em>rust</em>&lt;/b&gt; &amp; &#34;go&#34;"},
+		}},
+		{"no encoder", "", NewDocument("1", "", `a <b>rust</b> & "go"`), "rust", none, map[string][]string{
+			FieldContent: {`a <b><em>rust</em></b> & "go"`},
+		}},
+		{"custom tags", "", NewDocument("1", "", "rust & go"), "rust", tags, map[string][]string{
+			FieldContent: {`<mark class="hit">rust</mark> &amp; go`},
+		}},
+		// Exact phrases are tagged as a whole, sloppy ones term by term
+		{"phrase", "", NewDocument("1", "", "open source and open code"), `"open source"`, html, map[string][]string{
+			FieldContent: {"<em>open source</em> and open code"},
+		}},
+		{"sloppy phrase", "", NewDocument("1", "", "open source and open code"), `"open code"~2`, html, map[string][]string{
+			FieldContent: {"<em>open</em> source and <em>open</em> <em>code</em>"},
+		}},
+		// Matches follow the analyzer
+		{"stemmed", "english", NewDocument("1", "", "running runs ran"), "run", html, map[string][]string{
+			FieldContent: {"<em>running</em> <em>runs</em> ran"},
+		}},
+		{"cjk", "", NewDocument("1", "", "全文检索的关键技术"), "关键", html, map[string][]string{
+			FieldContent: {"全文检索的<em>关键</em>技术"},
+		}},
+	}
+	for _, tt := range tests {
+		engine, err := NewSearchEngine(filepath.Join(t.TempDir(), "index.db"), EngineOptions{Analyzer: tt.analyzer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDocuments(t, engine, tt.doc)
+		if got := highlightDocument(t, engine, tt.query, tt.options); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: highlights %q, want %q", tt.name, got, tt.want)
+		}
+		engine.Close()
+	}
+}
+
+func TestHighlightFragments(t *testing.T) {
+	filler := strings.Repeat("filler ", 10)
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "", "rust "+filler+"rust and go "+filler+"end"),
+		NewDocument("2", "", strings.Repeat("全文检索", 20)+"关键技术"+strings.Repeat("倒排索引", 20)),
+	)
+
+	options := DefaultHighlightOptions()
+	options.FragmentSize = 20
+	for fragments := 1; fragments <= 3; fragments++ {
+		options.Fragments = fragments
+		got := highlightDocument(t, engine, "rust go", options)[FieldContent]
+
+		// The fragment with the most distinct terms comes first, and
+		// fragments do not repeat matches
+		want := 2
+		if fragments == 1 {
+			want = 1
+		}
+		if len(got) != want || !strings.Contains(got[0], "<em>rust</em> and <em>go</em>") {
+			t.Errorf("%d fragments: %q, want %d with rust and go first", fragments, got, want)
+		}
+		checkFragmentSize(t, got, options.FragmentSize)
+	}
+
+	// Fragments of CJK text do not cut characters
+	options.Fragments = 3
+	got := highlightDocument(t, engine, "关键技术", options)[FieldContent]
+	if len(got) != 1 || !strings.Contains(got[0], "<em>关键技术</em>") || !utf8.ValidString(got[0]) {
+		t.Errorf("CJK fragments: %q, want one valid fragment with 关键技术", got)
+	}
+	checkFragmentSize(t, got, options.FragmentSize)
+}
+
+// checkFragmentSize checks that fragments without their tags are no longer
+// than the fragment size
+func checkFragmentSize(t *testing.T, fragments []string, size int) {
+	t.Helper()
+	for _, fragment := range fragments {
+		text := strings.NewReplacer("<em>", "", "</em>", "").Replace(fragment)
+		if n := utf8.RuneCountInString(text); n > size {
+			t.Errorf("fragment %q has %d characters, want at most %d", fragment, n, size)
+		}
+	}
+}
+
+func TestHighlightParameters(t *testing.T) {
+	api, engine := newTestAPI(t)
+	addDocuments(t, engine, NewDocument("1", "Rust", `<b>rust</b> & go`))
+
+	tests := []struct {
+		path   string
+		status int
+		want   map[string][]string
+	}{
+		{"/search?query=rust&highlight=true", 200, map[string][]string{
+			FieldTitle:   {"<em>Rust</em>"},
+			FieldContent: {"&lt;b&gt;<em>rust</em>&lt;/b&gt; &amp; go"},
+		}},
+		{"/search?query=rust&highlight=true&encoder=none&pre_tag=[&post_tag=]", 200, map[string][]string{
+			FieldTitle:   {"[Rust]"},
+			FieldContent: {"<b>[rust]</b> & go"},
+		}},
+		{"/search?query=rust&highlight=true&highlight_fields=title", 200, map[string][]string{
+			FieldTitle: {"<em>Rust</em>"},
+		}},
+		// Highlights are only returned when asked for
+		{"/search?query=rust", 200, nil},
+		{"/search?query=rust&highlight=true&encoder=xml", 400, nil},
+		{"/search?query=rust&highlight=true&highlight_fields=body", 400, nil},
+	}
+	for _, tt := range tests {
+		status, body := getJSON(t, api, tt.path)
+		var response struct {
+			Data struct {
+				Highlights []map[string][]string `json:"highlights"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatalf("GET %s: %v: %s", tt.path, err, body)
+		}
+		var got map[string][]string
+		if len(response.Data.Highlights) > 0 {
+			got = response.Data.Highlights[0]
+		}
+		if status != tt.status || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GET %s = %d with highlights %q, want %d with %q", tt.path, status, got, tt.status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Formats the import command reads
+const (
+	ImportJSONL = "jsonl"
+	ImportCSV   = "csv"
+	ImportDir   = "dir"
+)
+
+// importFileExtensions are the files read from a directory
+var importFileExtensions = map[string]bool{
+	".txt":      true,
+	".md":       true,
+	".markdown": true,
+	".html":     true,
+	".htm":      true,
+}
+
+// CSVColumns maps CSV columns onto document fields
+type CSVColumns struct {
+	ID      string
+	Title   string
+	Content string
+	URL     string
+	// Metadata lists the columns kept as metadata; empty means every
+	// column not mapped to a field
+	Metadata []string
+}
+
+// ImportOptions configures an import
+type ImportOptions struct {
+	Format    string // ImportJSONL, ImportCSV or ImportDir; detected from the path if empty
+	BatchSize int    // Records saved per transaction
+	Columns   CSVColumns
+	// Resume skips the records saved by a previous import of the same path
+	Resume bool
+	// Progress is called after each batch is saved
+	Progress func(ImportProgress)
+	// RecordError is called for each record that could not be imported
+	RecordError func(ImportRecordError)
+}
+
+// DefaultImportOptions returns default import options
+func DefaultImportOptions() ImportOptions {
+	return ImportOptions{
+		BatchSize: 500,
+		Columns: CSVColumns{
+			ID:      "id",
+			Title:   FieldTitle,
+			Content: FieldContent,
+			URL:     FieldURL,
+		},
+	}
+}
+
+// ImportProgress counts the records of an import
+type ImportProgress struct {
+	Records  int // Records read, including skipped and failed ones
+	Skipped  int // Records skipped because a previous import saved them
+	Imported int
+	Failed   int
+}
+
+// ImportRecordError is a record that could not be imported
+type ImportRecordError struct {
+	Location string // Line, row or file of the record
+	Err      error
+}
+
+// importRecord is a document read from an import source, or why it could
+// not be read
+type importRecord struct {
+	doc      *Document
+	location string
+	err      error
+}
+
+// recordReader reads the records of an import source in a stable order.
+// next returns false once there are no more records, and an error if the
+// source cannot be read any further.
+type recordReader interface {
+	next() (importRecord, bool, error)
+}
+
+// importCheckpoint records how far an import of a path got
+type importCheckpoint struct {
+	Records int `json:"records"` // Records read up to the last saved batch
+}
+
+// Import reads documents from a JSONL file, a CSV file or a directory of
+// text, Markdown and HTML files and saves them in batches. Records that
+// cannot be read or saved are reported and skipped. After each batch a
+// checkpoint is saved, so an interrupted import can be resumed; batches are
+// upserts, so one saved again after a crash is harmless.
+func (e *SearchEngine) Import(path string, options ImportOptions) (ImportProgress, error) {
+	var progress ImportProgress
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return progress, fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	format := options.Format
+	if format == "" {
+		if format, err = detectImportFormat(absPath); err != nil {
+			return progress, err
+		}
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultImportOptions().BatchSize
+	}
+
+	reader, closeReader, err := openRecordReader(absPath, format, options.Columns)
+	if err != nil {
+		return progress, err
+	}
+	defer closeReader()
+
+	checkpointKey := importMetaKeyPrefix + absPath
+	skip := 0
+	if options.Resume {
+		checkpoint, err := e.loadImportCheckpoint(checkpointKey)
+		if err != nil {
+			return progress, err
+		}
+		skip = checkpoint.Records
+	}
+
+	reportError := func(location string, err error) {
+		progress.Failed++
+		if options.RecordError != nil {
+			options.RecordError(ImportRecordError{Location: location, Err: err})
+		}
+	}
+
+	var batch []*Document
+	var locations []string
+	saveBatch := func() error {
+		if len(batch) > 0 {
+			results, err := e.UpsertBatch(batch)
+			if err != nil {
+				return err
+			}
+			for i, result := range results {
+				if result.Err != nil {
+					reportError(locations[i], result.Err)
+				} else {
+					progress.Imported++
+				}
+			}
+		}
+
+		if err := e.saveImportCheckpoint(checkpointKey, importCheckpoint{Records: progress.Records}); err != nil {
+			return err
+		}
+		batch, locations = batch[:0], locations[:0]
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+		return nil
+	}
+
+	pending := 0 // Records read since the last save
+	for {
+		record, ok, err := reader.next()
+		if err != nil {
+			return progress, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if !ok {
+			break
+		}
+
+		progress.Records++
+		switch {
+		case progress.Records <= skip:
+			progress.Skipped++
+			continue
+		case record.err != nil:
+			reportError(record.location, record.err)
+		default:
+			batch = append(batch, record.doc)
+			locations = append(locations, record.location)
+		}
+
+		pending++
+		if pending >= options.BatchSize {
+			if err := saveBatch(); err != nil {
+				return progress, err
+			}
+			pending = 0
+		}
+	}
+
+	if err := saveBatch(); err != nil {
+		return progress, err
+	}
+	// A finished import starts over next time
+	if err := e.storage.DeleteMetadata(checkpointKey); err != nil {
+		return progress, fmt.Errorf("failed to clear import checkpoint: %w", err)
+	}
+	return progress, nil
+}
+
+// importMetaKeyPrefix prefixes the metadata key of an import checkpoint,
+// followed by the absolute path imported
+const importMetaKeyPrefix = "import:"
+
+func (e *SearchEngine) loadImportCheckpoint(key string) (importCheckpoint, error) {
+	var checkpoint importCheckpoint
+	value, err := e.storage.GetMetadata(key)
+	if err != nil || value == "" {
+		return checkpoint, err
+	}
+	if err := json.Unmarshal([]byte(value), &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("failed to read import checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+func (e *SearchEngine) saveImportCheckpoint(key string, checkpoint importCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := e.storage.SaveMetadata(key, string(data)); err != nil {
+		return fmt.Errorf("failed to save import checkpoint: %w", err)
+	}
+	return nil
+}
+
+// detectImportFormat picks the format of a path from its type and extension
+func detectImportFormat(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return ImportDir, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson", ".json":
+		return ImportJSONL, nil
+	case ".csv":
+		return ImportCSV, nil
+	}
+	return "", fmt.Errorf("cannot tell the format of %s, use --format", path)
+}
+
+// openRecordReader opens a reader for an import source
+func openRecordReader(path, format string, columns CSVColumns) (recordReader, func(), error) {
+	if format == ImportDir {
+		reader, err := newDirReader(path)
+		return reader, func() {}, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeFile := func() { file.Close() }
+
+	switch format {
+	case ImportJSONL:
+		return newJSONLReader(file), closeFile, nil
+	case ImportCSV:
+		reader, err := newCSVReader(file, columns)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return reader, closeFile, nil
+	}
+
+	file.Close()
+	return nil, nil, fmt.Errorf("unknown import format %q (want %s, %s or %s)", format, ImportJSONL, ImportCSV, ImportDir)
+}
+
+// jsonlReader reads a JSON object per line. The ID is taken from "id" or
+// "_id"; the other fields map onto the document as in the bulk API.
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBulkLineSize)
+	return &jsonlReader{scanner: scanner}
+}
+
+func (r *jsonlReader) next() (importRecord, bool, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		record := importRecord{location: fmt.Sprintf("line %d", r.line)}
+		record.doc, record.err = jsonlDocument(line)
+		return record, true, nil
+	}
+	return importRecord{}, false, r.scanner.Err()
+}
+
+// jsonlDocument decodes a document from a JSON object
+func jsonlDocument(line []byte) (*Document, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+
+	raw, ok := fields["id"]
+	if !ok {
+		raw = fields["_id"]
+	}
+	var id string
+	if json.Unmarshal(raw, &id) != nil {
+		// Numeric IDs are kept as written
+		var number json.Number
+		if json.Unmarshal(raw, &number) == nil {
+			id = number.String()
+		}
+	}
+	if err := validateDocumentID(id); err != nil {
+		return nil, err
+	}
+
+	doc := NewDocument(id, "", "")
+	if err := applySource(doc, fields); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// csvReader reads a document per row of a CSV file with a header row
+type csvReader struct {
+	reader   *csv.Reader
+	columns  map[string]int // Column name -> index
+	mapping  CSVColumns
+	metadata []string
+	row      int
+}
+
+func newCSVReader(r io.Reader, mapping CSVColumns) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{mapping.ID, mapping.Content} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header has no %q column", required)
+		}
+	}
+
+	metadata := mapping.Metadata
+	if len(metadata) == 0 {
+		for _, name := range header {
+			name = strings.TrimSpace(name)
+			switch name {
+			case mapping.ID, mapping.Title, mapping.Content, mapping.URL:
+			default:
+				metadata = append(metadata, name)
+			}
+		}
+	}
+	for _, name := range metadata {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header has no %q column", name)
+		}
+	}
+
+	return &csvReader{reader: reader, columns: columns, mapping: mapping, metadata: metadata, row: 1}, nil
+}
+
+func (r *csvReader) next() (importRecord, bool, error) {
+	row, err := r.reader.Read()
+	if err == io.EOF {
+		return importRecord{}, false, nil
+	}
+	r.row++
+	record := importRecord{location: fmt.Sprintf("row %d", r.row)}
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		record.location = fmt.Sprintf("line %d", parseErr.StartLine)
+		record.err = parseErr.Err
+		return record, true, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+
+	value := func(column string) string {
+		if i, ok := r.columns[column]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	id := strings.TrimSpace(value(r.mapping.ID))
+	if record.err = validateDocumentID(id); record.err != nil {
+		return record, true, nil
+	}
+	record.doc = NewDocument(id, value(r.mapping.Title), value(r.mapping.Content))
+	record.doc.URL = value(r.mapping.URL)
+	for _, column := range r.metadata {
+		if v := value(column); v != "" {
+			record.doc.Metadata[column] = v
+		}
+	}
+	return record, true, nil
+}
+
+// dirReader reads a document per text, Markdown or HTML file under a
+// directory, in lexical order. A file's ID is its path relative to the
+// directory.
+type dirReader struct {
+	root  string
+	files []string
+}
+
+func newDirReader(root string) (*dirReader, error) {
+	reader := &dirReader{root: root}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && importFileExtensions[strings.ToLower(filepath.Ext(path))] {
+			reader.files = append(reader.files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+	return reader, nil
+}
+
+func (r *dirReader) next() (importRecord, bool, error) {
+	if len(r.files) == 0 {
+		return importRecord{}, false, nil
+	}
+	path := r.files[0]
+	r.files = r.files[1:]
+
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		rel = path
+	}
+	rel = filepath.ToSlash(rel)
+	record := importRecord{location: rel}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		record.err = err
+		return record, true, nil
+	}
+
+	text := string(data)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		if heading := markdownTitle(text); heading != "" {
+			title = heading
+		}
+	case ".html", ".htm":
+		if match := htmlTitlePattern.FindStringSubmatch(text); match != nil {
+			if heading := strings.TrimSpace(html.UnescapeString(match[1])); heading != "" {
+				title = heading
+			}
+		}
+		text = htmlText(text)
+	}
+
+	record.doc = NewDocument(rel, title, text)
+	return record, true, nil
+}
+
+// markdownTitle returns the text of the first top-level heading
+func markdownTitle(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			return strings.TrimSpace(line[2:])
+		}
+	}
+	return ""
+}
+
+var htmlTitlePattern = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+
+// htmlText returns the visible text of an HTML page: the text after the
+// head, stripped as the html analyzer strips it
+func htmlText(page string) string {
+	page = page[htmlBodyStart(page):]
+	return strings.Join(strings.Fields(HTMLStripCharFilter{}.Filter(page)), " ")
+}
+
+// htmlBodyStart returns the offset just past the opening body tag or the
+// closing head tag of a page, or 0 if it has neither. Tags inside comments
+// and script and style elements are skipped.
+func htmlBodyStart(page string) int {
+	for i := 0; ; {
+		start := strings.IndexByte(page[i:], '<')
+		if start < 0 {
+			return 0
+		}
+		i += start
+
+		if strings.HasPrefix(page[i:], "<!--") {
+			end := strings.Index(page[i+4:], "-->")
+			if end < 0 {
+				return 0
+			}
+			i += end + 7
+			continue
+		}
+
+		end := strings.IndexByte(page[i:], '>')
+		if end < 0 {
+			return 0
+		}
+		end += i + 1
+		switch name, closing := htmlTagName(page[i:end]); {
+		case name == "body" && !closing, name == "head" && closing:
+			return end
+		case htmlHiddenElements[name] && !closing:
+			end = htmlElementEnd(page, end, name)
+		}
+		i = end
+	}
+}
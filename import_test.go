@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles creates files under a directory, with parent directories
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// importFile imports a path with a small batch size and returns the
+// progress and the locations of the records that failed
+func importFile(t *testing.T, engine *SearchEngine, path string, options ImportOptions) (ImportProgress, []string) {
+	t.Helper()
+	var failed []string
+	options.BatchSize = 2
+	options.RecordError = func(e ImportRecordError) {
+		failed = append(failed, e.Location)
+	}
+	progress, err := engine.Import(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return progress, failed
+}
+
+// checkDocument checks the title, content and metadata of a saved document
+func checkDocument(t *testing.T, engine *SearchEngine, want *Document) {
+	t.Helper()
+	doc, err := engine.GetDocument(want.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc == nil {
+		t.Fatalf("document %q not imported", want.ID)
+	}
+	sameMetadata := reflect.DeepEqual(doc.Metadata, want.Metadata) || (len(doc.Metadata) == 0 && len(want.Metadata) == 0)
+	if doc.Title != want.Title || doc.Content != want.Content || doc.URL != want.URL || !sameMetadata {
+		t.Errorf("document %q = %+v, want %+v", want.ID, doc, want)
+	}
+}
+
+func TestImportJSONL(t *testing.T) {
+	engine := newTestEngine(t)
+	path := filepath.Join(t.TempDir(), "docs.jsonl")
+	writeFiles(t, filepath.Dir(path), map[string]string{"docs.jsonl": `{"id":"a","title":"Go","content":"Gophers","lang":"en"}
+{"_id":42,"content":"Numeric ID","stars":5}
+
+not json
+{"title":"No ID"}
+{"id":"b","url":"https://example.com","metadata":{"lang":"fr"}}
+`})
+
+	progress, failed := importFile(t, engine, path, DefaultImportOptions())
+	if want := (ImportProgress{Records: 5, Imported: 3, Failed: 2}); progress != want {
+		t.Errorf("progress = %+v, want %+v", progress, want)
+	}
+	if want := []string{"line 4", "line 5"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed records = %v, want %v", failed, want)
+	}
+
+	checkDocument(t, engine, &Document{ID: "a", Title: "Go", Content: "Gophers", Metadata: map[string]string{"lang": "en"}})
+	checkDocument(t, engine, &Document{ID: "42", Content: "Numeric ID", Metadata: map[string]string{"stars": "5"}})
+	checkDocument(t, engine, &Document{ID: "b", URL: "https://example.com", Metadata: map[string]string{"lang": "fr"}})
+}
+
+func TestImportCSV(t *testing.T) {
+	engine := newTestEngine(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"docs.csv": `id,title,content,lang,year
+a,Go,"Gophers, everywhere",en,2009
+,Missing,No ID,en,
+b,Rust,Crabs,,2015
+`})
+
+	progress, failed := importFile(t, engine, filepath.Join(dir, "docs.csv"), DefaultImportOptions())
+	if want := (ImportProgress{Records: 3, Imported: 2, Failed: 1}); progress != want {
+		t.Errorf("progress = %+v, want %+v", progress, want)
+	}
+	if want := []string{"row 3"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed records = %v, want %v", failed, want)
+	}
+	checkDocument(t, engine, &Document{ID: "a", Title: "Go", Content: "Gophers, everywhere", Metadata: map[string]string{"lang": "en", "year": "2009"}})
+	checkDocument(t, engine, &Document{ID: "b", Title: "Rust", Content: "Crabs", Metadata: map[string]string{"year": "2015"}})
+
+	// Only the listed columns are kept as metadata
+	options := DefaultImportOptions()
+	options.Columns.Metadata = []string{"lang"}
+	importFile(t, engine, filepath.Join(dir, "docs.csv"), options)
+	checkDocument(t, engine, &Document{ID: "a", Title: "Go", Content: "Gophers, everywhere", Metadata: map[string]string{"lang": "en"}})
+
+	options.Columns.Content = "body"
+	if _, err := engine.Import(filepath.Join(dir, "docs.csv"), options); err == nil {
+		t.Error("import with a missing content column succeeded")
+	}
+}
+
+func TestImportDir(t *testing.T) {
+	engine := newTestEngine(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"notes.txt":       "Plain text",
+		"guide.md":        "Intro\n# Getting Started\nSteps",
+		"site/page.html":  `<html><head><title>Tom &amp; Jerry</title></head><body><p>Cat <b>and</b> mouse</p></body></html>`,
+		"site/image.png":  "not text",
+		"site/empty.html": "<p>No title</p>",
+	})
+
+	progress, failed := importFile(t, engine, dir, DefaultImportOptions())
+	if want := (ImportProgress{Records: 4, Imported: 4}); progress != want || len(failed) > 0 {
+		t.Errorf("progress = %+v, failed %v, want %+v", progress, failed, want)
+	}
+	checkDocument(t, engine, &Document{ID: "notes.txt", Title: "notes", Content: "Plain text"})
+	checkDocument(t, engine, &Document{ID: "guide.md", Title: "Getting Started", Content: "Intro\n# Getting Started\nSteps"})
+	checkDocument(t, engine, &Document{ID: "site/page.html", Title: "Tom & Jerry", Content: "Cat and mouse"})
+	checkDocument(t, engine, &Document{ID: "site/empty.html", Title: "empty", Content: "No title"})
+	if doc, _ := engine.GetDocument("site/image.png"); doc != nil {
+		t.Error("file with an unknown extension imported")
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	engine := newTestEngine(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"docs.jsonl": `{"id":"a"}
+{"id":"b"}
+{"id":"c"}
+`})
+	path := filepath.Join(dir, "docs.jsonl")
+
+	// A previous import saved the first two records before stopping
+	if err := engine.saveImportCheckpoint(importMetaKeyPrefix+path, importCheckpoint{Records: 2}); err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultImportOptions()
+	options.Resume = true
+	progress, _ := importFile(t, engine, path, options)
+	if want := (ImportProgress{Records: 3, Skipped: 2, Imported: 1}); progress != want {
+		t.Errorf("progress = %+v, want %+v", progress, want)
+	}
+	if doc, _ := engine.GetDocument("a"); doc != nil {
+		t.Error("skipped record imported")
+	}
+
+	// A finished import leaves no checkpoint behind
+	checkpoint, err := engine.loadImportCheckpoint(importMetaKeyPrefix + path)
+	if err != nil || checkpoint.Records != 0 {
+		t.Errorf("checkpoint = %+v, %v after a finished import", checkpoint, err)
+	}
+}
+
+func TestDetectImportFormat(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.ndjson": "", "b.CSV": "", "c.xml": ""})
+
+	tests := map[string]string{dir: ImportDir, "a.ndjson": ImportJSONL, "b.CSV": ImportCSV, "c.xml": ""}
+	for name, want := range tests {
+		path := name
+		if name != dir {
+			path = filepath.Join(dir, name)
+		}
+		format, err := detectImportFormat(path)
+		if format != want || (want == "") != (err != nil) {
+			t.Errorf("detectImportFormat(%s) = %q, %v, want %q", name, format, err, want)
+		}
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		page, want string
+	}{
+		{
+			page: `<!DOCTYPE html>
+<html><head><title>Site</title>
+<style>body { color: red }</style>
+<script>var tag = "<body>"; if (a < b) {}</script>
+</head>
+<body class="main"><!-- <p>hidden</p> -->
+<h1>Site</h1>
+<p>Important &amp; <b>body</b> text</p>
+<script type="text/javascript">alert("</p>")</script>
+</body></html>`,
+			want: "Site Important & body text",
+		},
+		{page: "<p>Hello <b>world</b>&nbsp;again</p>", want: "Hello world again"},
+		{page: "<head><title>No body tag</title></head>Just text", want: "Just text"},
+		{page: "<head><!-- <body> --><title>Commented</title></head>Visible", want: "Visible"},
+	}
+	for _, tt := range tests {
+		if got := htmlText(tt.page); got != tt.want {
+			t.Errorf("htmlText(%q) = %q, want %q", tt.page, got, tt.want)
+		}
+	}
+}
+
+func TestMarkdownTitle(t *testing.T) {
+	tests := map[string]string{
+		"# Title\ntext":           "Title",
+		"intro\n## Sub\n# Main  ": "Main",
+		"#NoSpace\ntext":          "",
+	}
+	for text, want := range tests {
+		if got := markdownTitle(text); got != want {
+			t.Errorf("markdownTitle(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
@@ -1,51 +1,184 @@
 package main
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
+
+// FieldTerm is a term within a specific field
+type FieldTerm struct {
+	Field string `json:"field"`
+	Term  string `json:"term"`
+}
+
+// PhraseTerm is a term at a fixed offset from the start of a phrase
+type PhraseTerm struct {
+	Term   string
+	Offset int
+}
 
-// Index is an improved inverted index with CRUD support
+// TermBound bounds the per-document statistics of a term in a field: no
+// document has more occurrences than MaxFreq or a shorter field than
+// MinLength. It is tightened as documents are added and left as is when
+// they are removed, so it stays a valid (if looser) bound.
+type TermBound struct {
+	MaxFreq   int `json:"max_freq"`
+	MinLength int `json:"min_length"`
+}
+
+// A term's documents are also kept as a bitmap once it occurs in at least
+// 1/denseTermRatio of the documents and in at least minDenseTermDocs, so
+// boolean operations on common terms are word operations instead of list
+// merges. The bitmap is dropped when the term falls to half that density.
+const (
+	denseTermRatio   = 16
+	minDenseTermDocs = postingsBlockSize
+)
+
+// Index is an improved inverted index with CRUD support. Documents are
+// numbered densely in the order they are added, and postings are kept as
+// compressed lists sorted by number. Numbers are not reused, so new
+// documents append to the end of their posting lists; removed documents
+// leave gaps in docIDs, the forward index and the live bitmap until the
+// index is rebuilt (see SearchEngine.Compact). A forward index records the
+// terms of each document by term number, so removing one only touches its
+// own posting lists.
 type Index struct {
-	mu        sync.RWMutex
-	index     map[string][]string // token -> []docID
-	docCount  int
+	mu      sync.RWMutex
+	index   map[string]map[string]*PostingList // field -> token -> postings
+	sets    map[string]map[string]*Bitmap      // field -> token -> documents, dense terms only
+	bounds  map[string]map[string]TermBound    // field -> token -> bound
+	docNums map[string]uint32                  // document ID -> number
+	docIDs  []string                           // number -> document ID, "" once removed
+	live    *Bitmap                            // numbers of the indexed documents
+
+	// Terms are numbered in the order they are first indexed. Numbers are
+	// kept when a term loses its last posting, until the index is rebuilt.
+	termNums map[FieldTerm]uint32 // field term -> number
+	terms    []FieldTerm          // number -> field term
+	forward  [][]uint32           // document number -> term numbers
+
+	changes indexChanges // what to write on the next save
+}
+
+// indexChanges records what changed in an index since it was last saved, so
+// saving writes only the affected terms and documents
+type indexChanges struct {
+	all        bool               // Nothing was saved yet; the stored index is replaced
+	terms      map[FieldTerm]bool // Terms whose postings, bitmap or bound changed
+	docs       map[uint32]bool    // Documents added, replaced or removed
+	savedTerms int                // Terms numbered at the last save
 }
 
 // NewIndex creates a new inverted index
 func NewIndex() *Index {
 	return &Index{
-		index: make(map[string][]string),
+		index:    make(map[string]map[string]*PostingList),
+		sets:     make(map[string]map[string]*Bitmap),
+		bounds:   make(map[string]map[string]TermBound),
+		docNums:  make(map[string]uint32),
+		live:     NewBitmap(),
+		termNums: make(map[FieldTerm]uint32),
+		changes:  newIndexChanges(true),
 	}
 }
 
-// AddDocument adds or updates a document in the index
-func (idx *Index) AddDocument(docID string, tokens []string) {
+// newIndexChanges returns an empty change set; with all set the whole index
+// is written on the next save
+func newIndexChanges(all bool) indexChanges {
+	return indexChanges{
+		all:   all,
+		terms: make(map[FieldTerm]bool),
+		docs:  make(map[uint32]bool),
+	}
+}
+
+// markSaved clears the changes after they were written
+func (idx *Index) markSaved() {
+	idx.changes = newIndexChanges(false)
+	idx.changes.savedTerms = len(idx.terms)
+}
+
+// AddDocument adds a document to the index, replacing it if it exists
+func (idx *Index) AddDocument(docID string, fields map[string][]Token) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	// Get unique tokens
-	uniqueTokens := make(map[string]bool)
-	for _, token := range tokens {
-		uniqueTokens[token] = true
+	idx.addDocument(docID, fields)
+}
+
+func (idx *Index) addDocument(docID string, fields map[string][]Token) {
+	num, ok := idx.docNums[docID]
+	if ok {
+		idx.removePostings(num)
+	} else {
+		num = uint32(len(idx.docIDs))
+		idx.docNums[docID] = num
+		idx.docIDs = append(idx.docIDs, docID)
+		idx.forward = append(idx.forward, nil)
+		idx.live.Add(num)
 	}
+	idx.changes.docs[num] = true
 
-	// Add to index
-	for token := range uniqueTokens {
-		docList := idx.index[token]
+	var docTerms []uint32
 
-		// Check if doc already exists
-		found := false
-		for _, id := range docList {
-			if id == docID {
-				found = true
-				break
-			}
+	for field, tokens := range fields {
+		// Group positions by token
+		positions := make(map[string][]int)
+		for _, token := range tokens {
+			positions[token.Term] = append(positions[token.Term], token.Position)
 		}
+		if len(positions) == 0 {
+			continue
+		}
+		length := tokenLength(tokens)
 
-		if !found {
-			idx.index[token] = append(docList, docID)
+		terms, ok := idx.index[field]
+		if !ok {
+			terms = make(map[string]*PostingList)
+			idx.index[field] = terms
+		}
+		bounds, ok := idx.bounds[field]
+		if !ok {
+			bounds = make(map[string]TermBound)
+			idx.bounds[field] = bounds
+		}
+
+		// Add to index
+		for token, tokenPositions := range positions {
+			postings, ok := terms[token]
+			if !ok {
+				postings = &PostingList{}
+				terms[token] = postings
+			}
+			postings.add(num, tokenPositions)
+			idx.updateTermSet(field, token, postings, num, true)
+			docTerms = append(docTerms, idx.termNumber(field, token))
+			idx.changes.terms[FieldTerm{Field: field, Term: token}] = true
+
+			bound := bounds[token]
+			if len(tokenPositions) > bound.MaxFreq {
+				bound.MaxFreq = len(tokenPositions)
+			}
+			if bound.MinLength == 0 || length < bound.MinLength {
+				bound.MinLength = length
+			}
+			bounds[token] = bound
 		}
 	}
+	idx.forward[num] = docTerms
+}
 
-	idx.docCount++
+// termNumber returns the number of a field term, numbering it if it is new
+func (idx *Index) termNumber(field, token string) uint32 {
+	term := FieldTerm{Field: field, Term: token}
+	num, ok := idx.termNums[term]
+	if !ok {
+		num = uint32(len(idx.terms))
+		idx.termNums[term] = num
+		idx.terms = append(idx.terms, term)
+	}
+	return num
 }
 
 // RemoveDocument removes a document from the index
@@ -53,114 +186,457 @@ func (idx *Index) RemoveDocument(docID string) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	for token, docList := range idx.index {
-		newList := make([]string, 0, len(docList))
-		for _, id := range docList {
-			if id != docID {
-				newList = append(newList, id)
-			}
+	num, ok := idx.docNums[docID]
+	if !ok {
+		return
+	}
+
+	idx.removePostings(num)
+	delete(idx.docNums, docID)
+	idx.docIDs[num] = ""
+	idx.live.Remove(num)
+	idx.changes.docs[num] = true
+}
+
+// removePostings removes a document number from the posting lists of the
+// terms the forward index records for it
+func (idx *Index) removePostings(num uint32) {
+	for _, termNum := range idx.forward[num] {
+		term := idx.terms[termNum]
+		terms := idx.index[term.Field]
+		postings, ok := terms[term.Term]
+		if !ok || !postings.remove(num) {
+			continue
 		}
+		idx.changes.terms[term] = true
 
-		if len(newList) == 0 {
-			delete(idx.index, token)
-		} else {
-			idx.index[token] = newList
+		if postings.Len() > 0 {
+			idx.updateTermSet(term.Field, term.Term, postings, num, false)
+			continue
+		}
+		delete(terms, term.Term)
+		delete(idx.sets[term.Field], term.Term)
+		delete(idx.bounds[term.Field], term.Term)
+		if len(terms) == 0 {
+			delete(idx.index, term.Field)
+			delete(idx.sets, term.Field)
+			delete(idx.bounds, term.Field)
 		}
 	}
+	idx.forward[num] = nil
+}
 
-	idx.docCount--
-	if idx.docCount < 0 {
-		idx.docCount = 0
-	}
+// dense reports whether a term in docFreq documents should have a bitmap
+func (idx *Index) dense(docFreq int) bool {
+	return docFreq >= minDenseTermDocs && docFreq*denseTermRatio >= idx.live.Cardinality()
 }
 
-// UpdateDocument updates a document (remove old, add new)
-func (idx *Index) UpdateDocument(docID string, tokens []string) {
-	idx.RemoveDocument(docID)
-	idx.AddDocument(docID, tokens)
+// updateTermSet keeps the bitmap of a term in step with its posting list
+// after a document was added to or removed from it, creating or dropping
+// the bitmap as the term's density changes
+func (idx *Index) updateTermSet(field, token string, postings *PostingList, num uint32, added bool) {
+	set, ok := idx.sets[field][token]
+	switch {
+	case ok && !idx.dense(2*postings.Len()):
+		delete(idx.sets[field], token)
+	case ok && added:
+		set.Add(num)
+	case ok:
+		set.Remove(num)
+	case idx.dense(postings.Len()):
+		if idx.sets[field] == nil {
+			idx.sets[field] = make(map[string]*Bitmap)
+		}
+		idx.sets[field][token] = bitmapOf(postings.docs())
+	}
 }
 
-// SearchAND returns documents containing ALL tokens
-func (idx *Index) SearchAND(tokens []string) []string {
+// DocumentTokens rebuilds the indexed tokens of a document, by field, from
+// the forward index and the positions in its postings. It returns nil if
+// the document is not indexed.
+func (idx *Index) DocumentTokens(docID string) map[string][]Token {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	if len(tokens) == 0 {
+	num, ok := idx.docNums[docID]
+	if !ok {
 		return nil
 	}
 
-	// Start with first token's documents
-	result := make(map[string]bool)
-	firstDocs, ok := idx.index[tokens[0]]
-	if !ok {
-		return nil
+	fields := make(map[string][]Token)
+	for _, termNum := range idx.forward[num] {
+		term := idx.terms[termNum]
+		postings, ok := idx.index[term.Field][term.Term]
+		if !ok {
+			continue
+		}
+		it := postings.iterator()
+		if !it.advance(num) || it.doc != num {
+			continue
+		}
+		for _, pos := range it.positions() {
+			fields[term.Field] = append(fields[term.Field], Token{Term: term.Term, Position: pos})
+		}
 	}
 
-	for _, docID := range firstDocs {
-		result[docID] = true
+	for _, tokens := range fields {
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i].Position < tokens[j].Position })
 	}
+	return fields
+}
+
+// UpdateDocument replaces the postings of a document, keeping its number
+func (idx *Index) UpdateDocument(docID string, fields map[string][]Token) {
+	idx.AddDocument(docID, fields)
+}
 
-	// Intersect with remaining tokens
-	for i := 1; i < len(tokens); i++ {
-		docs, ok := idx.index[tokens[i]]
+// postingIterators returns an iterator over the postings of each field
+// term, or nil if any term is not indexed
+func (idx *Index) postingIterators(terms []FieldTerm) []*postingIterator {
+	iters := make([]*postingIterator, len(terms))
+	for i, term := range terms {
+		postings, ok := idx.index[term.Field][term.Term]
 		if !ok {
 			return nil
 		}
+		iters[i] = postings.iterator()
+	}
+	return iters
+}
 
-		// Create new result with intersection
-		newResult := make(map[string]bool)
-		for _, docID := range docs {
-			if result[docID] {
-				newResult[docID] = true
-			}
+// documentIDs maps document numbers back to IDs
+func (idx *Index) documentIDs(nums []uint32) []string {
+	docIDs := make([]string, len(nums))
+	for i, num := range nums {
+		docIDs[i] = idx.docIDs[num]
+	}
+	return docIDs
+}
+
+// DocumentIDs returns the IDs of a set of documents, in the order they
+// were added
+func (idx *Index) DocumentIDs(set *Bitmap) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.documentIDs(set.ToArray())
+}
+
+// DocumentNumber returns the number of an indexed document
+func (idx *Index) DocumentNumber(docID string) (uint32, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	num, ok := idx.docNums[docID]
+	return num, ok
+}
+
+// DocumentSet returns the set of the given documents that are indexed
+func (idx *Index) DocumentSet(docIDs []string) *Bitmap {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	set := NewBitmap()
+	for _, docID := range docIDs {
+		if num, ok := idx.docNums[docID]; ok {
+			set.Add(num)
 		}
-		result = newResult
+	}
+	return set
+}
 
-		if len(result) == 0 {
-			return nil
+// LiveDocs returns the set of all indexed documents. The set is shared
+// with the index and must not be modified.
+func (idx *Index) LiveDocs() *Bitmap {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.live
+}
+
+// TermSet returns the documents containing a token in field. The set may
+// be shared with the index and must not be modified.
+func (idx *Index) TermSet(field, token string) *Bitmap {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if set, ok := idx.sets[field][token]; ok {
+		return set
+	}
+	if postings, ok := idx.index[field][token]; ok {
+		return bitmapOf(postings.docs())
+	}
+	return NewBitmap()
+}
+
+// IntersectTerms returns the documents containing ALL field terms. Sparse
+// terms are merged block by block; dense terms are intersected as
+// bitmaps, or tested for membership when sparse terms lead.
+func (idx *Index) IntersectTerms(terms []FieldTerm) *Bitmap {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if len(terms) == 0 {
+		return NewBitmap()
+	}
+
+	var iters []*postingIterator
+	var sets []*Bitmap
+	for _, term := range terms {
+		if set, ok := idx.sets[term.Field][term.Term]; ok {
+			sets = append(sets, set)
+			continue
+		}
+		postings, ok := idx.index[term.Field][term.Term]
+		if !ok {
+			return NewBitmap()
 		}
+		iters = append(iters, postings.iterator())
 	}
 
-	// Convert to slice
-	resultSlice := make([]string, 0, len(result))
-	for docID := range result {
-		resultSlice = append(resultSlice, docID)
+	if len(iters) == 0 {
+		result := sets[0]
+		for _, set := range sets[1:] {
+			result = result.And(set)
+		}
+		return result
 	}
 
-	return resultSlice
+	var nums []uint32
+	intersectPostings(iters, func(doc uint32) {
+		for _, set := range sets {
+			if !set.Contains(doc) {
+				return
+			}
+		}
+		nums = append(nums, doc)
+	})
+	return bitmapOf(nums)
 }
 
-// SearchOR returns documents containing ANY token
-func (idx *Index) SearchOR(tokens []string) []string {
+// UnionTerms returns the documents containing ANY field term
+func (idx *Index) UnionTerms(terms []FieldTerm) *Bitmap {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	result := make(map[string]bool)
+	result := NewBitmap()
+	var iters []*postingIterator
+	for _, term := range terms {
+		if set, ok := idx.sets[term.Field][term.Term]; ok {
+			result = result.Or(set)
+		} else if postings, ok := idx.index[term.Field][term.Term]; ok {
+			iters = append(iters, postings.iterator())
+		}
+	}
+	return result.Or(bitmapOf(unionPostings(iters)))
+}
+
+// SearchAND returns documents containing ALL field terms, in the order
+// they were added
+func (idx *Index) SearchAND(terms []FieldTerm) []string {
+	return idx.DocumentIDs(idx.IntersectTerms(terms))
+}
+
+// SearchOR returns documents containing ANY field term, in the order they
+// were added
+func (idx *Index) SearchOR(terms []FieldTerm) []string {
+	return idx.DocumentIDs(idx.UnionTerms(terms))
+}
+
+// SearchNOT returns documents containing NONE of the field terms, in the
+// order they were added
+func (idx *Index) SearchNOT(terms []FieldTerm) []string {
+	return idx.DocumentIDs(idx.LiveDocs().AndNot(idx.UnionTerms(terms)))
+}
+
+// SearchPhrase returns the phrase frequency in each matching document.
+// With slop 0 the terms must occur exactly at their offsets and each match
+// counts 1. With slop > 0 the terms may be up to slop extra positions apart
+// (and in any order unless inOrder is set); each match then counts
+// 1/(distance+1), so looser matches contribute less.
+func (idx *Index) SearchPhrase(field string, terms []PhraseTerm, slop int, inOrder bool) map[string]float64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if len(terms) == 0 {
+		return nil
+	}
+
+	fieldTerms := make([]FieldTerm, len(terms))
+	for i, term := range terms {
+		fieldTerms[i] = FieldTerm{Field: field, Term: term.Term}
+	}
+	iters := idx.postingIterators(fieldTerms)
+	if len(iters) == 0 {
+		return nil
+	}
+
+	// Only documents containing every term are checked for the phrase
+	matches := make(map[string]float64)
+	intersectPostings(iters, func(doc uint32) {
+		positions := make([][]int, len(iters))
+		for i, it := range iters {
+			positions[i] = it.positions()
+		}
+
+		var freq float64
+		switch {
+		case slop == 0:
+			freq = exactPhraseFreq(terms, positions)
+		case inOrder:
+			freq = orderedPhraseFreq(terms, positions, slop)
+		default:
+			freq = unorderedPhraseFreq(terms, positions, slop)
+		}
+
+		if freq > 0 {
+			matches[idx.docIDs[doc]] = freq
+		}
+	})
+
+	return matches
+}
+
+// phraseWidth is the number of positions an exact match of the phrase spans
+func phraseWidth(terms []PhraseTerm) int {
+	return terms[len(terms)-1].Offset - terms[0].Offset
+}
 
-	for _, token := range tokens {
-		if docs, ok := idx.index[token]; ok {
-			for _, docID := range docs {
-				result[docID] = true
+// exactPhraseFreq counts occurrences with every term at its offset
+func exactPhraseFreq(terms []PhraseTerm, positions [][]int) float64 {
+	freq := 0
+	for _, pos := range positions[0] {
+		start := pos - terms[0].Offset
+		matched := true
+		for i := 1; i < len(terms); i++ {
+			want := start + terms[i].Offset
+			j := sort.SearchInts(positions[i], want)
+			if j == len(positions[i]) || positions[i][j] != want {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			freq++
+		}
+	}
+	return float64(freq)
+}
+
+// orderedPhraseFreq scores matches where the terms appear in phrase order.
+// Each occurrence of the first term is extended greedily with the nearest
+// following occurrence of every next term.
+func orderedPhraseFreq(terms []PhraseTerm, positions [][]int, slop int) float64 {
+	freq := 0.0
+	for _, start := range positions[0] {
+		end := start
+		for i := 1; i < len(terms); i++ {
+			j := sort.SearchInts(positions[i], end+1)
+			if j == len(positions[i]) {
+				// Later starts cannot find a following occurrence either
+				return freq
 			}
+			end = positions[i][j]
+		}
+
+		distance := (end - start) - phraseWidth(terms)
+		if distance < 0 {
+			distance = 0
+		}
+		if distance <= slop {
+			freq += 1.0 / float64(distance+1)
+		}
+	}
+	return freq
+}
+
+// unorderedPhraseFreq scores minimal windows that contain every phrase term
+// in any order
+func unorderedPhraseFreq(terms []PhraseTerm, positions [][]int, slop int) float64 {
+	type occurrence struct {
+		pos  int
+		term string
+	}
+
+	// Repeated phrase terms must be matched by distinct occurrences
+	need := make(map[string]int)
+	var occurrences []occurrence
+	for i, term := range terms {
+		need[term.Term]++
+		if need[term.Term] > 1 {
+			continue
+		}
+		for _, pos := range positions[i] {
+			occurrences = append(occurrences, occurrence{pos: pos, term: term.Term})
+		}
+	}
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].pos < occurrences[j].pos })
+
+	have := make(map[string]int, len(need))
+	missing := len(terms)
+	freq := 0.0
+	left, lastLeft := 0, -1
+
+	for right, occ := range occurrences {
+		if have[occ.term] < need[occ.term] {
+			missing--
+		}
+		have[occ.term]++
+
+		if missing > 0 {
+			continue
+		}
+
+		// Shrink to the minimal window ending at right
+		for have[occurrences[left].term] > need[occurrences[left].term] {
+			have[occurrences[left].term]--
+			left++
+		}
+		if left == lastLeft {
+			continue
+		}
+		lastLeft = left
+
+		distance := (occurrences[right].pos - occurrences[left].pos) - phraseWidth(terms)
+		if distance < 0 {
+			distance = 0
+		}
+		if distance <= slop {
+			freq += 1.0 / float64(distance+1)
 		}
 	}
 
-	// Convert to slice
-	resultSlice := make([]string, 0, len(result))
-	for docID := range result {
-		resultSlice = append(resultSlice, docID)
+	return freq
+}
+
+// DocFrequency returns number of documents containing the token in field
+func (idx *Index) DocFrequency(field, token string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if postings, ok := idx.index[field][token]; ok {
+		return postings.Len()
 	}
+	return 0
+}
 
-	return resultSlice
+// TermBound returns the statistics bound of a token in a field
+func (idx *Index) TermBound(field, token string) (TermBound, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	bound, ok := idx.bounds[field][token]
+	return bound, ok
 }
 
-// DocFrequency returns number of documents containing the token
-func (idx *Index) DocFrequency(token string) int {
+// CollectionFrequency returns the total number of occurrences of a token in
+// a field across all documents
+func (idx *Index) CollectionFrequency(field, token string) int {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	if docs, ok := idx.index[token]; ok {
-		return len(docs)
+	if postings, ok := idx.index[field][token]; ok {
+		return postings.TotalFreq()
 	}
 	return 0
 }
@@ -169,7 +645,7 @@ func (idx *Index) DocFrequency(token string) int {
 func (idx *Index) TotalDocuments() int {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
-	return idx.docCount
+	return idx.live.Cardinality()
 }
 
 // Stats returns index statistics
@@ -178,25 +654,35 @@ func (idx *Index) Stats() IndexStats {
 	defer idx.mu.RUnlock()
 
 	totalDocs := 0
-	for _, docs := range idx.index {
-		totalDocs += len(docs)
+	totalTokens := 0
+	fields := make(map[string]int, len(idx.index))
+	for field, terms := range idx.index {
+		for _, postings := range terms {
+			totalDocs += postings.Len()
+		}
+		totalTokens += len(terms)
+		fields[field] = len(terms)
 	}
 
 	avgDocsPerToken := 0.0
-	if len(idx.index) > 0 {
-		avgDocsPerToken = float64(totalDocs) / float64(len(idx.index))
+	if totalTokens > 0 {
+		avgDocsPerToken = float64(totalDocs) / float64(totalTokens)
 	}
 
 	return IndexStats{
-		TotalDocuments:  idx.docCount,
-		TotalTokens:     len(idx.index),
+		TotalDocuments:  idx.live.Cardinality(),
+		DocNumbers:      len(idx.docIDs),
+		TotalTokens:     totalTokens,
 		AvgDocsPerToken: avgDocsPerToken,
+		Fields:          fields,
 	}
 }
 
 // IndexStats contains index statistics
 type IndexStats struct {
-	TotalDocuments  int     `json:"total_documents"`
-	TotalTokens     int     `json:"total_tokens"`
-	AvgDocsPerToken float64 `json:"avg_docs_per_token"`
+	TotalDocuments  int            `json:"total_documents"`
+	DocNumbers      int            `json:"doc_numbers"` // Numbers assigned, including gaps left by updates and deletes
+	TotalTokens     int            `json:"total_tokens"`
+	AvgDocsPerToken float64        `json:"avg_docs_per_token"`
+	Fields          map[string]int `json:"fields"` // Unique tokens per field
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newPhraseIndex indexes texts as the content field of documents "1", "2",
+// ..., one token per space-separated word
+func newPhraseIndex(texts ...string) *Index {
+	idx := NewIndex()
+	for i, text := range texts {
+		var tokens []Token
+		for pos, word := range strings.Fields(text) {
+			tokens = append(tokens, Token{Term: word, Position: pos})
+		}
+		idx.AddDocument(fmt.Sprint(i+1), map[string][]Token{FieldContent: tokens})
+	}
+	return idx
+}
+
+// phrase builds phrase terms at consecutive offsets
+func phrase(words ...string) []PhraseTerm {
+	terms := make([]PhraseTerm, len(words))
+	for i, word := range words {
+		terms[i] = PhraseTerm{Term: word, Offset: i}
+	}
+	return terms
+}
+
+func TestSearchPhraseExact(t *testing.T) {
+	idx := newPhraseIndex(
+		"open source software is open source",
+		"source open",
+		"open and source",
+		"open open source",
+	)
+
+	tests := []struct {
+		name  string
+		terms []PhraseTerm
+		want  map[string]float64
+	}{
+		{"counts every occurrence", phrase("open", "source"), map[string]float64{"1": 2, "4": 1}},
+		{"order matters", phrase("source", "open"), map[string]float64{"2": 1}},
+		{"offset gap", []PhraseTerm{{"open", 0}, {"source", 2}}, map[string]float64{"3": 1, "4": 1}},
+		{"repeated term", phrase("open", "open", "source"), map[string]float64{"4": 1}},
+		{"three terms", phrase("open", "source", "software"), map[string]float64{"1": 1}},
+		{"single term", phrase("software"), map[string]float64{"1": 1}},
+		{"missing term", phrase("open", "closed"), nil},
+		{"no terms", nil, nil},
+	}
+	for _, tt := range tests {
+		got := idx.SearchPhrase(FieldContent, tt.terms, 0, false)
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("%s: SearchPhrase(%v) = %v, want %v", tt.name, tt.terms, got, tt.want)
+		}
+	}
+
+	// Phrases only match within their field
+	if got := idx.SearchPhrase(FieldTitle, phrase("open", "source"), 0, false); len(got) != 0 {
+		t.Errorf("SearchPhrase in title = %v, want none", got)
+	}
+}
+
+func TestSearchPhraseSlop(t *testing.T) {
+	idx := newPhraseIndex(
+		"quick brown fox",
+		"fox quick",
+		"quick fox",
+		"quick a b c fox",
+		"quick fox quick fox",
+	)
+
+	// Each match counts 1/(distance+1), where distance is the number of
+	// positions beyond an exact match
+	tests := []struct {
+		slop    int
+		inOrder bool
+		want    map[string]float64
+	}{
+		{0, false, map[string]float64{"3": 1, "5": 2}},
+		{1, true, map[string]float64{"1": 0.5, "3": 1, "5": 2}},
+		{2, true, map[string]float64{"1": 0.5, "3": 1, "5": 2}},
+		{3, true, map[string]float64{"1": 0.5, "3": 1, "4": 0.25, "5": 2}},
+		{1, false, map[string]float64{"1": 0.5, "2": 1, "3": 1, "5": 3}},
+		{3, false, map[string]float64{"1": 0.5, "2": 1, "3": 1, "4": 0.25, "5": 3}},
+	}
+	for _, tt := range tests {
+		got := idx.SearchPhrase(FieldContent, phrase("quick", "fox"), tt.slop, tt.inOrder)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchPhrase(slop %d, in order %v) = %v, want %v", tt.slop, tt.inOrder, got, tt.want)
+		}
+	}
+}
+
+func TestSearchPhraseSlopRepeatedTerms(t *testing.T) {
+	idx := newPhraseIndex(
+		"to be or not to be",
+		"to be",
+		"be to to",
+	)
+
+	tests := []struct {
+		slop    int
+		inOrder bool
+		want    map[string]float64
+	}{
+		// A repeated term needs as many distinct occurrences
+		{1, false, map[string]float64{"3": 1}},
+		{2, false, map[string]float64{"1": 1.0 / 3, "3": 1}},
+		{2, true, map[string]float64{"1": 1.0 / 3}},
+	}
+	for _, tt := range tests {
+		got := idx.SearchPhrase(FieldContent, phrase("to", "be", "to"), tt.slop, tt.inOrder)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchPhrase(slop %d, in order %v) = %v, want %v", tt.slop, tt.inOrder, got, tt.want)
+		}
+	}
+}
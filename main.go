@@ -1,16 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	dataDir string
+	dataDir      string
+	analyzerName string
 )
 
 func main() {
@@ -21,6 +25,7 @@ func main() {
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&dataDir, "data-dir", "d", "./data/search.db", "Data directory for storage")
+	rootCmd.PersistentFlags().StringVar(&analyzerName, "analyzer", "", fmt.Sprintf("Analyzer for a new index %v (default: the one the index was built with)", AnalyzerNames()))
 
 	// Serve command
 	serveCmd := &cobra.Command{
@@ -41,6 +46,7 @@ func main() {
 	insertCmd.Flags().StringP("title", "t", "", "Document title (required)")
 	insertCmd.Flags().StringP("content", "c", "", "Document content (required)")
 	insertCmd.Flags().StringP("url", "u", "", "Document URL")
+	insertCmd.Flags().StringToStringP("metadata", "m", nil, "Metadata indexed as exact-match keywords, e.g. lang=go,team=infra")
 	insertCmd.MarkFlagRequired("id")
 	insertCmd.MarkFlagRequired("title")
 	insertCmd.MarkFlagRequired("content")
@@ -51,11 +57,30 @@ func main() {
 		Short: "Search for documents",
 		Run:   runSearch,
 	}
-	searchCmd.Flags().StringP("query", "q", "", "Search query (required)")
+	searchCmd.Flags().StringP("query", "q", "", `Search query, e.g. '(go OR golang) -python "open source"~2 rust^2' (required without --filter)`)
 	searchCmd.Flags().IntP("limit", "l", 10, "Maximum results")
 	searchCmd.Flags().BoolP("ranked", "r", true, "Use BM25 ranking")
-	searchCmd.Flags().String("mode", "and", "Search mode: and or or")
-	searchCmd.MarkFlagRequired("query")
+	searchCmd.Flags().Bool("explain", false, "Show how each score was computed")
+	searchCmd.Flags().Bool("exact-total", false, "Count every match instead of stopping once the top results are known")
+	searchCmd.Flags().StringArray("filter", nil, "Only return documents with this metadata value, e.g. lang:go or priority:>=3 (repeatable)")
+	searchCmd.Flags().StringArray("agg", nil, "Aggregate a metadata field over all matches, e.g. terms:lang, histogram:price:10, range:price:..10,10.., stats:price (repeatable)")
+	searchCmd.Flags().Bool("highlight", false, "Show the best matching fragments with the matches colored")
+	searchCmd.Flags().Int("fragment-size", DefaultHighlightOptions().FragmentSize, "Length of a highlighted fragment in characters")
+	searchCmd.Flags().Int("fragments", DefaultHighlightOptions().Fragments, "Most highlighted fragments per field")
+	searchCmd.Flags().String("sort", "", "Sort by fields instead of score, e.g. priority:desc,_score (asc|desc, first|last for missing values)")
+	addSearchFlags(searchCmd)
+
+	// Explain command
+	explainCmd := &cobra.Command{
+		Use:   "explain",
+		Short: "Explain how documents are scored for a query",
+		Run:   runExplain,
+	}
+	explainCmd.Flags().StringP("query", "q", "", "Search query (required)")
+	explainCmd.Flags().StringP("id", "i", "", "Document ID to explain (default: the top results)")
+	explainCmd.Flags().IntP("limit", "l", 3, "Number of top results to explain when no ID is given")
+	addSearchFlags(explainCmd)
+	explainCmd.MarkFlagRequired("query")
 
 	// Get command
 	getCmd := &cobra.Command{
@@ -82,7 +107,65 @@ func main() {
 		Run:   runStats,
 	}
 
-	rootCmd.AddCommand(serveCmd, insertCmd, searchCmd, getCmd, deleteCmd, statsCmd)
+	// Config command
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Show or change the stopwords, synonyms, scoring setup and schema saved with the index",
+		Run:   runConfig,
+	}
+	configCmd.Flags().StringSlice("stopwords", nil, "Extra stopword files, one or more words per line")
+	configCmd.Flags().Bool("clear-stopwords", false, "Remove the saved extra stopwords")
+	configCmd.Flags().String("stopword-mode", "", fmt.Sprintf("Keep stopwords in the index (%s) or drop them (%s) (reindexes)", StopwordModeIndex, StopwordModeRemove))
+	configCmd.Flags().StringSlice("synonyms", nil, "Synonym files, e.g. \"laptop, notebook\" per line (reindexes)")
+	configCmd.Flags().Bool("clear-synonyms", false, "Remove the saved synonyms (reindexes)")
+	configCmd.Flags().String("scorer", "", fmt.Sprintf("Scorer %v", ScorerNames()))
+	configCmd.Flags().String("scorer-params", "", "Scorer parameters, e.g. k1:1.2,b:0.75")
+	configCmd.Flags().String("field-boosts", "", "Field weights, e.g. title:3,content:1")
+	configCmd.Flags().String("schema", "", "Typed metadata fields, e.g. priority:number,published:date,draft:boolean")
+
+	// Verify command
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that stored documents, statistics and the index agree",
+		Run:   runVerify,
+	}
+
+	// Compact command
+	compactCmd := &cobra.Command{
+		Use:   "compact",
+		Short: "Rebuild the index to drop the numbers of deleted documents",
+		Run:   runCompact,
+	}
+
+	// Import command
+	importCmd := &cobra.Command{
+		Use:   "import <path>",
+		Short: "Import documents from a JSONL file, a CSV file or a directory of text, Markdown and HTML files",
+		Args:  cobra.ExactArgs(1),
+		Run:   runImport,
+	}
+	importDefaults := DefaultImportOptions()
+	importCmd.Flags().String("format", "", fmt.Sprintf("Input format: %s, %s or %s (default: from the path)", ImportJSONL, ImportCSV, ImportDir))
+	importCmd.Flags().Int("batch-size", importDefaults.BatchSize, "Documents saved per transaction")
+	importCmd.Flags().Bool("resume", false, "Skip the records saved by an interrupted import of the same path")
+	importCmd.Flags().String("id-column", importDefaults.Columns.ID, "CSV column holding the document ID")
+	importCmd.Flags().String("title-column", importDefaults.Columns.Title, "CSV column holding the title")
+	importCmd.Flags().String("content-column", importDefaults.Columns.Content, "CSV column holding the content")
+	importCmd.Flags().String("url-column", importDefaults.Columns.URL, "CSV column holding the URL")
+	importCmd.Flags().StringSlice("metadata-columns", nil, "CSV columns kept as metadata (default: every other column)")
+
+	// Export command
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export documents as JSONL and optionally the term dictionary with postings",
+		Run:   runExport,
+	}
+	exportCmd.Flags().StringP("output", "o", "-", `File the documents are written to ("-" for stdout)`)
+	exportCmd.Flags().Bool("documents", true, "Export the documents")
+	exportCmd.Flags().String("terms", "", `File the term dictionary is written to ("-" for stdout)`)
+	exportCmd.Flags().Bool("postings", false, "Include each term's postings in the term dictionary")
+
+	rootCmd.AddCommand(serveCmd, insertCmd, importCmd, exportCmd, searchCmd, explainCmd, getCmd, deleteCmd, statsCmd, configCmd, verifyCmd, compactCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -90,13 +173,20 @@ func main() {
 	}
 }
 
+// engineOptions builds engine options from the global flags
+func engineOptions() EngineOptions {
+	options := DefaultEngineOptions()
+	options.Analyzer = analyzerName
+	return options
+}
+
 func runServe(cmd *cobra.Command, args []string) {
 	host, _ := cmd.Flags().GetString("host")
 	port, _ := cmd.Flags().GetInt("port")
 
 	log.Printf("Starting search engine with data: %s", dataDir)
 
-	engine, err := NewSearchEngine(dataDir)
+	engine, err := NewSearchEngine(dataDir, engineOptions())
 	if err != nil {
 		log.Fatalf("Failed to create search engine: %v", err)
 	}
@@ -111,8 +201,11 @@ func runServe(cmd *cobra.Command, args []string) {
 	log.Println("  GET    /documents/:id       - Get a document")
 	log.Println("  PUT    /documents/:id       - Update a document")
 	log.Println("  DELETE /documents/:id       - Delete a document")
+	log.Println("  GET    /documents/:id/explain?query=... - Explain a document's score")
 	log.Println("  GET    /search?query=...    - Search documents")
 	log.Println("  GET    /stats               - Get index statistics")
+	log.Println("  GET    /schema              - Get the typed metadata fields")
+	log.Println("  GET    /export              - Export documents as JSONL (?type=terms for the term dictionary)")
 
 	api := NewAPI(engine)
 	if err := api.Run(addr); err != nil {
@@ -125,8 +218,9 @@ func runInsert(cmd *cobra.Command, args []string) {
 	title, _ := cmd.Flags().GetString("title")
 	content, _ := cmd.Flags().GetString("content")
 	url, _ := cmd.Flags().GetString("url")
+	metadata, _ := cmd.Flags().GetStringToString("metadata")
 
-	engine, err := NewSearchEngine(dataDir)
+	engine, err := NewSearchEngine(dataDir, engineOptions())
 	if err != nil {
 		log.Fatalf("Failed to create search engine: %v", err)
 	}
@@ -134,6 +228,9 @@ func runInsert(cmd *cobra.Command, args []string) {
 
 	doc := NewDocument(id, title, content)
 	doc.URL = url
+	for key, value := range metadata {
+		doc.Metadata[key] = value
+	}
 
 	if err := engine.UpsertDocument(doc); err != nil {
 		log.Fatalf("Failed to insert document: %v", err)
@@ -142,58 +239,288 @@ func runInsert(cmd *cobra.Command, args []string) {
 	fmt.Printf("✓ Document '%s' inserted successfully\n", id)
 }
 
+// addSearchFlags adds the flags shared by commands that run a query
+func addSearchFlags(cmd *cobra.Command) {
+	cmd.Flags().String("mode", "and", "Default operator between clauses: and or or")
+	cmd.Flags().Int("slop", 0, `Extra positions allowed between phrase terms (overridden by "..."~N)`)
+	cmd.Flags().Bool("in-order", false, "Require sloppy phrase terms to keep their order")
+	cmd.Flags().StringSlice("fields", nil, "Fields searched by terms without a field prefix (default: title,content)")
+	cmd.Flags().String("boost", "", "Field weights for this query, e.g. title:3,content:1")
+	cmd.Flags().String("scorer", "", fmt.Sprintf("Scorer for this query %v (default: the index's scorer)", ScorerNames()))
+	cmd.Flags().String("scorer-params", "", "Scorer parameters for this query, e.g. k1:1.2,b:0.75")
+}
+
+// searchOptions builds search options from the flags added by addSearchFlags
+func searchOptions(cmd *cobra.Command) SearchOptions {
+	modeStr, _ := cmd.Flags().GetString("mode")
+	slop, _ := cmd.Flags().GetInt("slop")
+	inOrder, _ := cmd.Flags().GetBool("in-order")
+	fields, _ := cmd.Flags().GetStringSlice("fields")
+	boost, _ := cmd.Flags().GetString("boost")
+	scorer, _ := cmd.Flags().GetString("scorer")
+	params, _ := cmd.Flags().GetString("scorer-params")
+
+	options := DefaultSearchOptions()
+	options.Slop = slop
+	options.InOrder = inOrder
+	options.Fields = fields
+	if boost != "" {
+		boosts, err := ParseFieldBoosts(boost)
+		if err != nil {
+			log.Fatalf("Invalid --boost: %v", err)
+		}
+		options.FieldBoosts = boosts
+	}
+	options.Scorer = scorer
+	if params != "" {
+		scorerParams, err := ParseScorerParams(params)
+		if err != nil {
+			log.Fatalf("Invalid --scorer-params: %v", err)
+		}
+		options.ScorerParams = scorerParams
+	}
+
+	if modeStr == "or" {
+		options.Mode = SearchModeOR
+	}
+	return options
+}
+
+// checkSearchError exits with a message for a failed query, pointing at
+// the position of a syntax error
+func checkSearchError(query string, err error) {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		fmt.Printf("❌ Invalid query: %s\n   %s\n   %s^\n", queryErr.Message, query, strings.Repeat(" ", queryErr.Position))
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("Search failed: %v", err)
+	}
+}
+
+// ANSI escapes coloring highlighted matches in the terminal
+const (
+	ansiHighlight = "\x1b[1;33m"
+	ansiReset     = "\x1b[0m"
+)
+
+// preview returns the first n characters of a text, marking a cut with
+// "..."
+func preview(text string, n int) string {
+	chars := 0
+	for i := range text {
+		if chars == n {
+			return text[:i] + "..."
+		}
+		chars++
+	}
+	return text
+}
+
+// formatTotal formats the number of matches of a search
+func formatTotal(result *SearchResult) string {
+	if result.TotalExact {
+		return fmt.Sprintf("%d", result.Total)
+	}
+	return fmt.Sprintf("at least %d", result.Total)
+}
+
 func runSearch(cmd *cobra.Command, args []string) {
 	query, _ := cmd.Flags().GetString("query")
 	limit, _ := cmd.Flags().GetInt("limit")
 	ranked, _ := cmd.Flags().GetBool("ranked")
-	modeStr, _ := cmd.Flags().GetString("mode")
+	explain, _ := cmd.Flags().GetBool("explain")
+	exactTotal, _ := cmd.Flags().GetBool("exact-total")
+	filterValues, _ := cmd.Flags().GetStringArray("filter")
+	sortValue, _ := cmd.Flags().GetString("sort")
+	aggValues, _ := cmd.Flags().GetStringArray("agg")
+	highlight, _ := cmd.Flags().GetBool("highlight")
+	fragmentSize, _ := cmd.Flags().GetInt("fragment-size")
+	fragments, _ := cmd.Flags().GetInt("fragments")
+
+	if query == "" && len(filterValues) == 0 {
+		log.Fatalf("Either --query or --filter is required")
+	}
+	filters, err := ParseSearchFilters(filterValues)
+	if err != nil {
+		log.Fatalf("Invalid --filter: %v", err)
+	}
+	sortFields, err := ParseSort(sortValue)
+	if err != nil {
+		log.Fatalf("Invalid --sort: %v", err)
+	}
+	aggs, err := ParseAggregations(aggValues)
+	if err != nil {
+		log.Fatalf("Invalid --agg: %v", err)
+	}
 
-	engine, err := NewSearchEngine(dataDir)
+	engine, err := NewSearchEngine(dataDir, engineOptions())
 	if err != nil {
 		log.Fatalf("Failed to create search engine: %v", err)
 	}
 	defer engine.Close()
 
-	options := DefaultSearchOptions()
+	options := searchOptions(cmd)
 	options.Limit = limit
 	options.UseRanking = ranked
-
-	if modeStr == "or" {
-		options.Mode = SearchModeOR
+	options.Explain = explain
+	options.ExactTotal = exactTotal
+	options.Filters = filters
+	options.Sort = sortFields
+	options.Aggregations = aggs
+	if highlight {
+		if fragmentSize <= 0 || fragments <= 0 {
+			log.Fatalf("--fragment-size and --fragments must be positive")
+		}
+		options.Highlight = &HighlightOptions{
+			FragmentSize: fragmentSize,
+			Fragments:    fragments,
+			PreTag:       ansiHighlight,
+			PostTag:      ansiReset,
+			Encoder:      HighlightEncoderNone,
+		}
 	}
 
 	start := time.Now()
 	result, err := engine.Search(query, options)
-	if err != nil {
-		log.Fatalf("Search failed: %v", err)
-	}
+	checkSearchError(query, err)
 	duration := time.Since(start)
 
 	fmt.Printf("\n🔍 Search Results for: \"%s\"\n", query)
-	fmt.Printf("Found %d documents in %v\n\n", result.Total, duration)
+	fmt.Printf("Found %s documents in %v\n\n", formatTotal(result), duration)
 
 	for i, doc := range result.Documents {
+		var highlights map[string][]string
+		if len(result.Highlights) > i {
+			highlights = result.Highlights[i]
+		}
+
+		title := doc.Title
+		if fragments := highlights[FieldTitle]; len(fragments) > 0 {
+			title = fragments[0]
+		}
 		if len(result.Scores) > 0 {
-			fmt.Printf("%d. [Score: %.4f] %s\n", i+1, result.Scores[i], doc.Title)
+			fmt.Printf("%d. [Score: %.4f] %s\n", i+1, result.Scores[i], title)
 		} else {
-			fmt.Printf("%d. %s\n", i+1, doc.Title)
+			fmt.Printf("%d. %s\n", i+1, title)
 		}
 		fmt.Printf("   ID: %s\n", doc.ID)
 		if doc.URL != "" {
 			fmt.Printf("   URL: %s\n", doc.URL)
 		}
-		contentPreview := doc.Content
-		if len(contentPreview) > 100 {
-			contentPreview = contentPreview[:100] + "..."
+		if fragments := highlights[FieldContent]; len(fragments) > 0 {
+			for j, fragment := range fragments {
+				fragments[j] = strings.Join(strings.Fields(fragment), " ")
+			}
+			fmt.Printf("   Content: %s\n", strings.Join(fragments, " ... "))
+		} else {
+			fmt.Printf("   Content: %s\n", preview(doc.Content, 100))
+		}
+		if len(result.Explanations) > i {
+			fmt.Printf("   Explanation:\n%s", indent(result.Explanations[i].String(), "     "))
+		}
+		fmt.Println()
+	}
+
+	printAggregations(aggs, result.Aggregations)
+}
+
+// printAggregations prints aggregation results in the order requested
+func printAggregations(aggs []Aggregation, results map[string]*AggregationResult) {
+	if len(aggs) == 0 {
+		return
+	}
+
+	fmt.Println("📊 Aggregations")
+	for _, agg := range aggs {
+		result := results[agg.Name]
+		fmt.Printf("  %s (%s of %s):\n", agg.Name, agg.Type, agg.Field)
+		if stats := result.Stats; stats != nil {
+			if stats.Count == 0 {
+				fmt.Printf("    count=0\n")
+				continue
+			}
+			if stats.MinAsString != "" {
+				// The average and sum of dates mean little
+				fmt.Printf("    count=%d min=%s max=%s\n", stats.Count, stats.MinAsString, stats.MaxAsString)
+				continue
+			}
+			fmt.Printf("    count=%d min=%g max=%g avg=%g sum=%g\n", stats.Count, *stats.Min, *stats.Max, *stats.Avg, stats.Sum)
+			continue
+		}
+		for _, bucket := range result.Buckets {
+			fmt.Printf("    %-24s %d\n", bucket.Key, bucket.DocCount)
+		}
+		if result.OtherCount > 0 {
+			fmt.Printf("    %-24s %d\n", "(other)", result.OtherCount)
+		}
+	}
+	fmt.Println()
+}
+
+func runExplain(cmd *cobra.Command, args []string) {
+	query, _ := cmd.Flags().GetString("query")
+	id, _ := cmd.Flags().GetString("id")
+	limit, _ := cmd.Flags().GetInt("limit")
+
+	engine, err := NewSearchEngine(dataDir, engineOptions())
+	if err != nil {
+		log.Fatalf("Failed to create search engine: %v", err)
+	}
+	defer engine.Close()
+
+	options := searchOptions(cmd)
+
+	fmt.Printf("\n🔬 Score Explanation for: \"%s\"\n\n", query)
+
+	if id != "" {
+		explanation, err := engine.Explain(id, query, options)
+		checkSearchError(query, err)
+		if explanation == nil {
+			fmt.Printf("❌ Document '%s' not found\n", id)
+			return
+		}
+
+		if explanation.Matched {
+			fmt.Printf("Document '%s' matches with score %.4f\n", id, explanation.Score)
+		} else {
+			fmt.Printf("Document '%s' does not match the query\n", id)
+		}
+		fmt.Print(indent(explanation.Explanation.String(), "  "))
+		fmt.Println()
+		return
+	}
+
+	options.Limit = limit
+	options.Explain = true
+	result, err := engine.Search(query, options)
+	checkSearchError(query, err)
+
+	fmt.Printf("Found %s documents\n\n", formatTotal(result))
+	for i, doc := range result.Documents {
+		fmt.Printf("%d. [Score: %.4f] %s (ID: %s)\n", i+1, result.Scores[i], doc.Title, doc.ID)
+		fmt.Print(indent(result.Explanations[i].String(), "   "))
+		fmt.Println()
+	}
+}
+
+// indent prefixes every line of text
+func indent(text, prefix string) string {
+	lines := strings.SplitAfter(text, "\n")
+	var sb strings.Builder
+	for _, line := range lines {
+		if line != "" {
+			sb.WriteString(prefix + line)
 		}
-		fmt.Printf("   Content: %s\n\n", contentPreview)
 	}
+	return sb.String()
 }
 
 func runGet(cmd *cobra.Command, args []string) {
 	id, _ := cmd.Flags().GetString("id")
 
-	engine, err := NewSearchEngine(dataDir)
+	engine, err := NewSearchEngine(dataDir, engineOptions())
 	if err != nil {
 		log.Fatalf("Failed to create search engine: %v", err)
 	}
@@ -215,13 +542,25 @@ func runGet(cmd *cobra.Command, args []string) {
 	if doc.URL != "" {
 		fmt.Printf("URL:     %s\n", doc.URL)
 	}
+	if len(doc.Metadata) > 0 {
+		keys := make([]string, 0, len(doc.Metadata))
+		for key := range doc.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Println("Metadata:")
+		for _, key := range keys {
+			fmt.Printf("  %s: %s\n", key, doc.Metadata[key])
+		}
+	}
 	fmt.Printf("Content: %s\n\n", doc.Content)
 }
 
 func runDelete(cmd *cobra.Command, args []string) {
 	id, _ := cmd.Flags().GetString("id")
 
-	engine, err := NewSearchEngine(dataDir)
+	engine, err := NewSearchEngine(dataDir, engineOptions())
 	if err != nil {
 		log.Fatalf("Failed to create search engine: %v", err)
 	}
@@ -235,7 +574,7 @@ func runDelete(cmd *cobra.Command, args []string) {
 }
 
 func runStats(cmd *cobra.Command, args []string) {
-	engine, err := NewSearchEngine(dataDir)
+	engine, err := NewSearchEngine(dataDir, engineOptions())
 	if err != nil {
 		log.Fatalf("Failed to create search engine: %v", err)
 	}
@@ -244,7 +583,254 @@ func runStats(cmd *cobra.Command, args []string) {
 	stats := engine.Stats()
 
 	fmt.Println("\n📊 Index Statistics")
+	printConfig(engine)
 	fmt.Printf("Total Documents:       %d\n", stats.TotalDocuments)
+	fmt.Printf("Document Numbers:      %d\n", stats.DocNumbers)
 	fmt.Printf("Total Unique Tokens:   %d\n", stats.TotalTokens)
-	fmt.Printf("Avg Docs per Token:    %.2f\n\n", stats.AvgDocsPerToken)
+	fmt.Printf("Avg Docs per Token:    %.2f\n", stats.AvgDocsPerToken)
+
+	fields := make([]string, 0, len(stats.Fields))
+	for field := range stats.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	fmt.Println("Unique Tokens per Field:")
+	for _, field := range fields {
+		fmt.Printf("  %-20s %d\n", field, stats.Fields[field])
+	}
+	fmt.Println()
+}
+
+// runConfig saves the stopwords, synonyms, scoring setup and schema given
+// by its flags, then shows the configuration of the index. Only this
+// command changes them; the --scorer flags of search and explain apply to
+// one query.
+func runConfig(cmd *cobra.Command, args []string) {
+	stopwordFiles, _ := cmd.Flags().GetStringSlice("stopwords")
+	clearStopwords, _ := cmd.Flags().GetBool("clear-stopwords")
+	stopwordMode, _ := cmd.Flags().GetString("stopword-mode")
+	synonymFiles, _ := cmd.Flags().GetStringSlice("synonyms")
+	clearSynonyms, _ := cmd.Flags().GetBool("clear-synonyms")
+	scorer, _ := cmd.Flags().GetString("scorer")
+	scorerParams, _ := cmd.Flags().GetString("scorer-params")
+	fieldBoosts, _ := cmd.Flags().GetString("field-boosts")
+	schemaFields, _ := cmd.Flags().GetString("schema")
+
+	options := engineOptions()
+	options.StopwordFiles = stopwordFiles
+	options.ClearStopwords = clearStopwords
+	options.StopwordMode = stopwordMode
+	options.SynonymFiles = synonymFiles
+	options.ClearSynonyms = clearSynonyms
+	options.Scorer = scorer
+	if scorerParams != "" {
+		params, err := ParseScorerParams(scorerParams)
+		if err != nil {
+			log.Fatalf("Invalid --scorer-params: %v", err)
+		}
+		options.ScorerParams = params
+	}
+	if fieldBoosts != "" {
+		boosts, err := ParseFieldBoosts(fieldBoosts)
+		if err != nil {
+			log.Fatalf("Invalid --field-boosts: %v", err)
+		}
+		options.FieldBoosts = boosts
+	}
+	if schemaFields != "" {
+		schema, err := ParseSchema(schemaFields)
+		if err != nil {
+			log.Fatalf("Invalid --schema: %v", err)
+		}
+		options.Schema = schema
+	}
+
+	engine, err := NewSearchEngine(dataDir, options)
+	if err != nil {
+		log.Fatalf("Failed to create search engine: %v", err)
+	}
+	defer engine.Close()
+
+	fmt.Println("\n⚙️  Index Configuration")
+	printConfig(engine)
+	fmt.Println()
+}
+
+// printConfig prints the analyzer, scoring setup and schema of an index
+func printConfig(engine *SearchEngine) {
+	fmt.Printf("Analyzer:              %s\n", engine.AnalyzerName())
+	fmt.Printf("Stopwords:             %s\n", engine.StopwordMode())
+	if stopwords := engine.Stopwords(); len(stopwords) > 0 {
+		fmt.Printf("Extra Stopwords:       %d\n", len(stopwords))
+	}
+	if synonyms := engine.Synonyms(); len(synonyms) > 0 {
+		fmt.Printf("Synonym Terms:         %d\n", len(synonyms))
+	}
+	scoring := engine.Scoring()
+	if len(scoring.Params) > 0 {
+		fmt.Printf("Scorer:                %s (%s)\n", scoring.Scorer, FormatNamedValues(scoring.Params))
+	} else {
+		fmt.Printf("Scorer:                %s\n", scoring.Scorer)
+	}
+	if len(scoring.FieldBoosts) > 0 {
+		fmt.Printf("Field Boosts:          %s\n", FormatNamedValues(scoring.FieldBoosts))
+	}
+	if schema := engine.Schema(); len(schema) > 0 {
+		fmt.Printf("Schema:                %s\n", schema)
+	}
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	options := DefaultImportOptions()
+	options.Format, _ = cmd.Flags().GetString("format")
+	options.BatchSize, _ = cmd.Flags().GetInt("batch-size")
+	options.Resume, _ = cmd.Flags().GetBool("resume")
+	options.Columns.ID, _ = cmd.Flags().GetString("id-column")
+	options.Columns.Title, _ = cmd.Flags().GetString("title-column")
+	options.Columns.Content, _ = cmd.Flags().GetString("content-column")
+	options.Columns.URL, _ = cmd.Flags().GetString("url-column")
+	options.Columns.Metadata, _ = cmd.Flags().GetStringSlice("metadata-columns")
+
+	engine, err := NewSearchEngine(dataDir, engineOptions())
+	if err != nil {
+		log.Fatalf("Failed to create search engine: %v", err)
+	}
+	defer engine.Close()
+
+	start := time.Now()
+	lastReport := start
+	options.Progress = func(progress ImportProgress) {
+		// Report at most once a second
+		if time.Since(lastReport) < time.Second {
+			return
+		}
+		lastReport = time.Now()
+		fmt.Printf("… %d records read, %d imported, %d failed (%.0f records/s)\n",
+			progress.Records, progress.Imported, progress.Failed,
+			float64(progress.Records-progress.Skipped)/time.Since(start).Seconds())
+	}
+	options.RecordError = func(recordErr ImportRecordError) {
+		fmt.Printf("❌ %s: %v\n", recordErr.Location, recordErr.Err)
+	}
+
+	progress, err := engine.Import(args[0], options)
+	if err != nil {
+		log.Fatalf("Failed to import %s after %d records (rerun with --resume to continue): %v", args[0], progress.Records, err)
+	}
+
+	fmt.Printf("✓ Imported %d documents in %v", progress.Imported, time.Since(start).Round(time.Millisecond))
+	if progress.Skipped > 0 {
+		fmt.Printf(", skipped %d already imported", progress.Skipped)
+	}
+	if progress.Failed > 0 {
+		fmt.Printf(", %d records failed", progress.Failed)
+	}
+	fmt.Println()
+	if progress.Failed > 0 {
+		engine.Close()
+		os.Exit(1)
+	}
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("output")
+	documents, _ := cmd.Flags().GetBool("documents")
+	terms, _ := cmd.Flags().GetString("terms")
+	postings, _ := cmd.Flags().GetBool("postings")
+
+	if documents && terms == output && terms == "-" {
+		log.Fatalf("Documents and terms cannot both be written to stdout, use --output or --documents=false")
+	}
+
+	engine, err := NewSearchEngine(dataDir, engineOptions())
+	if err != nil {
+		log.Fatalf("Failed to create search engine: %v", err)
+	}
+	defer engine.Close()
+
+	// createOutput opens a file for writing, or stdout for "-"
+	var files []*os.File
+	createOutput := func(path string) *os.File {
+		if path == "-" {
+			return os.Stdout
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", path, err)
+		}
+		files = append(files, file)
+		return file
+	}
+
+	options := ExportOptions{Postings: postings}
+	if documents {
+		options.Documents = createOutput(output)
+	}
+	if terms != "" {
+		options.Terms = createOutput(terms)
+	}
+
+	summary, err := engine.Export(options)
+	for _, file := range files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+
+	// Stdout may hold the export, so report on stderr
+	var exported []string
+	if options.Documents != nil {
+		exported = append(exported, fmt.Sprintf("%d documents", summary.Documents))
+	}
+	if options.Terms != nil {
+		exported = append(exported, fmt.Sprintf("%d terms", summary.Terms))
+	}
+	fmt.Fprintf(os.Stderr, "✓ Exported %s\n", strings.Join(exported, " and "))
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	engine, err := NewSearchEngine(dataDir, engineOptions())
+	if err != nil {
+		log.Fatalf("Failed to create search engine: %v", err)
+	}
+	defer engine.Close()
+
+	problems, err := engine.Verify()
+	if err != nil {
+		log.Fatalf("Failed to verify: %v", err)
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("✅ %d documents, statistics and index are consistent\n", engine.Stats().TotalDocuments)
+		return
+	}
+
+	fmt.Printf("❌ Found %d problems:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Printf("  - %s\n", problem)
+	}
+	engine.Close()
+	os.Exit(1)
+}
+
+func runCompact(cmd *cobra.Command, args []string) {
+	engine, err := NewSearchEngine(dataDir, engineOptions())
+	if err != nil {
+		log.Fatalf("Failed to create search engine: %v", err)
+	}
+	defer engine.Close()
+
+	before := engine.Stats()
+	start := time.Now()
+	if err := engine.Compact(); err != nil {
+		log.Fatalf("Failed to compact: %v", err)
+	}
+	after := engine.Stats()
+
+	fmt.Printf("✓ Compacted %d documents in %v: document numbers %d -> %d\n",
+		after.TotalDocuments, time.Since(start).Round(time.Millisecond), before.DocNumbers, after.DocNumbers)
 }
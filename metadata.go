@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operators of a search filter
+const (
+	FilterEqual        = ""
+	FilterGreater      = "gt"
+	FilterGreaterEqual = "gte"
+	FilterLess         = "lt"
+	FilterLessEqual    = "lte"
+)
+
+// filterOperators maps the operator prefixes of a filter value to
+// operators, longest first
+var filterOperators = []struct {
+	prefix string
+	op     string
+}{
+	{">=", FilterGreaterEqual},
+	{"<=", FilterLessEqual},
+	{">", FilterGreater},
+	{"<", FilterLess},
+}
+
+// SearchFilter restricts a search to documents whose metadata value for
+// Key is Value, or compares to it by Op for number and date fields.
+// Filters select documents without changing scores.
+type SearchFilter struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// ParseSearchFilter parses a filter written as "key:value", or as
+// "key:>=value" with >, >=, < or <= for a range. The key may carry the
+// "metadata." field prefix.
+func ParseSearchFilter(s string) (SearchFilter, error) {
+	key, value, ok := strings.Cut(s, ":")
+	key = strings.TrimPrefix(strings.TrimSpace(key), metadataFieldPrefix)
+
+	filter := SearchFilter{Key: key, Value: value}
+	for _, operator := range filterOperators {
+		if strings.HasPrefix(value, operator.prefix) {
+			filter.Op, filter.Value = operator.op, strings.TrimSpace(value[len(operator.prefix):])
+			break
+		}
+	}
+
+	if !ok || key == "" || filter.Value == "" {
+		return SearchFilter{}, fmt.Errorf("invalid filter %q, expected key:value or key:>=value", s)
+	}
+	return filter, nil
+}
+
+// ParseSearchFilters parses filters written as "key:value"
+func ParseSearchFilters(values []string) ([]SearchFilter, error) {
+	filters := make([]SearchFilter, 0, len(values))
+	for _, value := range values {
+		filter, err := ParseSearchFilter(value)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// filterSet returns the documents passing every filter, or nil when there
+// are none. Range filters must all match, as must exact filters on
+// different keys; exact filters on the same key match any of their values.
+// Values are checked against the schema, and a filter that does not fit
+// its field's type is reported as a SchemaError. The set may be shared
+// with the index and must not be modified.
+func (e *SearchEngine) filterSet(filters []SearchFilter) (*Bitmap, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	var set *Bitmap
+	exact := make(map[string][]*Bitmap)
+	var keys []string
+	for _, filter := range filters {
+		typ := e.schema.Type(filter.Key)
+		if filter.Op != FilterEqual && !isRangeType(typ) {
+			return nil, &SchemaError{Field: filter.Key, Message: fmt.Sprintf("range filters need a %s or %s field, not %s", FieldTypeNumber, FieldTypeDate, typ)}
+		}
+
+		var matches *Bitmap
+		switch {
+		case isRangeType(typ):
+			value, err := parseRangeValue(filter.Key, typ, filter.Value)
+			if err != nil {
+				return nil, err
+			}
+			matches = e.rangeSet(filter.Key, filter.Op, value)
+		case typ == FieldTypeBoolean:
+			value, err := strconv.ParseBool(filter.Value)
+			if err != nil {
+				return nil, &SchemaError{Field: filter.Key, Message: fmt.Sprintf("%q is not a boolean", filter.Value)}
+			}
+			matches = e.index.TermSet(metadataFieldPrefix+filter.Key, strconv.FormatBool(value))
+		default:
+			matches = e.index.TermSet(metadataFieldPrefix+filter.Key, filter.Value)
+		}
+
+		if filter.Op != FilterEqual {
+			set = intersectSets(set, matches)
+			continue
+		}
+		if _, ok := exact[filter.Key]; !ok {
+			keys = append(keys, filter.Key)
+		}
+		exact[filter.Key] = append(exact[filter.Key], matches)
+	}
+
+	for _, key := range keys {
+		matches := exact[key][0]
+		for _, other := range exact[key][1:] {
+			matches = matches.Or(other)
+		}
+		set = intersectSets(set, matches)
+	}
+	return set, nil
+}
+
+// rangeSet returns the documents whose value for a number or date field
+// compares to value by op; equality matches the value exactly
+func (e *SearchEngine) rangeSet(key, op string, value float64) *Bitmap {
+	ranges, ok := e.values.ranges[key]
+	if !ok {
+		return NewBitmap()
+	}
+
+	switch op {
+	case FilterGreater:
+		return ranges.search(&rangeBound{value: value}, nil)
+	case FilterGreaterEqual:
+		return ranges.search(&rangeBound{value: value, inclusive: true}, nil)
+	case FilterLess:
+		return ranges.search(nil, &rangeBound{value: value})
+	case FilterLessEqual:
+		return ranges.search(nil, &rangeBound{value: value, inclusive: true})
+	}
+	bound := &rangeBound{value: value, inclusive: true}
+	return ranges.search(bound, bound)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// metadataDocument builds a document with metadata
+func metadataDocument(id, content string, metadata map[string]string) *Document {
+	doc := NewDocument(id, "", content)
+	doc.Metadata = metadata
+	return doc
+}
+
+func TestParseSearchFilter(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SearchFilter
+		wantErr bool
+	}{
+		{in: "lang:go", want: SearchFilter{Key: "lang", Value: "go"}},
+		{in: "metadata.lang:go", want: SearchFilter{Key: "lang", Value: "go"}},
+		{in: " lang :go", want: SearchFilter{Key: "lang", Value: "go"}},
+		// Only the first colon separates the key
+		{in: "url:https://example.com", want: SearchFilter{Key: "url", Value: "https://example.com"}},
+		{in: "priority:>3", want: SearchFilter{Key: "priority", Op: FilterGreater, Value: "3"}},
+		{in: "priority:>=3", want: SearchFilter{Key: "priority", Op: FilterGreaterEqual, Value: "3"}},
+		{in: "priority:< 3", want: SearchFilter{Key: "priority", Op: FilterLess, Value: "3"}},
+		{in: "published:<=2025-01-01", want: SearchFilter{Key: "published", Op: FilterLessEqual, Value: "2025-01-01"}},
+		{in: "lang", wantErr: true},
+		{in: ":go", wantErr: true},
+		{in: "lang:", wantErr: true},
+		{in: "priority:>=", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSearchFilter(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSearchFilter(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSearchFilter(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := ParseSearchFilters([]string{"lang:go", "team"}); err == nil {
+		t.Error("ParseSearchFilters with an invalid filter succeeded")
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		metadataDocument("1", "fast compiler", map[string]string{"lang": "go", "team": "infra"}),
+		metadataDocument("2", "fast compiler written in rust", map[string]string{"lang": "rust", "team": "infra"}),
+		metadataDocument("3", "fast web framework", map[string]string{"lang": "go", "team": "web"}),
+		metadataDocument("4", "fast scripts", nil),
+	)
+
+	tests := []struct {
+		query   string
+		filters []string
+		want    []string
+	}{
+		{"fast", []string{"lang:go"}, []string{"1", "3"}},
+		// Filters on different keys must all match
+		{"fast", []string{"lang:go", "team:infra"}, []string{"1"}},
+		// Filters on the same key match any of their values
+		{"fast", []string{"lang:go", "lang:rust"}, []string{"1", "2", "3"}},
+		{"fast", []string{"lang:Go"}, nil},
+		{"fast", []string{"lang:python"}, nil},
+		{"compiler", []string{"team:infra"}, []string{"1", "2"}},
+		// Without a query the documents passing the filters are listed
+		{"", []string{"team:infra"}, []string{"1", "2"}},
+		{" ", []string{"lang:go", "team:web"}, []string{"3"}},
+	}
+	for _, tt := range tests {
+		filters, err := ParseSearchFilters(tt.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ranking := range []bool{false, true} {
+			got := searchIDs(t, engine, tt.query, SearchOptions{UseRanking: ranking, Filters: filters})
+			sort.Strings(got)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("Search(%q, %v, ranking %v) = %v, want %v", tt.query, tt.filters, ranking, got, tt.want)
+			}
+		}
+	}
+
+	// Metadata is only matched through filters
+	if got := searchIDs(t, engine, "infra", SearchOptions{}); len(got) != 0 {
+		t.Errorf("Search(infra) = %v, want none", got)
+	}
+}
+
+func TestSearchFiltersKeepScores(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		metadataDocument("1", "rust rust compiler", map[string]string{"lang": "rust"}),
+		metadataDocument("2", "rust book", map[string]string{"lang": "go"}),
+		metadataDocument("3", "rust and go compiler", map[string]string{"lang": "rust"}),
+	)
+
+	scores := func(options SearchOptions) map[string]float64 {
+		t.Helper()
+		options.UseRanking, options.Limit = true, 10
+		result, err := engine.Search("rust compiler", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]float64, len(result.Documents))
+		for i, doc := range result.Documents {
+			byID[doc.ID] = result.Scores[i]
+		}
+		return byID
+	}
+
+	all := scores(SearchOptions{Mode: SearchModeOR})
+	filtered := scores(SearchOptions{Mode: SearchModeOR, Filters: []SearchFilter{{Key: "lang", Value: "rust"}}})
+	if len(filtered) != 2 {
+		t.Fatalf("filtered search returned %v, want documents 1 and 3", filtered)
+	}
+	for id, score := range filtered {
+		if !closeTo(score, all[id]) {
+			t.Errorf("score of %s = %v with the filter, %v without", id, score, all[id])
+		}
+	}
+}
+
+func TestSearchFilterAPI(t *testing.T) {
+	api, engine := newTestAPI(t)
+	addDocuments(t, engine,
+		metadataDocument("1", "fast compiler", map[string]string{"lang": "go"}),
+		metadataDocument("2", "fast compiler", map[string]string{"lang": "rust"}),
+	)
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/search?query=compiler&filter=lang:go", 200, `"total":1`},
+		{"/search?query=missing&filter=lang:go", 200, `"total":0`},
+		{"/search?filter=lang:rust", 200, `"id":"2"`},
+		{"/search?query=compiler&filter=lang", 400, "invalid filter"},
+		{"/search", 400, "query or filter parameter is required"},
+	}
+	for _, tt := range tests {
+		status, body := getJSON(t, api, tt.path)
+		if status != tt.status || !strings.Contains(body, tt.want) {
+			t.Errorf("GET %s = %d %s, want %d with %s", tt.path, status, body, tt.status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// QueryError is a syntax error in a query string
+type QueryError struct {
+	Position int    `json:"position"` // Character offset of the offending input
+	Message  string `json:"message"`
+}
+
+// Error implements error
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query parse error at position %d: %s", e.Position, e.Message)
+}
+
+// occur says how a clause takes part in a boolean query
+type occur int
+
+const (
+	occurShould occur = iota
+	occurMust
+	occurMustNot
+)
+
+type queryClause struct {
+	occur occur
+	query Query
+}
+
+// queryParser is a recursive descent parser for the query language:
+//
+//	go golang             terms, combined with the default operator
+//	go OR golang          either term; AND binds tighter than OR
+//	go AND NOT python     NOT or a leading - excludes, a leading + requires
+//	(go OR golang) -java  parentheses group clauses
+//	"open source"~2       phrases with optional slop (~N any order, ~>N in order)
+//	title:rust            field-qualified terms, phrases and groups
+//	rust^2                boosts on any clause
+type queryParser struct {
+	input    string
+	pos      int
+	analyzer Analyzer
+	options  SearchOptions
+	isField  func(name string) bool
+}
+
+// ParseQuery parses a query string into a query tree. isField reports
+// which field prefixes are valid. A nil query with a nil error means the
+// query analyzed to nothing searchable.
+func ParseQuery(input string, analyzer Analyzer, options SearchOptions, isField func(name string) bool) (Query, error) {
+	p := &queryParser{
+		input:    input,
+		analyzer: analyzer,
+		options:  options,
+		isField:  isField,
+	}
+
+	q, err := p.parseExpr("")
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.peekRune())
+	}
+
+	return dropStopwords(q), nil
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.pos, format, args...)
+}
+
+// errorAt returns a syntax error at a byte offset of the input
+func (p *queryParser) errorAt(pos int, format string, args ...interface{}) error {
+	return &QueryError{Position: p.charOffset(pos), Message: fmt.Sprintf(format, args...)}
+}
+
+// charOffset converts a byte offset of the input to a character offset
+func (p *queryParser) charOffset(pos int) int {
+	return utf8.RuneCountInString(p.input[:pos])
+}
+
+// isSpaceAt reports whether a whitespace character starts at a byte offset.
+// Characters are decoded whole, so bytes inside a multibyte character such
+// as 0x85 or 0xA0 are not mistaken for whitespace.
+func (p *queryParser) isSpaceAt(pos int) bool {
+	r, _ := utf8.DecodeRuneInString(p.input[pos:])
+	return unicode.IsSpace(r)
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.input) && p.isSpaceAt(p.pos) {
+		_, size := utf8.DecodeRuneInString(p.input[p.pos:])
+		p.pos += size
+	}
+}
+
+// peekRune returns the character at the cursor, for error messages
+func (p *queryParser) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	return r
+}
+
+func (p *queryParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// peekKeyword reports whether an operator keyword starts at the cursor
+func (p *queryParser) peekKeyword(keyword string) bool {
+	if !strings.HasPrefix(p.input[p.pos:], keyword) {
+		return false
+	}
+	end := p.pos + len(keyword)
+	return end == len(p.input) || p.isSpaceAt(end) || p.input[end] == '(' || p.input[end] == '"'
+}
+
+// parseExpr parses clauses up to a closing parenthesis or the end of input.
+// Runs of clauses separated by OR become should clauses of a boolean query.
+func (p *queryParser) parseExpr(field string) (Query, error) {
+	var groups [][]queryClause
+	var current []queryClause
+	requireNext := false
+
+	defaultOccur := occurMust
+	if p.options.Mode == SearchModeOR {
+		defaultOccur = occurShould
+	}
+
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.peek() == ')' {
+			break
+		}
+
+		switch {
+		case p.peekKeyword("OR"):
+			if len(current) == 0 {
+				return nil, p.errorf("OR must follow a clause")
+			}
+			p.pos += len("OR")
+			groups = append(groups, current)
+			current = nil
+			requireNext = false
+			continue
+		case p.peekKeyword("AND"):
+			if len(current) == 0 {
+				return nil, p.errorf("AND must follow a clause")
+			}
+			p.pos += len("AND")
+			if last := &current[len(current)-1]; last.occur == occurShould {
+				last.occur = occurMust
+			}
+			requireNext = true
+			continue
+		}
+
+		clauseOccur := defaultOccur
+		switch {
+		case p.peek() == '+':
+			clauseOccur = occurMust
+			p.pos++
+		case p.peek() == '-':
+			clauseOccur = occurMustNot
+			p.pos++
+		case p.peekKeyword("NOT"):
+			clauseOccur = occurMustNot
+			p.pos += len("NOT")
+			p.skipSpace()
+		}
+		if requireNext && clauseOccur == occurShould {
+			clauseOccur = occurMust
+		}
+		requireNext = false
+
+		// Clauses that analyze to nothing are kept as placeholders so
+		// operators around them still parse
+		q, err := p.parseClause(field)
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, queryClause{occur: clauseOccur, query: q})
+	}
+
+	if requireNext || (len(groups) > 0 && len(current) == 0) {
+		return nil, p.errorf("expected a clause")
+	}
+	if len(groups) == 0 {
+		return buildBoolean(current), nil
+	}
+
+	groups = append(groups, current)
+	or := &BooleanQuery{Boost: 1}
+	for _, group := range groups {
+		if q := buildBoolean(group); q != nil {
+			or.Should = append(or.Should, q)
+		}
+	}
+	return simplifyBoolean(or), nil
+}
+
+// parseClause parses a group, phrase or term with an optional field prefix
+// and boost
+func (p *queryParser) parseClause(field string) (Query, error) {
+	start := p.pos
+	var q Query
+	var err error
+
+	switch p.peek() {
+	case 0:
+		return nil, p.errorf("expected a clause")
+	case ')':
+		return nil, p.errorf("unexpected ')'")
+	case '(':
+		p.pos++
+		if q, err = p.parseExpr(field); err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ')' to close '(' at position %d", p.charOffset(start))
+		}
+		p.pos++
+	case '"':
+		if q, err = p.parsePhrase(field); err != nil {
+			return nil, err
+		}
+	default:
+		word, colon := p.readWord()
+		if word == "" {
+			return nil, p.errorf("unexpected %q", p.peekRune())
+		}
+
+		// field:value, field:"phrase" or field:(group)
+		if name, value, ok := splitField(word, colon); ok && (value != "" || p.peek() == '"' || p.peek() == '(') {
+			if field != "" {
+				return nil, p.errorAt(start, "field %q is nested inside field %q", name, field)
+			}
+			if !p.isField(name) {
+				return nil, p.errorAt(start, "unknown field %q", name)
+			}
+			if value == "" {
+				return p.parseClause(name)
+			}
+			word, field = value, name
+		}
+
+		q = p.analyzeClause(word, field, 0, false)
+	}
+
+	return p.parseBoost(q)
+}
+
+// parsePhrase parses a quoted phrase and its optional ~N or ~>N slop
+func (p *queryParser) parsePhrase(field string) (Query, error) {
+	start := p.pos
+	p.pos++ // opening quote
+
+	var sb strings.Builder
+	for {
+		if p.pos >= len(p.input) {
+			return nil, p.errorAt(start, "unterminated phrase")
+		}
+		c := p.input[p.pos]
+		p.pos++
+		if c == '"' {
+			break
+		}
+		if c == '\\' && p.pos < len(p.input) {
+			c = p.input[p.pos]
+			p.pos++
+		}
+		sb.WriteByte(c)
+	}
+
+	slop, inOrder := p.options.Slop, p.options.InOrder
+	if p.peek() == '~' {
+		p.pos++
+		inOrder = p.peek() == '>'
+		if inOrder {
+			p.pos++
+		}
+		n, err := p.readNumber()
+		if err != nil {
+			return nil, err
+		}
+		slop = int(n)
+	}
+
+	return p.analyzeClause(sb.String(), field, slop, inOrder), nil
+}
+
+// parseBoost applies an optional ^N suffix
+func (p *queryParser) parseBoost(q Query) (Query, error) {
+	if p.peek() != '^' {
+		return q, nil
+	}
+	p.pos++
+
+	boost, err := p.readNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	switch q := q.(type) {
+	case *TermQuery:
+		q.Boost = boost
+	case *PhraseQuery:
+		q.Boost = boost
+	case *BooleanQuery:
+		q.Boost = boost
+	}
+	return q, nil
+}
+
+// readNumber reads a non-negative number at the cursor
+func (p *queryParser) readNumber() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+		p.pos++
+	}
+
+	n, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, p.errorAt(start, "expected a number")
+	}
+	return n, nil
+}
+
+// readWord reads a bare term up to whitespace or a syntax character.
+// A backslash escapes the next character. It also returns the offset in
+// the term of the first colon that was not escaped, or -1.
+func (p *queryParser) readWord() (string, int) {
+	var sb strings.Builder
+	colon := -1
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if p.isSpaceAt(p.pos) || strings.IndexByte(`()"^`, c) >= 0 {
+			break
+		}
+		if c == '\\' && p.pos+1 < len(p.input) {
+			p.pos++
+		} else if c == ':' && colon < 0 {
+			colon = sb.Len()
+		}
+		_, size := utf8.DecodeRuneInString(p.input[p.pos:])
+		sb.WriteString(p.input[p.pos : p.pos+size])
+		p.pos += size
+	}
+	return sb.String(), colon
+}
+
+// splitField splits "name:value" at the colon at offset i, where name
+// looks like a field name. URLs ("http://...") and times ("10:30") are left
+// alone.
+func splitField(word string, i int) (string, string, bool) {
+	if i <= 0 || strings.HasPrefix(word[i+1:], "/") {
+		return "", "", false
+	}
+
+	name := word[:i]
+	for j, r := range name {
+		if !unicode.IsLetter(r) && (j == 0 || (!unicode.IsDigit(r) && r != '_' && r != '.')) {
+			return "", "", false
+		}
+	}
+	return name, word[i+1:], true
+}
+
+// analyzeClause runs text through the analyzer. One token becomes a term
+// query; several (a quoted phrase, or a word the analyzer splits such as CJK
+// bigrams) become a phrase query. Keyword fields match the text exactly.
+func (p *queryParser) analyzeClause(text, field string, slop int, inOrder bool) Query {
+	if isKeywordField(field) {
+		return &TermQuery{Field: field, Term: text, Boost: 1}
+	}
+
+	tokens := p.analyzer.Analyze(text)
+	switch len(tokens) {
+	case 0:
+		return nil
+	case 1:
+		return &TermQuery{Field: field, Term: tokens[0].Term, Boost: 1, stopword: tokens[0].Stopword}
+	}
+
+	phrase := &PhraseQuery{
+		Field:   field,
+		Terms:   make([]PhraseTerm, len(tokens)),
+		Slop:    slop,
+		InOrder: inOrder,
+		Boost:   1,
+	}
+	for i, token := range tokens {
+		phrase.Terms[i] = PhraseTerm{
+			Term:   token.Term,
+			Offset: token.Position - tokens[0].Position,
+		}
+	}
+	return phrase
+}
+
+// buildBoolean turns a run of clauses into a query
+func buildBoolean(clauses []queryClause) Query {
+	b := &BooleanQuery{Boost: 1}
+	for _, clause := range clauses {
+		if clause.query == nil {
+			continue
+		}
+		switch clause.occur {
+		case occurMust:
+			b.Must = append(b.Must, clause.query)
+		case occurMustNot:
+			b.MustNot = append(b.MustNot, clause.query)
+		default:
+			b.Should = append(b.Should, clause.query)
+		}
+	}
+	return simplifyBoolean(b)
+}
+
+// simplifyBoolean unwraps a boolean query with a single positive clause
+func simplifyBoolean(b *BooleanQuery) Query {
+	switch {
+	case len(b.Must)+len(b.Should)+len(b.MustNot) == 0:
+		return nil
+	case len(b.MustNot) == 0 && b.Boost == 1 && len(b.Must)+len(b.Should) == 1:
+		if len(b.Must) == 1 {
+			return b.Must[0]
+		}
+		return b.Should[0]
+	}
+	return b
+}
+
+// dropStopwords removes stopword terms from a query that has anything
+// else to search for, so "to be or not to be" still matches while "the"
+// does not dominate "the go language"
+func dropStopwords(q Query) Query {
+	if q == nil || !hasContentTerm(q) {
+		return q
+	}
+	return removeStopwords(q)
+}
+
+// hasContentTerm reports whether a positive clause has a non-stopword term
+func hasContentTerm(q Query) bool {
+	switch q := q.(type) {
+	case *TermQuery:
+		return !q.stopword
+	case *PhraseQuery:
+		return true
+	case *BooleanQuery:
+		for _, clauses := range [][]Query{q.Must, q.Should} {
+			for _, clause := range clauses {
+				if hasContentTerm(clause) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// removeStopwords drops stopword terms from the scoring clauses of the
+// query tree. Stopwords are indexed, so excluded clauses are kept whole:
+// "rust -the" still excludes documents containing "the".
+func removeStopwords(q Query) Query {
+	switch q := q.(type) {
+	case *TermQuery:
+		if q.stopword {
+			return nil
+		}
+	case *BooleanQuery:
+		filter := func(clauses []Query) []Query {
+			kept := clauses[:0]
+			for _, clause := range clauses {
+				if clause = removeStopwords(clause); clause != nil {
+					kept = append(kept, clause)
+				}
+			}
+			return kept
+		}
+		q.Must = filter(q.Must)
+		q.Should = filter(q.Should)
+		return simplifyBoolean(q)
+	}
+	return q
+}
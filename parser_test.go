@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// formatQuery writes a query tree in the query language: required and
+// excluded clauses are marked + and -, and boolean queries are wrapped in
+// parentheses. Phrase terms not at their offset in the phrase are written
+// term@offset.
+func formatQuery(q Query) string {
+	var sb strings.Builder
+	var write func(q Query)
+	write = func(q Query) {
+		boost := 1.0
+		switch q := q.(type) {
+		case nil:
+			sb.WriteString("<nil>")
+		case *TermQuery:
+			if q.Field != "" {
+				sb.WriteString(q.Field + ":")
+			}
+			sb.WriteString(q.Term)
+			boost = q.Boost
+		case *PhraseQuery:
+			if q.Field != "" {
+				sb.WriteString(q.Field + ":")
+			}
+			terms := make([]string, len(q.Terms))
+			for i, term := range q.Terms {
+				terms[i] = term.Term
+				if term.Offset != i {
+					terms[i] += "@" + strconv.Itoa(term.Offset)
+				}
+			}
+			sb.WriteString(`"` + strings.Join(terms, " ") + `"`)
+			switch {
+			case q.InOrder:
+				sb.WriteString("~>" + strconv.Itoa(q.Slop))
+			case q.Slop > 0:
+				sb.WriteString("~" + strconv.Itoa(q.Slop))
+			}
+			boost = q.Boost
+		case *BooleanQuery:
+			sb.WriteString("(")
+			n := 0
+			for _, group := range []struct {
+				prefix  string
+				clauses []Query
+			}{{"+", q.Must}, {"", q.Should}, {"-", q.MustNot}} {
+				for _, clause := range group.clauses {
+					if n > 0 {
+						sb.WriteString(" ")
+					}
+					sb.WriteString(group.prefix)
+					write(clause)
+					n++
+				}
+			}
+			sb.WriteString(")")
+			boost = q.Boost
+		}
+		if boost != 1 {
+			sb.WriteString("^" + strconv.FormatFloat(boost, 'g', -1, 64))
+		}
+	}
+	write(q)
+	return sb.String()
+}
+
+func englishAnalyzer(t *testing.T) Analyzer {
+	t.Helper()
+	analyzer, err := LookupAnalyzer("english", AnalyzerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return analyzer
+}
+
+func TestParseQuery(t *testing.T) {
+	analyzer := englishAnalyzer(t)
+	tests := []struct {
+		input   string
+		options SearchOptions
+		want    string
+	}{
+		// Operators
+		{input: "go", want: "go"},
+		{input: "go golang", want: "(+go +golang)"},
+		{input: "go golang", options: SearchOptions{Mode: SearchModeOR}, want: "(go golang)"},
+		{input: "go AND golang", options: SearchOptions{Mode: SearchModeOR}, want: "(+go +golang)"},
+		{input: "go OR golang", want: "(go golang)"},
+		{input: "go golang OR rust", want: "((+go +golang) rust)"},
+		{input: "go AND NOT python", want: "(+go -python)"},
+		{input: "-java +rust", want: "(+rust -java)"},
+		{input: "(go OR golang) -java", want: "(+(go golang) -java)"},
+		{input: "NOT(go)", want: "(-go)"},
+
+		// Phrases
+		{input: `"open source"`, want: `"open sourc"`},
+		{input: `"open source"~2`, want: `"open sourc"~2`},
+		{input: `"open source"~>2`, want: `"open sourc"~>2`},
+		{input: `"open source"`, options: SearchOptions{Slop: 1, InOrder: true}, want: `"open sourc"~>1`},
+		{input: `"open source"~0`, options: SearchOptions{Slop: 1}, want: `"open sourc"`},
+		{input: `"say \"hi\" there"`, want: `"say hi there"`},
+
+		// Fields and boosts
+		{input: "title:rust", want: "title:rust"},
+		{input: "title:rust^2", want: "title:rust^2"},
+		{input: `title:"open source"^1.5`, want: `title:"open sourc"^1.5`},
+		{input: "title:(rust OR go)", want: "(title:rust title:go)"},
+		{input: "(go OR golang)^2", want: "(go golang)^2"},
+		{input: "metadata.lang:Go", want: "metadata.lang:Go"},
+		{input: "http://example.com", want: `"http exampl com"`},
+		{input: `go\:lang`, want: `"go lang"`},
+
+		// CJK text is split into bigrams, however its UTF-8 bytes look
+		{input: "关键", want: "关键"},
+		{input: "内容", want: "内容"},
+		{input: "全文检索", want: `"全文 文检 检索"`},
+		{input: "title:关键 -内容", want: "(+title:关键 -内容)"},
+		{input: `关\键`, want: "关键"},
+
+		// Stopwords are dropped from scoring clauses only when something
+		// else is left to search for
+		{input: "the go language", want: "(+go +languag)"},
+		{input: "the", want: "the"},
+		{input: "to be or not to be", want: "(+to +be +or +not +to +be)"},
+		{input: "rust -the", want: "(+rust -the)"},
+		{input: `"the quick fox"`, want: `"the quick fox"`},
+		{input: "the OR rust", want: "rust"},
+
+		// Nothing searchable
+		{input: "", want: "<nil>"},
+		{input: "!!! ?", want: "<nil>"},
+		{input: "a OR b", want: "<nil>"},
+	}
+
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.input, analyzer, tt.options, isSearchableField)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.input, err)
+			continue
+		}
+		if got := formatQuery(q); got != tt.want {
+			t.Errorf("ParseQuery(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	analyzer := englishAnalyzer(t)
+	tests := []struct {
+		input    string
+		position int
+		message  string
+	}{
+		{"go AND", 6, "expected a clause"},
+		{"OR go", 0, "OR must follow a clause"},
+		{"AND go", 0, "AND must follow a clause"},
+		{"go OR", 5, "expected a clause"},
+		{`go "open source`, 3, "unterminated phrase"},
+		{"(go", 3, "expected ')' to close '(' at position 0"},
+		{"go)", 2, `unexpected ')'`},
+		{"author:go", 0, `unknown field "author"`},
+		{"title:(content:go)", 7, `field "content" is nested inside field "title"`},
+		{"go^x", 3, "expected a number"},
+		{`"go"~`, 5, "expected a number"},
+		{"关键 AND", 6, "expected a clause"},
+		{"关键 author:go", 3, `unknown field "author"`},
+		{"(关键", 3, "expected ')' to close '(' at position 0"},
+		{"内容 ^2", 3, `unexpected '^'`},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseQuery(tt.input, analyzer, SearchOptions{}, isSearchableField)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("ParseQuery(%q): err = %v, want a QueryError", tt.input, err)
+			continue
+		}
+		if queryErr.Position != tt.position || queryErr.Message != tt.message {
+			t.Errorf("ParseQuery(%q): error at %d %q, want at %d %q", tt.input, queryErr.Position, queryErr.Message, tt.position, tt.message)
+		}
+	}
+}
+
+func TestSplitField(t *testing.T) {
+	tests := []struct {
+		word        string
+		name, value string
+		ok          bool
+	}{
+		{"title:rust", "title", "rust", true},
+		{"metadata.lang:go", "metadata.lang", "go", true},
+		{"title:", "title", "", true},
+		{"http://example.com", "", "", false},
+		{"10:30", "", "", false},
+		{":go", "", "", false},
+		{"go", "", "", false},
+	}
+	for _, tt := range tests {
+		name, value, ok := splitField(tt.word, strings.IndexByte(tt.word, ':'))
+		if name != tt.name || value != tt.value || ok != tt.ok {
+			t.Errorf("splitField(%q) = %q, %q, %v, want %q, %q, %v", tt.word, name, value, ok, tt.name, tt.value, tt.ok)
+		}
+	}
+}
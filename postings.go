@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// postingsBlockSize is the number of documents in a block of a posting
+// list. Blocks are searched by their last document, so a lookup jumps over
+// whole blocks and decodes at most one, and changing a document re-encodes
+// only its block.
+const postingsBlockSize = 128
+
+// postingBlock is a run of documents of a posting list. Each document is a
+// varint delta from the previous document number (the first of a block is
+// stored in full, so blocks decode independently), a varint frequency, and
+// varint deltas between its positions.
+type postingBlock struct {
+	lastDoc uint32 // Highest document number in the block
+	count   int    // Documents in the block
+	data    []byte
+}
+
+// PostingList is the sorted, compressed list of documents containing a
+// term, stored by number in blocks of up to postingsBlockSize documents
+// (twice that after insertions before the block is split)
+type PostingList struct {
+	blocks []postingBlock
+	count  int // Documents in the list
+	freq   int // Occurrences over all documents
+}
+
+// postingEntry is a decoded document of a posting list
+type postingEntry struct {
+	doc       uint32
+	positions []int
+}
+
+// Len returns the number of documents in the list
+func (pl *PostingList) Len() int {
+	return pl.count
+}
+
+// TotalFreq returns the number of occurrences over all documents
+func (pl *PostingList) TotalFreq() int {
+	return pl.freq
+}
+
+// findBlock returns the first block that can contain a document
+func (pl *PostingList) findBlock(doc uint32) int {
+	return sort.Search(len(pl.blocks), func(i int) bool { return pl.blocks[i].lastDoc >= doc })
+}
+
+// add adds a document or replaces its positions. Documents numbered after
+// the last one are appended to the last block; anything else is spliced
+// into the block it belongs in.
+func (pl *PostingList) add(doc uint32, positions []int) {
+	if pl.count == 0 || doc > pl.blocks[len(pl.blocks)-1].lastDoc {
+		pl.append(doc, positions)
+		return
+	}
+
+	b := pl.findBlock(doc)
+	block := &pl.blocks[b]
+	prev, start, end, freq, found := block.locate(doc)
+	entry := appendEntry(nil, doc-prev, positions)
+	if found {
+		pl.freq -= freq
+		block.splice(start, end, entry, doc, doc)
+	} else {
+		block.splice(start, end, entry, prev, doc)
+		block.count++
+		pl.count++
+	}
+	pl.freq += len(positions)
+
+	if block.count > 2*postingsBlockSize {
+		// Split an overfull block in two
+		entries := block.entries()
+		half := len(entries) / 2
+		pl.blocks = append(pl.blocks, postingBlock{})
+		copy(pl.blocks[b+2:], pl.blocks[b+1:])
+		pl.blocks[b] = encodeBlock(entries[:half])
+		pl.blocks[b+1] = encodeBlock(entries[half:])
+	}
+}
+
+// remove removes a document and reports whether it was in the list. Only
+// the document's block is touched.
+func (pl *PostingList) remove(doc uint32) bool {
+	b := pl.findBlock(doc)
+	if b == len(pl.blocks) {
+		return false
+	}
+
+	block := &pl.blocks[b]
+	prev, start, end, freq, found := block.locate(doc)
+	if !found {
+		return false
+	}
+
+	pl.count--
+	pl.freq -= freq
+	if block.count == 1 {
+		pl.blocks = append(pl.blocks[:b], pl.blocks[b+1:]...)
+		return true
+	}
+
+	block.splice(start, end, nil, doc, prev)
+	block.count--
+	if block.lastDoc == doc {
+		block.lastDoc = prev
+	}
+	return true
+}
+
+// locate finds a document in the block. It returns the previous document
+// of the block (0 if none), the byte range of the document's entry (empty
+// at the insertion point if it is missing) and its frequency.
+func (block *postingBlock) locate(doc uint32) (prev uint32, start, end, freq int, found bool) {
+	it := &postingIterator{}
+	it.enter(block.data)
+	for {
+		start = it.offset
+		if !it.nextInBlock() || it.doc > doc {
+			return prev, start, start, 0, false
+		}
+		if it.doc == doc {
+			return prev, start, it.offset, it.freq, true
+		}
+		prev = it.doc
+	}
+}
+
+// splice replaces the bytes in [start, end) with an encoded entry. The
+// entry after them stores its document as a delta from the document that
+// preceded it, oldPrev, and is re-encoded relative to newPrev.
+func (block *postingBlock) splice(start, end int, entry []byte, oldPrev, newPrev uint32) {
+	data := make([]byte, 0, len(block.data)+len(entry)+binary.MaxVarintLen32)
+	data = append(data, block.data[:start]...)
+	data = append(data, entry...)
+	if end < len(block.data) {
+		delta, n := binary.Uvarint(block.data[end:])
+		data = binary.AppendUvarint(data, uint64(oldPrev+uint32(delta)-newPrev))
+		end += n
+	}
+	block.data = append(data, block.data[end:]...)
+}
+
+// append adds a document numbered after every document in the list
+func (pl *PostingList) append(doc uint32, positions []int) {
+	if n := len(pl.blocks); n == 0 || pl.blocks[n-1].count >= postingsBlockSize {
+		pl.blocks = append(pl.blocks, postingBlock{})
+	}
+	pl.blocks[len(pl.blocks)-1].append(doc, positions)
+	pl.count++
+	pl.freq += len(positions)
+}
+
+// append encodes a document numbered after every document in the block
+func (block *postingBlock) append(doc uint32, positions []int) {
+	var prev uint32
+	if block.count > 0 {
+		prev = block.lastDoc
+	}
+
+	block.data = appendEntry(block.data, doc-prev, positions)
+	block.lastDoc = doc
+	block.count++
+}
+
+// appendEntry encodes a document entry: its delta from the previous
+// document, its frequency and the deltas between its positions
+func appendEntry(data []byte, delta uint32, positions []int) []byte {
+	data = binary.AppendUvarint(data, uint64(delta))
+	data = binary.AppendUvarint(data, uint64(len(positions)))
+	last := 0
+	for _, pos := range positions {
+		data = binary.AppendUvarint(data, uint64(pos-last))
+		last = pos
+	}
+	return data
+}
+
+// encodeBlock encodes sorted entries as one block
+func encodeBlock(entries []postingEntry) postingBlock {
+	var block postingBlock
+	for _, entry := range entries {
+		block.append(entry.doc, entry.positions)
+	}
+	return block
+}
+
+// entries decodes every document of the block
+func (block *postingBlock) entries() []postingEntry {
+	entries := make([]postingEntry, 0, block.count)
+	it := &postingIterator{}
+	it.enter(block.data)
+	for it.nextInBlock() {
+		entries = append(entries, postingEntry{doc: it.doc, positions: it.positions()})
+	}
+	return entries
+}
+
+// docs returns the document numbers of the list in ascending order
+func (pl *PostingList) docs() []uint32 {
+	docs := make([]uint32, 0, pl.count)
+	it := pl.iterator()
+	for it.next() {
+		docs = append(docs, it.doc)
+	}
+	return docs
+}
+
+// MarshalBinary encodes the list: its document and occurrence counts, the
+// number of blocks, then each block's last document, count, length and data
+func (pl *PostingList) MarshalBinary() ([]byte, error) {
+	size := 16
+	for _, block := range pl.blocks {
+		size += len(block.data) + 12
+	}
+
+	buf := make([]byte, 0, size)
+	buf = binary.AppendUvarint(buf, uint64(pl.count))
+	buf = binary.AppendUvarint(buf, uint64(pl.freq))
+	buf = binary.AppendUvarint(buf, uint64(len(pl.blocks)))
+	for _, block := range pl.blocks {
+		buf = binary.AppendUvarint(buf, uint64(block.lastDoc))
+		buf = binary.AppendUvarint(buf, uint64(block.count))
+		buf = binary.AppendUvarint(buf, uint64(len(block.data)))
+		buf = append(buf, block.data...)
+	}
+	return buf, nil
+}
+
+// errCorruptPostings is returned when a posting list cannot be decoded
+var errCorruptPostings = fmt.Errorf("%w: bad posting list", errCorruptIndex)
+
+// UnmarshalBinary decodes a list encoded by MarshalBinary. Every block is
+// checked, so a corrupt list is an error rather than a panic when it is
+// read.
+func (pl *PostingList) UnmarshalBinary(data []byte) error {
+	read := func() uint64 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			data = nil
+			return 0
+		}
+		data = data[n:]
+		return value
+	}
+
+	count, freq, blocks := read(), read(), read()
+	if data == nil || blocks > uint64(len(data)) || count > math.MaxInt32 || freq > math.MaxInt32 {
+		return errCorruptPostings
+	}
+
+	*pl = PostingList{
+		count:  int(count),
+		freq:   int(freq),
+		blocks: make([]postingBlock, blocks),
+	}
+	var docs, total int
+	for i := range pl.blocks {
+		lastDoc, count, size := read(), read(), read()
+		if data == nil || size > uint64(len(data)) || lastDoc > math.MaxUint32 || count == 0 || count > size {
+			return errCorruptPostings
+		}
+		block := postingBlock{
+			lastDoc: uint32(lastDoc),
+			count:   int(count),
+			data:    append([]byte(nil), data[:size]...),
+		}
+		if i > 0 && block.lastDoc <= pl.blocks[i-1].lastDoc {
+			return errCorruptPostings
+		}
+		blockFreq, err := checkBlock(block)
+		if err != nil {
+			return err
+		}
+		pl.blocks[i] = block
+		docs += block.count
+		total += blockFreq
+		data = data[size:]
+	}
+	if len(data) > 0 || docs != pl.count || total != pl.freq {
+		return errCorruptPostings
+	}
+	return nil
+}
+
+// checkBlock checks that block data holds count documents in increasing
+// order ending at lastDoc, with their positions, and returns their total
+// frequency
+func checkBlock(block postingBlock) (int, error) {
+	data := block.data
+	read := func() (uint64, bool) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, false
+		}
+		data = data[n:]
+		return value, true
+	}
+
+	var doc uint64
+	total := 0
+	for i := 0; i < block.count; i++ {
+		delta, ok := read()
+		if !ok || (i > 0 && delta == 0) || doc+delta > math.MaxUint32 {
+			return 0, errCorruptPostings
+		}
+		doc += delta
+		freq, ok := read()
+		if !ok || freq == 0 || freq > uint64(len(data)) {
+			return 0, errCorruptPostings
+		}
+		for j := uint64(0); j < freq; j++ {
+			if _, ok := read(); !ok {
+				return 0, errCorruptPostings
+			}
+		}
+		total += int(freq)
+	}
+	if len(data) > 0 || doc != uint64(block.lastDoc) {
+		return 0, errCorruptPostings
+	}
+	return total, nil
+}
+
+// iterator returns an iterator positioned before the first document
+func (pl *PostingList) iterator() *postingIterator {
+	return &postingIterator{list: pl, block: -1}
+}
+
+// postingIterator walks a posting list in document order
+type postingIterator struct {
+	list        *PostingList
+	block       int    // Current block, -1 before the first
+	data        []byte // Data of the current block
+	offset      int    // Offset of the next document in the data
+	doc         uint32 // Current document
+	valid       bool   // Whether doc is a document of the list
+	freq        int    // Frequency in the current document
+	positionsAt int    // Offset of the current document's positions
+}
+
+// next moves to the next document and reports whether there is one
+func (it *postingIterator) next() bool {
+	for !it.nextInBlock() {
+		if it.block+1 >= len(it.list.blocks) {
+			it.block = len(it.list.blocks)
+			it.valid = false
+			return false
+		}
+		it.enterBlock(it.block + 1)
+	}
+	return true
+}
+
+// nextInBlock moves to the next document of the current block
+func (it *postingIterator) nextInBlock() bool {
+	if it.offset >= len(it.data) {
+		return false
+	}
+
+	delta, n := binary.Uvarint(it.data[it.offset:])
+	it.offset += n
+	freq, n := binary.Uvarint(it.data[it.offset:])
+	it.offset += n
+
+	it.doc += uint32(delta)
+	it.valid = true
+	it.freq = int(freq)
+	it.positionsAt = it.offset
+
+	// Skip the positions; they are decoded on demand
+	for i := 0; i < it.freq; i++ {
+		for it.data[it.offset] >= 0x80 {
+			it.offset++
+		}
+		it.offset++
+	}
+	return true
+}
+
+// advance moves to the first document numbered target or higher, skipping
+// blocks that end before it, and reports whether there is one. It does not
+// move if the current document already qualifies.
+func (it *postingIterator) advance(target uint32) bool {
+	blocks := it.list.blocks
+	if it.block >= len(blocks) {
+		return false
+	}
+	if it.valid && it.doc >= target {
+		return true
+	}
+
+	if it.block < 0 || blocks[it.block].lastDoc < target {
+		block := it.list.findBlock(target)
+		if block == len(blocks) {
+			it.block = block
+			it.valid = false
+			return false
+		}
+		it.enterBlock(block)
+	}
+
+	for it.next() {
+		if it.doc >= target {
+			return true
+		}
+	}
+	return false
+}
+
+// enterBlock positions the iterator before the first document of a block
+func (it *postingIterator) enterBlock(block int) {
+	it.block = block
+	it.enter(it.list.blocks[block].data)
+}
+
+// enter positions the iterator before the first document of block data
+func (it *postingIterator) enter(data []byte) {
+	it.data = data
+	it.offset = 0
+	it.doc = 0
+	it.valid = false
+}
+
+// positions decodes the positions of the current document
+func (it *postingIterator) positions() []int {
+	positions := make([]int, it.freq)
+	offset, last := it.positionsAt, 0
+	for i := range positions {
+		delta, n := binary.Uvarint(it.data[offset:])
+		offset += n
+		last += int(delta)
+		positions[i] = last
+	}
+	return positions
+}
+
+// intersectPostings calls visit for every document present in all
+// iterators, in document order. The rarest list leads and the others
+// advance to its documents, skipping whole blocks.
+func intersectPostings(iters []*postingIterator, visit func(doc uint32)) {
+	if len(iters) == 0 {
+		return
+	}
+
+	order := append([]*postingIterator(nil), iters...)
+	sort.Slice(order, func(i, j int) bool { return order[i].list.Len() < order[j].list.Len() })
+
+	lead := order[0]
+	if !lead.next() {
+		return
+	}
+	target := lead.doc
+	for {
+		matched := true
+		for _, it := range order {
+			if !it.advance(target) {
+				return
+			}
+			if it.doc > target {
+				target = it.doc
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		visit(target)
+		if !lead.next() {
+			return
+		}
+		target = lead.doc
+	}
+}
+
+// unionPostings returns the documents present in any iterator, in document
+// order
+func unionPostings(iters []*postingIterator) []uint32 {
+	active := make([]*postingIterator, 0, len(iters))
+	for _, it := range iters {
+		if it.next() {
+			active = append(active, it)
+		}
+	}
+
+	var docs []uint32
+	for len(active) > 0 {
+		min := active[0].doc
+		for _, it := range active[1:] {
+			if it.doc < min {
+				min = it.doc
+			}
+		}
+		docs = append(docs, min)
+
+		remaining := active[:0]
+		for _, it := range active {
+			if it.doc != min || it.next() {
+				remaining = append(remaining, it)
+			}
+		}
+		active = remaining
+	}
+	return docs
+}
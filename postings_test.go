@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// postingsModel is the expected content of a posting list
+type postingsModel map[uint32][]int
+
+func (m postingsModel) docs() []uint32 {
+	docs := make([]uint32, 0, len(m))
+	for doc := range m {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i] < docs[j] })
+	return docs
+}
+
+// checkPostings compares a posting list with the model, including the
+// positions of every document
+func checkPostings(t *testing.T, pl *PostingList, want postingsModel) {
+	t.Helper()
+
+	freq := 0
+	for _, positions := range want {
+		freq += len(positions)
+	}
+	if pl.Len() != len(want) || pl.TotalFreq() != freq {
+		t.Fatalf("Len, TotalFreq = %d, %d, want %d, %d", pl.Len(), pl.TotalFreq(), len(want), freq)
+	}
+
+	got := make(postingsModel)
+	it := pl.iterator()
+	for it.next() {
+		got[it.doc] = it.positions()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("postings = %v, want %v", got, want)
+	}
+	if docs := pl.docs(); !reflect.DeepEqual(docs, want.docs()) && len(want) > 0 {
+		t.Fatalf("docs() = %v, want %v", docs, want.docs())
+	}
+}
+
+func randomPositions(r *rand.Rand) []int {
+	positions := make([]int, 1+r.Intn(4))
+	at := r.Intn(10)
+	for i := range positions {
+		positions[i] = at
+		at += 1 + r.Intn(50)
+	}
+	return positions
+}
+
+func TestPostingListAddRemove(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pl := &PostingList{}
+	want := make(postingsModel)
+
+	// Enough documents, out of order, to split blocks, then removals that
+	// empty some of them
+	for i := 0; i < 5000; i++ {
+		doc := uint32(r.Intn(2000))
+		if r.Intn(3) == 0 {
+			_, ok := want[doc]
+			if removed := pl.remove(doc); removed != ok {
+				t.Fatalf("remove(%d) = %v, want %v", doc, removed, ok)
+			}
+			delete(want, doc)
+			continue
+		}
+		positions := randomPositions(r)
+		pl.add(doc, positions)
+		want[doc] = positions
+	}
+	checkPostings(t, pl, want)
+
+	for i, block := range pl.blocks {
+		if block.count == 0 || block.count > 2*postingsBlockSize {
+			t.Fatalf("block %d has %d documents", i, block.count)
+		}
+	}
+
+	for _, doc := range want.docs() {
+		pl.remove(doc)
+	}
+	checkPostings(t, pl, postingsModel{})
+	if len(pl.blocks) != 0 {
+		t.Fatalf("%d blocks left in an empty list", len(pl.blocks))
+	}
+}
+
+func TestPostingListAppendInOrder(t *testing.T) {
+	pl := &PostingList{}
+	want := make(postingsModel)
+	for doc := uint32(0); doc < 3*postingsBlockSize+5; doc++ {
+		pl.add(doc, []int{int(doc)})
+		want[doc] = []int{int(doc)}
+	}
+	checkPostings(t, pl, want)
+	if len(pl.blocks) != 4 {
+		t.Fatalf("appending %d documents made %d blocks, want 4", len(want), len(pl.blocks))
+	}
+}
+
+func TestPostingListMarshalRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for _, n := range []int{0, 1, postingsBlockSize, 1000} {
+		pl := &PostingList{}
+		want := make(postingsModel)
+		for i := 0; i < n; i++ {
+			doc := uint32(r.Intn(1 << 20))
+			positions := randomPositions(r)
+			pl.add(doc, positions)
+			want[doc] = positions
+		}
+
+		data, err := pl.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded PostingList
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%d documents: %v", n, err)
+		}
+		checkPostings(t, &decoded, want)
+	}
+}
+
+func TestPostingListUnmarshalCorrupt(t *testing.T) {
+	pl := &PostingList{}
+	for doc := uint32(0); doc < 300; doc += 2 {
+		pl.add(doc, []int{1, 4})
+	}
+	data, err := pl.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][]byte{
+		"empty":          nil,
+		"truncated":      data[:len(data)/2],
+		"trailing bytes": append(append([]byte(nil), data...), 0),
+		"wrong count":    append([]byte{byte(data[0] + 1)}, data[1:]...),
+		"huge blocks":    {1, 1, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		"empty block":    {0, 0, 1, 0, 0, 0},
+		"bad lastDoc":    {1, 1, 1, 7, 1, 2, 3, 1, 0},
+		"zero freq":      {1, 0, 1, 3, 1, 2, 3, 0},
+	}
+	for name, input := range cases {
+		var decoded PostingList
+		if err := decoded.UnmarshalBinary(input); !errors.Is(err, errCorruptIndex) {
+			t.Errorf("%s: err = %v, want errCorruptIndex", name, err)
+		}
+	}
+
+	// Random damage must be reported or decode to a list that can be read
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 20000; i++ {
+		damaged := append([]byte(nil), data...)
+		damaged[r.Intn(len(damaged))] = byte(r.Intn(256))
+		var decoded PostingList
+		if err := decoded.UnmarshalBinary(damaged); err != nil {
+			if !errors.Is(err, errCorruptIndex) {
+				t.Fatalf("err = %v, want errCorruptIndex", err)
+			}
+			continue
+		}
+		it := decoded.iterator()
+		for it.next() {
+			it.positions()
+		}
+	}
+}
+
+func TestIntersectAndUnionPostings(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	models := make([]postingsModel, 3)
+	lists := make([]*PostingList, 3)
+	for i, density := range []int{2, 5, 50} {
+		models[i] = make(postingsModel)
+		lists[i] = &PostingList{}
+		for doc := uint32(0); doc < 5000; doc++ {
+			if r.Intn(density) == 0 {
+				models[i][doc] = []int{0}
+				lists[i].add(doc, []int{0})
+			}
+		}
+	}
+
+	iterators := func() []*postingIterator {
+		iters := make([]*postingIterator, len(lists))
+		for i, pl := range lists {
+			iters[i] = pl.iterator()
+		}
+		return iters
+	}
+
+	var wantAnd, wantOr []uint32
+	for doc := uint32(0); doc < 5000; doc++ {
+		in := 0
+		for _, m := range models {
+			if _, ok := m[doc]; ok {
+				in++
+			}
+		}
+		if in == len(models) {
+			wantAnd = append(wantAnd, doc)
+		}
+		if in > 0 {
+			wantOr = append(wantOr, doc)
+		}
+	}
+
+	var gotAnd []uint32
+	intersectPostings(iterators(), func(doc uint32) { gotAnd = append(gotAnd, doc) })
+	if !reflect.DeepEqual(gotAnd, wantAnd) {
+		t.Errorf("intersection = %v, want %v", gotAnd, wantAnd)
+	}
+	if gotOr := unionPostings(iterators()); !reflect.DeepEqual(gotOr, wantOr) {
+		t.Errorf("union has %d documents, want %d", len(gotOr), len(wantOr))
+	}
+}
+
+func TestPostingIteratorAdvance(t *testing.T) {
+	pl := &PostingList{}
+	for doc := uint32(10); doc < 2000; doc += 10 {
+		pl.add(doc, []int{0})
+	}
+
+	it := pl.iterator()
+	for _, step := range []struct {
+		target uint32
+		want   uint32
+		ok     bool
+	}{
+		{0, 10, true},
+		{10, 10, true}, // Does not move when the current document qualifies
+		{15, 20, true},
+		{1500, 1500, true},
+		{1991, 0, false},
+	} {
+		ok := it.advance(step.target)
+		if ok != step.ok || (ok && it.doc != step.want) {
+			t.Fatalf("advance(%d) = %v at %d, want %v at %d", step.target, ok, it.doc, step.ok, step.want)
+		}
+	}
+}
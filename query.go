@@ -0,0 +1,225 @@
+package main
+
+// Query is a node of a parsed query tree
+type Query interface {
+	isQuery()
+}
+
+// TermQuery matches documents containing a single term
+type TermQuery struct {
+	Field string
+	Term  string
+	Boost float64
+
+	stopword bool
+}
+
+// PhraseQuery matches terms at fixed offsets from each other, or within
+// Slop extra positions when Slop > 0
+type PhraseQuery struct {
+	Field   string
+	Terms   []PhraseTerm
+	Slop    int
+	InOrder bool
+	Boost   float64
+
+	// matches holds the (possibly sloppy) phrase frequency per document,
+	// filled in before the query is evaluated
+	matches map[string]float64
+}
+
+// BooleanQuery combines clauses. A document matches when it matches every
+// Must clause, no MustNot clause, and at least one Should clause if there
+// are no Must clauses. Should clauses only add to the score otherwise.
+type BooleanQuery struct {
+	Must    []Query
+	Should  []Query
+	MustNot []Query
+	Boost   float64
+}
+
+// MultiFieldQuery is one term or phrase searched across several fields
+// and scored as a single term with BM25F. Clauses holds one TermQuery or
+// PhraseQuery per field, boosted by the field weight.
+type MultiFieldQuery struct {
+	Clauses []Query
+	Boost   float64
+
+	// docFreq is the number of documents matching any clause, filled in
+	// before the query is evaluated
+	docFreq int
+}
+
+func (*TermQuery) isQuery()       {}
+func (*PhraseQuery) isQuery()     {}
+func (*BooleanQuery) isQuery()    {}
+func (*MultiFieldQuery) isQuery() {}
+
+// queryMatches reports whether a document matches the query
+func queryMatches(q Query, stats *DocStats) bool {
+	switch q := q.(type) {
+	case *TermQuery:
+		return stats.TermFrequency(q.Field, q.Term) > 0
+	case *PhraseQuery:
+		return q.matches[stats.ID] > 0
+	case *BooleanQuery:
+		for _, clause := range q.MustNot {
+			if queryMatches(clause, stats) {
+				return false
+			}
+		}
+		for _, clause := range q.Must {
+			if !queryMatches(clause, stats) {
+				return false
+			}
+		}
+		if len(q.Must) > 0 || len(q.Should) == 0 {
+			return true
+		}
+		for _, clause := range q.Should {
+			if queryMatches(clause, stats) {
+				return true
+			}
+		}
+	case *MultiFieldQuery:
+		for _, clause := range q.Clauses {
+			if queryMatches(clause, stats) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryPhrases returns every phrase in the query tree
+func queryPhrases(q Query) []*PhraseQuery {
+	switch q := q.(type) {
+	case *PhraseQuery:
+		return []*PhraseQuery{q}
+	case *BooleanQuery:
+		var phrases []*PhraseQuery
+		for _, clauses := range [][]Query{q.Must, q.Should, q.MustNot} {
+			for _, clause := range clauses {
+				phrases = append(phrases, queryPhrases(clause)...)
+			}
+		}
+		return phrases
+	case *MultiFieldQuery:
+		var phrases []*PhraseQuery
+		for _, clause := range q.Clauses {
+			phrases = append(phrases, queryPhrases(clause)...)
+		}
+		return phrases
+	}
+	return nil
+}
+
+// multiFieldQueries returns every multi-field query in the query tree
+func multiFieldQueries(q Query) []*MultiFieldQuery {
+	switch q := q.(type) {
+	case *MultiFieldQuery:
+		return []*MultiFieldQuery{q}
+	case *BooleanQuery:
+		var multi []*MultiFieldQuery
+		for _, clauses := range [][]Query{q.Must, q.Should, q.MustNot} {
+			for _, clause := range clauses {
+				multi = append(multi, multiFieldQueries(clause)...)
+			}
+		}
+		return multi
+	}
+	return nil
+}
+
+// matchesWithoutTerms reports whether a document containing none of the
+// positive terms can still match, as with a purely negative query like
+// "-python"
+func matchesWithoutTerms(q Query) bool {
+	b, ok := q.(*BooleanQuery)
+	if !ok {
+		return false
+	}
+
+	for _, clause := range b.Must {
+		if !matchesWithoutTerms(clause) {
+			return false
+		}
+	}
+	if len(b.Must) > 0 || len(b.Should) == 0 {
+		return true
+	}
+	for _, clause := range b.Should {
+		if matchesWithoutTerms(clause) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandFields resolves terms and phrases without a field against the
+// search fields and applies the field weights. By default a clause over
+// several fields becomes a should query, so its score is the sum of the
+// per-field scores; with blend every term or phrase becomes a
+// MultiFieldQuery scored with BM25F.
+func expandFields(q Query, fields []string, weights map[string]float64, blend bool) Query {
+	var expanded []Query
+	var boost float64
+	switch q := q.(type) {
+	case *TermQuery:
+		if q.Field != "" {
+			q.Boost = queryBoost(q.Boost) * fieldWeight(weights, q.Field)
+			expanded, boost = []Query{q}, 1
+			break
+		}
+		for _, field := range fields {
+			expanded = append(expanded, &TermQuery{Field: field, Term: q.Term, Boost: fieldWeight(weights, field)})
+		}
+		boost = queryBoost(q.Boost)
+	case *PhraseQuery:
+		if q.Field != "" {
+			q.Boost = queryBoost(q.Boost) * fieldWeight(weights, q.Field)
+			expanded, boost = []Query{q}, 1
+			break
+		}
+		for _, field := range fields {
+			phrase := *q
+			phrase.Field = field
+			phrase.Boost = fieldWeight(weights, field)
+			expanded = append(expanded, &phrase)
+		}
+		boost = queryBoost(q.Boost)
+	case *BooleanQuery:
+		for _, clauses := range [][]Query{q.Must, q.Should, q.MustNot} {
+			for i, clause := range clauses {
+				clauses[i] = expandFields(clause, fields, weights, blend)
+			}
+		}
+		return q
+	default:
+		return q
+	}
+
+	if blend {
+		return &MultiFieldQuery{Clauses: expanded, Boost: boost}
+	}
+	if len(expanded) == 1 && boost == 1 {
+		return expanded[0]
+	}
+	return simplifyBoolean(&BooleanQuery{Should: expanded, Boost: boost})
+}
+
+// fieldWeight returns the weight of a field, defaulting to 1
+func fieldWeight(weights map[string]float64, field string) float64 {
+	if weight, ok := weights[field]; ok {
+		return weight
+	}
+	return 1
+}
+
+// queryBoost returns the boost of a query node, defaulting to 1
+func queryBoost(boost float64) float64 {
+	if boost == 0 {
+		return 1
+	}
+	return boost
+}
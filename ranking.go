@@ -1,78 +1,512 @@
 package main
 
 import (
+	"container/heap"
+	"fmt"
 	"math"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// BM25 implements the BM25 ranking algorithm
-type BM25 struct {
-	K1 float64 // Term frequency saturation parameter
-	B  float64 // Length normalization parameter
+// DefaultScorer is the scorer used when none is configured
+const DefaultScorer = "bm25"
+
+// ScoringConfig is the per-index scoring setup saved in the metadata bucket
+type ScoringConfig struct {
+	Scorer      string             `json:"scorer"`
+	Params      map[string]float64 `json:"params,omitempty"`
+	FieldBoosts map[string]float64 `json:"field_boosts,omitempty"`
+}
+
+// DefaultScoringConfig returns the scoring setup of a new index
+func DefaultScoringConfig() ScoringConfig {
+	return ScoringConfig{Scorer: DefaultScorer}
+}
+
+// TermStats are the statistics of one term or phrase in one field of a
+// document, as seen by a scorer
+type TermStats struct {
+	Field            string
+	Freq             float64 // Occurrences in the field, or the phrase frequency
+	FieldLength      float64 // Tokens in the field
+	AvgFieldLength   float64 // Average tokens in the field over the index
+	DocFreq          float64 // Documents containing the term
+	TotalDocs        float64 // Documents in the index
+	CollectionFreq   float64 // Occurrences in the field over the index
+	CollectionLength float64 // Tokens in the field over the index
+	Weight           float64 // Field weight, used when blending fields
+}
+
+// Scorer scores a term or phrase found in a field of a document. When expl
+// is not nil the scorer records how it computed the score as a child of it.
+type Scorer interface {
+	ScoreTerm(t TermStats, expl *Explanation) float64
+}
+
+// FieldScorer is a scorer that scores a term found in several fields as one
+// term (BM25F). Terms without a field prefix are blended across the search
+// fields when the scorer is a FieldScorer.
+type FieldScorer interface {
+	Scorer
+	ScoreFields(fields []TermStats, expl *Explanation) float64
+}
+
+// ScorerFactory builds a scorer from its parameters
+type ScorerFactory func(params map[string]float64) (Scorer, error)
+
+var (
+	scorersMu sync.RWMutex
+	scorers   = make(map[string]ScorerFactory)
+)
+
+// RegisterScorer makes a scorer available by name
+func RegisterScorer(name string, factory ScorerFactory) {
+	scorersMu.Lock()
+	defer scorersMu.Unlock()
+	scorers[name] = factory
 }
 
-// NewBM25 creates a new BM25 ranker with default parameters
-func NewBM25() *BM25 {
-	return &BM25{
-		K1: 1.5,
-		B:  0.75,
+// LookupScorer returns a registered scorer configured with params
+func LookupScorer(name string, params map[string]float64) (Scorer, error) {
+	scorersMu.RLock()
+	factory, ok := scorers[name]
+	scorersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown scorer %q (available: %v)", name, ScorerNames())
 	}
+	return factory(params)
 }
 
-// Score calculates BM25 score for a document
-func (bm25 *BM25) Score(queryTerms []string, docStats *DocStats, idx *Index, avgDocLength float64) float64 {
-	score := 0.0
-	docLength := float64(docStats.Length)
-	totalDocs := float64(idx.TotalDocuments())
+// ScorerNames returns the names of all registered scorers
+func ScorerNames() []string {
+	scorersMu.RLock()
+	defer scorersMu.RUnlock()
+
+	names := make([]string, 0, len(scorers))
+	for name := range scorers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	for _, term := range queryTerms {
-		// Get term frequency in document
-		tf := float64(docStats.TermFrequencies[term])
-		if tf == 0 {
+// withScorerDefaults fills in default parameter values and rejects
+// parameters the scorer does not have
+func withScorerDefaults(scorer string, params, defaults map[string]float64) (map[string]float64, error) {
+	merged := make(map[string]float64, len(defaults))
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range params {
+		if _, ok := defaults[name]; !ok {
+			if len(defaults) == 0 {
+				return nil, fmt.Errorf("scorer %q has no parameters", scorer)
+			}
+			return nil, fmt.Errorf("scorer %q has no parameter %q (available: %s)", scorer, name, FormatNamedValues(defaults))
+		}
+		merged[name] = value
+	}
+	return merged, nil
+}
+
+// parseNamedValues parses "name:value" pairs separated by commas
+func parseNamedValues(s string) (map[string]float64, error) {
+	values := make(map[string]float64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
 			continue
 		}
 
-		// Calculate IDF (Inverse Document Frequency)
-		docFreq := float64(idx.DocFrequency(term))
-		idf := 0.0
-		if docFreq > 0 {
-			idf = math.Log((totalDocs-docFreq+0.5)/(docFreq+0.5) + 1.0)
+		i := strings.LastIndexByte(part, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid value %q, expected name:number", part)
+		}
+		value, err := strconv.ParseFloat(part[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: expected a number", part[:i])
 		}
+		values[part[:i]] = value
+	}
+	return values, nil
+}
 
-		// Calculate BM25 score component
-		normalizedTF := (tf * (bm25.K1 + 1.0)) / (tf + bm25.K1*(1.0-bm25.B+bm25.B*(docLength/avgDocLength)))
+// ParseFieldBoosts parses field weights written as "title:3,content:1"
+func ParseFieldBoosts(s string) (map[string]float64, error) {
+	boosts, err := parseNamedValues(s)
+	if err != nil {
+		return nil, err
+	}
+	for field, weight := range boosts {
+		if !isSearchableField(field) {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if weight <= 0 {
+			return nil, fmt.Errorf("invalid weight for field %q: must be a positive number", field)
+		}
+	}
+	return boosts, nil
+}
+
+// ParseScorerParams parses scorer parameters written as "k1:1.2,b:0.75"
+func ParseScorerParams(s string) (map[string]float64, error) {
+	params, err := parseNamedValues(s)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range params {
+		if value < 0 {
+			return nil, fmt.Errorf("invalid value for parameter %q: must not be negative", name)
+		}
+	}
+	return params, nil
+}
+
+// FormatNamedValues writes field weights or scorer parameters as
+// "content:1,title:3"
+func FormatNamedValues(values map[string]float64) string {
+	parts := make([]string, 0, len(values))
+	for name, value := range values {
+		parts = append(parts, name+":"+strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// ScoringContext holds the index-wide statistics scorers need for one search
+type ScoringContext struct {
+	Index             *Index
+	AvgFieldLengths   map[string]float64
+	TotalFieldLengths map[string]int
 
-		score += idf * normalizedTF
+	// collectionFreqs caches the collection frequency of each term and
+	// phrase of the query
+	collectionFreqs map[Query]float64
+}
+
+// NewScoringContext creates a scoring context over an index
+func NewScoringContext(idx *Index, avgFieldLengths map[string]float64, totalFieldLengths map[string]int) *ScoringContext {
+	return &ScoringContext{
+		Index:             idx,
+		AvgFieldLengths:   avgFieldLengths,
+		TotalFieldLengths: totalFieldLengths,
+		collectionFreqs:   make(map[Query]float64),
 	}
+}
 
-	return score
+// termStats gathers the statistics of a term or phrase query for a
+// document. It returns false if the document does not contain it.
+func (ctx *ScoringContext) termStats(q Query, docStats *DocStats) (TermStats, bool) {
+	var field string
+	var stats TermStats
+	switch q := q.(type) {
+	case *TermQuery:
+		field = q.Field
+		stats.Freq = float64(docStats.TermFrequency(q.Field, q.Term))
+		stats.DocFreq = float64(ctx.Index.DocFrequency(q.Field, q.Term))
+		stats.Weight = queryBoost(q.Boost)
+	case *PhraseQuery:
+		field = q.Field
+		stats.Freq = q.matches[docStats.ID]
+		stats.DocFreq = float64(len(q.matches))
+		stats.Weight = queryBoost(q.Boost)
+	default:
+		return stats, false
+	}
+	if stats.Freq == 0 {
+		return stats, false
+	}
+
+	stats.FieldLength = float64(docStats.FieldLength(field))
+	ctx.fillStats(&stats, q, field)
+	return stats, true
+}
+
+// boundStats returns the most favourable statistics any document can have
+// for a term or phrase: the highest frequency and the shortest field. It
+// returns false if no document contains it.
+func (ctx *ScoringContext) boundStats(q Query) (TermStats, bool) {
+	var field string
+	var stats TermStats
+	switch q := q.(type) {
+	case *TermQuery:
+		bound, ok := ctx.Index.TermBound(q.Field, q.Term)
+		if !ok {
+			return stats, false
+		}
+		field = q.Field
+		stats.Freq = float64(bound.MaxFreq)
+		stats.FieldLength = float64(bound.MinLength)
+		stats.DocFreq = float64(ctx.Index.DocFrequency(q.Field, q.Term))
+		stats.Weight = queryBoost(q.Boost)
+	case *PhraseQuery:
+		if len(q.matches) == 0 {
+			return stats, false
+		}
+		field = q.Field
+		for _, freq := range q.matches {
+			stats.Freq = math.Max(stats.Freq, freq)
+		}
+		// A field containing the phrase is at least as long as the shortest
+		// field containing each of its terms
+		for _, term := range q.Terms {
+			if bound, ok := ctx.Index.TermBound(q.Field, term.Term); ok {
+				stats.FieldLength = math.Max(stats.FieldLength, float64(bound.MinLength))
+			}
+		}
+		stats.DocFreq = float64(len(q.matches))
+		stats.Weight = queryBoost(q.Boost)
+	default:
+		return stats, false
+	}
+
+	ctx.fillStats(&stats, q, field)
+	return stats, true
+}
+
+// fillStats fills in the index-wide statistics of a term or phrase
+func (ctx *ScoringContext) fillStats(stats *TermStats, q Query, field string) {
+	collectionFreq, ok := ctx.collectionFreqs[q]
+	if !ok {
+		switch q := q.(type) {
+		case *TermQuery:
+			collectionFreq = float64(ctx.Index.CollectionFrequency(q.Field, q.Term))
+		case *PhraseQuery:
+			for _, freq := range q.matches {
+				collectionFreq += freq
+			}
+		}
+		ctx.collectionFreqs[q] = collectionFreq
+	}
+
+	stats.Field = field
+	stats.AvgFieldLength = ctx.AvgFieldLengths[field]
+	stats.TotalDocs = float64(ctx.Index.TotalDocuments())
+	stats.CollectionFreq = collectionFreq
+	stats.CollectionLength = float64(ctx.TotalFieldLengths[field])
+}
+
+// scoreQuery calculates the score of a query for a document. Each term or
+// phrase is scored within its field; multi-field terms are blended by a
+// FieldScorer. Scores of the matching clauses of a boolean query are
+// summed; boosts multiply. When expl is not nil the calculation is recorded
+// as a child of it.
+func scoreQuery(scorer Scorer, q Query, docStats *DocStats, ctx *ScoringContext, expl *Explanation) float64 {
+	switch q := q.(type) {
+	case *TermQuery, *PhraseQuery:
+		stats, ok := ctx.termStats(q, docStats)
+		if !ok {
+			expl.add(0, "no match on %s", describeQuery(q))
+			return 0
+		}
+
+		node := expl.add(0, "weight(%s), product of:", describeQuery(q))
+		node.add(stats.Weight, "boost")
+		return node.set(stats.Weight * scorer.ScoreTerm(stats, node))
+	case *BooleanQuery:
+		boost := queryBoost(q.Boost)
+		description := "sum of:"
+		if boost != 1 {
+			description = fmt.Sprintf("%g * sum of:", boost)
+		}
+		node := expl.add(0, "%s", description)
+
+		score := 0.0
+		for _, clauses := range [][]Query{q.Must, q.Should} {
+			for _, clause := range clauses {
+				if queryMatches(clause, docStats) {
+					score += scoreQuery(scorer, clause, docStats, ctx, node)
+				}
+			}
+		}
+		return node.set(boost * score)
+	case *MultiFieldQuery:
+		boost := queryBoost(q.Boost)
+		fieldScorer, ok := scorer.(FieldScorer)
+		if !ok {
+			node := expl.add(0, "%g * sum of fields:", boost)
+			score := 0.0
+			for _, clause := range q.Clauses {
+				score += scoreQuery(scorer, clause, docStats, ctx, node)
+			}
+			return node.set(boost * score)
+		}
+
+		var fields []TermStats
+		for _, clause := range q.Clauses {
+			if stats, ok := ctx.termStats(clause, docStats); ok {
+				// A document counts once however many fields contain the term
+				stats.DocFreq = float64(q.docFreq)
+				fields = append(fields, stats)
+			}
+		}
+		if len(fields) == 0 {
+			expl.add(0, "no match on %s", describeQuery(q))
+			return 0
+		}
+
+		node := expl.add(0, "weight(%s), product of:", describeQuery(q))
+		node.add(boost, "boost")
+		return node.set(boost * fieldScorer.ScoreFields(fields, node))
+	}
+	return 0
+}
+
+// upperBound returns the highest score a query can give any document. It
+// scores the bound statistics kept by the index for each term (highest
+// frequency, shortest field), so only the IDF and average lengths are
+// computed per query. This assumes scores grow with term frequency and
+// shrink with field length, which holds for every built-in scorer.
+func upperBound(scorer Scorer, q Query, ctx *ScoringContext) float64 {
+	switch q := q.(type) {
+	case *TermQuery, *PhraseQuery:
+		stats, ok := ctx.boundStats(q)
+		if !ok {
+			return 0
+		}
+		return stats.Weight * scorer.ScoreTerm(stats, nil)
+	case *BooleanQuery:
+		bound := 0.0
+		for _, clauses := range [][]Query{q.Must, q.Should} {
+			for _, clause := range clauses {
+				bound += upperBound(scorer, clause, ctx)
+			}
+		}
+		return queryBoost(q.Boost) * bound
+	case *MultiFieldQuery:
+		fieldScorer, ok := scorer.(FieldScorer)
+		if !ok {
+			bound := 0.0
+			for _, clause := range q.Clauses {
+				bound += upperBound(scorer, clause, ctx)
+			}
+			return queryBoost(q.Boost) * bound
+		}
+
+		var fields []TermStats
+		for _, clause := range q.Clauses {
+			if stats, ok := ctx.boundStats(clause); ok {
+				stats.DocFreq = float64(q.docFreq)
+				fields = append(fields, stats)
+			}
+		}
+		if len(fields) == 0 {
+			return 0
+		}
+		return queryBoost(q.Boost) * fieldScorer.ScoreFields(fields, nil)
+	}
+	return 0
+}
+
+// explainScore scores a query for a document and returns the calculation
+func explainScore(scorer Scorer, q Query, docStats *DocStats, ctx *ScoringContext) *Explanation {
+	root := &Explanation{}
+	scoreQuery(scorer, q, docStats, ctx, root)
+	if len(root.Details) == 0 {
+		return root
+	}
+	return root.Details[0]
 }
 
 // ScoredDocument represents a document with its relevance score
 type ScoredDocument struct {
 	DocID string
 	Score float64
+	num   uint32 // Document number, set for sorting by doc values
 }
 
-// RankDocuments ranks documents using BM25
-func RankDocuments(queryTerms []string, candidateDocs []string, docStatsMap map[string]*DocStats, idx *Index, avgDocLength float64) []ScoredDocument {
-	bm25 := NewBM25()
-	scored := make([]ScoredDocument, 0, len(candidateDocs))
+// RankDocuments ranks documents with a scorer and returns the k best, or
+// all of them if k <= 0. Documents with equal scores are ordered by ID.
+func RankDocuments(query Query, candidateDocs []string, docStatsMap map[string]*DocStats, scorer Scorer, ctx *ScoringContext, k int) []ScoredDocument {
+	top := newTopDocs(k)
 
 	for _, docID := range candidateDocs {
 		if stats, ok := docStatsMap[docID]; ok {
-			score := bm25.Score(queryTerms, stats, idx, avgDocLength)
-			scored = append(scored, ScoredDocument{
+			score := scoreQuery(scorer, query, stats, ctx, nil)
+			top.add(ScoredDocument{
 				DocID: docID,
 				Score: score,
 			})
 		}
 	}
 
-	// Sort by score descending
-	sort.Slice(scored, func(i, j int) bool {
-		return scored[i].Score > scored[j].Score
+	return top.results()
+}
+
+// ranksBefore reports whether a ranks ahead of b: by score descending,
+// then by ID
+func ranksBefore(a, b ScoredDocument) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.DocID < b.DocID
+}
+
+// topDocs collects the k best scored documents in a bounded min-heap, so
+// ranking n documents costs O(n log k) instead of a full sort
+type topDocs struct {
+	k    int
+	docs scoredHeap
+}
+
+// newTopDocs creates a collector for the k best documents by score; k <= 0
+// keeps all
+func newTopDocs(k int) *topDocs {
+	return newSortedTopDocs(k, ranksBefore)
+}
+
+// newSortedTopDocs creates a collector for the first k documents in the
+// order given by before; k <= 0 keeps all
+func newSortedTopDocs(k int, before func(a, b ScoredDocument) bool) *topDocs {
+	return &topDocs{k: k, docs: scoredHeap{before: before}}
+}
+
+// add offers a document to the collector
+func (t *topDocs) add(doc ScoredDocument) {
+	if t.k <= 0 || t.docs.Len() < t.k {
+		heap.Push(&t.docs, doc)
+		return
+	}
+	if t.docs.before(doc, t.docs.docs[0]) {
+		t.docs.docs[0] = doc
+		heap.Fix(&t.docs, 0)
+	}
+}
+
+// threshold returns the score a document has to beat to be collected. It
+// returns false while the collector is not full.
+func (t *topDocs) threshold() (float64, bool) {
+	if t.k <= 0 || t.docs.Len() < t.k {
+		return 0, false
+	}
+	return t.docs.docs[0].Score, true
+}
+
+// results returns the collected documents, best first
+func (t *topDocs) results() []ScoredDocument {
+	results := append([]ScoredDocument(nil), t.docs.docs...)
+	sort.Slice(results, func(i, j int) bool {
+		return t.docs.before(results[i], results[j])
 	})
+	return results
+}
+
+// scoredHeap is a heap.Interface with the last ranked document on top
+type scoredHeap struct {
+	docs   []ScoredDocument
+	before func(a, b ScoredDocument) bool
+}
 
-	return scored
+func (h scoredHeap) Len() int            { return len(h.docs) }
+func (h scoredHeap) Less(i, j int) bool  { return h.before(h.docs[j], h.docs[i]) }
+func (h scoredHeap) Swap(i, j int)       { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *scoredHeap) Push(x interface{}) { h.docs = append(h.docs, x.(ScoredDocument)) }
+func (h *scoredHeap) Pop() interface{} {
+	old := h.docs
+	doc := old[len(old)-1]
+	h.docs = old[:len(old)-1]
+	return doc
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rankingWords is the vocabulary of the random ranking corpus, picked by
+// a Zipf distribution so some terms are common and others rare
+var rankingWords = strings.Fields("search engine index query rust golang python java score rank " +
+	"token phrase field boost title content bitmap posting skip block heap merge sort filter " +
+	"facet bucket range schema number date keyword stem stop word bigram analyzer tokenizer")
+
+// randomText returns n words of the ranking vocabulary
+func randomText(zipf *rand.Zipf, n int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = rankingWords[zipf.Uint64()]
+	}
+	return strings.Join(words, " ")
+}
+
+// randomRankingQuery returns a disjunction of terms, some with a field
+// prefix or a boost, and sometimes a phrase
+func randomRankingQuery(r *rand.Rand, zipf *rand.Zipf) string {
+	clauses := make([]string, 1+r.Intn(5))
+	for i := range clauses {
+		clause := rankingWords[zipf.Uint64()]
+		switch r.Intn(6) {
+		case 0:
+			clause = "title:" + clause
+		case 1:
+			clause = fmt.Sprintf("%s^%d", clause, 2+r.Intn(3))
+		case 2:
+			clause = fmt.Sprintf("%q", randomText(zipf, 2))
+		}
+		clauses[i] = clause
+	}
+	return strings.Join(clauses, " ")
+}
+
+// TestRankingPruningMatchesFullRanking checks that the top k of a ranked
+// search, which stops once no unseen document can enter the top k, is the
+// start of the full ranking for every scorer and with field boosts
+func TestRankingPruningMatchesFullRanking(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 2, uint64(len(rankingWords)-1))
+	engine := newTestEngine(t)
+
+	var docs []*Document
+	for i := 0; i < 300; i++ {
+		doc := NewDocument(fmt.Sprintf("doc%03d", i), randomText(zipf, 1+r.Intn(4)), randomText(zipf, 3+r.Intn(40)))
+		// Copies of earlier documents score the same and are ordered by ID
+		if i > 0 && r.Intn(5) == 0 {
+			copied := docs[r.Intn(len(docs))]
+			doc.Title, doc.Content = copied.Title, copied.Content
+		}
+		docs = append(docs, doc)
+	}
+	if _, err := engine.UpsertBatch(docs); err != nil {
+		t.Fatal(err)
+	}
+
+	boosts := []map[string]float64{nil, {FieldTitle: 5, FieldContent: 1}, {FieldTitle: 0.5, FieldContent: 2}}
+	checked := 0
+	for _, scorer := range []string{"bm25", "bm25f", "bm25plus", "tfidf", "dfr", "dirichlet"} {
+		for i := 0; i < 150; i++ {
+			query := randomRankingQuery(r, zipf)
+			options := SearchOptions{
+				Mode:        SearchModeOR,
+				UseRanking:  true,
+				Scorer:      scorer,
+				FieldBoosts: boosts[r.Intn(len(boosts))],
+			}
+
+			options.Limit = len(docs)
+			full, err := engine.Search(query, options)
+			if err != nil {
+				t.Fatalf("%s %q: %v", scorer, query, err)
+			}
+
+			options.Limit = 1 + r.Intn(10)
+			options.Offset = r.Intn(3)
+			pruned, err := engine.Search(query, options)
+			if err != nil {
+				t.Fatalf("%s %q: %v", scorer, query, err)
+			}
+
+			start := options.Offset
+			if start > len(full.Documents) {
+				start = len(full.Documents)
+			}
+			end := start + options.Limit
+			if end > len(full.Documents) {
+				end = len(full.Documents)
+			}
+			if len(pruned.Documents) != end-start {
+				t.Fatalf("%s %q limit %d offset %d: %d results, want %d", scorer, query, options.Limit, options.Offset, len(pruned.Documents), end-start)
+			}
+			for j, doc := range pruned.Documents {
+				want := full.Documents[start+j]
+				if doc.ID != want.ID || pruned.Scores[j] != full.Scores[start+j] {
+					t.Fatalf("%s %q limit %d offset %d: result %d is %s (%g), want %s (%g)",
+						scorer, query, options.Limit, options.Offset, j, doc.ID, pruned.Scores[j], want.ID, full.Scores[start+j])
+				}
+			}
+
+			if pruned.Total > full.Total || (pruned.TotalExact && pruned.Total != full.Total) {
+				t.Fatalf("%s %q: total %d (exact %v), want %d", scorer, query, pruned.Total, pruned.TotalExact, full.Total)
+			}
+			if !pruned.TotalExact {
+				checked++
+			}
+		}
+	}
+
+	// The corpus and queries must make pruning happen
+	if checked == 0 {
+		t.Fatal("no search was pruned")
+	}
+}
+
+func TestRankingTiesAreOrderedByID(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("c", "rust", "systems language"),
+		NewDocument("a", "rust", "systems language"),
+		NewDocument("b", "rust", "systems language"),
+		NewDocument("d", "go", "systems language"),
+	)
+
+	for _, scorer := range []string{"bm25", "bm25f", "bm25plus", "tfidf", "dfr", "dirichlet"} {
+		for limit := 1; limit <= 3; limit++ {
+			got := searchIDs(t, engine, "rust go^0.1", SearchOptions{Mode: SearchModeOR, UseRanking: true, Scorer: scorer, Limit: limit})
+			want := []string{"a", "b", "c"}[:limit]
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s limit %d: %v, want %v", scorer, limit, got, want)
+			}
+		}
+	}
+}
+
+func TestParseFieldBoosts(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{input: "title:3,content:1", want: map[string]float64{FieldTitle: 3, FieldContent: 1}},
+		{input: "url:0.5", want: map[string]float64{FieldURL: 0.5}},
+		{input: "body:2", wantErr: true},
+		{input: "title:0", wantErr: true},
+		{input: "title:-1", wantErr: true},
+		{input: "title", wantErr: true},
+		{input: "title:x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFieldBoosts(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFieldBoosts(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFieldBoosts(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseScorerParams(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{input: "k1:1.2,b:0.75", want: map[string]float64{"k1": 1.2, "b": 0.75}},
+		{input: " mu:500 , ", want: map[string]float64{"mu": 500}},
+		{input: "b:0", want: map[string]float64{"b": 0}},
+		{input: "k1:-1", wantErr: true},
+		{input: "k1", wantErr: true},
+		{input: "k1:fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseScorerParams(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseScorerParams(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseScorerParams(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
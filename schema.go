@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType is the type of a metadata field declared in the schema
+type FieldType string
+
+// Field types. Undeclared metadata fields are keywords.
+const (
+	FieldTypeKeyword FieldType = "keyword"
+	FieldTypeNumber  FieldType = "number"
+	FieldTypeDate    FieldType = "date"
+	FieldTypeBoolean FieldType = "boolean"
+)
+
+// dateFormats are the layouts accepted for date values, tried in order
+var dateFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// Schema declares the type of metadata fields, by metadata key. Values of
+// typed fields are validated when documents are written; number and date
+// fields can also be filtered by range.
+type Schema map[string]FieldType
+
+// ParseSchema parses a schema written as "priority:number,published:date"
+func ParseSchema(s string) (Schema, error) {
+	schema := make(Schema)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, typ, ok := strings.Cut(part, ":")
+		key = strings.TrimPrefix(key, metadataFieldPrefix)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid field %q, expected key:type", part)
+		}
+		switch FieldType(typ) {
+		case FieldTypeKeyword, FieldTypeNumber, FieldTypeDate, FieldTypeBoolean:
+			schema[key] = FieldType(typ)
+		default:
+			return nil, fmt.Errorf("unknown type %q for field %q (want %s, %s, %s or %s)", typ, key, FieldTypeKeyword, FieldTypeNumber, FieldTypeDate, FieldTypeBoolean)
+		}
+	}
+	return schema, nil
+}
+
+// String writes the schema in the form ParseSchema reads
+func (s Schema) String() string {
+	parts := make([]string, 0, len(s))
+	for key, typ := range s {
+		parts = append(parts, key+":"+string(typ))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// Type returns the type of a metadata field
+func (s Schema) Type(key string) FieldType {
+	if typ, ok := s[key]; ok {
+		return typ
+	}
+	return FieldTypeKeyword
+}
+
+// isRangeType reports whether a field type has a range index
+func isRangeType(typ FieldType) bool {
+	return typ == FieldTypeNumber || typ == FieldTypeDate
+}
+
+// SchemaError is a value that does not match the type of its field
+type SchemaError struct {
+	Field   string // Metadata key
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("field %q: %s", e.Field, e.Message)
+}
+
+// Validate checks the metadata of a document against the schema
+func (s Schema) Validate(doc *Document) error {
+	keys := make([]string, 0, len(doc.Metadata))
+	for key := range doc.Metadata {
+		keys = append(keys, key)
+	}
+	// Report the same field first every time
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := doc.Metadata[key]
+		switch typ := s.Type(key); typ {
+		case FieldTypeBoolean:
+			if value != "true" && value != "false" {
+				return &SchemaError{Field: key, Message: fmt.Sprintf("%q is not a boolean, expected true or false", value)}
+			}
+		case FieldTypeNumber, FieldTypeDate:
+			if _, err := parseRangeValue(key, typ, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseRangeValue parses the value of a number or date field. Dates are
+// ordered as milliseconds since the Unix epoch.
+func parseRangeValue(key string, typ FieldType, value string) (float64, error) {
+	if typ == FieldTypeDate {
+		for _, layout := range dateFormats {
+			if t, err := time.Parse(layout, value); err == nil {
+				return float64(t.UnixMilli()), nil
+			}
+		}
+		return 0, &SchemaError{Field: key, Message: fmt.Sprintf("%q is not a date, expected YYYY-MM-DD or RFC 3339", value)}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, &SchemaError{Field: key, Message: fmt.Sprintf("%q is not a number", value)}
+	}
+	return n, nil
+}
+
+// rangeEntry is the value of a field in a document
+type rangeEntry struct {
+	value float64
+	doc   uint32
+}
+
+// rangeIndex holds the values of a number or date field sorted for range
+// filters, over the column of each document's value
+type rangeIndex struct {
+	sorted []rangeEntry // By value, then document number
+	column numberColumn
+}
+
+func newRangeIndex() *rangeIndex {
+	return &rangeIndex{}
+}
+
+// newRangeIndexOf builds a range index over a column of values
+func newRangeIndexOf(column numberColumn) *rangeIndex {
+	r := &rangeIndex{column: column}
+	for doc, present := range column.present {
+		if present {
+			r.sorted = append(r.sorted, rangeEntry{value: column.values[doc], doc: uint32(doc)})
+		}
+	}
+	sort.Slice(r.sorted, func(i, j int) bool { return rangeEntryLess(r.sorted[i], r.sorted[j]) })
+	return r
+}
+
+// rangeUpdate sets or, when ok is false, removes the value of a document
+type rangeUpdate struct {
+	doc   uint32
+	value float64
+	ok    bool
+}
+
+// set sets the value of a document
+func (r *rangeIndex) set(doc uint32, value float64) {
+	r.apply([]rangeUpdate{{doc: doc, value: value, ok: true}})
+}
+
+// remove removes the value of a document, if it has one
+func (r *rangeIndex) remove(doc uint32) {
+	if _, ok := r.column.get(doc); ok {
+		r.apply([]rangeUpdate{{doc: doc}})
+	}
+}
+
+// apply applies updates in one pass over the sorted values: the changed
+// documents are dropped, and their new values are sorted and merged in.
+// Updating m documents costs O(n + m log m), so a batch pays for one pass
+// rather than one per document.
+func (r *rangeIndex) apply(updates []rangeUpdate) {
+	changed := make(map[uint32]bool, len(updates))
+	var added []rangeEntry
+	for _, update := range updates {
+		changed[update.doc] = true
+		if update.ok {
+			r.column.set(update.doc, update.value)
+		} else {
+			r.column.clear(update.doc)
+		}
+	}
+	for doc := range changed {
+		if value, ok := r.column.get(doc); ok {
+			added = append(added, rangeEntry{value: value, doc: doc})
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return rangeEntryLess(added[i], added[j]) })
+
+	merged := make([]rangeEntry, 0, len(r.sorted)+len(added))
+	for _, entry := range r.sorted {
+		if changed[entry.doc] {
+			continue
+		}
+		for len(added) > 0 && rangeEntryLess(added[0], entry) {
+			merged = append(merged, added[0])
+			added = added[1:]
+		}
+		merged = append(merged, entry)
+	}
+	r.sorted = append(merged, added...)
+}
+
+// rangeEntryLess orders entries by value, then document number
+func rangeEntryLess(a, b rangeEntry) bool {
+	return a.value < b.value || (a.value == b.value && a.doc < b.doc)
+}
+
+// search returns the documents with a value between the bounds. A nil
+// bound is open.
+func (r *rangeIndex) search(lower, upper *rangeBound) *Bitmap {
+	start, end := 0, len(r.sorted)
+	if lower != nil {
+		start = sort.Search(len(r.sorted), func(i int) bool {
+			v := r.sorted[i].value
+			return v > lower.value || (lower.inclusive && v == lower.value)
+		})
+	}
+	if upper != nil {
+		end = sort.Search(len(r.sorted), func(i int) bool {
+			v := r.sorted[i].value
+			return v > upper.value || (!upper.inclusive && v == upper.value)
+		})
+	}
+	if start >= end {
+		return NewBitmap()
+	}
+
+	nums := make([]uint32, 0, end-start)
+	for _, entry := range r.sorted[start:end] {
+		nums = append(nums, entry.doc)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return bitmapOf(nums)
+}
+
+// rangeBound is one end of a range filter
+type rangeBound struct {
+	value     float64
+	inclusive bool
+}
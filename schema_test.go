@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newSchemaEngine opens a search engine with a schema on a new index
+func newSchemaEngine(t *testing.T, schema string) *SearchEngine {
+	t.Helper()
+	parsed, err := ParseSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewSearchEngine(filepath.Join(t.TempDir(), "index.db"), EngineOptions{Schema: parsed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+func TestParseSchema(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Schema
+		wantErr bool
+	}{
+		{in: "", want: Schema{}},
+		{in: "priority:number", want: Schema{"priority": FieldTypeNumber}},
+		{in: " priority:number , metadata.published:date,draft:boolean,lang:keyword ,", want: Schema{
+			"priority": FieldTypeNumber, "published": FieldTypeDate, "draft": FieldTypeBoolean, "lang": FieldTypeKeyword,
+		}},
+		{in: "priority", wantErr: true},
+		{in: ":number", wantErr: true},
+		{in: "priority:integer", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSchema(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSchema(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSchema(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if !tt.wantErr {
+			if again, err := ParseSchema(got.String()); err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("ParseSchema(%q) = %v, %v, want %v", got.String(), again, err, got)
+			}
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema := Schema{"priority": FieldTypeNumber, "published": FieldTypeDate, "draft": FieldTypeBoolean}
+
+	tests := []struct {
+		metadata map[string]string
+		field    string // Field of the error, if any
+	}{
+		{map[string]string{"priority": "3", "published": "2025-01-01", "draft": "false", "lang": "anything"}, ""},
+		{map[string]string{"priority": "-1.5e3", "published": "2025-01-01T10:00:00", "draft": "true"}, ""},
+		{map[string]string{"published": "2025-01-01T10:00:00+02:00"}, ""},
+		{map[string]string{"priority": "high"}, "priority"},
+		{map[string]string{"priority": "NaN"}, "priority"},
+		{map[string]string{"priority": "Inf"}, "priority"},
+		{map[string]string{"published": "01/02/2025"}, "published"},
+		{map[string]string{"draft": "yes"}, "draft"},
+		{map[string]string{"draft": "TRUE"}, "draft"},
+		// The first invalid field in key order is reported
+		{map[string]string{"priority": "x", "draft": "x"}, "draft"},
+	}
+	for _, tt := range tests {
+		err := schema.Validate(metadataDocument("1", "", tt.metadata))
+		var schemaErr *SchemaError
+		switch {
+		case tt.field == "" && err != nil:
+			t.Errorf("Validate(%v) = %v, want nil", tt.metadata, err)
+		case tt.field != "" && (!errors.As(err, &schemaErr) || schemaErr.Field != tt.field):
+			t.Errorf("Validate(%v) = %v, want a schema error for %s", tt.metadata, err, tt.field)
+		}
+	}
+}
+
+func TestRangeFilters(t *testing.T) {
+	engine := newSchemaEngine(t, "priority:number,published:date,draft:boolean")
+	addDocuments(t, engine,
+		metadataDocument("1", "release notes", map[string]string{"priority": "1", "published": "2024-06-01", "draft": "false"}),
+		metadataDocument("2", "release plan", map[string]string{"priority": "3", "published": "2025-01-01", "draft": "true"}),
+		metadataDocument("3", "release party", map[string]string{"priority": "5", "published": "2025-01-01T12:00:00Z"}),
+		metadataDocument("4", "release", map[string]string{"priority": "3.0"}),
+		metadataDocument("5", "release", nil),
+	)
+
+	tests := []struct {
+		filters []string
+		want    []string
+	}{
+		{[]string{"priority:3"}, []string{"2", "4"}},
+		{[]string{"priority:>3"}, []string{"3"}},
+		{[]string{"priority:>=3"}, []string{"2", "3", "4"}},
+		{[]string{"priority:<3"}, []string{"1"}},
+		{[]string{"priority:<=3"}, []string{"1", "2", "4"}},
+		{[]string{"priority:>=2", "priority:<5"}, []string{"2", "4"}},
+		{[]string{"priority:>5"}, nil},
+		{[]string{"published:>=2025-01-01"}, []string{"2", "3"}},
+		{[]string{"published:>2025-01-01"}, []string{"3"}},
+		{[]string{"published:2025-01-01T00:00:00Z"}, []string{"2"}},
+		{[]string{"published:<2025-01-01", "priority:>=1"}, []string{"1"}},
+		{[]string{"draft:true"}, []string{"2"}},
+		{[]string{"draft:false"}, []string{"1"}},
+	}
+	for _, tt := range tests {
+		filters, err := ParseSearchFilters(tt.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, query := range []string{"", "release"} {
+			got := searchIDs(t, engine, query, SearchOptions{Filters: filters})
+			sort.Strings(got)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("Search(%q, %v) = %v, want %v", query, tt.filters, got, tt.want)
+			}
+		}
+	}
+
+	// Values that do not fit the field are schema errors
+	for _, filter := range []string{"priority:high", "priority:>high", "published:>=yesterday", "draft:maybe", "lang:>3"} {
+		filters, err := ParseSearchFilters([]string{filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = engine.Search("", SearchOptions{Filters: filters, Limit: 10})
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) || schemaErr.Field != filters[0].Key {
+			t.Errorf("Search with %s: %v, want a schema error for %s", filter, err, filters[0].Key)
+		}
+	}
+
+	// A rejected document is not written
+	if err := engine.UpsertDocument(metadataDocument("1", "release", map[string]string{"priority": "high"})); err == nil {
+		t.Error("UpsertDocument with an invalid number succeeded")
+	}
+	if got := searchIDs(t, engine, "notes", SearchOptions{}); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("Search(notes) after a rejected update = %v, want [1]", got)
+	}
+}
+
+func TestChangeSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	open := func(schema Schema) (*SearchEngine, error) {
+		return NewSearchEngine(path, EngineOptions{Schema: schema})
+	}
+
+	engine, err := open(Schema{"priority": FieldTypeNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDocuments(t, engine, metadataDocument("1", "release", map[string]string{"priority": "3", "lang": "go"}))
+	engine.Close()
+
+	// A schema the stored documents do not match is refused
+	if engine, err := open(Schema{"lang": FieldTypeNumber}); err == nil {
+		engine.Close()
+		t.Fatal("opened with a schema the documents do not match")
+	}
+
+	// Nil keeps the saved schema
+	engine, err = open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := engine.Schema(); !reflect.DeepEqual(got, Schema{"priority": FieldTypeNumber}) {
+		t.Errorf("Schema() = %v, want the saved schema", got)
+	}
+	engine.Close()
+}
+
+func TestSchemaErrorStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	api := NewAPI(newSchemaEngine(t, "priority:number,published:date"))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		field  string
+	}{
+		{"valid", http.MethodPost, "/documents", `{"id":"1","title":"Title","content":"Content","metadata":{"priority":"3"}}`, http.StatusOK, ""},
+		{"insert", http.MethodPost, "/documents", `{"id":"2","title":"Title","content":"Content","metadata":{"priority":"high"}}`, http.StatusBadRequest, "priority"},
+		{"update", http.MethodPut, "/documents/1", `{"title":"Title","content":"Content","metadata":{"published":"soon"}}`, http.StatusBadRequest, "published"},
+		{"search", http.MethodGet, "/search?filter=priority:>high", "", http.StatusBadRequest, "priority"},
+		{"range on a keyword", http.MethodGet, "/search?filter=lang:>=3", "", http.StatusBadRequest, "lang"},
+		{"range search", http.MethodGet, "/search?filter=priority:>=3", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		api.router.ServeHTTP(rec, req)
+
+		var response struct {
+			Field string `json:"field"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v: %s", tt.name, err, rec.Body)
+		}
+		if rec.Code != tt.status || response.Field != tt.field {
+			t.Errorf("%s: status %d with field %q, want %d with %q: %s", tt.name, rec.Code, response.Field, tt.status, tt.field, rec.Body)
+		}
+	}
+}
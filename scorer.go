@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// BM25 implements the BM25 ranking algorithm
+type BM25 struct {
+	K1 float64 // Term frequency saturation parameter
+	B  float64 // Length normalization parameter
+}
+
+// NewBM25 creates a new BM25 ranker with default parameters
+func NewBM25() *BM25 {
+	return &BM25{
+		K1: 1.5,
+		B:  0.75,
+	}
+}
+
+// ScoreTerm implements Scorer
+func (bm25 *BM25) ScoreTerm(t TermStats, expl *Explanation) float64 {
+	idf := bm25IDF(t.DocFreq, t.TotalDocs)
+	tfNorm := (t.Freq * (bm25.K1 + 1.0)) / (t.Freq + bm25.K1*bm25.lengthNorm(t))
+	score := idf * tfNorm
+
+	if expl != nil {
+		node := expl.add(score, "score(bm25), computed as idf * tfNorm from:")
+		explainBM25IDF(node, idf, t)
+		bm25.explainTFNorm(node, tfNorm, t, "tfNorm, computed as freq * (k1 + 1) / (freq + k1 * (1 - b + b * dl / avgdl)) from:")
+	}
+	return score
+}
+
+// lengthNorm is the document length normalization of a field
+func (bm25 *BM25) lengthNorm(t TermStats) float64 {
+	return 1.0 - bm25.B + bm25.B*(t.FieldLength/t.AvgFieldLength)
+}
+
+// explainTFNorm records a BM25 term frequency normalization
+func (bm25 *BM25) explainTFNorm(expl *Explanation, tfNorm float64, t TermStats, description string) *Explanation {
+	node := expl.add(tfNorm, "%s", description)
+	node.add(t.Freq, "freq, occurrences of the term in the field")
+	node.add(bm25.K1, "k1, term frequency saturation parameter")
+	node.add(bm25.B, "b, length normalization parameter")
+	explainFieldLength(node, t)
+	return node
+}
+
+// bm25IDF calculates the BM25 inverse document frequency of a term
+func bm25IDF(docFreq, totalDocs float64) float64 {
+	if docFreq == 0 {
+		return 0
+	}
+	return math.Log((totalDocs-docFreq+0.5)/(docFreq+0.5) + 1.0)
+}
+
+// explainBM25IDF records a BM25 inverse document frequency
+func explainBM25IDF(expl *Explanation, idf float64, t TermStats) {
+	explainDocFreq(expl.add(idf, "idf, computed as log(1 + (N - n + 0.5) / (n + 0.5)) from:"), t)
+}
+
+// explainDocFreq records the document counts an IDF is computed from
+func explainDocFreq(expl *Explanation, t TermStats) {
+	expl.add(t.DocFreq, "n, number of documents containing the term")
+	expl.add(t.TotalDocs, "N, total number of documents")
+}
+
+// explainFieldLength records the field lengths a score is normalized by
+func explainFieldLength(expl *Explanation, t TermStats) {
+	expl.add(t.FieldLength, "dl, length of field %s", t.Field)
+	expl.add(t.AvgFieldLength, "avgdl, average length of field %s", t.Field)
+}
+
+// BM25F is BM25 over several weighted fields. Each field's frequency is
+// normalized by that field's length and multiplied by its weight, and the
+// sum is saturated once, so a term repeated across fields is not counted as
+// several independent terms.
+type BM25F struct {
+	BM25
+}
+
+// ScoreFields implements FieldScorer
+func (bm25f *BM25F) ScoreFields(fields []TermStats, expl *Explanation) float64 {
+	weightedTF := 0.0
+	contributions := make([]float64, len(fields))
+	for i, t := range fields {
+		contributions[i] = t.Weight * t.Freq / bm25f.lengthNorm(t)
+		weightedTF += contributions[i]
+	}
+
+	idf := bm25IDF(fields[0].DocFreq, fields[0].TotalDocs)
+	tfNorm := (weightedTF * (bm25f.K1 + 1.0)) / (weightedTF + bm25f.K1)
+	score := idf * tfNorm
+
+	if expl != nil {
+		node := expl.add(score, "score(bm25f), computed as idf * tfNorm from:")
+		explainBM25IDF(node, idf, fields[0])
+		tfNode := node.add(tfNorm, "tfNorm, computed as tf * (k1 + 1) / (tf + k1) from:")
+		tfNode.add(bm25f.K1, "k1, term frequency saturation parameter")
+		sumNode := tfNode.add(weightedTF, "tf, sum of weight * freq / (1 - b + b * dl / avgdl) over fields:")
+		for i, t := range fields {
+			fieldNode := sumNode.add(contributions[i], "field %s, computed from:", t.Field)
+			fieldNode.add(t.Weight, "weight")
+			fieldNode.add(t.Freq, "freq, occurrences of the term in the field")
+			fieldNode.add(bm25f.B, "b, length normalization parameter")
+			explainFieldLength(fieldNode, t)
+		}
+	}
+	return score
+}
+
+// BM25Plus is BM25 with a lower bound Delta on the contribution of a
+// matching term, so very long documents are not scored below documents
+// that lack the term (Lv & Zhai, 2011)
+type BM25Plus struct {
+	BM25
+	Delta float64
+}
+
+// ScoreTerm implements Scorer
+func (bm25 *BM25Plus) ScoreTerm(t TermStats, expl *Explanation) float64 {
+	idf := math.Log((t.TotalDocs + 1.0) / t.DocFreq)
+	tfNorm := (t.Freq*(bm25.K1+1.0))/(t.Freq+bm25.K1*bm25.lengthNorm(t)) + bm25.Delta
+	score := idf * tfNorm
+
+	if expl != nil {
+		node := expl.add(score, "score(bm25plus), computed as idf * tfNorm from:")
+		explainDocFreq(node.add(idf, "idf, computed as log((N + 1) / n) from:"), t)
+		tfNode := bm25.explainTFNorm(node, tfNorm, t, "tfNorm, computed as freq * (k1 + 1) / (freq + k1 * (1 - b + b * dl / avgdl)) + delta from:")
+		tfNode.add(bm25.Delta, "delta, lower bound of a matching term")
+	}
+	return score
+}
+
+// TFIDF is the classic vector space weighting: square root term frequency,
+// squared IDF (once for the query, once for the document) and 1/sqrt(length)
+// field length normalization
+type TFIDF struct{}
+
+// ScoreTerm implements Scorer
+func (TFIDF) ScoreTerm(t TermStats, expl *Explanation) float64 {
+	tf := math.Sqrt(t.Freq)
+	idf := 1.0 + math.Log(t.TotalDocs/(t.DocFreq+1.0))
+	lengthNorm := 1.0 / math.Sqrt(t.FieldLength)
+	score := tf * idf * idf * lengthNorm
+
+	if expl != nil {
+		node := expl.add(score, "score(tfidf), computed as tf * idf^2 * lengthNorm from:")
+		node.add(tf, "tf, computed as sqrt(freq) from:").add(t.Freq, "freq, occurrences of the term in the field")
+		explainDocFreq(node.add(idf, "idf, computed as 1 + log(N / (n + 1)) from:"), t)
+		node.add(lengthNorm, "lengthNorm, computed as 1 / sqrt(dl) from:").add(t.FieldLength, "dl, length of field %s", t.Field)
+	}
+	return score
+}
+
+// DFR is the InL2 divergence from randomness model: inverse document
+// frequency basic model, Laplace after-effect and normalization 2 with
+// parameter C
+type DFR struct {
+	C float64
+}
+
+// ScoreTerm implements Scorer
+func (dfr *DFR) ScoreTerm(t TermStats, expl *Explanation) float64 {
+	tfn := t.Freq * math.Log2(1.0+dfr.C*t.AvgFieldLength/t.FieldLength)
+	informativeContent := tfn * math.Log2((t.TotalDocs+1.0)/(t.DocFreq+0.5))
+	afterEffect := 1.0 / (tfn + 1.0)
+	score := informativeContent * afterEffect
+
+	if expl != nil {
+		node := expl.add(score, "score(dfr), computed as inf * afterEffect from:")
+		tfnNode := node.add(tfn, "tfn, computed as freq * log2(1 + c * avgdl / dl) from:")
+		tfnNode.add(t.Freq, "freq, occurrences of the term in the field")
+		tfnNode.add(dfr.C, "c, normalization parameter")
+		explainFieldLength(tfnNode, t)
+		explainDocFreq(node.add(informativeContent, "inf, computed as tfn * log2((N + 1) / (n + 0.5)) from:"), t)
+		node.add(afterEffect, "afterEffect, computed as 1 / (tfn + 1)")
+	}
+	return score
+}
+
+// Dirichlet is query likelihood with Dirichlet prior smoothing: the field
+// is treated as a language model smoothed towards the collection model
+// with weight Mu. Scores are clamped at zero so they stay additive.
+type Dirichlet struct {
+	Mu float64
+}
+
+// ScoreTerm implements Scorer
+func (lm *Dirichlet) ScoreTerm(t TermStats, expl *Explanation) float64 {
+	collectionProb := (t.CollectionFreq + 1.0) / (t.CollectionLength + 1.0)
+	termWeight := math.Log(1.0 + t.Freq/(lm.Mu*collectionProb))
+	lengthWeight := math.Log(lm.Mu / (t.FieldLength + lm.Mu))
+	score := math.Max(termWeight+lengthWeight, 0)
+
+	if expl != nil {
+		node := expl.add(score, "score(dirichlet), computed as max(0, termWeight + lengthWeight) from:")
+		termNode := node.add(termWeight, "termWeight, computed as log(1 + freq / (mu * p)) from:")
+		termNode.add(t.Freq, "freq, occurrences of the term in the field")
+		termNode.add(lm.Mu, "mu, smoothing parameter")
+		probNode := termNode.add(collectionProb, "p, collection probability, computed as (cf + 1) / (cl + 1) from:")
+		probNode.add(t.CollectionFreq, "cf, occurrences of the term in field %s over all documents", t.Field)
+		probNode.add(t.CollectionLength, "cl, length of field %s over all documents", t.Field)
+		lengthNode := node.add(lengthWeight, "lengthWeight, computed as log(mu / (dl + mu)) from:")
+		lengthNode.add(t.FieldLength, "dl, length of field %s", t.Field)
+	}
+	return score
+}
+
+func init() {
+	// bm25: each field scored separately, field scores summed
+	RegisterScorer("bm25", func(params map[string]float64) (Scorer, error) {
+		p, err := withScorerDefaults("bm25", params, map[string]float64{"k1": 1.5, "b": 0.75})
+		if err != nil {
+			return nil, err
+		}
+		return &BM25{K1: p["k1"], B: p["b"]}, nil
+	})
+
+	// bm25f: terms without a field prefix blended across fields
+	RegisterScorer("bm25f", func(params map[string]float64) (Scorer, error) {
+		p, err := withScorerDefaults("bm25f", params, map[string]float64{"k1": 1.5, "b": 0.75})
+		if err != nil {
+			return nil, err
+		}
+		return &BM25F{BM25{K1: p["k1"], B: p["b"]}}, nil
+	})
+
+	// bm25plus: BM25 with a floor on matching terms
+	RegisterScorer("bm25plus", func(params map[string]float64) (Scorer, error) {
+		p, err := withScorerDefaults("bm25plus", params, map[string]float64{"k1": 1.5, "b": 0.75, "delta": 1.0})
+		if err != nil {
+			return nil, err
+		}
+		return &BM25Plus{BM25: BM25{K1: p["k1"], B: p["b"]}, Delta: p["delta"]}, nil
+	})
+
+	// tfidf: classic TF-IDF
+	RegisterScorer("tfidf", func(params map[string]float64) (Scorer, error) {
+		if _, err := withScorerDefaults("tfidf", params, nil); err != nil {
+			return nil, err
+		}
+		return TFIDF{}, nil
+	})
+
+	// dfr: divergence from randomness (InL2)
+	RegisterScorer("dfr", func(params map[string]float64) (Scorer, error) {
+		p, err := withScorerDefaults("dfr", params, map[string]float64{"c": 1.0})
+		if err != nil {
+			return nil, err
+		}
+		return &DFR{C: p["c"]}, nil
+	})
+
+	// dirichlet: query likelihood language model
+	RegisterScorer("dirichlet", func(params map[string]float64) (Scorer, error) {
+		p, err := withScorerDefaults("dirichlet", params, map[string]float64{"mu": 2000})
+		if err != nil {
+			return nil, err
+		}
+		if p["mu"] == 0 {
+			return nil, fmt.Errorf("scorer %q: mu must be positive", "dirichlet")
+		}
+		return &Dirichlet{Mu: p["mu"]}, nil
+	})
+}
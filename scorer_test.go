@@ -0,0 +1,194 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// closeTo reports whether two scores are equal up to rounding
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+func TestBM25FScoreFields(t *testing.T) {
+	scorer := &BM25F{BM25{K1: 1.2, B: 0.75}}
+	title := TermStats{Field: FieldTitle, Freq: 1, FieldLength: 2, AvgFieldLength: 4, DocFreq: 3, TotalDocs: 10, Weight: 3}
+	content := TermStats{Field: FieldContent, Freq: 2, FieldLength: 10, AvgFieldLength: 5, DocFreq: 3, TotalDocs: 10, Weight: 1}
+
+	// Each field's frequency is normalized by its own length and weighted,
+	// then the sum is saturated once
+	idf := math.Log(1 + (10-3+0.5)/(3+0.5))
+	blended := func(tf float64) float64 { return idf * tf * 2.2 / (tf + 1.2) }
+	titleTF := 3 * 1 / (1 - 0.75 + 0.75*2.0/4)
+	contentTF := 1 * 2 / (1 - 0.75 + 0.75*10.0/5)
+
+	tests := []struct {
+		name   string
+		fields []TermStats
+		want   float64
+	}{
+		{"title", []TermStats{title}, blended(titleTF)},
+		{"content", []TermStats{content}, blended(contentTF)},
+		{"both", []TermStats{title, content}, blended(titleTF + contentTF)},
+	}
+	for _, tt := range tests {
+		if got := scorer.ScoreFields(tt.fields, nil); !closeTo(got, tt.want) {
+			t.Errorf("%s: ScoreFields = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Blending fields is not the same as adding independent field scores
+	sum := scorer.ScoreFields([]TermStats{title}, nil) + scorer.ScoreFields([]TermStats{content}, nil)
+	if both := scorer.ScoreFields([]TermStats{title, content}, nil); both >= sum {
+		t.Errorf("blended score %v not below the sum of field scores %v", both, sum)
+	}
+
+	// With one field of weight 1 BM25F is BM25
+	content.Weight = 1
+	if got, want := scorer.ScoreFields([]TermStats{content}, nil), scorer.BM25.ScoreTerm(content, nil); !closeTo(got, want) {
+		t.Errorf("single field BM25F = %v, BM25 = %v", got, want)
+	}
+}
+
+func TestFieldBoostsRanking(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "rust guide", "a book about programming"),
+		NewDocument("2", "a programming guide", "rust book"),
+	)
+
+	tests := []struct {
+		boosts map[string]float64
+		want   []string
+	}{
+		{map[string]float64{FieldTitle: 3, FieldContent: 1}, []string{"1", "2"}},
+		{map[string]float64{FieldTitle: 1, FieldContent: 3}, []string{"2", "1"}},
+	}
+	for _, tt := range tests {
+		for _, scorer := range []string{"bm25", "bm25f"} {
+			options := SearchOptions{UseRanking: true, Scorer: scorer, FieldBoosts: tt.boosts, Limit: 10}
+			result, err := engine.Search("rust", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, doc := range result.Documents {
+				got = append(got, doc.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) || result.Scores[0] <= result.Scores[1] {
+				t.Errorf("%s with boosts %v: %v scored %v, want %v ranked first", scorer, tt.boosts, got, result.Scores, tt.want[0])
+			}
+		}
+	}
+}
+
+func TestScorerFormulas(t *testing.T) {
+	stats := TermStats{
+		Field: FieldContent, Freq: 2, FieldLength: 8, AvgFieldLength: 4,
+		DocFreq: 3, TotalDocs: 10, CollectionFreq: 5, CollectionLength: 40, Weight: 1,
+	}
+	rare := stats
+	rare.Freq, rare.CollectionFreq = 1, 39
+
+	bm25TF := 2 * 2.2 / (2 + 1.2*(1-0.75+0.75*8.0/4))
+	dfrTFN := 2 * math.Log2(1+1*4.0/8)
+
+	tests := []struct {
+		name   string
+		scorer Scorer
+		stats  TermStats
+		want   float64
+	}{
+		{"bm25", &BM25{K1: 1.2, B: 0.75}, stats, math.Log(1+(10-3+0.5)/(3+0.5)) * bm25TF},
+		{"bm25 without length normalization", &BM25{K1: 1.2, B: 0}, stats, math.Log(1+(10-3+0.5)/(3+0.5)) * 2 * 2.2 / (2 + 1.2)},
+		{"bm25plus", &BM25Plus{BM25: BM25{K1: 1.2, B: 0.75}, Delta: 1}, stats, math.Log(11.0/3) * (bm25TF + 1)},
+		{"tfidf", TFIDF{}, stats, math.Sqrt(2) * math.Pow(1+math.Log(10.0/4), 2) / math.Sqrt(8)},
+		{"dfr", &DFR{C: 1}, stats, dfrTFN * math.Log2(11/3.5) / (dfrTFN + 1)},
+		{"dirichlet", &Dirichlet{Mu: 100}, stats, math.Log(1+2/(100*6.0/41)) + math.Log(100.0/108)},
+		{"dirichlet clamped at zero", &Dirichlet{Mu: 100}, rare, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.scorer.ScoreTerm(tt.stats, nil); !closeTo(got, tt.want) {
+			t.Errorf("%s: ScoreTerm = %v, want %v", tt.name, got, tt.want)
+		}
+		// Recording an explanation does not change the score
+		expl := &Explanation{}
+		if got := tt.scorer.ScoreTerm(tt.stats, expl); !closeTo(got, tt.want) || len(expl.Details) != 1 || !closeTo(expl.Details[0].Value, got) {
+			t.Errorf("%s: explained ScoreTerm = %v with %+v, want %v", tt.name, got, expl.Details, tt.want)
+		}
+	}
+}
+
+func TestLookupScorer(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]float64
+		want    Scorer
+		wantErr bool
+	}{
+		{name: "bm25", want: &BM25{K1: 1.5, B: 0.75}},
+		{name: "bm25", params: map[string]float64{"k1": 1.2}, want: &BM25{K1: 1.2, B: 0.75}},
+		{name: "bm25f", params: map[string]float64{"b": 0.5}, want: &BM25F{BM25{K1: 1.5, B: 0.5}}},
+		{name: "bm25plus", want: &BM25Plus{BM25: BM25{K1: 1.5, B: 0.75}, Delta: 1}},
+		{name: "tfidf", want: TFIDF{}},
+		{name: "dfr", params: map[string]float64{"c": 2}, want: &DFR{C: 2}},
+		{name: "dirichlet", want: &Dirichlet{Mu: 2000}},
+		{name: "bm25", params: map[string]float64{"mu": 100}, wantErr: true},
+		{name: "tfidf", params: map[string]float64{"k1": 1}, wantErr: true},
+		{name: "dirichlet", params: map[string]float64{"mu": 0}, wantErr: true},
+		{name: "lucene", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := LookupScorer(tt.name, tt.params)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LookupScorer(%q, %v) error = %v, want error %v", tt.name, tt.params, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupScorer(%q, %v) = %#v, want %#v", tt.name, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestSearchScorerOverride(t *testing.T) {
+	engine := newTestEngine(t)
+	addDocuments(t, engine,
+		NewDocument("1", "Rust", "rust rust rust in a rather long body of text about many things"),
+		NewDocument("2", "Go", "rust"),
+	)
+
+	scores := make(map[string]float64)
+	for _, scorer := range ScorerNames() {
+		result, err := engine.Search("rust", SearchOptions{UseRanking: true, Scorer: scorer, Limit: 10})
+		if err != nil {
+			t.Fatalf("%s: %v", scorer, err)
+		}
+		if result.Total != 2 {
+			t.Errorf("%s: %d results, want 2", scorer, result.Total)
+		}
+		scores[scorer] = result.Scores[0]
+	}
+	if scores["bm25"] == scores["tfidf"] || scores["bm25"] == scores["dfr"] {
+		t.Errorf("scorers give the same scores: %v", scores)
+	}
+
+	// Parameters apply to the query's scorer
+	tuned, err := engine.Search("rust", SearchOptions{UseRanking: true, ScorerParams: map[string]float64{"k1": 0.1}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tuned.Scores[0] == scores[DefaultScorer] {
+		t.Errorf("k1 override did not change the score %v", tuned.Scores[0])
+	}
+
+	for _, options := range []SearchOptions{
+		{Scorer: "lucene"},
+		{Scorer: "dirichlet", ScorerParams: map[string]float64{"k1": 1}},
+	} {
+		options.UseRanking = true
+		if _, err := engine.Search("rust", options); err == nil {
+			t.Errorf("Search with scorer %q and params %v succeeded", options.Scorer, options.ScorerParams)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import "strings"
+
+// EnglishStemFilter reduces English words to their Porter2 (Snowball) stem
+// ("programming", "programs" -> "program")
+type EnglishStemFilter struct{}
+
+// Filter implements TokenFilter
+func (EnglishStemFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Term = porter2Stem(tokens[i].Term)
+	}
+	return tokens
+}
+
+// porter2Exceptions are words the algorithm would otherwise mangle
+var porter2Exceptions = map[string]string{
+	"skis": "ski", "skies": "sky", "dying": "die", "lying": "lie", "tying": "tie",
+	"idly": "idl", "gently": "gentl", "ugly": "ugli", "early": "earli", "only": "onli",
+	"singly": "singl", "sky": "sky", "news": "news", "howe": "howe",
+	"atlas": "atlas", "cosmos": "cosmos", "bias": "bias", "andes": "andes",
+}
+
+// porter2Step1aExceptions are left alone once step 1a has run
+var porter2Step1aExceptions = map[string]bool{
+	"inning": true, "outing": true, "canning": true, "herring": true,
+	"earring": true, "proceed": true, "exceed": true, "succeed": true,
+}
+
+// porter2Stem returns the Porter2 stem of a lowercase English word. Words
+// containing anything other than ASCII letters and apostrophes are returned
+// unchanged, which keeps numbers and CJK bigrams intact.
+func porter2Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if (word[i] < 'a' || word[i] > 'z') && word[i] != '\'' {
+			return word
+		}
+	}
+	if stem, ok := porter2Exceptions[word]; ok {
+		return stem
+	}
+
+	w := []byte(strings.TrimPrefix(word, "'"))
+	if len(w) <= 2 {
+		return string(w)
+	}
+
+	// Mark consonant y as Y
+	for i := range w {
+		if w[i] == 'y' && (i == 0 || isVowel(w[i-1])) {
+			w[i] = 'Y'
+		}
+	}
+
+	r1, r2 := porter2Regions(w)
+
+	w = porter2Step0(w)
+	w = porter2Step1a(w)
+	if porter2Step1aExceptions[string(w)] {
+		return string(w)
+	}
+	w = porter2Step1b(w, r1)
+	w = porter2Step1c(w)
+	w = porter2Step2(w, r1)
+	w = porter2Step3(w, r1, r2)
+	w = porter2Step4(w, r2)
+	w = porter2Step5(w, r1, r2)
+
+	return strings.ToLower(string(w))
+}
+
+func isVowel(c byte) bool {
+	switch c {
+	case 'a', 'e', 'i', 'o', 'u', 'y':
+		return true
+	}
+	return false
+}
+
+func isDouble(w []byte) bool {
+	n := len(w)
+	if n < 2 || w[n-1] != w[n-2] {
+		return false
+	}
+	switch w[n-1] {
+	case 'b', 'd', 'f', 'g', 'm', 'n', 'p', 'r', 't':
+		return true
+	}
+	return false
+}
+
+func isValidLiEnding(c byte) bool {
+	switch c {
+	case 'c', 'd', 'e', 'g', 'h', 'k', 'm', 'n', 'r', 't':
+		return true
+	}
+	return false
+}
+
+// porter2Regions computes R1 and R2 as offsets into w
+func porter2Regions(w []byte) (int, int) {
+	r1 := len(w)
+	switch {
+	case hasPrefix(w, "gener"), hasPrefix(w, "arsen"):
+		r1 = 5
+	case hasPrefix(w, "commun"):
+		r1 = 6
+	default:
+		r1 = regionAfter(w, 0)
+	}
+	return r1, regionAfter(w, r1)
+}
+
+// regionAfter returns the offset after the first non-vowel following a vowel,
+// scanning from start
+func regionAfter(w []byte, start int) int {
+	for i := start + 1; i < len(w); i++ {
+		if !isVowel(w[i]) && isVowel(w[i-1]) {
+			return i + 1
+		}
+	}
+	return len(w)
+}
+
+// endsShortSyllable reports whether w ends in a short syllable
+func endsShortSyllable(w []byte) bool {
+	n := len(w)
+	if n == 2 {
+		return isVowel(w[0]) && !isVowel(w[1])
+	}
+	if n >= 3 {
+		last := w[n-1]
+		return !isVowel(w[n-3]) && isVowel(w[n-2]) && !isVowel(last) &&
+			last != 'w' && last != 'x' && last != 'Y'
+	}
+	return false
+}
+
+func isShortWord(w []byte, r1 int) bool {
+	return r1 >= len(w) && endsShortSyllable(w)
+}
+
+func hasPrefix(w []byte, prefix string) bool {
+	return len(w) >= len(prefix) && string(w[:len(prefix)]) == prefix
+}
+
+func hasSuffix(w []byte, suffix string) bool {
+	return len(w) >= len(suffix) && string(w[len(w)-len(suffix):]) == suffix
+}
+
+// longestSuffix returns the longest suffix of w found in suffixes
+func longestSuffix(w []byte, suffixes ...string) string {
+	longest := ""
+	for _, suffix := range suffixes {
+		if len(suffix) > len(longest) && hasSuffix(w, suffix) {
+			longest = suffix
+		}
+	}
+	return longest
+}
+
+func containsVowel(w []byte) bool {
+	for _, c := range w {
+		if isVowel(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func replaceSuffix(w []byte, suffix, replacement string) []byte {
+	return append(w[:len(w)-len(suffix)], replacement...)
+}
+
+func porter2Step0(w []byte) []byte {
+	if suffix := longestSuffix(w, "'", "'s", "'s'"); suffix != "" {
+		return w[:len(w)-len(suffix)]
+	}
+	return w
+}
+
+func porter2Step1a(w []byte) []byte {
+	switch suffix := longestSuffix(w, "sses", "ied", "ies", "s", "us", "ss"); suffix {
+	case "sses":
+		return replaceSuffix(w, suffix, "ss")
+	case "ied", "ies":
+		if len(w) > 4 {
+			return replaceSuffix(w, suffix, "i")
+		}
+		return replaceSuffix(w, suffix, "ie")
+	case "s":
+		if len(w) >= 3 && containsVowel(w[:len(w)-2]) {
+			return w[:len(w)-1]
+		}
+	}
+	return w
+}
+
+func porter2Step1b(w []byte, r1 int) []byte {
+	suffix := longestSuffix(w, "eed", "eedly", "ed", "edly", "ing", "ingly")
+	switch suffix {
+	case "":
+		return w
+	case "eed", "eedly":
+		if len(w)-len(suffix) >= r1 {
+			return replaceSuffix(w, suffix, "ee")
+		}
+		return w
+	}
+
+	stem := w[:len(w)-len(suffix)]
+	if !containsVowel(stem) {
+		return w
+	}
+
+	switch {
+	case hasSuffix(stem, "at"), hasSuffix(stem, "bl"), hasSuffix(stem, "iz"):
+		return append(stem, 'e')
+	case isDouble(stem):
+		return stem[:len(stem)-1]
+	case isShortWord(stem, r1):
+		return append(stem, 'e')
+	}
+	return stem
+}
+
+func porter2Step1c(w []byte) []byte {
+	n := len(w)
+	if n > 2 && (w[n-1] == 'y' || w[n-1] == 'Y') && !isVowel(w[n-2]) {
+		w[n-1] = 'i'
+	}
+	return w
+}
+
+var porter2Step2Suffixes = map[string]string{
+	"tional": "tion", "enci": "ence", "anci": "ance", "abli": "able", "entli": "ent",
+	"izer": "ize", "ization": "ize", "ational": "ate", "ation": "ate", "ator": "ate",
+	"alism": "al", "aliti": "al", "alli": "al", "fulness": "ful", "ousli": "ous",
+	"ousness": "ous", "iveness": "ive", "iviti": "ive", "biliti": "ble", "bli": "ble",
+	"ogi": "og", "fulli": "ful", "lessli": "less", "li": "",
+}
+
+func porter2Step2(w []byte, r1 int) []byte {
+	suffix := longestSuffixOf(w, porter2Step2Suffixes)
+	if suffix == "" || len(w)-len(suffix) < r1 {
+		return w
+	}
+
+	stem := w[:len(w)-len(suffix)]
+	switch suffix {
+	case "ogi":
+		if !hasSuffix(stem, "l") {
+			return w
+		}
+	case "li":
+		if len(stem) == 0 || !isValidLiEnding(stem[len(stem)-1]) {
+			return w
+		}
+	}
+	return replaceSuffix(w, suffix, porter2Step2Suffixes[suffix])
+}
+
+var porter2Step3Suffixes = map[string]string{
+	"tional": "tion", "ational": "ate", "alize": "al", "icate": "ic",
+	"iciti": "ic", "ical": "ic", "ful": "", "ness": "", "ative": "",
+}
+
+func porter2Step3(w []byte, r1, r2 int) []byte {
+	suffix := longestSuffixOf(w, porter2Step3Suffixes)
+	if suffix == "" || len(w)-len(suffix) < r1 {
+		return w
+	}
+	if suffix == "ative" && len(w)-len(suffix) < r2 {
+		return w
+	}
+	return replaceSuffix(w, suffix, porter2Step3Suffixes[suffix])
+}
+
+var porter2Step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ism", "ate", "iti", "ous", "ive", "ize", "ion",
+}
+
+func porter2Step4(w []byte, r2 int) []byte {
+	suffix := longestSuffix(w, porter2Step4Suffixes...)
+	if suffix == "" || len(w)-len(suffix) < r2 {
+		return w
+	}
+
+	stem := w[:len(w)-len(suffix)]
+	if suffix == "ion" && !hasSuffix(stem, "s") && !hasSuffix(stem, "t") {
+		return w
+	}
+	return stem
+}
+
+func porter2Step5(w []byte, r1, r2 int) []byte {
+	n := len(w)
+	switch {
+	case n > 0 && w[n-1] == 'e':
+		stem := w[:n-1]
+		if n-1 >= r2 || (n-1 >= r1 && !endsShortSyllable(stem)) {
+			return stem
+		}
+	case n > 1 && w[n-1] == 'l' && w[n-2] == 'l' && n-1 >= r2:
+		return w[:n-1]
+	}
+	return w
+}
+
+// longestSuffixOf returns the longest suffix of w that is a key of suffixes
+func longestSuffixOf(w []byte, suffixes map[string]string) string {
+	longest := ""
+	for suffix := range suffixes {
+		if len(suffix) > len(longest) && hasSuffix(w, suffix) {
+			longest = suffix
+		}
+	}
+	return longest
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPorter2Stem(t *testing.T) {
+	// Samples from the Snowball English vocabulary and its stemmed output
+	tests := map[string]string{
+		"consign": "consign", "consigned": "consign", "consigning": "consign",
+		"consignment": "consign", "consistency": "consist", "consistently": "consist",
+		"consolation": "consol", "consolatory": "consolatori", "consolidated": "consolid",
+		"consolingly": "consol", "conspicuously": "conspicu", "conspiracy": "conspiraci",
+		"conspirators": "conspir", "constable": "constabl", "constancy": "constanc",
+		"knackeries": "knackeri", "kneaded": "knead", "kneels": "kneel",
+		"knightly": "knight", "knitting": "knit", "knives": "knive", "knocker": "knocker",
+		"generously": "generous", "generation": "generat", "generic": "generic",
+		"caresses": "caress", "ponies": "poni", "ties": "tie", "cats": "cat",
+		"agreed": "agre", "disabled": "disabl", "matting": "mat", "mating": "mate",
+		"meetings": "meet", "happy": "happi", "crying": "cri", "cries": "cri",
+		"saying": "say", "running": "run", "hopping": "hop", "hoped": "hope",
+		"programming": "program", "programs": "program",
+
+		// Exceptions and words left as they are
+		"skies": "sky", "dying": "die", "news": "news", "proceed": "proceed",
+		"john's": "john", "go": "go", "go1": "go1", "2024": "2024", "café": "café",
+	}
+	for word, want := range tests {
+		if got := porter2Stem(word); got != want {
+			t.Errorf("porter2Stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestStemPlural(t *testing.T) {
+	tests := map[string]string{
+		"queries": "query", "documents": "document", "days": "day", "boxes": "boxe",
+		"shoes": "shoes", "glass": "glass", "status": "status", "is": "is",
+		"programming": "programming",
+	}
+	for word, want := range tests {
+		if got := stemPlural(word); got != want {
+			t.Errorf("stemPlural(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestEnglishAnalyzers(t *testing.T) {
+	tests := []struct {
+		analyzer string
+		want     []string
+	}{
+		{"english", []string{"the", "program", "queri", "program"}},
+		{"minimal_english", []string{"the", "programming", "query", "program"}},
+	}
+	for _, tt := range tests {
+		analyzer, err := LookupAnalyzer(tt.analyzer, AnalyzerConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tokenTerms(analyzer.Analyze("The Programming queries programs")); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s analyzer: %v, want %v", tt.analyzer, got, tt.want)
+		}
+	}
+}
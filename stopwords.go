@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Stopword modes: how an index treats stopwords
+const (
+	// StopwordModeIndex indexes stopwords and leaves them out of queries
+	// that have other terms, so stopword-only queries still match
+	StopwordModeIndex = "index"
+	// StopwordModeRemove drops stopwords from documents and queries, so
+	// they take no space in the index or in field lengths
+	StopwordModeRemove = "remove"
+)
+
+// EnglishStopwords is the default English stopword list
+var EnglishStopwords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in",
+	"into", "is", "it", "no", "not", "of", "on", "or", "such", "that", "the",
+	"their", "then", "there", "these", "they", "this", "to", "was", "will", "with",
+}
+
+// LoadStopwords reads a stopword file. Words are separated by whitespace;
+// anything after '#' or '|' on a line is a comment (the Snowball list format).
+func LoadStopwords(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stopword file: %w", err)
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#|"); i >= 0 {
+			line = line[:i]
+		}
+		for _, word := range strings.Fields(line) {
+			words = append(words, strings.ToLower(word))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stopword file %s: %w", path, err)
+	}
+	return words, nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -14,6 +17,16 @@ var (
 	metaBucket  = []byte("metadata")
 )
 
+// Keys in the metadata bucket
+const (
+	analyzerMetaKey     = "analyzer"
+	stopwordsMetaKey    = "stopwords"
+	stopwordModeMetaKey = "stopword_mode"
+	synonymsMetaKey     = "synonyms"
+	scoringMetaKey      = "scoring"
+	schemaMetaKey       = "schema"
+)
+
 // Storage handles persistent storage using BoltDB
 type Storage struct {
 	db *bolt.DB
@@ -49,15 +62,37 @@ func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
+// maxTermLength is the longest term in bytes. Terms are keys of the
+// index bucket, so analyzers cut longer ones to fit bolt's key size.
+const maxTermLength = bolt.MaxKeySize
+
+// IDError is a document ID that cannot be used as a key
+type IDError struct {
+	Message string
+}
+
+func (e *IDError) Error() string {
+	return e.Message
+}
+
+// errMissingID is returned for a document without an ID
+var errMissingID = &IDError{Message: "document ID is required"}
+
+// validateDocumentID checks that a document ID can be used as a key
+func validateDocumentID(id string) error {
+	switch {
+	case id == "":
+		return errMissingID
+	case len(id) > bolt.MaxKeySize:
+		return &IDError{Message: fmt.Sprintf("document ID is longer than %d bytes", bolt.MaxKeySize)}
+	}
+	return nil
+}
+
 // SaveDocument saves a document
 func (s *Storage) SaveDocument(doc *Document) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(docsBucket)
-		data, err := json.Marshal(doc)
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(doc.ID), data)
+		return putJSON(tx.Bucket(docsBucket), doc.ID, doc)
 	})
 }
 
@@ -119,18 +154,6 @@ func (s *Storage) CountDocuments() (int, error) {
 	return count, err
 }
 
-// SaveDocStats saves document statistics
-func (s *Storage) SaveDocStats(stats *DocStats) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(statsBucket)
-		data, err := json.Marshal(stats)
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(stats.ID), data)
-	})
-}
-
 // GetDocStats retrieves document statistics
 func (s *Storage) GetDocStats(id string) (*DocStats, error) {
 	var stats *DocStats
@@ -176,54 +199,488 @@ func (s *Storage) DeleteDocStats(id string) error {
 	})
 }
 
-// SaveIndex saves the inverted index
+// indexFormatVersion is bumped whenever the stored index changes shape
+//
+//	0: token -> []docID
+//	1: token -> []Posting with positions
+//	2: field -> token -> []Posting
+//	3: adds field -> token -> TermBound
+//	4: document numbers, field -> token -> compressed PostingList
+//	5: adds field -> token -> Bitmap for dense terms
+//	6: adds the term dictionary and the forward index, document number ->
+//	   term numbers
+//	7: a record per term and per document in nested buckets instead of a
+//	   single main_index value, so a write only touches what changed
+//	8: metadata values indexed as exact-match keywords instead of analyzed
+const indexFormatVersion = 8
+
+// errLegacyIndex is returned by LoadIndex for an index saved in an older
+// format; it has to be rebuilt from the stored documents
+var errLegacyIndex = errors.New("index was saved in an older format")
+
+// errCorruptIndex is returned when a stored index record cannot be decoded
+var errCorruptIndex = errors.New("corrupt index record")
+
+// Keys and nested buckets of the index bucket. Terms and bitmaps are kept
+// in a bucket per field keyed by token; documents and the term dictionary
+// are keyed by their big-endian number.
+var (
+	indexVersionKey   = []byte("version")
+	indexDocCountKey  = []byte("doc_count")
+	legacyIndexKey    = []byte("main_index")
+	termsBucket       = []byte("terms")        // field -> token -> bound and postings
+	setsBucket        = []byte("sets")         // field -> token -> bitmap, dense terms only
+	termNumbersBucket = []byte("term_numbers") // term number -> field term
+	docNumbersBucket  = []byte("doc_numbers")  // document number -> ID and term numbers
+)
+
+// SaveIndex writes the terms and documents of the index that changed since
+// it was last saved or loaded. An index that was never saved, such as a
+// rebuilt one, replaces the stored index.
 func (s *Storage) SaveIndex(idx *Index) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(indexBucket)
+	return s.updateWithIndex(idx, func(tx *bolt.Tx) error { return nil })
+}
 
-		// Serialize index data
-		data, err := json.Marshal(struct {
-			Index    map[string][]string `json:"index"`
-			DocCount int                 `json:"doc_count"`
-		}{
-			Index:    idx.index,
-			DocCount: idx.docCount,
-		})
+// CommitDocument saves a document, its statistics and the index changes it
+// caused in one transaction, so a failure or crash saves none of them
+func (s *Storage) CommitDocument(doc *Document, stats *DocStats, idx *Index) error {
+	return s.updateWithIndex(idx, func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(docsBucket), doc.ID, doc); err != nil {
+			return fmt.Errorf("failed to save document: %w", err)
+		}
+		if err := putJSON(tx.Bucket(statsBucket), stats.ID, stats); err != nil {
+			return fmt.Errorf("failed to save doc stats: %w", err)
+		}
+		return failpoint("upsert-mid-commit")
+	})
+}
 
-		if err != nil {
+// CommitBatch saves documents, their statistics and the index changes they
+// caused in one transaction. stats holds the statistics of each document.
+func (s *Storage) CommitBatch(docs []*Document, stats []*DocStats, idx *Index) error {
+	return s.updateWithIndex(idx, func(tx *bolt.Tx) error {
+		for i, doc := range docs {
+			if err := putJSON(tx.Bucket(docsBucket), doc.ID, doc); err != nil {
+				return fmt.Errorf("failed to save document %s: %w", doc.ID, err)
+			}
+			if err := putJSON(tx.Bucket(statsBucket), doc.ID, stats[i]); err != nil {
+				return fmt.Errorf("failed to save doc stats of %s: %w", doc.ID, err)
+			}
+		}
+		return failpoint("batch-mid-commit")
+	})
+}
+
+// CommitRebuild replaces the statistics of every document and the whole
+// index, and saves metadata entries, in one transaction, so a crash during
+// a rebuild leaves the old ones in place. An empty metadata value deletes
+// the entry.
+func (s *Storage) CommitRebuild(stats map[string]*DocStats, idx *Index, metadata map[string]string) error {
+	return s.updateWithIndex(idx, func(tx *bolt.Tx) error {
+		if err := putMetadata(tx, metadata); err != nil {
 			return err
 		}
+		if err := tx.DeleteBucket(statsBucket); err != nil {
+			return fmt.Errorf("failed to clear doc stats: %w", err)
+		}
+		b, err := tx.CreateBucket(statsBucket)
+		if err != nil {
+			return fmt.Errorf("failed to clear doc stats: %w", err)
+		}
+		for id, docStats := range stats {
+			if err := putJSON(b, id, docStats); err != nil {
+				return fmt.Errorf("failed to save doc stats of %s: %w", id, err)
+			}
+		}
+		return nil
+	})
+}
 
-		return b.Put([]byte("main_index"), data)
+// CommitDeletion deletes a document and its statistics and saves the index
+// changes of the deletion in one transaction
+func (s *Storage) CommitDeletion(docID string, idx *Index) error {
+	return s.updateWithIndex(idx, func(tx *bolt.Tx) error {
+		if err := tx.Bucket(docsBucket).Delete([]byte(docID)); err != nil {
+			return fmt.Errorf("failed to delete document: %w", err)
+		}
+		if err := tx.Bucket(statsBucket).Delete([]byte(docID)); err != nil {
+			return fmt.Errorf("failed to delete doc stats: %w", err)
+		}
+		return failpoint("delete-mid-commit")
 	})
 }
 
-// LoadIndex loads the inverted index
+// updateWithIndex runs fn and writes the index changes in the same
+// transaction. The changes are only marked saved once it commits.
+func (s *Storage) updateWithIndex(idx *Index, fn func(tx *bolt.Tx) error) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := writeIndex(tx.Bucket(indexBucket), idx); err != nil {
+			return fmt.Errorf("failed to save index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.markSaved()
+	return nil
+}
+
+// putJSON stores a value as JSON
+func putJSON(b *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// writeIndex writes the changes of an index to the index bucket
+func writeIndex(b *bolt.Bucket, idx *Index) error {
+	changes := idx.changes
+	if changes.all {
+		// Drop the stored index, including one in an older format
+		for _, name := range [][]byte{termsBucket, setsBucket, termNumbersBucket, docNumbersBucket} {
+			if err := b.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		if err := b.Delete(legacyIndexKey); err != nil {
+			return err
+		}
+
+		for field, terms := range idx.index {
+			for token := range terms {
+				changes.terms[FieldTerm{Field: field, Term: token}] = true
+			}
+		}
+		for num := range idx.docIDs {
+			changes.docs[uint32(num)] = true
+		}
+		changes.savedTerms = 0
+	}
+
+	terms, err := b.CreateBucketIfNotExists(termsBucket)
+	if err != nil {
+		return err
+	}
+	sets, err := b.CreateBucketIfNotExists(setsBucket)
+	if err != nil {
+		return err
+	}
+	for term := range changes.terms {
+		if err := writeTerm(terms, sets, idx, term); err != nil {
+			return fmt.Errorf("failed to save term %s:%s: %w", term.Field, term.Term, err)
+		}
+	}
+
+	numbers, err := b.CreateBucketIfNotExists(termNumbersBucket)
+	if err != nil {
+		return err
+	}
+	for num := changes.savedTerms; num < len(idx.terms); num++ {
+		if err := numbers.Put(numberKey(uint32(num)), encodeFieldTerm(idx.terms[num])); err != nil {
+			return err
+		}
+	}
+
+	docs, err := b.CreateBucketIfNotExists(docNumbersBucket)
+	if err != nil {
+		return err
+	}
+	for num := range changes.docs {
+		if idx.docIDs[num] == "" {
+			err = docs.Delete(numberKey(num))
+		} else {
+			err = docs.Put(numberKey(num), encodeDocRecord(idx.docIDs[num], idx.forward[num]))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save document %d: %w", num, err)
+		}
+	}
+
+	if err := b.Put(indexDocCountKey, []byte(strconv.Itoa(len(idx.docIDs)))); err != nil {
+		return err
+	}
+	return b.Put(indexVersionKey, []byte(strconv.Itoa(indexFormatVersion)))
+}
+
+// writeTerm writes the postings, bound and bitmap of a term, or deletes
+// them if the term has no documents left
+func writeTerm(terms, sets *bolt.Bucket, idx *Index, term FieldTerm) error {
+	key := []byte(term.Term)
+	postings, ok := idx.index[term.Field][term.Term]
+	if !ok {
+		if err := deleteNested(terms, term.Field, key); err != nil {
+			return err
+		}
+		return deleteNested(sets, term.Field, key)
+	}
+
+	fieldTerms, err := terms.CreateBucketIfNotExists([]byte(term.Field))
+	if err != nil {
+		return err
+	}
+	record, err := encodeTermRecord(idx.bounds[term.Field][term.Term], postings)
+	if err != nil {
+		return err
+	}
+	if err := fieldTerms.Put(key, record); err != nil {
+		return err
+	}
+
+	set, ok := idx.sets[term.Field][term.Term]
+	if !ok {
+		return deleteNested(sets, term.Field, key)
+	}
+	fieldSets, err := sets.CreateBucketIfNotExists([]byte(term.Field))
+	if err != nil {
+		return err
+	}
+	data, err := set.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return fieldSets.Put(key, data)
+}
+
+// deleteNested deletes a key from a field's bucket, and the bucket once it
+// is empty
+func deleteNested(parent *bolt.Bucket, field string, key []byte) error {
+	b := parent.Bucket([]byte(field))
+	if b == nil {
+		return nil
+	}
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	if k, _ := b.Cursor().First(); k == nil {
+		return parent.DeleteBucket([]byte(field))
+	}
+	return nil
+}
+
+// LoadIndex streams the stored index in record by record. It returns
+// errLegacyIndex for an index saved in an older format, including the
+// single main_index value written before version 7.
 func (s *Storage) LoadIndex() (*Index, error) {
 	idx := NewIndex()
+	loaded := false
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(indexBucket)
-		data := b.Get([]byte("main_index"))
-		if data == nil {
+		if b.Get(legacyIndexKey) != nil {
+			return errLegacyIndex
+		}
+
+		version := b.Get(indexVersionKey)
+		if version == nil {
 			return nil
 		}
+		if string(version) != strconv.Itoa(indexFormatVersion) {
+			return errLegacyIndex
+		}
 
-		var indexData struct {
-			Index    map[string][]string `json:"index"`
-			DocCount int                 `json:"doc_count"`
+		loaded = true
+		return readIndex(b, idx)
+	})
+	if err != nil {
+		return idx, err
+	}
+
+	if loaded {
+		idx.markSaved()
+	}
+	return idx, nil
+}
+
+// readIndex decodes every record of the index bucket into an empty index
+func readIndex(b *bolt.Bucket, idx *Index) error {
+	count, err := strconv.Atoi(string(b.Get(indexDocCountKey)))
+	if err != nil {
+		return fmt.Errorf("failed to read document count: %w", err)
+	}
+
+	idx.docIDs = make([]string, count)
+	idx.forward = make([][]uint32, count)
+	var live []uint32
+	err = forEachRecord(b, docNumbersBucket, func(k, v []byte) error {
+		docID, terms, err := decodeDocRecord(v)
+		if err != nil || len(k) != 4 || int(binary.BigEndian.Uint32(k)) >= count {
+			return fmt.Errorf("failed to decode document %x: %w", k, errCorruptIndex)
 		}
+		num := binary.BigEndian.Uint32(k)
 
-		if err := json.Unmarshal(data, &indexData); err != nil {
-			return err
+		idx.docIDs[num] = docID
+		idx.docNums[docID] = num
+		idx.forward[num] = terms
+		live = append(live, num)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	idx.live = bitmapOf(live)
+
+	err = forEachRecord(b, termNumbersBucket, func(k, v []byte) error {
+		term, err := decodeFieldTerm(v)
+		if err != nil || len(k) != 4 || int(binary.BigEndian.Uint32(k)) != len(idx.terms) {
+			return fmt.Errorf("failed to decode term %x: %w", k, errCorruptIndex)
 		}
 
-		idx.index = indexData.Index
-		idx.docCount = indexData.DocCount
+		idx.termNums[term] = uint32(len(idx.terms))
+		idx.terms = append(idx.terms, term)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = forEachField(b, termsBucket, func(field string, fieldTerms *bolt.Bucket) error {
+		idx.index[field] = make(map[string]*PostingList)
+		idx.bounds[field] = make(map[string]TermBound)
+		return fieldTerms.ForEach(func(k, v []byte) error {
+			bound, postings, err := decodeTermRecord(v)
+			if err != nil {
+				return fmt.Errorf("failed to decode postings of %s:%s: %w", field, k, err)
+			}
+			idx.index[field][string(k)] = postings
+			idx.bounds[field][string(k)] = bound
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return forEachField(b, setsBucket, func(field string, fieldSets *bolt.Bucket) error {
+		idx.sets[field] = make(map[string]*Bitmap)
+		return fieldSets.ForEach(func(k, v []byte) error {
+			set := NewBitmap()
+			if err := set.UnmarshalBinary(v); err != nil {
+				return fmt.Errorf("failed to decode bitmap of %s:%s: %w", field, k, err)
+			}
+			idx.sets[field][string(k)] = set
+			return nil
+		})
+	})
+}
+
+// forEachRecord calls fn for every record of a nested bucket, if it exists
+func forEachRecord(parent *bolt.Bucket, name []byte, fn func(k, v []byte) error) error {
+	b := parent.Bucket(name)
+	if b == nil {
 		return nil
+	}
+	return b.ForEach(fn)
+}
+
+// forEachField calls fn for every field bucket nested in a bucket
+func forEachField(parent *bolt.Bucket, name []byte, fn func(field string, b *bolt.Bucket) error) error {
+	return forEachRecord(parent, name, func(k, v []byte) error {
+		fieldBucket := parent.Bucket(name).Bucket(k)
+		if v != nil || fieldBucket == nil {
+			return fmt.Errorf("unexpected key %q in %s: %w", k, name, errCorruptIndex)
+		}
+		return fn(string(k), fieldBucket)
 	})
+}
+
+// numberKey encodes a document or term number as a key that sorts by number
+func numberKey(num uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, num)
+	return key
+}
+
+// encodeTermRecord encodes a term's bound followed by its posting list
+func encodeTermRecord(bound TermBound, postings *PostingList) ([]byte, error) {
+	data, err := postings.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
 
-	return idx, err
+	record := make([]byte, 0, len(data)+2*binary.MaxVarintLen32)
+	record = binary.AppendUvarint(record, uint64(bound.MaxFreq))
+	record = binary.AppendUvarint(record, uint64(bound.MinLength))
+	return append(record, data...), nil
+}
+
+// decodeTermRecord decodes a record written by encodeTermRecord
+func decodeTermRecord(record []byte) (TermBound, *PostingList, error) {
+	maxFreq, n := binary.Uvarint(record)
+	if n <= 0 {
+		return TermBound{}, nil, errCorruptIndex
+	}
+	record = record[n:]
+	minLength, n := binary.Uvarint(record)
+	if n <= 0 {
+		return TermBound{}, nil, errCorruptIndex
+	}
+
+	postings := &PostingList{}
+	if err := postings.UnmarshalBinary(record[n:]); err != nil {
+		return TermBound{}, nil, err
+	}
+	return TermBound{MaxFreq: int(maxFreq), MinLength: int(minLength)}, postings, nil
+}
+
+// encodeFieldTerm encodes a field term as the field's length, the field and
+// the token
+func encodeFieldTerm(term FieldTerm) []byte {
+	record := binary.AppendUvarint(nil, uint64(len(term.Field)))
+	record = append(record, term.Field...)
+	return append(record, term.Term...)
+}
+
+// decodeFieldTerm decodes a record written by encodeFieldTerm
+func decodeFieldTerm(record []byte) (FieldTerm, error) {
+	length, n := binary.Uvarint(record)
+	if n <= 0 || length > uint64(len(record)-n) {
+		return FieldTerm{}, errCorruptIndex
+	}
+	record = record[n:]
+	return FieldTerm{Field: string(record[:length]), Term: string(record[length:])}, nil
+}
+
+// encodeDocRecord encodes a document's ID and the numbers of its terms
+func encodeDocRecord(docID string, terms []uint32) []byte {
+	record := make([]byte, 0, len(docID)+binary.MaxVarintLen32*(len(terms)+1))
+	record = binary.AppendUvarint(record, uint64(len(docID)))
+	record = append(record, docID...)
+	for _, num := range terms {
+		record = binary.AppendUvarint(record, uint64(num))
+	}
+	return record
+}
+
+// decodeDocRecord decodes a record written by encodeDocRecord
+func decodeDocRecord(record []byte) (string, []uint32, error) {
+	length, n := binary.Uvarint(record)
+	if n <= 0 || length == 0 || length > uint64(len(record)-n) {
+		return "", nil, errCorruptIndex
+	}
+	record = record[n:]
+	docID := string(record[:length])
+	record = record[length:]
+
+	var terms []uint32
+	for len(record) > 0 {
+		num, n := binary.Uvarint(record)
+		if n <= 0 {
+			return "", nil, errCorruptIndex
+		}
+		terms = append(terms, uint32(num))
+		record = record[n:]
+	}
+	return docID, terms, nil
 }
 
 // SaveMetadata saves metadata
@@ -249,3 +706,36 @@ func (s *Storage) GetMetadata(key string) (string, error) {
 
 	return value, err
 }
+
+// CommitMetadata saves metadata entries in one transaction. An empty value
+// deletes the entry.
+func (s *Storage) CommitMetadata(metadata map[string]string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putMetadata(tx, metadata)
+	})
+}
+
+// putMetadata saves metadata entries, deleting those with an empty value
+func putMetadata(tx *bolt.Tx, metadata map[string]string) error {
+	b := tx.Bucket(metaBucket)
+	for key, value := range metadata {
+		var err error
+		if value == "" {
+			err = b.Delete([]byte(key))
+		} else {
+			err = b.Put([]byte(key), []byte(value))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save %s metadata: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// DeleteMetadata deletes metadata
+func (s *Storage) DeleteMetadata(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket)
+		return b.Delete([]byte(key))
+	})
+}
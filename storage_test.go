@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexSnapshot is the content of an engine's index and document
+// statistics by document ID, independent of document numbers
+type indexSnapshot struct {
+	postings map[string]map[string][]int // field/term -> document ID -> positions
+	stats    map[string]*DocStats
+	lengths  map[string]int // field -> total length
+	live     int
+}
+
+func snapshotEngine(t *testing.T, engine *SearchEngine) indexSnapshot {
+	t.Helper()
+	idx := engine.index
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	snapshot := indexSnapshot{
+		postings: make(map[string]map[string][]int),
+		stats:    make(map[string]*DocStats, len(engine.docStats)),
+		lengths:  make(map[string]int, len(engine.totalFieldLengths)),
+		live:     idx.live.Cardinality(),
+	}
+	for docID, stats := range engine.docStats {
+		snapshot.stats[docID] = stats
+	}
+	for field, length := range engine.totalFieldLengths {
+		snapshot.lengths[field] = length
+	}
+	for field, terms := range idx.index {
+		for term, postings := range terms {
+			docs := make(map[string][]int)
+			it := postings.iterator()
+			for it.next() {
+				docs[idx.docIDs[it.doc]] = it.positions()
+			}
+			snapshot.postings[field+"/"+term] = docs
+		}
+	}
+	return snapshot
+}
+
+func checkSnapshot(t *testing.T, name string, got, want indexSnapshot) {
+	t.Helper()
+	if got.live != want.live {
+		t.Errorf("%s: %d live documents, want %d", name, got.live, want.live)
+	}
+	if !reflect.DeepEqual(got.stats, want.stats) {
+		t.Errorf("%s: doc stats differ", name)
+	}
+	if !reflect.DeepEqual(got.lengths, want.lengths) {
+		t.Errorf("%s: field lengths = %v, want %v", name, got.lengths, want.lengths)
+	}
+	if len(got.postings) != len(want.postings) {
+		t.Errorf("%s: %d terms, want %d", name, len(got.postings), len(want.postings))
+	}
+	for term, docs := range want.postings {
+		if !reflect.DeepEqual(got.postings[term], docs) {
+			t.Errorf("%s: postings of %s = %v, want %v", name, term, got.postings[term], docs)
+		}
+	}
+}
+
+func openEngine(t *testing.T, path string) *SearchEngine {
+	t.Helper()
+	engine, err := NewSearchEngine(path, EngineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func TestReopenAfterIncrementalWrites(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 2, uint64(len(rankingWords)-1))
+	path := filepath.Join(t.TempDir(), "index.db")
+	engine := openEngine(t, path)
+
+	randomDoc := func(id string) *Document {
+		doc := NewDocument(id, randomText(zipf, 1+r.Intn(3)), randomText(zipf, 2+r.Intn(20)))
+		if r.Intn(2) == 0 {
+			doc.Metadata["lang"] = rankingWords[r.Intn(5)]
+		}
+		return doc
+	}
+
+	// Batches, single upserts, updates and deletes, each saving only what
+	// it changed
+	final := make(map[string]*Document)
+	var batch []*Document
+	for i := 0; i < 60; i++ {
+		batch = append(batch, randomDoc(fmt.Sprintf("doc%02d", i)))
+	}
+	if _, err := engine.UpsertBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range batch {
+		final[doc.ID] = doc
+	}
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("doc%02d", r.Intn(80))
+		if r.Intn(3) == 0 {
+			if _, ok := final[id]; !ok {
+				continue
+			}
+			if err := engine.DeleteDocument(id); err != nil {
+				t.Fatal(err)
+			}
+			delete(final, id)
+			continue
+		}
+		doc := randomDoc(id)
+		if err := engine.UpsertDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+		final[id] = doc
+	}
+	before := snapshotEngine(t, engine)
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored index is loaded as it is, not rebuilt
+	storage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadIndex(); err != nil {
+		t.Fatalf("LoadIndex: %v", err)
+	}
+	storage.Close()
+
+	reopened := openEngine(t, path)
+	defer reopened.Close()
+	checkSnapshot(t, "reopened", snapshotEngine(t, reopened), before)
+
+	// The same documents written at once give the same index
+	fresh := newTestEngine(t)
+	for _, doc := range final {
+		addDocuments(t, fresh, doc)
+	}
+	checkSnapshot(t, "rebuilt", snapshotEngine(t, fresh), before)
+
+	for _, query := range []string{"search", "rust OR golang", `"index query"~3`, "metadata.lang:search"} {
+		options := SearchOptions{UseRanking: true, Limit: 100}
+		got := searchIDs(t, reopened, query, options)
+		want := searchIDs(t, fresh, query, options)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Search(%q) after reopening = %v, want %v", query, got, want)
+		}
+	}
+}
+
+// legacyDocStats is the document statistics record written before fields
+// were indexed separately
+type legacyDocStats struct {
+	ID              string         `json:"id"`
+	Length          int            `json:"length"`
+	TermFrequencies map[string]int `json:"term_frequencies"`
+}
+
+func TestOpenLegacyIndex(t *testing.T) {
+	docs := []*Document{
+		NewDocument("1", "Go Programming", "Go is an open source programming language"),
+		NewDocument("2", "Rust Programming", "Rust is a systems programming language"),
+		NewDocument("3", "关键技术", "全文检索"),
+	}
+
+	// The layout of the first version: documents, statistics without
+	// fields and the whole index in one main_index value
+	path := filepath.Join(t.TempDir(), "index.db")
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		legacyIndex := map[string][]string{}
+		for _, name := range [][]byte{docsBucket, statsBucket, indexBucket, metaBucket} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, doc := range docs {
+			data, _ := json.Marshal(doc)
+			if err := tx.Bucket(docsBucket).Put([]byte(doc.ID), data); err != nil {
+				return err
+			}
+			stats := legacyDocStats{ID: doc.ID, Length: 5, TermFrequencies: map[string]int{"programming": 1}}
+			data, _ = json.Marshal(stats)
+			if err := tx.Bucket(statsBucket).Put([]byte(doc.ID), data); err != nil {
+				return err
+			}
+			legacyIndex["programming"] = append(legacyIndex["programming"], doc.ID)
+		}
+		data, _ := json.Marshal(map[string]interface{}{"index": legacyIndex, "doc_count": len(docs)})
+		return tx.Bucket(indexBucket).Put(legacyIndexKey, data)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := openEngine(t, path)
+	want := newTestEngine(t)
+	addDocuments(t, want, docs...)
+	checkSnapshot(t, "migrated", snapshotEngine(t, engine), snapshotEngine(t, want))
+
+	tests := map[string][]string{
+		"programming":   {"1", "2"},
+		"title:rust":    {"2"},
+		`"open source"`: {"1"},
+		"关键":            {"3"},
+	}
+	for query, ids := range tests {
+		if got := searchIDs(t, engine, query, SearchOptions{}); !reflect.DeepEqual(got, ids) {
+			t.Errorf("Search(%q) = %v, want %v", query, got, ids)
+		}
+	}
+
+	// The migrated index is saved in the current format and loads as it is
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err := storage.LoadIndex(); err != nil {
+		t.Fatalf("LoadIndex after migration: %v", err)
+	}
+}
+
+func TestOpenOlderIndexVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	engine := openEngine(t, path)
+	addDocuments(t, engine, NewDocument("1", "Go", "gophers"), NewDocument("2", "Rust", "crabs"))
+	want := snapshotEngine(t, engine)
+	engine.Close()
+
+	// An index saved by an older version is rebuilt from the documents
+	storage, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).Put(indexVersionKey, []byte("7"))
+	})
+	if err == nil {
+		_, err = storage.LoadIndex()
+	}
+	storage.Close()
+	if !errors.Is(err, errLegacyIndex) {
+		t.Fatalf("LoadIndex of version 7: %v, want errLegacyIndex", err)
+	}
+
+	reopened := openEngine(t, path)
+	defer reopened.Close()
+	checkSnapshot(t, "rebuilt", snapshotEngine(t, reopened), want)
+	if got := searchIDs(t, reopened, "gophers", SearchOptions{}); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("Search(gophers) = %v", got)
+	}
+}
+
+func TestLongTermsFitInKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	engine, err := NewSearchEngine(path, EngineOptions{Analyzer: "keyword"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A keyword-analyzed value longer than a bolt key, cut inside a
+	// multibyte character
+	long := strings.Repeat("a", maxTermLength-1) + "检索" + strings.Repeat("b", 100)
+	addDocuments(t, engine, NewDocument("long", long, "short"))
+	for _, token := range engine.analyzer.Analyze(long) {
+		if len(token.Term) != maxTermLength-1 || !utf8.ValidString(token.Term) {
+			t.Fatalf("term of %d bytes, want %d valid UTF-8 bytes", len(token.Term), maxTermLength-1)
+		}
+	}
+	if got := searchIDs(t, engine, long, SearchOptions{Fields: []string{FieldTitle}}); !reflect.DeepEqual(got, []string{"long"}) {
+		t.Errorf("search for the long title = %v", got)
+	}
+	engine.Close()
+
+	reopened := openEngine(t, path)
+	defer reopened.Close()
+	if got := searchIDs(t, reopened, long, SearchOptions{Fields: []string{FieldTitle}}); !reflect.DeepEqual(got, []string{"long"}) {
+		t.Errorf("search for the long title after reopening = %v", got)
+	}
+}
+
+func TestFailedCompactKeepsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	engine := openEngine(t, path)
+	for i, rank := range []string{"high", "low", "medium"} {
+		doc := NewDocument(fmt.Sprint(i), "Title", "some content "+rank)
+		doc.Metadata = map[string]string{"rank": rank}
+		if err := engine.UpsertDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := engine.DeleteDocument("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Declaring the keyword field a number makes building doc values fail
+	// after the documents were reindexed
+	before, values, stats := snapshotEngine(t, engine), engine.values, engine.Stats()
+	engine.schema = Schema{"rank": FieldTypeNumber}
+	if err := engine.Compact(); err == nil {
+		t.Fatal("Compact succeeded with values that do not parse")
+	}
+	engine.schema = Schema{}
+	checkSnapshot(t, "memory", snapshotEngine(t, engine), before)
+	if engine.values != values {
+		t.Error("doc values were replaced")
+	}
+	if got := engine.Stats(); !reflect.DeepEqual(got, stats) {
+		t.Errorf("stats = %+v, want %+v", got, stats)
+	}
+	engine.Close()
+
+	engine = openEngine(t, path)
+	defer engine.Close()
+	checkSnapshot(t, "disk", snapshotEngine(t, engine), before)
+	if got := engine.Stats(); !reflect.DeepEqual(got, stats) {
+		t.Errorf("stats after reopening = %+v, want %+v", got, stats)
+	}
+}
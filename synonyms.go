@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadSynonyms reads a synonym file in the Solr format. Each line is either
+// a list of equivalent words ("laptop, notebook") or words mapped to others
+// ("car, auto => vehicle"); anything after '#' is a comment. Synonyms are
+// expanded when documents are indexed, so with an explicit mapping a search
+// for "vehicle" finds documents that only say "car", but not the other way
+// around.
+func LoadSynonyms(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open synonym file: %w", err)
+	}
+	defer f.Close()
+
+	synonyms := make(map[string][]string)
+	add := func(from string, to []string) {
+		for _, word := range to {
+			if word != from && !containsString(synonyms[from], word) {
+				synonyms[from] = append(synonyms[from], word)
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		from, to, mapped := strings.Cut(text, "=>")
+		left, err := synonymWords(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid synonym file %s line %d: %w", path, line, err)
+		}
+		if !mapped {
+			for _, word := range left {
+				add(word, left)
+			}
+			continue
+		}
+
+		right, err := synonymWords(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid synonym file %s line %d: %w", path, line, err)
+		}
+		for _, word := range left {
+			add(word, right)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read synonym file %s: %w", path, err)
+	}
+	return synonyms, nil
+}
+
+// synonymWords splits a comma-separated list of single words, lowercased
+func synonymWords(list string) ([]string, error) {
+	var words []string
+	for _, word := range strings.Split(list, ",") {
+		word = strings.ToLower(strings.TrimSpace(word))
+		switch {
+		case word == "":
+			return nil, fmt.Errorf("empty synonym in %q", strings.TrimSpace(list))
+		case len(strings.Fields(word)) > 1:
+			return nil, fmt.Errorf("multi-word synonym %q is not supported", word)
+		}
+		words = append(words, word)
+	}
+	return words, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
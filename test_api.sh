@@ -116,6 +116,93 @@ echo -e "${BLUE}12. 再次搜索验证删除${NC}"
 curl -s "${API_URL}/search?query=python" | jq
 echo ""
 
+sleep 1
+
+echo -e "${BLUE}13. _bulk 批量写入（index、create 冲突、update、delete）${NC}"
+curl -s -X POST ${API_URL}/_bulk \
+  -H "Content-Type: application/x-ndjson" \
+  --data-binary '{"index":{"_id":"4"}}
+{"title":"Open Source Search","content":"SimpleFTS is an open source full-text search engine. Queries such as a < b && c > d are escaped in highlights.","category":"search","team":"infra"}
+{"index":{"_id":"5"}}
+{"title":"Building Search Engines","content":"Build a search engine from open, well documented source code.","category":"search","team":"web"}
+{"create":{"_id":"6"}}
+{"title":"Rust Web Servers","content":"Fast and safe web servers written in Rust.","category":"web","team":"web"}
+{"create":{"_id":"6"}}
+{"title":"Duplicate"}
+{"update":{"_id":"1"}}
+{"doc":{"category":"language","team":"infra"}}
+{"update":{"_id":"2"}}
+{"doc":{"category":"language","team":"web"}}
+{"update":{"_id":"missing"}}
+{"doc":{"title":"Missing"}}
+{"delete":{"_id":"missing"}}
+' | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}14. 按元数据过滤 'search'（category:search 且 team:infra）${NC}"
+curl -s "${API_URL}/search?query=search&filter=category:search&filter=team:infra" | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}15. 按元数据排序 'programming search'（category 升序，再按 ID）${NC}"
+curl -s "${API_URL}/search?query=programming+search&mode=or&sort=category:asc,_id" | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}16. 聚合 'programming search'（按 category 和 team 计数）${NC}"
+curl -s "${API_URL}/search?query=programming+search&mode=or&agg=terms:category&agg=teams=terms:team" | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}17. 高亮 'escaped'（默认 HTML 转义）${NC}"
+curl -s "${API_URL}/search?query=escaped&highlight=true&fragment_size=60" | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}18. 高亮 'escaped'（encoder=none，自定义标签）${NC}"
+curl -s "${API_URL}/search?query=escaped&highlight=true&fragment_size=60&encoder=none&pre_tag=%5B&post_tag=%5D" | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}19. 短语 slop、字段和权重 '\"open source\"~2'${NC}"
+curl -s -G "${API_URL}/search" \
+  --data-urlencode 'query="open source"~2' \
+  --data-urlencode "fields=title,content" \
+  --data-urlencode "boost=title:3" \
+  --data-urlencode "highlight=true" | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}20. 导出文档${NC}"
+curl -s ${API_URL}/export | jq -c
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}21. 导出词项和倒排表（前 5 行）${NC}"
+curl -s "${API_URL}/export?type=terms&postings=true" | head -5 | jq -c
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}22. 压缩文档编号${NC}"
+curl -s -X POST ${API_URL}/_compact | jq
+echo ""
+
+sleep 1
+
+echo -e "${BLUE}23. 压缩后的统计信息${NC}"
+curl -s ${API_URL}/stats | jq
+echo ""
+
 echo -e "${GREEN}=== API 测试完成 ===${NC}"
 echo ""
 echo -e "${YELLOW}提示：如果看到 'command not found: jq'，请安装 jq 工具${NC}"
@@ -0,0 +1,140 @@
+package main
+
+import "unicode"
+
+// Token is a single term produced by analysis
+type Token struct {
+	Term     string `json:"term"`
+	Position int    `json:"position"` // Ordinal position in the token stream
+	Start    int    `json:"start"`    // Byte offset of the first character in the source text
+	End      int    `json:"end"`      // Byte offset just past the last character
+	Stopword bool   `json:"stopword,omitempty"`
+}
+
+// Tokenizer splits text into a stream of tokens
+type Tokenizer interface {
+	Tokenize(text string) []Token
+}
+
+// StandardTokenizer groups runs of letters and digits into word tokens.
+// CJK text has no spaces between words, so runs of Han, Hiragana, Katakana
+// and Hangul are split into overlapping bigrams instead
+// ("搜索引擎" -> "搜索", "索引", "引擎"). A lone CJK character is kept as a unigram.
+type StandardTokenizer struct{}
+
+// Tokenize implements Tokenizer
+func (StandardTokenizer) Tokenize(text string) []Token {
+	var tokens []Token
+	wordStart := -1
+	var cjkRun []int // byte offsets of the runes in the current CJK run
+
+	flushWord := func(end int) {
+		if wordStart >= 0 {
+			tokens = append(tokens, Token{
+				Term:     text[wordStart:end],
+				Position: len(tokens),
+				Start:    wordStart,
+				End:      end,
+			})
+			wordStart = -1
+		}
+	}
+
+	flushCJK := func(end int) {
+		tokens = appendCJKBigrams(tokens, text, cjkRun, end)
+		cjkRun = cjkRun[:0]
+	}
+
+	for i, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord(i)
+			cjkRun = append(cjkRun, i)
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			flushCJK(i)
+			if wordStart < 0 {
+				wordStart = i
+			}
+		default:
+			flushWord(i)
+			flushCJK(i)
+		}
+	}
+
+	flushWord(len(text))
+	flushCJK(len(text))
+
+	return tokens
+}
+
+// WhitespaceTokenizer splits text on Unicode whitespace only
+type WhitespaceTokenizer struct{}
+
+// Tokenize implements Tokenizer
+func (WhitespaceTokenizer) Tokenize(text string) []Token {
+	var tokens []Token
+	start := -1
+
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				tokens = append(tokens, Token{Term: text[start:i], Position: len(tokens), Start: start, End: i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, Token{Term: text[start:], Position: len(tokens), Start: start, End: len(text)})
+	}
+
+	return tokens
+}
+
+// KeywordTokenizer emits the whole input as a single token
+type KeywordTokenizer struct{}
+
+// Tokenize implements Tokenizer
+func (KeywordTokenizer) Tokenize(text string) []Token {
+	if text == "" {
+		return nil
+	}
+	return []Token{{Term: text, Position: 0, Start: 0, End: len(text)}}
+}
+
+// isCJK reports whether r belongs to a script written without word separators
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r) ||
+		r == 'ー' // Katakana prolonged sound mark is in the Common script
+}
+
+// appendCJKBigrams appends overlapping bigrams for a run of CJK characters.
+// run holds the byte offset of each character and end is the offset just
+// past the last one.
+func appendCJKBigrams(tokens []Token, text string, run []int, end int) []Token {
+	switch len(run) {
+	case 0:
+		return tokens
+	case 1:
+		return append(tokens, Token{Term: text[run[0]:end], Position: len(tokens), Start: run[0], End: end})
+	}
+
+	for i := 0; i < len(run)-1; i++ {
+		bigramEnd := end
+		if i+2 < len(run) {
+			bigramEnd = run[i+2]
+		}
+		tokens = append(tokens, Token{
+			Term:     text[run[i]:bigramEnd],
+			Position: len(tokens),
+			Start:    run[i],
+			End:      bigramEnd,
+		})
+	}
+	return tokens
+}
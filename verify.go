@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Verify checks that the stored documents, their statistics and the index
+// agree: every document has statistics and is indexed, nothing else is, and
+// the index and doc values match ones rebuilt from the documents, which
+// must match the schema. It returns a line for each problem found.
+func (e *SearchEngine) Verify() ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	docs, err := e.storage.GetAllDocuments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load documents: %w", err)
+	}
+	storedStats, err := e.storage.GetAllDocStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load doc stats: %w", err)
+	}
+
+	var problems []string
+	rebuilt := NewIndex()
+	stored := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		stored[doc.ID] = true
+		fields, docStats := e.analyzeDocument(doc)
+		rebuilt.AddDocument(doc.ID, fields)
+
+		stats, ok := storedStats[doc.ID]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("document %s has no stored statistics", doc.ID))
+		case !reflect.DeepEqual(stats, docStats):
+			problems = append(problems, fmt.Sprintf("stored statistics of document %s do not match its content", doc.ID))
+		}
+		if _, ok := e.docStats[doc.ID]; !ok {
+			problems = append(problems, fmt.Sprintf("document %s has no statistics in memory", doc.ID))
+		}
+		if err := e.schema.Validate(doc); err != nil {
+			problems = append(problems, fmt.Sprintf("document %s does not match the schema: %v", doc.ID, err))
+		}
+	}
+	for docID := range storedStats {
+		if !stored[docID] {
+			problems = append(problems, fmt.Sprintf("statistics are stored for missing document %s", docID))
+		}
+	}
+	for docID := range e.docStats {
+		if !stored[docID] {
+			problems = append(problems, fmt.Sprintf("statistics are in memory for missing document %s", docID))
+		}
+	}
+
+	sort.Strings(problems)
+	problems = append(problems, diffIndexes(e.index, rebuilt)...)
+	problems = append(problems, e.diffDocValues(docs)...)
+
+	totals := make(map[string]int)
+	for _, stats := range e.docStats {
+		for field, fieldStats := range stats.Fields {
+			totals[field] += fieldStats.Length
+		}
+	}
+	if !reflect.DeepEqual(totals, e.totalFieldLengths) {
+		problems = append(problems, fmt.Sprintf("field lengths %v do not match the documents, expected %v", e.totalFieldLengths, totals))
+	}
+
+	return problems, nil
+}
+
+// diffDocValues lists the fields whose doc values do not hold the values
+// of the documents, and range indexes out of order with their column
+func (e *SearchEngine) diffDocValues(docs []*Document) []string {
+	expected := newDocValues(e.schema)
+	for _, doc := range docs {
+		if num, ok := e.index.DocumentNumber(doc.ID); ok {
+			expected.set(num, doc)
+		}
+	}
+
+	var problems []string
+	got, want := docValueEntries(e.values), docValueEntries(expected)
+	for _, key := range unionKeys(got, want) {
+		if !reflect.DeepEqual(got[key], want[key]) {
+			problems = append(problems, fmt.Sprintf("doc values of field %s do not match the documents", key))
+		}
+	}
+	for key, ranges := range e.values.ranges {
+		sorted := newRangeIndexOf(ranges.column).sorted
+		if len(sorted) != len(ranges.sorted) || (len(sorted) > 0 && !reflect.DeepEqual(sorted, ranges.sorted)) {
+			problems = append(problems, fmt.Sprintf("range index of field %s is out of order", key))
+		}
+	}
+	return problems
+}
+
+// docValueEntries returns the values held for each field by document
+// number, leaving out fields without any
+func docValueEntries(dv *docValues) map[string]map[uint32]string {
+	entries := make(map[string]map[uint32]string)
+	add := func(key string, doc uint32, value string) {
+		if entries[key] == nil {
+			entries[key] = make(map[uint32]string)
+		}
+		entries[key][doc] = value
+	}
+	for key, column := range dv.keywords {
+		for doc := range column.values {
+			if value, ok := column.get(uint32(doc)); ok {
+				add(key, uint32(doc), value)
+			}
+		}
+	}
+	for key, ranges := range dv.ranges {
+		for doc := range ranges.column.values {
+			if value, ok := ranges.column.get(uint32(doc)); ok {
+				add(key, uint32(doc), strconv.FormatFloat(value, 'g', -1, 64))
+			}
+		}
+	}
+	return entries
+}
+
+// unionKeys returns the keys of two maps, sorted
+func unionKeys(a, b map[string]map[uint32]string) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffIndexes lists the documents and postings in which an index differs
+// from the expected one, and bitmaps or forward index entries that
+// disagree with its own postings
+func diffIndexes(got, want *Index) []string {
+	got.mu.RLock()
+	defer got.mu.RUnlock()
+	want.mu.RLock()
+	defer want.mu.RUnlock()
+
+	var problems []string
+	for docID := range got.docNums {
+		if _, ok := want.docNums[docID]; !ok {
+			problems = append(problems, fmt.Sprintf("index has document %s, which is not stored", docID))
+		}
+	}
+	for docID := range want.docNums {
+		if _, ok := got.docNums[docID]; !ok {
+			problems = append(problems, fmt.Sprintf("document %s is not indexed", docID))
+		}
+	}
+	if got.live.Cardinality() != len(got.docNums) {
+		problems = append(problems, fmt.Sprintf("index has %d live documents but %d document IDs", got.live.Cardinality(), len(got.docNums)))
+	}
+
+	terms := make(map[FieldTerm]bool)
+	for _, idx := range []*Index{got, want} {
+		for field, fieldTerms := range idx.index {
+			for token := range fieldTerms {
+				terms[FieldTerm{Field: field, Term: token}] = true
+			}
+		}
+	}
+
+	// Terms each document should be listed under in the forward index
+	docTerms := make(map[uint32]map[FieldTerm]bool)
+	for term := range terms {
+		gotPostings := got.termPostings(term)
+		if !reflect.DeepEqual(gotPostings, want.termPostings(term)) {
+			problems = append(problems, fmt.Sprintf("postings of %s:%s do not match the documents", term.Field, term.Term))
+		}
+
+		postings, ok := got.index[term.Field][term.Term]
+		if !ok {
+			continue
+		}
+		docs := postings.docs()
+		if set, ok := got.sets[term.Field][term.Term]; ok && !reflect.DeepEqual(set.ToArray(), docs) {
+			problems = append(problems, fmt.Sprintf("bitmap of %s:%s does not match its postings", term.Field, term.Term))
+		}
+		for _, num := range docs {
+			if docTerms[num] == nil {
+				docTerms[num] = make(map[FieldTerm]bool)
+			}
+			docTerms[num][term] = true
+		}
+	}
+
+	for num, termNums := range got.forward {
+		expected := docTerms[uint32(num)]
+		matches := len(termNums) == len(expected)
+		for _, termNum := range termNums {
+			matches = matches && expected[got.terms[termNum]]
+		}
+		if !matches {
+			problems = append(problems, fmt.Sprintf("forward index of document %d does not match the postings", num))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// termPostings returns the positions of a term in each document, by
+// document ID
+func (idx *Index) termPostings(term FieldTerm) map[string][]int {
+	postings := make(map[string][]int)
+	if list, ok := idx.index[term.Field][term.Term]; ok {
+		it := list.iterator()
+		for it.next() {
+			postings[idx.docIDs[it.doc]] = it.positions()
+		}
+	}
+	return postings
+}